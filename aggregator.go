@@ -0,0 +1,204 @@
+package metcap
+
+import (
+	"math"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Aggregator groups metrics by name and tags and every FlushInterval emits
+// single metric per group with min, max, sum, count and mean of each
+// numeric field, named {field}_min, {field}_max etc.
+type Aggregator struct {
+	stage
+	FlushInterval time.Duration
+	Size          int
+	Logger        *Logger
+	Stats         *AggregatorStats
+	groups        map[string]*aggregatorGroup
+	lock          *sync.Mutex
+}
+
+type aggregatorGroup struct {
+	name   string
+	tags   map[string]string
+	fields map[string]*aggregatorField
+}
+
+type aggregatorField struct {
+	min, max, sum float64
+	count         int64
+}
+
+// NewAggregator
+func NewAggregator(c *AggregatorConfig, input <-chan *Metric, exitFlag *Flag, logger *Logger) *Aggregator {
+	if c.FlushInterval.Duration == 0 {
+		c.FlushInterval.Duration = 10 * time.Second
+	}
+
+	if c.BufferSize == 0 {
+		c.BufferSize = 1000
+	}
+
+	return &Aggregator{
+		stage:         newStage(input, c.BufferSize, exitFlag),
+		FlushInterval: c.FlushInterval.Duration,
+		Size:          c.BufferSize,
+		Logger:        logger,
+		Stats:         NewAggregatorStats(),
+		groups:        make(map[string]*aggregatorGroup),
+		lock:          &sync.Mutex{},
+	}
+}
+
+// numericFields returns numeric fields of the metric, including "value"
+// unless it's zero next to other values (see SerializeLineProtocol)
+func numericFields(m *Metric) map[string]float64 {
+	fields := make(map[string]float64, len(m.Values)+1)
+	if m.Value != 0 || len(m.Values) == 0 {
+		fields["value"] = m.Value
+	}
+	for k, v := range m.Values {
+		switch n := v.(type) {
+		case float64:
+			fields[k] = n
+		case int64:
+			fields[k] = float64(n)
+		}
+	}
+	return fields
+}
+
+// aggregatorKey identifies the group by name and sorted tags
+func aggregatorKey(m *Metric) string {
+	tags := make([]string, 0, len(m.Fields))
+	for k, v := range m.Fields {
+		tags = append(tags, k+"="+v)
+	}
+	sort.Strings(tags)
+	return m.Name + "," + strings.Join(tags, ",")
+}
+
+// Add accounts the metric to its group
+func (a *Aggregator) Add(m *Metric) {
+	key := aggregatorKey(m)
+
+	a.lock.Lock()
+	defer a.lock.Unlock()
+
+	g, ok := a.groups[key]
+	if !ok {
+		tags := make(map[string]string, len(m.Fields))
+		for k, v := range m.Fields {
+			tags[k] = v
+		}
+		g = &aggregatorGroup{
+			name:   m.Name,
+			tags:   tags,
+			fields: make(map[string]*aggregatorField),
+		}
+		a.groups[key] = g
+	}
+
+	for k, v := range numericFields(m) {
+		f, ok := g.fields[k]
+		if !ok {
+			f = &aggregatorField{min: math.Inf(1), max: math.Inf(-1)}
+			g.fields[k] = f
+		}
+		f.min = math.Min(f.min, v)
+		f.max = math.Max(f.max, v)
+		f.sum += v
+		f.count++
+	}
+	a.Stats.Received.Increment(1)
+}
+
+// Flush emits aggregated metrics of all groups and starts a new interval
+func (a *Aggregator) Flush() {
+	a.lock.Lock()
+	groups := a.groups
+	a.groups = make(map[string]*aggregatorGroup)
+	a.lock.Unlock()
+
+	now := time.Now()
+	for _, g := range groups {
+		if len(g.fields) == 0 {
+			continue
+		}
+		values := make(map[string]interface{}, len(g.fields)*5)
+		for k, f := range g.fields {
+			values[k+"_min"] = f.min
+			values[k+"_max"] = f.max
+			values[k+"_sum"] = f.sum
+			values[k+"_count"] = f.count
+			values[k+"_mean"] = f.sum / float64(f.count)
+		}
+		a.Output <- &Metric{
+			Name:      g.name,
+			Timestamp: now,
+			Fields:    g.tags,
+			Values:    values,
+		}
+		a.Stats.Emitted.Increment(1)
+	}
+}
+
+func (a *Aggregator) Start() {
+	a.Wg.Add(1)
+	go func() {
+		defer a.Wg.Done()
+		tick := time.NewTicker(a.FlushInterval)
+		defer tick.Stop()
+		for {
+			select {
+			case m := <-a.Input:
+				a.Add(m)
+			case <-tick.C:
+				a.Flush()
+			case <-a.ExitChan:
+				for len(a.Input) > 0 {
+					a.Add(<-a.Input)
+				}
+				a.Flush()
+				return
+			}
+		}
+	}()
+
+	a.watchExit()
+}
+
+// Stop flushes the metrics aggregated so far
+func (a *Aggregator) LogReport() {
+	a.lock.Lock()
+	groups := len(a.groups)
+	a.lock.Unlock()
+	a.Logger.Info("[aggregator] %d/%d (output/capacity), groups: %d, metrics: %d/%d (received/emitted)",
+		len(a.Output),
+		a.Size,
+		groups,
+		a.Stats.Received.Total(),
+		a.Stats.Emitted.Total(),
+	)
+}
+
+type AggregatorStats struct {
+	Received *StatsCounter
+	Emitted  *StatsCounter
+}
+
+func NewAggregatorStats() *AggregatorStats {
+	now := time.Now()
+	return &AggregatorStats{
+		Received: NewStatsCounter(now),
+		Emitted:  NewStatsCounter(now),
+	}
+}
+
+func (s *AggregatorStats) Reset() {
+	s.Received.Reset()
+	s.Emitted.Reset()
+}
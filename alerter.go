@@ -0,0 +1,319 @@
+package metcap
+
+import (
+	"fmt"
+	"math"
+	"time"
+)
+
+// AlertOperator compares aggregated field against the threshold
+type AlertOperator int
+
+const (
+	AlertGreater AlertOperator = iota
+	AlertLess
+	AlertGreaterOrEqual
+	AlertLessOrEqual
+	AlertEqual
+)
+
+// ParseAlertOperator parses one of ">", "<", ">=", "<=" and "=="
+func ParseAlertOperator(s string) (AlertOperator, error) {
+	switch s {
+	case ">":
+		return AlertGreater, nil
+	case "<":
+		return AlertLess, nil
+	case ">=":
+		return AlertGreaterOrEqual, nil
+	case "<=":
+		return AlertLessOrEqual, nil
+	case "==":
+		return AlertEqual, nil
+	default:
+		return AlertGreater, fmt.Errorf("unknown alert operator '%s'", s)
+	}
+}
+
+func (o AlertOperator) String() string {
+	switch o {
+	case AlertGreater:
+		return ">"
+	case AlertLess:
+		return "<"
+	case AlertGreaterOrEqual:
+		return ">="
+	case AlertLessOrEqual:
+		return "<="
+	case AlertEqual:
+		return "=="
+	default:
+		return fmt.Sprintf("AlertOperator(%d)", int(o))
+	}
+}
+
+// Compare reports whether "v <operator> threshold" holds
+func (o AlertOperator) Compare(v, threshold float64) bool {
+	switch o {
+	case AlertGreater:
+		return v > threshold
+	case AlertLess:
+		return v < threshold
+	case AlertGreaterOrEqual:
+		return v >= threshold
+	case AlertLessOrEqual:
+		return v <= threshold
+	case AlertEqual:
+		return v == threshold
+	}
+	return false
+}
+
+// AlertAggregate selects how field values within the window are combined
+type AlertAggregate int
+
+const (
+	AlertMean AlertAggregate = iota
+	AlertMax
+	AlertMin
+)
+
+// ParseAlertAggregate parses "mean", "max" or "min", empty string means
+// AlertMean
+func ParseAlertAggregate(s string) (AlertAggregate, error) {
+	switch s {
+	case "", "mean":
+		return AlertMean, nil
+	case "max":
+		return AlertMax, nil
+	case "min":
+		return AlertMin, nil
+	default:
+		return AlertMean, fmt.Errorf("unknown alert aggregate '%s'", s)
+	}
+}
+
+func (a AlertAggregate) String() string {
+	switch a {
+	case AlertMean:
+		return "mean"
+	case AlertMax:
+		return "max"
+	case AlertMin:
+		return "min"
+	default:
+		return fmt.Sprintf("AlertAggregate(%d)", int(a))
+	}
+}
+
+type alertRule struct {
+	AlertRule
+	operator  AlertOperator
+	aggregate AlertAggregate
+	series    map[string]*alertSeries
+}
+
+type alertSample struct {
+	timestamp time.Time
+	value     float64
+}
+
+// alertSeries holds samples of a single series within the window
+type alertSeries struct {
+	samples  []alertSample
+	alerting bool
+}
+
+// add appends the sample, drops those older than window and returns the
+// aggregate of the rest
+func (s *alertSeries) add(sample alertSample, window time.Duration, aggregate AlertAggregate) float64 {
+	s.samples = append(s.samples, sample)
+	since := sample.timestamp.Add(-window)
+	i := 0
+	for i < len(s.samples) && !s.samples[i].timestamp.After(since) {
+		i++
+	}
+	s.samples = s.samples[i:]
+
+	switch aggregate {
+	case AlertMax:
+		v := math.Inf(-1)
+		for _, sample := range s.samples {
+			v = math.Max(v, sample.value)
+		}
+		return v
+	case AlertMin:
+		v := math.Inf(1)
+		for _, sample := range s.samples {
+			v = math.Min(v, sample.value)
+		}
+		return v
+	default:
+		sum := 0.0
+		for _, sample := range s.samples {
+			sum += sample.value
+		}
+		return sum / float64(len(s.samples))
+	}
+}
+
+// Alerter forwards all the metrics and evaluates alert rules on them. For
+// each series (name and tags) of the rule's measurement, field values
+// within the window are aggregated and compared to the threshold; when the
+// result changes, metric named by Output with the series tags is emitted,
+// "alerting" field is 1 when the condition starts to hold and 0 when it
+// stops, value is the aggregate.
+type Alerter struct {
+	stage
+	Rules  []AlertRule
+	Size   int
+	Logger *Logger
+	Stats  *AlerterStats
+	rules  []*alertRule
+}
+
+// NewAlerter
+func NewAlerter(c *AlerterConfig, input <-chan *Metric, exitFlag *Flag, logger *Logger) (*Alerter, error) {
+	if c.BufferSize == 0 {
+		c.BufferSize = 1000
+	}
+
+	rules := make([]*alertRule, 0, len(c.Rules))
+	for i, rule := range c.Rules {
+		if rule.Measurement == "" || rule.Output == "" {
+			return nil, fmt.Errorf("alert rule %d: measurement and output have to be set", i+1)
+		}
+		if rule.Field == "" {
+			rule.Field = "value"
+		}
+		operator, err := ParseAlertOperator(rule.Operator)
+		if err != nil {
+			return nil, fmt.Errorf("alert rule %d: %v", i+1, err)
+		}
+		aggregate, err := ParseAlertAggregate(rule.Aggregate)
+		if err != nil {
+			return nil, fmt.Errorf("alert rule %d: %v", i+1, err)
+		}
+		if rule.Window.Duration == 0 {
+			rule.Window.Duration = 1 * time.Minute
+		}
+		rules = append(rules, &alertRule{
+			AlertRule: rule,
+			operator:  operator,
+			aggregate: aggregate,
+			series:    make(map[string]*alertSeries),
+		})
+	}
+
+	return &Alerter{
+		stage:  newStage(input, c.BufferSize, exitFlag),
+		Rules:  c.Rules,
+		Size:   c.BufferSize,
+		Logger: logger,
+		Stats:  NewAlerterStats(),
+		rules:  rules,
+	}, nil
+}
+
+// Evaluate accounts the metric to matching rules and returns alert metrics
+// of series whose state changed
+func (a *Alerter) Evaluate(m *Metric) []*Metric {
+	var alerts []*Metric
+	for _, rule := range a.rules {
+		if rule.Measurement != m.Name {
+			continue
+		}
+		v, ok := numericFields(m)[rule.Field]
+		if !ok {
+			continue
+		}
+
+		key := aggregatorKey(m)
+		s, ok := rule.series[key]
+		if !ok {
+			s = &alertSeries{}
+			rule.series[key] = s
+		}
+		aggregated := s.add(alertSample{m.Timestamp, v}, rule.Window.Duration, rule.aggregate)
+		alerting := rule.operator.Compare(aggregated, rule.Threshold)
+		if alerting == s.alerting {
+			continue
+		}
+		s.alerting = alerting
+
+		tags := make(map[string]string, len(m.Fields))
+		for k, v := range m.Fields {
+			tags[k] = v
+		}
+		state := int64(0)
+		if alerting {
+			state = 1
+		}
+		alerts = append(alerts, &Metric{
+			Name:      rule.Output,
+			Timestamp: m.Timestamp,
+			Value:     aggregated,
+			Fields:    tags,
+			Values:    map[string]interface{}{"alerting": state},
+			OK:        true,
+		})
+	}
+	return alerts
+}
+
+func (a *Alerter) process(m *Metric) {
+	alerts := a.Evaluate(m)
+	a.Output <- m
+	a.Stats.Passed.Increment(1)
+	for _, alert := range alerts {
+		a.Output <- alert
+		a.Stats.Alerts.Increment(1)
+	}
+}
+
+func (a *Alerter) Start() {
+	a.Wg.Add(1)
+	go func() {
+		defer a.Wg.Done()
+		for {
+			select {
+			case m := <-a.Input:
+				a.process(m)
+			case <-a.ExitChan:
+				for len(a.Input) > 0 {
+					a.process(<-a.Input)
+				}
+				return
+			}
+		}
+	}()
+
+	a.watchExit()
+}
+
+func (a *Alerter) LogReport() {
+	a.Logger.Info("[alerter] %d/%d (output/capacity), metrics: %d passed, alerts: %d emitted",
+		len(a.Output),
+		a.Size,
+		a.Stats.Passed.Total(),
+		a.Stats.Alerts.Total(),
+	)
+}
+
+type AlerterStats struct {
+	Passed *StatsCounter
+	Alerts *StatsCounter
+}
+
+func NewAlerterStats() *AlerterStats {
+	now := time.Now()
+	return &AlerterStats{
+		Passed: NewStatsCounter(now),
+		Alerts: NewStatsCounter(now),
+	}
+}
+
+func (s *AlerterStats) Reset() {
+	s.Passed.Reset()
+	s.Alerts.Reset()
+}
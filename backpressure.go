@@ -0,0 +1,246 @@
+package metcap
+
+import (
+	"fmt"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// BackpressureMode selects what happens to metrics sent to a full channel
+type BackpressureMode int
+
+const (
+	// BackpressureBlock blocks the producer until there's room
+	BackpressureBlock BackpressureMode = iota
+	// BackpressureDrop drops the new metric
+	BackpressureDrop
+	// BackpressureDropOldest drops the oldest waiting metric to make room,
+	// for real-time streams where old values are worthless
+	BackpressureDropOldest
+)
+
+// ParseBackpressureMode parses "block", "drop" or "drop_oldest",
+// empty string means BackpressureBlock
+func ParseBackpressureMode(s string) (BackpressureMode, error) {
+	switch s {
+	case "", "block":
+		return BackpressureBlock, nil
+	case "drop":
+		return BackpressureDrop, nil
+	case "drop_oldest":
+		return BackpressureDropOldest, nil
+	default:
+		return BackpressureBlock, fmt.Errorf("unknown backpressure mode '%s'", s)
+	}
+}
+
+func (m BackpressureMode) String() string {
+	switch m {
+	case BackpressureBlock:
+		return "block"
+	case BackpressureDrop:
+		return "drop"
+	case BackpressureDropOldest:
+		return "drop_oldest"
+	default:
+		return fmt.Sprintf("BackpressureMode(%d)", int(m))
+	}
+}
+
+// backpressureQueue moves metrics from Input to Output, queueing up to
+// Size of them and applying Mode (drop or drop oldest) when the queue is
+// full, so that writing to Input doesn't block on slow Output
+type backpressureQueue struct {
+	Name    string
+	Mode    BackpressureMode
+	Size    int
+	Input   chan *Metric
+	Output  chan<- *Metric
+	Passed  *StatsCounter
+	Dropped *StatsCounter
+	queue   []*Metric
+	queued  int64
+}
+
+func newBackpressureQueue(name string, mode BackpressureMode, size int, output chan<- *Metric) *backpressureQueue {
+	now := time.Now()
+	return &backpressureQueue{
+		Name:    name,
+		Mode:    mode,
+		Size:    size,
+		Input:   make(chan *Metric, size),
+		Output:  output,
+		Passed:  NewStatsCounter(now),
+		Dropped: NewStatsCounter(now),
+	}
+}
+
+func (q *backpressureQueue) drop() {
+	q.Dropped.Increment(1)
+	pipelineStats.Dropped.Add("backpressure", 1)
+}
+
+// enqueue queues the metric, returns ChannelOverflowError if the queue is
+// full and either of the metrics got dropped
+func (q *backpressureQueue) enqueue(m *Metric) error {
+	var err error
+	if len(q.queue) >= q.Size {
+		err = &ChannelOverflowError{q.Name, 1}
+		q.drop()
+		if q.Mode == BackpressureDrop {
+			return err
+		}
+		q.queue[0] = nil
+		q.queue = q.queue[1:]
+	}
+	q.queue = append(q.queue, m)
+	atomic.StoreInt64(&q.queued, int64(len(q.queue)))
+	return err
+}
+
+func (q *backpressureQueue) dequeue() {
+	q.queue[0] = nil
+	q.queue = q.queue[1:]
+	atomic.StoreInt64(&q.queued, int64(len(q.queue)))
+	q.Passed.Increment(1)
+}
+
+// Len returns number of metrics waiting in Input and the queue
+func (q *backpressureQueue) Len() int {
+	return len(q.Input) + int(atomic.LoadInt64(&q.queued))
+}
+
+// flush passes queued metrics on while Output has room, drops the rest,
+// returning ChannelOverflowError with all the metrics dropped
+func (q *backpressureQueue) flush() error {
+	dropped := 0
+	for len(q.Input) > 0 {
+		if q.enqueue(<-q.Input) != nil {
+			dropped++
+		}
+	}
+	for len(q.queue) > 0 {
+		select {
+		case q.Output <- q.queue[0]:
+			q.dequeue()
+		default:
+			for range q.queue {
+				q.drop()
+			}
+			dropped += len(q.queue)
+			q.queue = nil
+			atomic.StoreInt64(&q.queued, 0)
+		}
+	}
+	if dropped > 0 {
+		return &ChannelOverflowError{q.Name, dropped}
+	}
+	return nil
+}
+
+// run forwards the metrics until exit is closed or receives, returning
+// error of the final flush. Overflows while running are only counted, as
+// they're expected under load.
+func (q *backpressureQueue) run(exit <-chan bool) error {
+	for {
+		// sending is enabled only with something queued
+		var (
+			output chan<- *Metric
+			next   *Metric
+		)
+		if len(q.queue) > 0 {
+			output, next = q.Output, q.queue[0]
+		}
+		select {
+		case m := <-q.Input:
+			q.enqueue(m)
+		case output <- next:
+			q.dequeue()
+		case <-exit:
+			return q.flush()
+		}
+	}
+}
+
+// BackpressuredTransport queues up to Size metrics in front of input of
+// the wrapped transport and applies Mode when the queue is full, so that
+// producers (listeners) never block. Metrics still queued on exit are
+// passed on while the transport has room, the rest is dropped.
+type BackpressuredTransport struct {
+	Transport
+	Mode     BackpressureMode
+	Size     int
+	Queue    *backpressureQueue
+	ExitChan chan bool
+	ExitFlag *Flag
+	Wg       *sync.WaitGroup
+	Logger   *Logger
+}
+
+// NewBackpressuredTransport
+func NewBackpressuredTransport(t Transport, mode BackpressureMode, c *TransportConfig, exitFlag *Flag, logger *Logger) *BackpressuredTransport {
+	if c.BufferSize == 0 {
+		c.BufferSize = 1000
+	}
+
+	return &BackpressuredTransport{
+		Transport: t,
+		Mode:      mode,
+		Size:      c.BufferSize,
+		Queue:     newBackpressureQueue("backpressure", mode, c.BufferSize, t.InputChan()),
+		ExitChan:  make(chan bool, 1),
+		ExitFlag:  exitFlag,
+		Wg:        &sync.WaitGroup{},
+		Logger:    logger,
+	}
+}
+
+func (t *BackpressuredTransport) Start() {
+	t.Transport.Start()
+
+	t.Wg.Add(1)
+	go func() {
+		defer t.Wg.Done()
+		if err := t.Queue.run(t.ExitChan); err != nil {
+			t.Logger.Error("[backpressure] Exiting: %v", err)
+		}
+	}()
+
+	go func() {
+		<-t.ExitFlag.Done()
+		t.ExitChan <- true
+	}()
+}
+
+func (t *BackpressuredTransport) Stop() {
+	t.Wg.Wait()
+	t.Transport.Stop()
+}
+
+// Ready implements ReadinessChecker for the wrapped transport
+func (t *BackpressuredTransport) Ready() error {
+	if checker, ok := t.Transport.(ReadinessChecker); ok {
+		return checker.Ready()
+	}
+	return nil
+}
+
+func (t *BackpressuredTransport) InputChan() chan<- *Metric {
+	return t.Queue.Input
+}
+
+func (t *BackpressuredTransport) InputChanLen() int {
+	return t.Queue.Len()
+}
+
+func (t *BackpressuredTransport) LogReport() {
+	t.Logger.Info("[backpressure] %d/%d (queued/capacity), mode: %s, metrics: %d/%d (passed/dropped)",
+		t.Queue.Len(),
+		t.Size,
+		t.Mode,
+		t.Queue.Passed.Total(),
+		t.Queue.Dropped.Total(),
+	)
+	t.Transport.LogReport()
+}
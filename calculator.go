@@ -0,0 +1,174 @@
+package metcap
+
+import (
+	"context"
+	"fmt"
+	"path"
+	"time"
+
+	"github.com/PaesslerAG/gval"
+)
+
+type calculatorRule struct {
+	CalculatorRule
+	eval gval.Evaluable
+}
+
+// FieldCalculator adds fields computed by gval expressions to metrics
+// whose name matches the rule's pattern. Expressions refer to fields of
+// the metric by name ("value" is the metric value), rules are applied in
+// order so they can use fields computed by previous ones. When any of them
+// fails, the metric is forwarded unchanged.
+type FieldCalculator struct {
+	stage
+	Rules  []CalculatorRule
+	Size   int
+	Logger *Logger
+	Stats  *FieldCalculatorStats
+	rules  []calculatorRule
+}
+
+// NewFieldCalculator
+func NewFieldCalculator(c *CalculatorConfig, input <-chan *Metric, exitFlag *Flag, logger *Logger) (*FieldCalculator, error) {
+	if c.BufferSize == 0 {
+		c.BufferSize = 1000
+	}
+
+	rules := make([]calculatorRule, 0, len(c.Rules))
+	for i, rule := range c.Rules {
+		if rule.Field == "" {
+			return nil, fmt.Errorf("calculator rule %d: field has to be set", i+1)
+		}
+		if rule.Measurement == "" {
+			rule.Measurement = "*"
+		}
+		if _, err := path.Match(rule.Measurement, ""); err != nil {
+			return nil, fmt.Errorf("calculator rule %d: invalid pattern '%s': %v", i+1, rule.Measurement, err)
+		}
+		eval, err := gval.Full().NewEvaluable(rule.Expression)
+		if err != nil {
+			return nil, fmt.Errorf("calculator rule %d: %v", i+1, err)
+		}
+		rules = append(rules, calculatorRule{rule, eval})
+	}
+
+	return &FieldCalculator{
+		stage:  newStage(input, c.BufferSize, exitFlag),
+		Rules:  c.Rules,
+		Size:   c.BufferSize,
+		Logger: logger,
+		Stats:  NewFieldCalculatorStats(),
+		rules:  rules,
+	}, nil
+}
+
+// calculatorValue converts result of an expression to a field value
+func calculatorValue(v interface{}) (interface{}, error) {
+	switch n := v.(type) {
+	case float64, int64, string, bool:
+		return n, nil
+	case int:
+		return int64(n), nil
+	case float32:
+		return float64(n), nil
+	}
+	return nil, fmt.Errorf("unsupported result type %T", v)
+}
+
+// Calculate returns the metric with computed fields, the metric is copied
+// when any rule matches
+func (f *FieldCalculator) Calculate(m *Metric) (*Metric, error) {
+	var values map[string]interface{}
+	for _, rule := range f.rules {
+		if ok, _ := path.Match(rule.Measurement, m.Name); !ok {
+			continue
+		}
+		if values == nil {
+			values = make(map[string]interface{}, len(m.Values)+2)
+			values["value"] = m.Value
+			for k, v := range m.Values {
+				values[k] = v
+			}
+		}
+		result, err := rule.eval(context.Background(), values)
+		if err != nil {
+			return m, fmt.Errorf("field '%s': %v", rule.Field, err)
+		}
+		if values[rule.Field], err = calculatorValue(result); err != nil {
+			return m, fmt.Errorf("field '%s': %v", rule.Field, err)
+		}
+	}
+	if values == nil {
+		return m, nil
+	}
+
+	calculated := *m
+	calculated.Value, _ = histogramValue(values["value"])
+	delete(values, "value")
+	calculated.Values = values
+	return &calculated, nil
+}
+
+func (f *FieldCalculator) process(m *Metric) {
+	calculated, err := f.Calculate(m)
+	switch {
+	case err != nil:
+		f.Logger.Warn("[calculator] Metric '%s': %v", m.Name, err)
+		f.Stats.Errors.Increment(1)
+	case calculated != m:
+		f.Stats.Calculated.Increment(1)
+	}
+	f.Output <- calculated
+	f.Stats.Passed.Increment(1)
+}
+
+func (f *FieldCalculator) Start() {
+	f.Wg.Add(1)
+	go func() {
+		defer f.Wg.Done()
+		for {
+			select {
+			case m := <-f.Input:
+				f.process(m)
+			case <-f.ExitChan:
+				for len(f.Input) > 0 {
+					f.process(<-f.Input)
+				}
+				return
+			}
+		}
+	}()
+
+	f.watchExit()
+}
+
+func (f *FieldCalculator) LogReport() {
+	f.Logger.Info("[calculator] %d/%d (output/capacity), metrics: %d/%d/%d (passed/calculated/failed)",
+		len(f.Output),
+		f.Size,
+		f.Stats.Passed.Total(),
+		f.Stats.Calculated.Total(),
+		f.Stats.Errors.Total(),
+	)
+}
+
+type FieldCalculatorStats struct {
+	Passed     *StatsCounter
+	Calculated *StatsCounter
+	Errors     *StatsCounter
+}
+
+func NewFieldCalculatorStats() *FieldCalculatorStats {
+	now := time.Now()
+	return &FieldCalculatorStats{
+		Passed:     NewStatsCounter(now),
+		Calculated: NewStatsCounter(now),
+		Errors:     NewStatsCounter(now),
+	}
+}
+
+func (s *FieldCalculatorStats) Reset() {
+	s.Passed.Reset()
+	s.Calculated.Reset()
+	s.Errors.Reset()
+}
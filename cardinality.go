@@ -0,0 +1,260 @@
+package metcap
+
+import (
+	"fmt"
+	"hash/fnv"
+	"math"
+	"math/bits"
+	"sort"
+	"time"
+)
+
+// CardinalityOverflowValue replaces tag values of metrics over the budget
+const CardinalityOverflowValue = "__overflow__"
+
+// hllPrecision gives 2^12 registers per measurement, ~1.6% standard error
+const hllPrecision = 12
+
+// CardinalityAction selects what happens to metrics with new tag values
+// once their measurement is over the budget
+type CardinalityAction int
+
+const (
+	// CardinalityOverflow replaces all the tag values with "__overflow__"
+	CardinalityOverflow CardinalityAction = iota
+	// CardinalityDrop discards the metric
+	CardinalityDrop
+)
+
+// ParseCardinalityAction parses "overflow" or "drop", empty string means
+// CardinalityOverflow
+func ParseCardinalityAction(s string) (CardinalityAction, error) {
+	switch s {
+	case "", "overflow":
+		return CardinalityOverflow, nil
+	case "drop":
+		return CardinalityDrop, nil
+	default:
+		return CardinalityOverflow, fmt.Errorf("unknown cardinality action '%s'", s)
+	}
+}
+
+func (a CardinalityAction) String() string {
+	switch a {
+	case CardinalityOverflow:
+		return "overflow"
+	case CardinalityDrop:
+		return "drop"
+	default:
+		return fmt.Sprintf("CardinalityAction(%d)", int(a))
+	}
+}
+
+// hyperLogLog estimates number of distinct hashes added to it
+type hyperLogLog struct {
+	registers [1 << hllPrecision]uint8
+}
+
+func (h *hyperLogLog) add(hash uint64) {
+	i := hash >> (64 - hllPrecision)
+	if rank := uint8(bits.LeadingZeros64(hash<<hllPrecision|1<<(hllPrecision-1)) + 1); rank > h.registers[i] {
+		h.registers[i] = rank
+	}
+}
+
+// estimate returns the estimated cardinality, with linear counting for
+// small ones
+func (h *hyperLogLog) estimate() float64 {
+	m := float64(len(h.registers))
+	sum, zeros := 0.0, 0
+	for _, r := range h.registers {
+		sum += math.Ldexp(1, -int(r))
+		if r == 0 {
+			zeros++
+		}
+	}
+	estimate := 0.7213 / (1 + 1.079/m) * m * m / sum
+	if estimate <= 2.5*m && zeros > 0 {
+		return m * math.Log(m/float64(zeros))
+	}
+	return estimate
+}
+
+// cardinality tracks tag combinations of a single measurement, the sketch
+// counts all of them while admitted holds hashes of those let through
+type cardinality struct {
+	sketch   hyperLogLog
+	admitted map[uint64]struct{}
+	exceeded bool
+}
+
+// CardinalityGuard keeps a HyperLogLog sketch of tag combinations of each
+// measurement. Once its estimated cardinality exceeds MaxCardinality,
+// metrics with combinations not admitted before get their tag values
+// replaced or are dropped, by the action of the measurement. At most
+// MaxCardinality hashes are remembered per measurement.
+type CardinalityGuard struct {
+	stage
+	MaxCardinality int
+	Action         CardinalityAction
+	Actions        map[string]CardinalityAction
+	Size           int
+	Logger         *Logger
+	Stats          *CardinalityGuardStats
+	measurements   map[string]*cardinality
+}
+
+// NewCardinalityGuard
+func NewCardinalityGuard(c *CardinalityGuardConfig, input <-chan *Metric, exitFlag *Flag, logger *Logger) (*CardinalityGuard, error) {
+	if c.BufferSize == 0 {
+		c.BufferSize = 1000
+	}
+
+	action, err := ParseCardinalityAction(c.Action)
+	if err != nil {
+		return nil, err
+	}
+
+	actions := make(map[string]CardinalityAction, len(c.Actions))
+	for name, s := range c.Actions {
+		if actions[name], err = ParseCardinalityAction(s); err != nil {
+			return nil, err
+		}
+	}
+
+	return &CardinalityGuard{
+		stage:          newStage(input, c.BufferSize, exitFlag),
+		MaxCardinality: c.MaxCardinality,
+		Action:         action,
+		Actions:        actions,
+		Size:           c.BufferSize,
+		Logger:         logger,
+		Stats:          NewCardinalityGuardStats(),
+		measurements:   make(map[string]*cardinality),
+	}, nil
+}
+
+// tagsHash hashes sorted tags of the metric
+func tagsHash(m *Metric) uint64 {
+	keys := make([]string, 0, len(m.Fields))
+	for k := range m.Fields {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	h := fnv.New64a()
+	for _, k := range keys {
+		h.Write([]byte(k))
+		h.Write([]byte{0})
+		h.Write([]byte(m.Fields[k]))
+		h.Write([]byte{0})
+	}
+	// FNV doesn't spread the bits well enough for the sketch
+	x := h.Sum64()
+	x ^= x >> 33
+	x *= 0xff51afd7ed558ccd
+	x ^= x >> 33
+	x *= 0xc4ceb9fe1a85ec53
+	x ^= x >> 33
+	return x
+}
+
+// Check returns the metric to forward, nil when it's dropped; the metric
+// is copied when modified
+func (g *CardinalityGuard) Check(m *Metric) *Metric {
+	c, ok := g.measurements[m.Name]
+	if !ok {
+		c = &cardinality{admitted: make(map[uint64]struct{})}
+		g.measurements[m.Name] = c
+	}
+
+	hash := tagsHash(m)
+	c.sketch.add(hash)
+	if _, ok := c.admitted[hash]; ok {
+		return m
+	}
+	if len(c.admitted) < g.MaxCardinality && c.sketch.estimate() <= float64(g.MaxCardinality) {
+		c.admitted[hash] = struct{}{}
+		return m
+	}
+	if !c.exceeded {
+		c.exceeded = true
+		g.Logger.Warn("[cardinality] Measurement '%s' exceeded %d tag combinations", m.Name, g.MaxCardinality)
+	}
+
+	action, ok := g.Actions[m.Name]
+	if !ok {
+		action = g.Action
+	}
+	if action == CardinalityDrop {
+		g.Stats.Dropped.Increment(1)
+		pipelineStats.Dropped.Add("cardinality", 1)
+		return nil
+	}
+	fields := make(map[string]string, len(m.Fields))
+	for k := range m.Fields {
+		fields[k] = CardinalityOverflowValue
+	}
+	overflown := *m
+	overflown.Fields = fields
+	g.Stats.Overflown.Increment(1)
+	return &overflown
+}
+
+func (g *CardinalityGuard) process(m *Metric) {
+	if m = g.Check(m); m == nil {
+		return
+	}
+	g.Output <- m
+	g.Stats.Passed.Increment(1)
+}
+
+func (g *CardinalityGuard) Start() {
+	g.Wg.Add(1)
+	go func() {
+		defer g.Wg.Done()
+		for {
+			select {
+			case m := <-g.Input:
+				g.process(m)
+			case <-g.ExitChan:
+				for len(g.Input) > 0 {
+					g.process(<-g.Input)
+				}
+				return
+			}
+		}
+	}()
+
+	g.watchExit()
+}
+
+func (g *CardinalityGuard) LogReport() {
+	g.Logger.Info("[cardinality] %d/%d (output/capacity), metrics: %d/%d/%d (passed/overflown/dropped)",
+		len(g.Output),
+		g.Size,
+		g.Stats.Passed.Total(),
+		g.Stats.Overflown.Total(),
+		g.Stats.Dropped.Total(),
+	)
+}
+
+type CardinalityGuardStats struct {
+	Passed    *StatsCounter
+	Overflown *StatsCounter
+	Dropped   *StatsCounter
+}
+
+func NewCardinalityGuardStats() *CardinalityGuardStats {
+	now := time.Now()
+	return &CardinalityGuardStats{
+		Passed:    NewStatsCounter(now),
+		Overflown: NewStatsCounter(now),
+		Dropped:   NewStatsCounter(now),
+	}
+}
+
+func (s *CardinalityGuardStats) Reset() {
+	s.Passed.Reset()
+	s.Overflown.Reset()
+	s.Dropped.Reset()
+}
@@ -0,0 +1,197 @@
+package metcap
+
+import (
+	"fmt"
+	"sync"
+	"time"
+)
+
+// CircuitState of the CircuitBreaker
+type CircuitState int
+
+const (
+	// CircuitClosed lets requests through
+	CircuitClosed CircuitState = iota
+	// CircuitOpen refuses requests until Timeout passes
+	CircuitOpen
+	// CircuitHalfOpen lets requests through to probe the downstream
+	CircuitHalfOpen
+)
+
+func (s CircuitState) String() string {
+	switch s {
+	case CircuitClosed:
+		return "closed"
+	case CircuitOpen:
+		return "open"
+	case CircuitHalfOpen:
+		return "half-open"
+	default:
+		return fmt.Sprintf("CircuitState(%d)", int(s))
+	}
+}
+
+// CircuitBreaker opens after FailureThreshold consecutive failures. Once
+// Timeout passes it goes half-open and closes again after SuccessThreshold
+// consecutive successes, any failure while half-open opens it again.
+type CircuitBreaker struct {
+	Name             string
+	FailureThreshold int
+	SuccessThreshold int
+	Timeout          time.Duration
+	Logger           *Logger
+	state            CircuitState
+	failures         int
+	successes        int
+	openedAt         time.Time
+	lock             *sync.Mutex
+}
+
+// NewCircuitBreaker
+func NewCircuitBreaker(name string, failureThreshold int, successThreshold int, timeout time.Duration, logger *Logger) *CircuitBreaker {
+	if failureThreshold == 0 {
+		failureThreshold = 5
+	}
+
+	if successThreshold == 0 {
+		successThreshold = 1
+	}
+
+	if timeout == 0 {
+		timeout = 30 * time.Second
+	}
+
+	return &CircuitBreaker{
+		Name:             name,
+		FailureThreshold: failureThreshold,
+		SuccessThreshold: successThreshold,
+		Timeout:          timeout,
+		Logger:           logger,
+		state:            CircuitClosed,
+		lock:             &sync.Mutex{},
+	}
+}
+
+// transition has to be called with the lock held
+func (c *CircuitBreaker) transition(state CircuitState) {
+	c.Logger.Info("[%s] Circuit %s -> %s", c.Name, c.state, state)
+	c.state = state
+	c.failures, c.successes = 0, 0
+	if state == CircuitOpen {
+		c.openedAt = time.Now()
+	}
+}
+
+// Allow reports whether a request may be made
+func (c *CircuitBreaker) Allow() bool {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	if c.state == CircuitOpen {
+		if time.Since(c.openedAt) < c.Timeout {
+			return false
+		}
+		c.transition(CircuitHalfOpen)
+	}
+	return true
+}
+
+// Success records successful request
+func (c *CircuitBreaker) Success() {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	switch c.state {
+	case CircuitClosed:
+		c.failures = 0
+	case CircuitHalfOpen:
+		c.successes++
+		if c.successes >= c.SuccessThreshold {
+			c.transition(CircuitClosed)
+		}
+	}
+}
+
+// Failure records failed request
+func (c *CircuitBreaker) Failure() {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	switch c.state {
+	case CircuitClosed:
+		c.failures++
+		if c.failures >= c.FailureThreshold {
+			c.transition(CircuitOpen)
+		}
+	case CircuitHalfOpen:
+		c.transition(CircuitOpen)
+	}
+}
+
+func (c *CircuitBreaker) State() CircuitState {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	return c.state
+}
+
+// MetricRing is a fixed size FIFO buffer overwriting the oldest metrics
+// when full
+type MetricRing struct {
+	buf         []*Metric
+	head        int
+	length      int
+	overwritten uint64
+	lock        *sync.Mutex
+}
+
+// NewMetricRing
+func NewMetricRing(size int) *MetricRing {
+	return &MetricRing{
+		buf:  make([]*Metric, size),
+		lock: &sync.Mutex{},
+	}
+}
+
+func (r *MetricRing) Push(m *Metric) {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	if len(r.buf) == 0 {
+		r.overwritten++
+		return
+	}
+	r.buf[(r.head+r.length)%len(r.buf)] = m
+	if r.length < len(r.buf) {
+		r.length++
+	} else {
+		r.head = (r.head + 1) % len(r.buf)
+		r.overwritten++
+	}
+}
+
+// Pop returns the oldest metric, nil when empty
+func (r *MetricRing) Pop() *Metric {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	if r.length == 0 {
+		return nil
+	}
+	m := r.buf[r.head]
+	r.buf[r.head] = nil
+	r.head = (r.head + 1) % len(r.buf)
+	r.length--
+	return m
+}
+
+func (r *MetricRing) Len() int {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	return r.length
+}
+
+func (r *MetricRing) Cap() int {
+	return len(r.buf)
+}
+
+// Overwritten returns count of metrics lost to overwriting
+func (r *MetricRing) Overwritten() uint64 {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	return r.overwritten
+}
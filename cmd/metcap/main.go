@@ -48,6 +48,9 @@ func main() {
 	}
 	runtime.GOMAXPROCS(*cores)
 	mc, exitCode := metcap.NewEngine(config)
+	if _, err := os.Stat(*cfg); err == nil {
+		mc.ConfigFile = *cfg
+	}
 	mc.Run()
 	codeNum := <-exitCode
 	if *prof != "" {
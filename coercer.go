@@ -0,0 +1,142 @@
+package metcap
+
+import (
+	"strconv"
+	"time"
+)
+
+// TypeCoercer converts string values of metrics to int64 or float64,
+// either of all the fields or of the listed ones. Values that can't be
+// parsed stay strings
+type TypeCoercer struct {
+	stage
+	CoerceAll bool
+	Fields    map[string]bool
+	Size      int
+	Logger    *Logger
+	Stats     *TypeCoercerStats
+}
+
+// NewTypeCoercer
+func NewTypeCoercer(c *TypeCoercerConfig, input <-chan *Metric, exitFlag *Flag, logger *Logger) *TypeCoercer {
+	if c.BufferSize == 0 {
+		c.BufferSize = 1000
+	}
+
+	fields := make(map[string]bool, len(c.Fields))
+	for _, name := range c.Fields {
+		fields[name] = true
+	}
+
+	return &TypeCoercer{
+		stage:     newStage(input, c.BufferSize, exitFlag),
+		CoerceAll: c.CoerceAllStringFields,
+		Fields:    fields,
+		Size:      c.BufferSize,
+		Logger:    logger,
+		Stats:     NewTypeCoercerStats(),
+	}
+}
+
+// coerceValue parses s as int64, or float64 if it's not an integer
+func coerceValue(s string) (interface{}, bool) {
+	if i, err := strconv.ParseInt(s, 10, 64); err == nil {
+		return i, true
+	}
+	if f, err := strconv.ParseFloat(s, 64); err == nil {
+		return f, true
+	}
+	return s, false
+}
+
+// Coerce returns the metric with string values converted and count of
+// values that failed to convert. Metric is copied when modified
+func (c *TypeCoercer) Coerce(m *Metric) (*Metric, int) {
+	var (
+		values map[string]interface{}
+		failed int
+	)
+	for k, v := range m.Values {
+		s, ok := v.(string)
+		if !ok || !(c.CoerceAll || c.Fields[k]) {
+			continue
+		}
+		converted, ok := coerceValue(s)
+		if !ok {
+			failed++
+			continue
+		}
+		if values == nil {
+			values = make(map[string]interface{}, len(m.Values))
+			for k, v := range m.Values {
+				values[k] = v
+			}
+		}
+		values[k] = converted
+	}
+	if values == nil {
+		return m, failed
+	}
+
+	coerced := *m
+	coerced.Values = values
+	return &coerced, failed
+}
+
+func (c *TypeCoercer) process(m *Metric) {
+	coerced, failed := c.Coerce(m)
+	if coerced != m {
+		c.Stats.Coerced.Increment(1)
+	}
+	if failed > 0 {
+		c.Stats.Failed.Increment(failed)
+	}
+	c.Output <- coerced
+}
+
+func (c *TypeCoercer) Start() {
+	c.Wg.Add(1)
+	go func() {
+		defer c.Wg.Done()
+		for {
+			select {
+			case m := <-c.Input:
+				c.process(m)
+			case <-c.ExitChan:
+				for len(c.Input) > 0 {
+					c.process(<-c.Input)
+				}
+				return
+			}
+		}
+	}()
+
+	c.watchExit()
+}
+
+func (c *TypeCoercer) LogReport() {
+	c.Logger.Info("[coercer] %d/%d (output/capacity), metrics: %d coerced, values: %d failed",
+		len(c.Output),
+		c.Size,
+		c.Stats.Coerced.Total(),
+		c.Stats.Failed.Total(),
+	)
+}
+
+type TypeCoercerStats struct {
+	Coerced *StatsCounter
+	Failed  *StatsCounter
+}
+
+func NewTypeCoercerStats() *TypeCoercerStats {
+	now := time.Now()
+	return &TypeCoercerStats{
+		Coerced: NewStatsCounter(now),
+		Failed:  NewStatsCounter(now),
+	}
+}
+
+func (s *TypeCoercerStats) Reset() {
+	s.Coerced.Reset()
+	s.Failed.Reset()
+}
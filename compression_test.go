@@ -0,0 +1,58 @@
+package metcap
+
+import (
+	"bytes"
+	"testing"
+)
+
+func TestCompress(t *testing.T) {
+	data := wideBenchMetric().Serialize()
+	for _, compression := range []string{"", CompressionNone, CompressionGzip, CompressionZstd} {
+		t.Run(compression, func(t *testing.T) {
+			compressed, err := Compress(compression, data)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if compression == CompressionGzip || compression == CompressionZstd {
+				if len(compressed) >= len(data) {
+					t.Errorf("compressed %d bytes into %d", len(data), len(compressed))
+				}
+			}
+			decompressed, err := Decompress(compression, compressed)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !bytes.Equal(decompressed, data) {
+				t.Errorf("Decompress() doesn't revert Compress()")
+			}
+		})
+	}
+
+	if _, err := Compress("lz4", data); err == nil {
+		t.Errorf("Compress() with unknown compression didn't fail")
+	}
+	if _, err := Decompress(CompressionGzip, data); err == nil {
+		t.Errorf("Decompress() of uncompressed data didn't fail")
+	}
+}
+
+// benchmarkCompress reports compressed size as B/msg next to the speed
+func benchmarkCompress(b *testing.B, compression string) {
+	data := wideBenchMetric().Serialize()
+	var out []byte
+	b.SetBytes(int64(len(data)))
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		var err error
+		if out, err = Compress(compression, data); err != nil {
+			b.Fatal(err)
+		}
+	}
+	b.StopTimer()
+	b.ReportMetric(float64(len(out)), "B/msg")
+}
+
+func BenchmarkCompressNone(b *testing.B) { benchmarkCompress(b, CompressionNone) }
+func BenchmarkCompressGzip(b *testing.B) { benchmarkCompress(b, CompressionGzip) }
+func BenchmarkCompressZstd(b *testing.B) { benchmarkCompress(b, CompressionZstd) }
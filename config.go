@@ -1,36 +1,314 @@
 package metcap
 
 import (
+	"bytes"
+	"encoding/json"
 	"fmt"
+	"io"
+	"io/ioutil"
+	"net/url"
 	"os"
+	"path/filepath"
+	"reflect"
+	"strconv"
+	"strings"
 	"time"
 
 	"github.com/BurntSushi/toml"
+	"github.com/fsnotify/fsnotify"
+	"gopkg.in/yaml.v3"
 )
 
 type Config struct {
-	Syslog      bool
-	Debug       bool
-	ReportEvery configDuration `toml:"report_every"`
-	Transport   TransportConfig
-	Listener    map[string]ListenerConfig
-	Writer      WriterConfig
-	Aggregator  AggregatorConfig
+	Syslog              bool
+	Debug               bool
+	LogFormat           string         `toml:"log_format" yaml:"log_format"`
+	LogLevel            string         `toml:"log_level" yaml:"log_level"`
+	ReportEvery         configDuration `toml:"report_every" yaml:"report_every"`
+	ShutdownTimeout     configDuration `toml:"shutdown_timeout" yaml:"shutdown_timeout"`
+	Transport           TransportConfig
+	Pipeline            PipelineConfig
+	Listener            map[string]ListenerConfig
+	Writer              WriterConfig
+	Sanitizer           SanitizerConfig
+	TypeCoercer         TypeCoercerConfig         `toml:"type_coercer" yaml:"type_coercer"`
+	TimestampNormalizer TimestampNormalizerConfig `toml:"timestamp_normalizer" yaml:"timestamp_normalizer"`
+	Histogram           HistogramUnpackerConfig
+	Calculator          CalculatorConfig
+	Enricher            EnricherConfig
+	Relabel             RelabelConfig
+	Alerter             AlerterConfig
+	CardinalityGuard    CardinalityGuardConfig `toml:"cardinality_guard" yaml:"cardinality_guard"`
+	Sampler             SamplerConfig
+	Aggregator          AggregatorConfig
+	Downsampler         DownsamplerConfig
+	Deduplicator        DeduplicatorConfig
+	RateLimiter         RateLimiterConfig  `toml:"rate_limiter" yaml:"rate_limiter"`
+	ExpiryFilter        ExpiryFilterConfig `toml:"expiry_filter" yaml:"expiry_filter"`
+	Prometheus          PrometheusConfig
+	Health              HealthConfig
 }
 
 type TransportConfig struct {
-	Type             string
-	BufferSize       int    `toml:"buffer_size"`
-	RedisURL         string `toml:"redis_url"`
-	RedisTimeout     int    `toml:"redis_timeout"`
-	RedisWait        int    `toml:"redis_wait"`
-	RedisRetries     int    `toml:"redis_retries"`
-	RedisConnections int    `toml:"redis_connections"`
-	RedisQueue       string `toml:"redis_queue"`
-	AMQPURL          string `toml:"amqp_url"`
-	AMQPTag          string `toml:"amqp_tag"`
-	AMQPTimeout      int    `toml:"amqp_timeout"`
-	AMQPWorkers      int    `toml:"amqp_workers"`
+	Type                      string
+	BufferSize                int                  `toml:"buffer_size" yaml:"buffer_size"`
+	DiskBufferPath            string               `toml:"disk_buffer_path" yaml:"disk_buffer_path"`
+	DiskBufferMaxBytes        int64                `toml:"disk_buffer_max_bytes" yaml:"disk_buffer_max_bytes"`
+	Backpressure              string               `toml:"backpressure" yaml:"backpressure"`
+	SerializationFormat       string               `toml:"serialization_format" yaml:"serialization_format"`
+	SourceTagging             bool                 `toml:"source_tagging" yaml:"source_tagging"`
+	RedisURL                  string               `toml:"redis_url" yaml:"redis_url"`
+	RedisTimeout              int                  `toml:"redis_timeout" yaml:"redis_timeout"`
+	RedisWait                 int                  `toml:"redis_wait" yaml:"redis_wait"`
+	RedisRetries              int                  `toml:"redis_retries" yaml:"redis_retries"`
+	RedisConnections          int                  `toml:"redis_connections" yaml:"redis_connections"`
+	RedisQueue                string               `toml:"redis_queue" yaml:"redis_queue"`
+	RedisStream               string               `toml:"redis_stream" yaml:"redis_stream"`
+	RedisGroup                string               `toml:"redis_group" yaml:"redis_group"`
+	RedisConsumerID           string               `toml:"redis_consumer_id" yaml:"redis_consumer_id"`
+	AMQPURL                   string               `toml:"amqp_url" yaml:"amqp_url"`
+	AMQPVHost                 string               `toml:"amqp_vhost" yaml:"amqp_vhost"`
+	AMQPTag                   string               `toml:"amqp_tag" yaml:"amqp_tag"`
+	AMQPTimeout               int                  `toml:"amqp_timeout" yaml:"amqp_timeout"`
+	AMQPHeartbeat             configDuration       `toml:"amqp_heartbeat" yaml:"amqp_heartbeat"`
+	AMQPReadTimeout           configDuration       `toml:"amqp_read_timeout" yaml:"amqp_read_timeout"`
+	AMQPWriteTimeout          configDuration       `toml:"amqp_write_timeout" yaml:"amqp_write_timeout"`
+	AMQPShareConnection       bool                 `toml:"amqp_share_connection" yaml:"amqp_share_connection"`
+	AMQPChannelPerProducer    bool                 `toml:"amqp_channel_per_producer" yaml:"amqp_channel_per_producer"`
+	AMQPWorkers               int                  `toml:"amqp_workers" yaml:"amqp_workers"`
+	AMQPQueues                []string             `toml:"amqp_queues" yaml:"amqp_queues"`
+	AMQPExchangeType          string               `toml:"amqp_exchange_type" yaml:"amqp_exchange_type"`
+	AMQPRoutingKey            string               `toml:"amqp_routing_key" yaml:"amqp_routing_key"`
+	AMQPRoutingKeyTemplate    string               `toml:"amqp_routing_key_template" yaml:"amqp_routing_key_template"`
+	AMQPExchanges             []AMQPExchangeConfig `toml:"amqp_exchange" yaml:"amqp_exchange"`
+	AMQPBatchSize             int                  `toml:"amqp_batch_size" yaml:"amqp_batch_size"`
+	AMQPBatchTimeout          configDuration       `toml:"amqp_batch_timeout" yaml:"amqp_batch_timeout"`
+	AMQPPrefetchCount         int                  `toml:"amqp_prefetch_count" yaml:"amqp_prefetch_count"`
+	AMQPPrefetchSize          int                  `toml:"amqp_prefetch_size" yaml:"amqp_prefetch_size"`
+	AMQPMaxPriority           uint8                `toml:"amqp_max_priority" yaml:"amqp_max_priority"`
+	AMQPDeadLetterExchange    string               `toml:"amqp_dead_letter_exchange" yaml:"amqp_dead_letter_exchange"`
+	AMQPDeadLetterQueue       string               `toml:"amqp_dead_letter_queue" yaml:"amqp_dead_letter_queue"`
+	AMQPReconnectMax          configDuration       `toml:"amqp_reconnect_max" yaml:"amqp_reconnect_max"`
+	AMQPPublisherConfirms     bool                 `toml:"amqp_publisher_confirms" yaml:"amqp_publisher_confirms"`
+	AMQPConfirmTimeout        configDuration       `toml:"amqp_confirm_timeout" yaml:"amqp_confirm_timeout"`
+	AMQPMaxRetries            int                  `toml:"amqp_max_retries" yaml:"amqp_max_retries"`
+	AMQPCompression           string               `toml:"amqp_compression" yaml:"amqp_compression"`
+	AMQPTLSCertFile           string               `toml:"amqp_tls_cert_file" yaml:"amqp_tls_cert_file"`
+	AMQPTLSKeyFile            string               `toml:"amqp_tls_key_file" yaml:"amqp_tls_key_file"`
+	AMQPTLSCAFile             string               `toml:"amqp_tls_ca_file" yaml:"amqp_tls_ca_file"`
+	KafkaBrokers              []string             `toml:"kafka_brokers" yaml:"kafka_brokers"`
+	KafkaTopic                string               `toml:"kafka_topic" yaml:"kafka_topic"`
+	KafkaGroupID              string               `toml:"kafka_group_id" yaml:"kafka_group_id"`
+	KafkaPartitions           int                  `toml:"kafka_partitions" yaml:"kafka_partitions"`
+	KafkaOffset               string               `toml:"kafka_offset" yaml:"kafka_offset"`
+	KafkaTimeout              int                  `toml:"kafka_timeout" yaml:"kafka_timeout"`
+	KafkaBatchSize            int                  `toml:"kafka_batch_size" yaml:"kafka_batch_size"`
+	KafkaBatchWait            configDuration       `toml:"kafka_batch_wait" yaml:"kafka_batch_wait"`
+	KafkaSerializationFormat  string               `toml:"kafka_serialization_format" yaml:"kafka_serialization_format"`
+	KafkaSchemaRegistryURL    string               `toml:"kafka_schema_registry_url" yaml:"kafka_schema_registry_url"`
+	KafkaSchemaSubject        string               `toml:"kafka_schema_subject" yaml:"kafka_schema_subject"`
+	NATSServers               []string             `toml:"nats_servers" yaml:"nats_servers"`
+	NATSSubject               string               `toml:"nats_subject" yaml:"nats_subject"`
+	NATSStream                string               `toml:"nats_stream" yaml:"nats_stream"`
+	NATSConsumerName          string               `toml:"nats_consumer_name" yaml:"nats_consumer_name"`
+	NATSMaxInflight           int                  `toml:"nats_max_inflight" yaml:"nats_max_inflight"`
+	NATSTimeout               int                  `toml:"nats_timeout" yaml:"nats_timeout"`
+	HTTPListenAddr            string               `toml:"http_listen_addr" yaml:"http_listen_addr"`
+	HTTPMaxBodyBytes          int64                `toml:"http_max_body_bytes" yaml:"http_max_body_bytes"`
+	HTTPTimeout               int                  `toml:"http_timeout" yaml:"http_timeout"`
+	TCPListenAddr             string               `toml:"tcp_listen_addr" yaml:"tcp_listen_addr"`
+	TCPMaxConns               int                  `toml:"tcp_max_conns" yaml:"tcp_max_conns"`
+	TCPReadTimeout            configDuration       `toml:"tcp_read_timeout" yaml:"tcp_read_timeout"`
+	UDPListenAddr             string               `toml:"udp_listen_addr" yaml:"udp_listen_addr"`
+	UDPMaxDatagramSize        int                  `toml:"udp_max_datagram_size" yaml:"udp_max_datagram_size"`
+	SyslogAddr                string               `toml:"syslog_addr" yaml:"syslog_addr"`
+	SyslogProtocol            string               `toml:"syslog_protocol" yaml:"syslog_protocol"`
+	SyslogSDToTags            []string             `toml:"syslog_sd_to_tags" yaml:"syslog_sd_to_tags"`
+	SNMPListenAddr            string               `toml:"snmp_listen_addr" yaml:"snmp_listen_addr"`
+	SNMPCommunity             string               `toml:"snmp_community" yaml:"snmp_community"`
+	SNMPMIBPath               string               `toml:"snmp_mib_path" yaml:"snmp_mib_path"`
+	JolokiaURL                string               `toml:"jolokia_url" yaml:"jolokia_url"`
+	JolokiaRequests           []JolokiaRequest     `toml:"jolokia_request" yaml:"jolokia_request"`
+	JolokiaScrapeInterval     configDuration       `toml:"jolokia_scrape_interval" yaml:"jolokia_scrape_interval"`
+	JolokiaTimeout            configDuration       `toml:"jolokia_timeout" yaml:"jolokia_timeout"`
+	StatsDListenAddr          string               `toml:"statsd_listen_addr" yaml:"statsd_listen_addr"`
+	StatsDFlushInterval       configDuration       `toml:"statsd_flush_interval" yaml:"statsd_flush_interval"`
+	StatsDMTags               bool                 `toml:"statsd_mtags" yaml:"statsd_mtags"`
+	PrometheusTargets         []string             `toml:"prometheus_targets" yaml:"prometheus_targets"`
+	PrometheusScrapeInterval  configDuration       `toml:"prometheus_scrape_interval" yaml:"prometheus_scrape_interval"`
+	PrometheusHonorTimestamps bool                 `toml:"prometheus_honor_timestamps" yaml:"prometheus_honor_timestamps"`
+	PrometheusHTTPTimeout     configDuration       `toml:"prometheus_http_timeout" yaml:"prometheus_http_timeout"`
+	CollectdListenAddr        string               `toml:"collectd_listen_addr" yaml:"collectd_listen_addr"`
+	CollectdSecurityLevel     string               `toml:"collectd_security_level" yaml:"collectd_security_level"`
+	CollectdAuthFile          string               `toml:"collectd_auth_file" yaml:"collectd_auth_file"`
+	ReplayPath                string               `toml:"replay_path" yaml:"replay_path"`
+	ReplayRate                float64              `toml:"replay_rate" yaml:"replay_rate"`
+	Router                    RouterConfig         `toml:"router" yaml:"router"`
+}
+
+type RouterConfig struct {
+	Default    string                     `toml:"default" yaml:"default"`
+	Rules      []RouteRule                `toml:"rule" yaml:"rule"`
+	Transports map[string]TransportConfig `toml:"transports" yaml:"transports"`
+}
+
+// PipelineConfig declares named transports connected by edges, used
+// instead of the single transport when it has any transports
+type PipelineConfig struct {
+	BufferSize int                        `toml:"buffer_size" yaml:"buffer_size"`
+	Transports map[string]TransportConfig `toml:"transports" yaml:"transports"`
+	Edges      []PipelineEdge             `toml:"edge" yaml:"edge"`
+}
+
+// PipelineEdge feeds output of transport From to input of transport To
+type PipelineEdge struct {
+	From string `toml:"from" yaml:"from"`
+	To   string `toml:"to" yaml:"to"`
+}
+
+// AMQPExchangeConfig is an exchange metrics are published to in addition
+// to the exchange of the transport, Type and RoutingKeyTemplate default to
+// those of the transport
+type AMQPExchangeConfig struct {
+	Name               string `toml:"name" yaml:"name"`
+	Type               string `toml:"type" yaml:"type"`
+	RoutingKeyTemplate string `toml:"routing_key_template" yaml:"routing_key_template"`
+}
+
+// JolokiaRequest reads Attributes of MBeans matching the pattern, all of
+// their attributes if there are none
+type JolokiaRequest struct {
+	MBean      string   `toml:"mbean" yaml:"mbean"`
+	Attributes []string `toml:"attributes" yaml:"attributes"`
+}
+
+// RouteRule sends metrics with name matching glob Pattern to Transport
+type RouteRule struct {
+	Pattern   string `toml:"pattern" yaml:"pattern"`
+	Transport string `toml:"transport" yaml:"transport"`
+}
+
+// Validate checks options of the transport type and returns all the
+// problems found at once. Defaults have to be applied already.
+func (c *TransportConfig) Validate() []error {
+	var errs []error
+	if c.BufferSize <= 0 {
+		errs = append(errs, fmt.Errorf("buffer_size has to be positive"))
+	}
+	switch c.Type {
+	case "amqp":
+		errs = append(errs, c.validateAMQP()...)
+	case "kafka":
+		errs = append(errs, c.validateKafka()...)
+	}
+	return errs
+}
+
+func (c *TransportConfig) validateKafka() []error {
+	var errs []error
+	switch c.KafkaSerializationFormat {
+	case "":
+	case "avro":
+		if u, err := url.Parse(c.KafkaSchemaRegistryURL); err != nil || u.Host == "" {
+			errs = append(errs, fmt.Errorf("kafka_schema_registry_url is required by avro kafka_serialization_format"))
+		}
+	default:
+		if _, err := NewSerializationFormat(c.KafkaSerializationFormat); err != nil {
+			errs = append(errs, fmt.Errorf("kafka_serialization_format: %v", err))
+		}
+	}
+	return errs
+}
+
+func (c *TransportConfig) validateAMQP() []error {
+	var errs []error
+	if u, err := url.Parse(c.AMQPURL); err != nil {
+		errs = append(errs, fmt.Errorf("invalid amqp_url: %v", err))
+	} else if u.Scheme != "amqp" && u.Scheme != "amqps" || u.Host == "" {
+		errs = append(errs, fmt.Errorf("amqp_url has to be amqp:// or amqps:// URL"))
+	} else if u.Scheme != "amqps" && (c.AMQPTLSCertFile != "" || c.AMQPTLSKeyFile != "" || c.AMQPTLSCAFile != "") {
+		errs = append(errs, fmt.Errorf("TLS is configured, but amqp_url doesn't use amqps:// scheme"))
+	}
+	if c.AMQPVHost != "" && !strings.HasPrefix(c.AMQPVHost, "/") {
+		errs = append(errs, fmt.Errorf("amqp_vhost has to start with '/'"))
+	}
+	// the workers are both consumers and producers
+	if c.AMQPWorkers < 1 {
+		errs = append(errs, fmt.Errorf("amqp_workers has to be at least 1"))
+	}
+	if c.AMQPTimeout <= 0 {
+		errs = append(errs, fmt.Errorf("amqp_timeout has to be positive"))
+	}
+	if c.AMQPHeartbeat.Duration < 0 {
+		errs = append(errs, fmt.Errorf("amqp_heartbeat can't be negative"))
+	}
+	if c.AMQPWriteTimeout.Duration < 0 {
+		errs = append(errs, fmt.Errorf("amqp_write_timeout can't be negative"))
+	}
+	// heartbeats are the only traffic of an idle connection
+	if c.AMQPReadTimeout.Duration < 0 || (c.AMQPReadTimeout.Duration > 0 && c.AMQPReadTimeout.Duration <= c.AMQPHeartbeat.Duration) {
+		errs = append(errs, fmt.Errorf("amqp_read_timeout has to be longer than amqp_heartbeat"))
+	}
+	if c.AMQPPrefetchCount < 0 || c.AMQPPrefetchSize < 0 {
+		errs = append(errs, fmt.Errorf("amqp_prefetch_count and amqp_prefetch_size can't be negative"))
+	}
+	switch c.AMQPExchangeType {
+	case "direct", "fanout", "topic", "headers":
+	default:
+		errs = append(errs, fmt.Errorf("unknown amqp_exchange_type '%s'", c.AMQPExchangeType))
+	}
+	if c.AMQPRoutingKeyTemplate != "" {
+		// direct exchange would route the messages nowhere
+		if c.AMQPExchangeType != "topic" {
+			errs = append(errs, fmt.Errorf("amqp_routing_key_template requires topic amqp_exchange_type"))
+		}
+		if _, err := newAMQPRoutingKeyTemplate(c.AMQPRoutingKeyTemplate); err != nil {
+			errs = append(errs, err)
+		}
+	}
+	exchanges := map[string]bool{"metcap:" + c.AMQPTag: true}
+	for i, exchange := range c.AMQPExchanges {
+		if exchange.Name == "" {
+			errs = append(errs, fmt.Errorf("amqp_exchange %d: name has to be set", i+1))
+			continue
+		}
+		if exchanges[exchange.Name] {
+			errs = append(errs, fmt.Errorf("amqp_exchange '%s' is already used", exchange.Name))
+		}
+		exchanges[exchange.Name] = true
+		switch exchange.Type {
+		case "direct", "fanout", "topic", "headers":
+		default:
+			errs = append(errs, fmt.Errorf("amqp_exchange '%s': unknown type '%s'", exchange.Name, exchange.Type))
+		}
+		if exchange.RoutingKeyTemplate != "" {
+			if exchange.Type != "topic" {
+				errs = append(errs, fmt.Errorf("amqp_exchange '%s': routing_key_template requires topic type", exchange.Name))
+			}
+			if _, err := newAMQPRoutingKeyTemplate(exchange.RoutingKeyTemplate); err != nil {
+				errs = append(errs, fmt.Errorf("amqp_exchange '%s': %v", exchange.Name, err))
+			}
+		}
+	}
+	if err := CheckCompression(c.AMQPCompression); err != nil {
+		errs = append(errs, err)
+	}
+	if (c.AMQPDeadLetterExchange == "") != (c.AMQPDeadLetterQueue == "") {
+		errs = append(errs, fmt.Errorf("both amqp_dead_letter_exchange and amqp_dead_letter_queue have to be set"))
+	}
+	if _, err := NewSerializationFormat(c.SerializationFormat); err != nil {
+		errs = append(errs, err)
+	}
+	return errs
+}
+
+// joinErrors formats errors returned by Validate as one
+func joinErrors(errs []error) error {
+	msgs := make([]string, len(errs))
+	for i, err := range errs {
+		msgs[i] = err.Error()
+	}
+	return fmt.Errorf("%s", strings.Join(msgs, "; "))
 }
 
 type ListenerConfig struct {
@@ -38,20 +316,226 @@ type ListenerConfig struct {
 	Protocol    string
 	Codec       string
 	Decoders    int
-	MutatorFile string `toml:"mutator_file"`
+	MutatorFile string `toml:"mutator_file" yaml:"mutator_file"`
 }
 
 type WriterConfig struct {
-	URLs        []string       `toml:"urls"`
-	Timeout     int            `toml:"timeout"`
-	Concurrency int            `toml:"concurrency"`
-	BulkMax     int            `toml:"bulk_max"`
-	BulkWait    configDuration `toml:"bulk_wait"`
-	Index       string         `toml:"index"`
-	DocType     string         `toml:"doc_type"`
+	URLs        []string       `toml:"urls" yaml:"urls"`
+	Timeout     int            `toml:"timeout" yaml:"timeout"`
+	Concurrency int            `toml:"concurrency" yaml:"concurrency"`
+	BulkMax     int            `toml:"bulk_max" yaml:"bulk_max"`
+	BulkWait    configDuration `toml:"bulk_wait" yaml:"bulk_wait"`
+	Index       string         `toml:"index" yaml:"index"`
+	DocType     string         `toml:"doc_type" yaml:"doc_type"`
+
+	CircuitFailureThreshold int            `toml:"circuit_failure_threshold" yaml:"circuit_failure_threshold"`
+	CircuitSuccessThreshold int            `toml:"circuit_success_threshold" yaml:"circuit_success_threshold"`
+	CircuitTimeout          configDuration `toml:"circuit_timeout" yaml:"circuit_timeout"`
+	CircuitBufferSize       int            `toml:"circuit_buffer_size" yaml:"circuit_buffer_size"`
+
+	InfluxURL           string         `toml:"influx_url" yaml:"influx_url"`
+	InfluxToken         string         `toml:"influx_token" yaml:"influx_token"`
+	InfluxOrg           string         `toml:"influx_org" yaml:"influx_org"`
+	InfluxBucket        string         `toml:"influx_bucket" yaml:"influx_bucket"`
+	InfluxBatchSize     int            `toml:"influx_batch_size" yaml:"influx_batch_size"`
+	InfluxFlushInterval configDuration `toml:"influx_flush_interval" yaml:"influx_flush_interval"`
+	InfluxMaxRetries    int            `toml:"influx_max_retries" yaml:"influx_max_retries"`
+	InfluxShardCount    int            `toml:"influx_shard_count" yaml:"influx_shard_count"`
+	InfluxDB            string         `toml:"influx_db" yaml:"influx_db"`
+	InfluxRP            string         `toml:"influx_rp" yaml:"influx_rp"`
+	InfluxUsername      string         `toml:"influx_username" yaml:"influx_username"`
+	InfluxPassword      string         `toml:"influx_password" yaml:"influx_password"`
+	InfluxPrecision     string         `toml:"influx_precision" yaml:"influx_precision"`
+	InfluxWriteGzip     bool           `toml:"influx_write_gzip" yaml:"influx_write_gzip"`
+
+	ESAddresses        []string `toml:"es_addresses" yaml:"es_addresses"`
+	ESIndex            string   `toml:"es_index" yaml:"es_index"`
+	ESIndexTimePattern string   `toml:"es_index_time_pattern" yaml:"es_index_time_pattern"`
+	ESUsername         string   `toml:"es_username" yaml:"es_username"`
+	ESPassword         string   `toml:"es_password" yaml:"es_password"`
+	ESBulkSize         int      `toml:"es_bulk_size" yaml:"es_bulk_size"`
+
+	AWSRegion           string `toml:"aws_region" yaml:"aws_region"`
+	AWSCredentialSource string `toml:"aws_credential_source" yaml:"aws_credential_source"`
+	CloudWatchNamespace string `toml:"cloudwatch_namespace" yaml:"cloudwatch_namespace"`
+	CloudWatchBatchSize int    `toml:"cloudwatch_batch_size" yaml:"cloudwatch_batch_size"`
+
+	StatsDAddr       string `toml:"statsd_addr" yaml:"statsd_addr"`
+	StatsDPrefix     string `toml:"statsd_prefix" yaml:"statsd_prefix"`
+	StatsDSuffix     string `toml:"statsd_suffix" yaml:"statsd_suffix"`
+	StatsDMaxUDPSize int    `toml:"statsd_max_udp_size" yaml:"statsd_max_udp_size"`
+
+	GraphiteAddr           string         `toml:"graphite_addr" yaml:"graphite_addr"`
+	GraphiteConnTimeout    configDuration `toml:"graphite_conn_timeout" yaml:"graphite_conn_timeout"`
+	GraphiteReconnectDelay configDuration `toml:"graphite_reconnect_delay" yaml:"graphite_reconnect_delay"`
+	GraphitePrefix         string         `toml:"graphite_prefix" yaml:"graphite_prefix"`
+	GraphiteTemplate       string         `toml:"graphite_template" yaml:"graphite_template"`
+
+	WebhookURL           string            `toml:"webhook_url" yaml:"webhook_url"`
+	WebhookBatchSize     int               `toml:"webhook_batch_size" yaml:"webhook_batch_size"`
+	WebhookFlushInterval configDuration    `toml:"webhook_flush_interval" yaml:"webhook_flush_interval"`
+	WebhookHeaders       map[string]string `toml:"webhook_headers" yaml:"webhook_headers"`
+	WebhookTimeout       configDuration    `toml:"webhook_timeout" yaml:"webhook_timeout"`
+	WebhookMaxRetries    int               `toml:"webhook_max_retries" yaml:"webhook_max_retries"`
+
+	FilePath       string `toml:"file_path" yaml:"file_path"`
+	FileCompress   bool   `toml:"file_compress" yaml:"file_compress"`
+	FileMaxSizeMB  int    `toml:"file_max_size_mb" yaml:"file_max_size_mb"`
+	FileMaxBackups int    `toml:"file_max_backups" yaml:"file_max_backups"`
+}
+
+type PrometheusConfig struct {
+	ListenAddr string `toml:"listen_addr" yaml:"listen_addr"`
 }
 
-type AggregatorConfig struct{}
+type HealthConfig struct {
+	ListenAddr string `toml:"listen_addr" yaml:"listen_addr"`
+}
+
+type SanitizerConfig struct {
+	IllegalChars    string `toml:"illegal_chars" yaml:"illegal_chars"`
+	Replacement     string `toml:"replacement" yaml:"replacement"`
+	MaxTagValueLen  int    `toml:"max_tag_value_len" yaml:"max_tag_value_len"`
+	DropInvalidName bool   `toml:"drop_invalid_name" yaml:"drop_invalid_name"`
+	BufferSize      int    `toml:"buffer_size" yaml:"buffer_size"`
+}
+
+// Enabled reports whether any of the rules is turned on
+func (c *SanitizerConfig) Enabled() bool {
+	return c.IllegalChars != "" || c.MaxTagValueLen > 0 || c.DropInvalidName
+}
+
+type TypeCoercerConfig struct {
+	CoerceAllStringFields bool     `toml:"coerce_all_string_fields" yaml:"coerce_all_string_fields"`
+	Fields                []string `toml:"fields" yaml:"fields"`
+	BufferSize            int      `toml:"buffer_size" yaml:"buffer_size"`
+}
+
+type TimestampNormalizerConfig struct {
+	RoundTo         configDuration `toml:"round_to" yaml:"round_to"`
+	ConvertToUTC    bool           `toml:"convert_to_utc" yaml:"convert_to_utc"`
+	MaxFutureOffset configDuration `toml:"max_future_offset" yaml:"max_future_offset"`
+	MaxPastOffset   configDuration `toml:"max_past_offset" yaml:"max_past_offset"`
+	BufferSize      int            `toml:"buffer_size" yaml:"buffer_size"`
+}
+
+// Enabled reports whether any of the adjustments is turned on
+func (c *TimestampNormalizerConfig) Enabled() bool {
+	return c.RoundTo.Duration > 0 || c.ConvertToUTC || c.MaxFutureOffset.Duration > 0 || c.MaxPastOffset.Duration > 0
+}
+
+type HistogramUnpackerConfig struct {
+	Enabled    bool `toml:"enabled" yaml:"enabled"`
+	BufferSize int  `toml:"buffer_size" yaml:"buffer_size"`
+}
+
+type CalculatorConfig struct {
+	Rules      []CalculatorRule `toml:"rule" yaml:"rule"`
+	BufferSize int              `toml:"buffer_size" yaml:"buffer_size"`
+}
+
+// CalculatorRule sets Field of metrics with name matching Measurement
+// pattern to result of the gval Expression
+type CalculatorRule struct {
+	Measurement string `toml:"measurement" yaml:"measurement"`
+	Field       string `toml:"field" yaml:"field"`
+	Expression  string `toml:"expression" yaml:"expression"`
+}
+
+type EnricherConfig struct {
+	Tags       map[string]string `toml:"tags" yaml:"tags"`
+	OnConflict string            `toml:"on_conflict" yaml:"on_conflict"`
+	BufferSize int               `toml:"buffer_size" yaml:"buffer_size"`
+}
+
+type RelabelConfig struct {
+	Rules      []RelabelRule `toml:"rule" yaml:"rule"`
+	BufferSize int           `toml:"buffer_size" yaml:"buffer_size"`
+}
+
+// RelabelRule matches Source regex against Label (tag name, or "__name__"
+// for metric name) and applies Action; Target is the replacement that
+// can refer to capture groups ($1)
+type RelabelRule struct {
+	Label       string `toml:"label" yaml:"label"`
+	Source      string `toml:"source" yaml:"source"`
+	Target      string `toml:"target" yaml:"target"`
+	TargetLabel string `toml:"target_label" yaml:"target_label"`
+	Action      string `toml:"action" yaml:"action"`
+}
+
+type DownsamplerConfig struct {
+	Resolution configDuration `toml:"resolution" yaml:"resolution"`
+	Patterns   []string       `toml:"patterns" yaml:"patterns"`
+	Counters   []string       `toml:"counters" yaml:"counters"`
+	BufferSize int            `toml:"buffer_size" yaml:"buffer_size"`
+}
+
+type AlerterConfig struct {
+	Rules      []AlertRule `toml:"rule" yaml:"rule"`
+	BufferSize int         `toml:"buffer_size" yaml:"buffer_size"`
+}
+
+// AlertRule compares Aggregate ("mean", "max" or "min") of Field of
+// Measurement metrics within Window to Threshold using Operator, Output
+// is name of the alert metric
+type AlertRule struct {
+	Measurement string         `toml:"measurement" yaml:"measurement"`
+	Field       string         `toml:"field" yaml:"field"`
+	Operator    string         `toml:"operator" yaml:"operator"`
+	Threshold   float64        `toml:"threshold" yaml:"threshold"`
+	Window      configDuration `toml:"window" yaml:"window"`
+	Aggregate   string         `toml:"aggregate" yaml:"aggregate"`
+	Output      string         `toml:"output" yaml:"output"`
+}
+
+// CardinalityGuardConfig limits number of tag combinations per
+// measurement, Actions overrides Action ("overflow" or "drop") by name
+type CardinalityGuardConfig struct {
+	MaxCardinality int               `toml:"max_cardinality" yaml:"max_cardinality"`
+	Action         string            `toml:"action" yaml:"action"`
+	Actions        map[string]string `toml:"actions" yaml:"actions"`
+	BufferSize     int               `toml:"buffer_size" yaml:"buffer_size"`
+}
+
+// Enabled reports whether the cardinality is limited
+func (c *CardinalityGuardConfig) Enabled() bool {
+	return c.MaxCardinality > 0
+}
+
+type SamplerConfig struct {
+	SampleRate map[string]float64 `toml:"sample_rate" yaml:"sample_rate"`
+	Default    float64            `toml:"default" yaml:"default"`
+	BufferSize int                `toml:"buffer_size" yaml:"buffer_size"`
+}
+
+// Enabled reports whether any metrics are sampled out
+func (c *SamplerConfig) Enabled() bool {
+	return len(c.SampleRate) > 0 || (c.Default > 0 && c.Default < 1)
+}
+
+type AggregatorConfig struct {
+	FlushInterval configDuration `toml:"flush_interval" yaml:"flush_interval"`
+	BufferSize    int            `toml:"buffer_size" yaml:"buffer_size"`
+}
+
+type DeduplicatorConfig struct {
+	TTL        configDuration `toml:"ttl" yaml:"ttl"`
+	CacheSize  int            `toml:"cache_size" yaml:"cache_size"`
+	BufferSize int            `toml:"buffer_size" yaml:"buffer_size"`
+}
+
+type ExpiryFilterConfig struct {
+	Enabled    bool `toml:"enabled" yaml:"enabled"`
+	BufferSize int  `toml:"buffer_size" yaml:"buffer_size"`
+}
+
+type RateLimiterConfig struct {
+	MaxMetricsPerSecond int    `toml:"max_metrics_per_second" yaml:"max_metrics_per_second"`
+	Burst               int    `toml:"burst" yaml:"burst"`
+	Mode                string `toml:"mode" yaml:"mode"`
+	BufferSize          int    `toml:"buffer_size" yaml:"buffer_size"`
+}
 
 type configDuration struct {
 	time.Duration
@@ -63,19 +547,459 @@ func (d *configDuration) UnmarshalText(text []byte) error {
 	return err
 }
 
+func (d configDuration) MarshalText() ([]byte, error) {
+	return []byte(d.Duration.String()), nil
+}
+
 // ReadConfig
 //
 func ReadConfig(configfile *string) Config {
-	if _, err := os.Stat(*configfile); err != nil {
+	var (
+		config *Config
+		err    error
+	)
+
+	if _, statErr := os.Stat(*configfile); statErr == nil {
+		config, err = LoadConfig(*configfile)
+	} else if envConfigured() {
+		config, err = LoadConfigFromEnv()
+	} else {
 		fmt.Println("Can't read configfile")
 		os.Exit(1)
 	}
-
-	var config Config
-	if _, err := toml.DecodeFile(*configfile, &config); err != nil {
+	if err != nil {
 		fmt.Println(err)
 		os.Exit(1)
 	}
 
-	return config
+	return *config
+}
+
+// LoadConfig parses the config file, files with .yaml, .yml or .json
+// extension are read as YAML (JSON being its subset), all the others as
+// TOML. Environment variables take
+// precedence over the file (see ApplyEnv)
+func LoadConfig(configfile string) (*Config, error) {
+	var (
+		config *Config
+		err    error
+	)
+
+	switch strings.ToLower(filepath.Ext(configfile)) {
+	case ".yaml", ".yml", ".json":
+		config, err = LoadConfigYAML(configfile)
+	default:
+		config, err = LoadConfigTOML(configfile)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	if err := ApplyEnv(config); err != nil {
+		return nil, err
+	}
+	return config, nil
+}
+
+func envConfigured() bool {
+	for _, env := range os.Environ() {
+		if strings.HasPrefix(env, EnvPrefix) {
+			return true
+		}
+	}
+	return false
+}
+
+// LoadConfigTOML
+func LoadConfigTOML(configfile string) (*Config, error) {
+	var config Config
+	if _, err := toml.DecodeFile(configfile, &config); err != nil {
+		return nil, err
+	}
+	return &config, nil
+}
+
+// LoadConfigYAML reads config with the same keys as in TOML
+func LoadConfigYAML(configfile string) (*Config, error) {
+	data, err := ioutil.ReadFile(configfile)
+	if err != nil {
+		return nil, err
+	}
+
+	var config Config
+	if err := yaml.Unmarshal(data, &config); err != nil {
+		return nil, fmt.Errorf("%s: %v", configfile, err)
+	}
+	return &config, nil
+}
+
+// Config formats of Encode and DecodeConfig
+const (
+	ConfigTOML = "toml"
+	ConfigYAML = "yaml"
+	ConfigJSON = "json"
+)
+
+// DecodeConfig reads config in the format, JSON is read as YAML
+func DecodeConfig(r io.Reader, format string) (*Config, error) {
+	var config Config
+	switch format {
+	case ConfigTOML:
+		if _, err := toml.NewDecoder(r).Decode(&config); err != nil {
+			return nil, err
+		}
+	case ConfigYAML, ConfigJSON:
+		if err := yaml.NewDecoder(r).Decode(&config); err != nil && err != io.EOF {
+			return nil, err
+		}
+	default:
+		return nil, fmt.Errorf("unknown config format '%s'", format)
+	}
+	return &config, nil
+}
+
+// Encode writes the config in the format, with the same keys as config
+// files use
+func (c *Config) Encode(w io.Writer, format string) error {
+	switch format {
+	case ConfigTOML:
+		return toml.NewEncoder(w).Encode(c)
+	case ConfigYAML:
+		data, err := yaml.Marshal(c)
+		if err != nil {
+			return err
+		}
+		_, err = w.Write(data)
+		return err
+	case ConfigJSON:
+		// there are no json tags, keys are taken from YAML
+		data, err := yaml.Marshal(c)
+		if err != nil {
+			return err
+		}
+		var generic interface{}
+		if err := yaml.Unmarshal(data, &generic); err != nil {
+			return err
+		}
+		enc := json.NewEncoder(w)
+		enc.SetIndent("", "  ")
+		return enc.Encode(generic)
+	default:
+		return fmt.Errorf("unknown config format '%s'", format)
+	}
+}
+
+// WriteTo writes the config as TOML, see Encode for other formats
+func (c *Config) WriteTo(w io.Writer) (int64, error) {
+	var buf bytes.Buffer
+	if err := c.Encode(&buf, ConfigTOML); err != nil {
+		return 0, err
+	}
+	return buf.WriteTo(w)
+}
+
+// ReadFrom replaces the config by TOML one read from r, see DecodeConfig
+// for other formats
+func (c *Config) ReadFrom(r io.Reader) (int64, error) {
+	data, err := ioutil.ReadAll(r)
+	if err != nil {
+		return int64(len(data)), err
+	}
+	config, err := DecodeConfig(bytes.NewReader(data), ConfigTOML)
+	if err != nil {
+		return int64(len(data)), err
+	}
+	*c = *config
+	return int64(len(data)), nil
+}
+
+// redacted replaces secrets in String
+const redacted = "[REDACTED]"
+
+// String returns the config as TOML with secrets (passwords, tokens,
+// passwords in URLs and webhook headers) redacted
+func (c *Config) String() string {
+	var buf bytes.Buffer
+	if err := c.Redacted().Encode(&buf, ConfigTOML); err != nil {
+		return fmt.Sprintf("failed to encode config: %v", err)
+	}
+	return buf.String()
+}
+
+// Redacted returns copy of the config with secrets redacted
+func (c *Config) Redacted() *Config {
+	r := *c
+	r.Transport = c.Transport.redacted()
+	if c.Pipeline.Transports != nil {
+		transports := make(map[string]TransportConfig, len(c.Pipeline.Transports))
+		for name, t := range c.Pipeline.Transports {
+			transports[name] = t.redacted()
+		}
+		r.Pipeline.Transports = transports
+	}
+
+	w := &r.Writer
+	w.URLs = redactURLs(w.URLs)
+	w.ESAddresses = redactURLs(w.ESAddresses)
+	w.InfluxURL = redactURL(w.InfluxURL)
+	w.WebhookURL = redactURL(w.WebhookURL)
+	w.InfluxToken = redactString(w.InfluxToken)
+	w.InfluxPassword = redactString(w.InfluxPassword)
+	w.ESPassword = redactString(w.ESPassword)
+	if w.WebhookHeaders != nil {
+		headers := make(map[string]string, len(w.WebhookHeaders))
+		for k := range w.WebhookHeaders {
+			headers[k] = redacted
+		}
+		w.WebhookHeaders = headers
+	}
+	return &r
+}
+
+func (c TransportConfig) redacted() TransportConfig {
+	c.AMQPURL = redactURL(c.AMQPURL)
+	c.RedisURL = redactURL(c.RedisURL)
+	c.KafkaSchemaRegistryURL = redactURL(c.KafkaSchemaRegistryURL)
+	c.SNMPCommunity = redactString(c.SNMPCommunity)
+	c.JolokiaURL = redactURL(c.JolokiaURL)
+	c.PrometheusTargets = redactURLs(c.PrometheusTargets)
+	if c.Router.Transports != nil {
+		transports := make(map[string]TransportConfig, len(c.Router.Transports))
+		for name, t := range c.Router.Transports {
+			transports[name] = t.redacted()
+		}
+		c.Router.Transports = transports
+	}
+	return c
+}
+
+func redactString(s string) string {
+	if s == "" {
+		return s
+	}
+	return redacted
+}
+
+// redactURL replaces password in the URL, if it has one
+func redactURL(s string) string {
+	u, err := url.Parse(s)
+	if err != nil || u.User == nil {
+		return s
+	}
+	password, ok := u.User.Password()
+	if !ok {
+		return s
+	}
+	userinfo := url.UserPassword(u.User.Username(), password).String()
+	return strings.Replace(s, userinfo+"@", u.User.Username()+":"+redacted+"@", 1)
+}
+
+func redactURLs(urls []string) []string {
+	if urls == nil {
+		return nil
+	}
+	out := make([]string, len(urls))
+	for i, s := range urls {
+		out[i] = redactURL(s)
+	}
+	return out
+}
+
+// reloadableConfig lists options that are applied without restart,
+// changes of all the others take effect on next start
+var reloadableConfig = map[string]bool{
+	"debug":                               true,
+	"log_level":                           true,
+	"deduplicator.ttl":                    true,
+	"deduplicator.cache_size":             true,
+	"rate_limiter.max_metrics_per_second": true,
+	"rate_limiter.burst":                  true,
+	"rate_limiter.mode":                   true,
+}
+
+// configKey returns name of the option in config file
+func configKey(field reflect.StructField) string {
+	if name := field.Tag.Get("toml"); name != "" {
+		return name
+	}
+	return strings.ToLower(field.Name)
+}
+
+// Diff returns names of options that differ, nested ones joined
+// with dot (e.g. "rate_limiter.burst")
+func (c *Config) Diff(other *Config) []string {
+	return diffConfig("", reflect.ValueOf(*c), reflect.ValueOf(*other))
+}
+
+func diffConfig(prefix string, a reflect.Value, b reflect.Value) []string {
+	var changed []string
+	t := a.Type()
+	for i := 0; i < t.NumField(); i++ {
+		field := t.Field(i)
+		name := prefix + configKey(field)
+
+		fa, fb := a.Field(i), b.Field(i)
+		if fa.Kind() == reflect.Struct && field.Type != reflect.TypeOf(configDuration{}) {
+			changed = append(changed, diffConfig(name+".", fa, fb)...)
+			continue
+		}
+		if !reflect.DeepEqual(fa.Interface(), fb.Interface()) {
+			changed = append(changed, name)
+		}
+	}
+	return changed
+}
+
+// EnvPrefix starts names of environment variables overriding config options
+const EnvPrefix = "METCAP_"
+
+// LoadConfigFromEnv reads config from environment variables only
+func LoadConfigFromEnv() (*Config, error) {
+	var config Config
+	if err := ApplyEnv(&config); err != nil {
+		return nil, err
+	}
+	return &config, nil
+}
+
+// ApplyEnv overrides config options by environment variables. Top-level and
+// transport options are named METCAP_<OPTION> (METCAP_LOG_LEVEL, METCAP_AMQP_URL),
+// options of other sections METCAP_<SECTION>_<OPTION> (METCAP_WRITER_URLS).
+// Lists are comma separated. Listeners and routed transports can be
+// configured only in the config file
+func ApplyEnv(c *Config) error {
+	return applyEnv(EnvPrefix, reflect.ValueOf(c).Elem())
+}
+
+func applyEnv(prefix string, v reflect.Value) error {
+	t := v.Type()
+	for i := 0; i < t.NumField(); i++ {
+		field := t.Field(i)
+		name := prefix + strings.ToUpper(configKey(field))
+		fv := v.Field(i)
+
+		if fv.Kind() == reflect.Struct && field.Type != reflect.TypeOf(configDuration{}) {
+			// transport options are prefixed already
+			if field.Type == reflect.TypeOf(TransportConfig{}) {
+				name = strings.TrimSuffix(prefix, "_")
+			}
+			if err := applyEnv(name+"_", fv); err != nil {
+				return err
+			}
+			continue
+		}
+
+		value, ok := os.LookupEnv(name)
+		if !ok {
+			continue
+		}
+		if err := setConfigValue(fv, value); err != nil {
+			return fmt.Errorf("%s: %v", name, err)
+		}
+	}
+	return nil
+}
+
+func setConfigValue(v reflect.Value, s string) error {
+	if d, ok := v.Addr().Interface().(*configDuration); ok {
+		return d.UnmarshalText([]byte(s))
+	}
+
+	switch v.Kind() {
+	case reflect.String:
+		v.SetString(s)
+	case reflect.Bool:
+		b, err := strconv.ParseBool(s)
+		if err != nil {
+			return err
+		}
+		v.SetBool(b)
+	case reflect.Int, reflect.Int64:
+		n, err := strconv.ParseInt(s, 10, v.Type().Bits())
+		if err != nil {
+			return err
+		}
+		v.SetInt(n)
+	case reflect.Uint8:
+		n, err := strconv.ParseUint(s, 10, 8)
+		if err != nil {
+			return err
+		}
+		v.SetUint(n)
+	case reflect.Float64:
+		f, err := strconv.ParseFloat(s, 64)
+		if err != nil {
+			return err
+		}
+		v.SetFloat(f)
+	case reflect.Slice:
+		if v.Type().Elem().Kind() != reflect.String {
+			return fmt.Errorf("can't be set from environment")
+		}
+		var values []string
+		for _, item := range strings.Split(s, ",") {
+			if item = strings.TrimSpace(item); item != "" {
+				values = append(values, item)
+			}
+		}
+		v.Set(reflect.ValueOf(values))
+	default:
+		return fmt.Errorf("can't be set from environment")
+	}
+	return nil
+}
+
+// Watch re-reads the config file whenever it changes and passes it to
+// onChange if it differs from the previous one. The directory is watched
+// as editors usually replace the file instead of writing to it.
+// Invalid config and watcher errors are logged, the previous config stays
+// in effect
+func (c *Config) Watch(path string, logger *Logger, onChange func(*Config)) error {
+	watcher, err := fsnotify.NewWatcher()
+	if err != nil {
+		return err
+	}
+
+	path = filepath.Clean(path)
+	if err := watcher.Add(filepath.Dir(path)); err != nil {
+		watcher.Close()
+		return err
+	}
+
+	current := *c
+	go func() {
+		defer watcher.Close()
+		// wait for the writes to settle before parsing
+		var reload <-chan time.Time
+		for {
+			select {
+			case event, ok := <-watcher.Events:
+				if !ok {
+					return
+				}
+				if filepath.Clean(event.Name) == path && event.Op&(fsnotify.Write|fsnotify.Create|fsnotify.Rename) != 0 {
+					reload = time.After(100 * time.Millisecond)
+				}
+			case err, ok := <-watcher.Errors:
+				if !ok {
+					return
+				}
+				logger.Error("[config] Failed to watch %s: %v", path, err)
+			case <-reload:
+				reload = nil
+				next, err := LoadConfig(path)
+				if err != nil {
+					logger.Error("[config] Failed to reload %s: %v", path, err)
+					continue
+				}
+				if len(current.Diff(next)) == 0 {
+					continue
+				}
+				current = *next
+				onChange(next)
+			}
+		}
+	}()
+
+	return nil
 }
@@ -0,0 +1,180 @@
+package metcap
+
+import (
+	"container/list"
+	"fmt"
+	"sync"
+	"time"
+)
+
+// Deduplicator drops metrics identical to one seen less than TTL ago.
+// Metrics are compared by their line protocol form with timestamp
+// truncated to seconds, the most recent CacheSize ones are remembered.
+type Deduplicator struct {
+	stage
+	TTL       time.Duration
+	CacheSize int
+	Size      int
+	Logger    *Logger
+	Stats     *DeduplicatorStats
+	cache     map[string]*list.Element
+	lru       *list.List
+	lock      *sync.Mutex
+}
+
+type deduplicatorEntry struct {
+	key  string
+	seen time.Time
+}
+
+// NewDeduplicator
+func NewDeduplicator(c *DeduplicatorConfig, input <-chan *Metric, exitFlag *Flag, logger *Logger) *Deduplicator {
+	if c.TTL.Duration == 0 {
+		c.TTL.Duration = 1 * time.Minute
+	}
+
+	if c.CacheSize == 0 {
+		c.CacheSize = 100000
+	}
+
+	if c.BufferSize == 0 {
+		c.BufferSize = 1000
+	}
+
+	return &Deduplicator{
+		stage:     newStage(input, c.BufferSize, exitFlag),
+		TTL:       c.TTL.Duration,
+		CacheSize: c.CacheSize,
+		Size:      c.BufferSize,
+		Logger:    logger,
+		Stats:     NewDeduplicatorStats(),
+		cache:     make(map[string]*list.Element, c.CacheSize),
+		lru:       list.New(),
+		lock:      &sync.Mutex{},
+	}
+}
+
+// Update applies new TTL and cache size from the config
+func (d *Deduplicator) Update(c *DeduplicatorConfig) error {
+	if c.TTL.Duration <= 0 {
+		return fmt.Errorf("ttl has to be positive")
+	}
+
+	size := c.CacheSize
+	if size == 0 {
+		size = 100000
+	}
+
+	d.lock.Lock()
+	defer d.lock.Unlock()
+	d.TTL = c.TTL.Duration
+	d.CacheSize = size
+	d.evict()
+	return nil
+}
+
+func deduplicatorKey(m *Metric) string {
+	rounded := *m
+	rounded.Timestamp = m.Timestamp.Truncate(time.Second)
+	return rounded.SerializeLineProtocol()
+}
+
+// Seen reports whether identical metric passed within TTL,
+// otherwise it remembers the metric
+func (d *Deduplicator) Seen(m *Metric) bool {
+	key := deduplicatorKey(m)
+	if key == "" {
+		// nothing to tell such metrics apart by
+		return false
+	}
+	now := time.Now()
+
+	d.lock.Lock()
+	defer d.lock.Unlock()
+
+	if e, ok := d.cache[key]; ok {
+		entry := e.Value.(*deduplicatorEntry)
+		if now.Sub(entry.seen) < d.TTL {
+			d.lru.MoveToFront(e)
+			return true
+		}
+		entry.seen = now
+		d.lru.MoveToFront(e)
+		return false
+	}
+
+	d.cache[key] = d.lru.PushFront(&deduplicatorEntry{key, now})
+	d.evict()
+	return false
+}
+
+// evict removes least recently seen metrics over CacheSize, lock has to be held
+func (d *Deduplicator) evict() {
+	for d.lru.Len() > d.CacheSize {
+		oldest := d.lru.Back()
+		delete(d.cache, oldest.Value.(*deduplicatorEntry).key)
+		d.lru.Remove(oldest)
+	}
+}
+
+func (d *Deduplicator) process(m *Metric) {
+	if d.Seen(m) {
+		d.Stats.Dropped.Increment(1)
+		pipelineStats.Dropped.Add("duplicate", 1)
+		return
+	}
+	d.Output <- m
+	d.Stats.Passed.Increment(1)
+}
+
+func (d *Deduplicator) Start() {
+	d.Wg.Add(1)
+	go func() {
+		defer d.Wg.Done()
+		for {
+			select {
+			case m := <-d.Input:
+				d.process(m)
+			case <-d.ExitChan:
+				for len(d.Input) > 0 {
+					d.process(<-d.Input)
+				}
+				return
+			}
+		}
+	}()
+
+	d.watchExit()
+}
+
+func (d *Deduplicator) LogReport() {
+	d.lock.Lock()
+	cached, size := d.lru.Len(), d.CacheSize
+	d.lock.Unlock()
+	d.Logger.Info("[deduplicator] %d/%d (output/capacity), cache: %d/%d (length/capacity), metrics: %d/%d (passed/dropped)",
+		len(d.Output),
+		d.Size,
+		cached,
+		size,
+		d.Stats.Passed.Total(),
+		d.Stats.Dropped.Total(),
+	)
+}
+
+type DeduplicatorStats struct {
+	Passed  *StatsCounter
+	Dropped *StatsCounter
+}
+
+func NewDeduplicatorStats() *DeduplicatorStats {
+	now := time.Now()
+	return &DeduplicatorStats{
+		Passed:  NewStatsCounter(now),
+		Dropped: NewStatsCounter(now),
+	}
+}
+
+func (s *DeduplicatorStats) Reset() {
+	s.Passed.Reset()
+	s.Dropped.Reset()
+}
@@ -0,0 +1,306 @@
+package metcap
+
+import (
+	"encoding/binary"
+	"fmt"
+	"sync"
+	"time"
+
+	bolt "go.etcd.io/bbolt"
+)
+
+var diskBufferBucket = []byte("metrics")
+
+// DiskBuffer is a persistent FIFO of metrics stored in bbolt database
+type DiskBuffer struct {
+	DB       *bolt.DB
+	MaxBytes int64
+	bytes    int64
+	length   int
+	lock     *sync.Mutex
+}
+
+// NewDiskBuffer opens (or creates) the buffer at path, metrics left
+// there by previous run are kept
+func NewDiskBuffer(path string, maxBytes int64) (*DiskBuffer, error) {
+	db, err := bolt.Open(path, 0600, &bolt.Options{Timeout: 1 * time.Second})
+	if err != nil {
+		return nil, err
+	}
+
+	b := &DiskBuffer{
+		DB:       db,
+		MaxBytes: maxBytes,
+		lock:     &sync.Mutex{},
+	}
+
+	err = db.Update(func(tx *bolt.Tx) error {
+		bucket, err := tx.CreateBucketIfNotExists(diskBufferBucket)
+		if err != nil {
+			return err
+		}
+		return bucket.ForEach(func(k, v []byte) error {
+			b.bytes += int64(len(v))
+			b.length++
+			return nil
+		})
+	})
+	if err != nil {
+		db.Close()
+		return nil, err
+	}
+
+	return b, nil
+}
+
+// Push appends the metric, it fails when the buffer would exceed MaxBytes
+func (b *DiskBuffer) Push(m *Metric) error {
+	data := m.Serialize()
+
+	b.lock.Lock()
+	defer b.lock.Unlock()
+
+	if b.MaxBytes > 0 && b.bytes+int64(len(data)) > b.MaxBytes {
+		return fmt.Errorf("disk buffer full (%d bytes)", b.bytes)
+	}
+
+	err := b.DB.Update(func(tx *bolt.Tx) error {
+		bucket := tx.Bucket(diskBufferBucket)
+		seq, err := bucket.NextSequence()
+		if err != nil {
+			return err
+		}
+		key := make([]byte, 8)
+		binary.BigEndian.PutUint64(key, seq)
+		return bucket.Put(key, data)
+	})
+	if err != nil {
+		return err
+	}
+	b.bytes += int64(len(data))
+	b.length++
+	return nil
+}
+
+// Pop removes and returns the oldest metric, nil when the buffer is empty
+func (b *DiskBuffer) Pop() (*Metric, error) {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+
+	var data []byte
+	err := b.DB.Update(func(tx *bolt.Tx) error {
+		c := tx.Bucket(diskBufferBucket).Cursor()
+		k, v := c.First()
+		if k == nil {
+			return nil
+		}
+		data = append([]byte{}, v...)
+		return c.Delete()
+	})
+	if err != nil || data == nil {
+		return nil, err
+	}
+	b.bytes -= int64(len(data))
+	b.length--
+
+	m, err := DeserializeMetric(string(data))
+	if err != nil {
+		return nil, err
+	}
+	return &m, nil
+}
+
+func (b *DiskBuffer) Len() int {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+	return b.length
+}
+
+func (b *DiskBuffer) Bytes() int64 {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+	return b.bytes
+}
+
+func (b *DiskBuffer) Close() error {
+	return b.DB.Close()
+}
+
+// DiskBufferedTransport puts metrics that don't fit into input of the
+// wrapped transport to disk and feeds them back once there's room again.
+// Metrics buffered on disk when exiting are sent on the next start, before
+// any new ones.
+type DiskBufferedTransport struct {
+	Transport
+	Disk     *DiskBuffer
+	Size     int
+	Input    chan *Metric
+	ExitChan chan bool
+	ExitFlag *Flag
+	Wg       *sync.WaitGroup
+	Logger   *Logger
+	Stats    *DiskBufferStats
+}
+
+// NewDiskBufferedTransport
+func NewDiskBufferedTransport(t Transport, c *TransportConfig, exitFlag *Flag, logger *Logger) (*DiskBufferedTransport, error) {
+	disk, err := NewDiskBuffer(c.DiskBufferPath, c.DiskBufferMaxBytes)
+	if err != nil {
+		return nil, &TransportError{"disk-buffer", err}
+	}
+
+	if c.BufferSize == 0 {
+		c.BufferSize = 1000
+	}
+
+	if disk.Len() > 0 {
+		logger.Info("[disk-buffer] Found %d metrics from previous run in %s", disk.Len(), c.DiskBufferPath)
+	}
+
+	return &DiskBufferedTransport{
+		Transport: t,
+		Disk:      disk,
+		Size:      c.BufferSize,
+		Input:     make(chan *Metric, c.BufferSize),
+		ExitChan:  make(chan bool, 1),
+		ExitFlag:  exitFlag,
+		Wg:        &sync.WaitGroup{},
+		Logger:    logger,
+		Stats:     NewDiskBufferStats(),
+	}, nil
+}
+
+func (t *DiskBufferedTransport) spill(m *Metric) {
+	if err := t.Disk.Push(m); err != nil {
+		t.Stats.Dropped.Increment(1)
+		pipelineStats.Dropped.Add("disk_buffer_full", 1)
+		t.Logger.Error("[disk-buffer] Dropping metric: %v", err)
+		return
+	}
+	t.Stats.Spilled.Increment(1)
+}
+
+// forward passes the metric on, keeping order with metrics on disk
+func (t *DiskBufferedTransport) forward(m *Metric) {
+	if t.Disk.Len() > 0 {
+		t.spill(m)
+		return
+	}
+	select {
+	case t.Transport.InputChan() <- m:
+	default:
+		t.spill(m)
+	}
+}
+
+// replay moves metrics from disk while the wrapped transport has room
+func (t *DiskBufferedTransport) replay() {
+	for t.Transport.InputChanLen() < t.Size {
+		m, err := t.Disk.Pop()
+		if err != nil {
+			t.Logger.Error("[disk-buffer] Failed to read metric: %v", err)
+			return
+		}
+		if m == nil {
+			return
+		}
+		t.Transport.InputChan() <- m
+		t.Stats.Replayed.Increment(1)
+	}
+}
+
+func (t *DiskBufferedTransport) Start() {
+	t.Transport.Start()
+
+	t.Wg.Add(1)
+	go func() {
+		defer t.Wg.Done()
+
+		// old metrics go first
+		for t.Disk.Len() > 0 && !t.ExitFlag.Get() {
+			t.replay()
+			time.Sleep(10 * time.Millisecond)
+		}
+
+		tick := time.NewTicker(100 * time.Millisecond)
+		defer tick.Stop()
+		for {
+			select {
+			case m := <-t.Input:
+				t.forward(m)
+			case <-tick.C:
+				t.replay()
+			case <-t.ExitChan:
+				// whatever is left is kept for the next run
+				for len(t.Input) > 0 {
+					t.spill(<-t.Input)
+				}
+				return
+			}
+		}
+	}()
+
+	go func() {
+		<-t.ExitFlag.Done()
+		t.ExitChan <- true
+	}()
+}
+
+func (t *DiskBufferedTransport) Stop() {
+	t.Wg.Wait()
+	t.Transport.Stop()
+	if t.Disk.Len() > 0 {
+		t.Logger.Info("[disk-buffer] Keeping %d metrics on disk for next run", t.Disk.Len())
+	}
+	t.Disk.Close()
+}
+
+// Ready implements ReadinessChecker for the wrapped transport
+func (t *DiskBufferedTransport) Ready() error {
+	if checker, ok := t.Transport.(ReadinessChecker); ok {
+		return checker.Ready()
+	}
+	return nil
+}
+
+func (t *DiskBufferedTransport) InputChan() chan<- *Metric {
+	return t.Input
+}
+
+func (t *DiskBufferedTransport) InputChanLen() int {
+	return len(t.Input)
+}
+
+func (t *DiskBufferedTransport) LogReport() {
+	t.Logger.Info("[disk-buffer] %d/%d (input/capacity), disk: %d metrics, %d bytes, metrics: %d/%d/%d (spilled/replayed/dropped)",
+		len(t.Input),
+		t.Size,
+		t.Disk.Len(),
+		t.Disk.Bytes(),
+		t.Stats.Spilled.Total(),
+		t.Stats.Replayed.Total(),
+		t.Stats.Dropped.Total(),
+	)
+	t.Transport.LogReport()
+}
+
+type DiskBufferStats struct {
+	Spilled  *StatsCounter
+	Replayed *StatsCounter
+	Dropped  *StatsCounter
+}
+
+func NewDiskBufferStats() *DiskBufferStats {
+	now := time.Now()
+	return &DiskBufferStats{
+		Spilled:  NewStatsCounter(now),
+		Replayed: NewStatsCounter(now),
+		Dropped:  NewStatsCounter(now),
+	}
+}
+
+func (s *DiskBufferStats) Reset() {
+	s.Spilled.Reset()
+	s.Replayed.Reset()
+	s.Dropped.Reset()
+}
@@ -0,0 +1,238 @@
+package metcap
+
+import (
+	"fmt"
+	"path"
+	"sync"
+	"time"
+)
+
+// Downsampler forwards at most one metric per name and tags in each
+// Resolution long bucket. Values of fields listed as counters are summed
+// within the bucket, the last value is kept for the others. Metrics whose
+// name doesn't match any of the patterns pass unchanged
+type Downsampler struct {
+	stage
+	Resolution time.Duration
+	Patterns   []string
+	Counters   map[string]bool
+	Size       int
+	Logger     *Logger
+	Stats      *DownsamplerStats
+	buckets    map[string]*Metric
+	lock       *sync.Mutex
+}
+
+// NewDownsampler
+func NewDownsampler(c *DownsamplerConfig, input <-chan *Metric, exitFlag *Flag, logger *Logger) (*Downsampler, error) {
+	if c.BufferSize == 0 {
+		c.BufferSize = 1000
+	}
+
+	for _, pattern := range c.Patterns {
+		if _, err := path.Match(pattern, ""); err != nil {
+			return nil, fmt.Errorf("invalid pattern '%s': %v", pattern, err)
+		}
+	}
+
+	counters := make(map[string]bool, len(c.Counters))
+	for _, name := range c.Counters {
+		counters[name] = true
+	}
+
+	return &Downsampler{
+		stage:      newStage(input, c.BufferSize, exitFlag),
+		Resolution: c.Resolution.Duration,
+		Patterns:   c.Patterns,
+		Counters:   counters,
+		Size:       c.BufferSize,
+		Logger:     logger,
+		Stats:      NewDownsamplerStats(),
+		buckets:    make(map[string]*Metric),
+		lock:       &sync.Mutex{},
+	}, nil
+}
+
+// matches reports whether the metric is downsampled, with no patterns
+// all of them are
+func (d *Downsampler) matches(m *Metric) bool {
+	if len(d.Patterns) == 0 {
+		return true
+	}
+	for _, pattern := range d.Patterns {
+		if ok, _ := path.Match(pattern, m.Name); ok {
+			return true
+		}
+	}
+	return false
+}
+
+// sumValues adds numeric values, int64 stays int64 if both are
+func sumValues(a interface{}, b interface{}) (interface{}, bool) {
+	if x, ok := a.(int64); ok {
+		if y, ok := b.(int64); ok {
+			return x + y, true
+		}
+	}
+	var x, y float64
+	switch n := a.(type) {
+	case float64:
+		x = n
+	case int64:
+		x = float64(n)
+	default:
+		return nil, false
+	}
+	switch n := b.(type) {
+	case float64:
+		y = n
+	case int64:
+		y = float64(n)
+	default:
+		return nil, false
+	}
+	return x + y, true
+}
+
+// merge accounts the metric to the bucket's metric
+func (d *Downsampler) merge(bucket *Metric, m *Metric) {
+	if d.Counters["value"] {
+		bucket.Value += m.Value
+	} else {
+		bucket.Value = m.Value
+	}
+	for k, v := range m.Values {
+		if d.Counters[k] {
+			if sum, ok := sumValues(bucket.Values[k], v); ok {
+				bucket.Values[k] = sum
+				continue
+			}
+		}
+		bucket.Values[k] = v
+	}
+}
+
+// Add accounts the metric to its bucket and returns metrics to be
+// forwarded: buckets completed by it or the metric itself when it's not
+// downsampled. Metrics for older bucket than the current one are dropped
+func (d *Downsampler) Add(m *Metric) []*Metric {
+	if !d.matches(m) {
+		return []*Metric{m}
+	}
+
+	key := aggregatorKey(m)
+	start := m.Timestamp.Truncate(d.Resolution)
+
+	d.lock.Lock()
+	defer d.lock.Unlock()
+
+	var done []*Metric
+	if bucket, ok := d.buckets[key]; ok {
+		switch {
+		case start.Equal(bucket.Timestamp):
+			d.merge(bucket, m)
+			return nil
+		case start.Before(bucket.Timestamp):
+			d.Stats.Late.Increment(1)
+			pipelineStats.Dropped.Add("downsample_late", 1)
+			return nil
+		}
+		done = append(done, bucket)
+	}
+
+	bucket := m.Clone()
+	bucket.Timestamp = start
+	if bucket.Values == nil {
+		bucket.Values = make(map[string]interface{})
+	}
+	d.buckets[key] = bucket
+	return done
+}
+
+// Flush returns buckets that ended before now, all of them with force set
+func (d *Downsampler) Flush(now time.Time, force bool) []*Metric {
+	d.lock.Lock()
+	defer d.lock.Unlock()
+
+	var done []*Metric
+	for key, bucket := range d.buckets {
+		if force || !bucket.Timestamp.Add(d.Resolution).After(now) {
+			done = append(done, bucket)
+			delete(d.buckets, key)
+		}
+	}
+	return done
+}
+
+func (d *Downsampler) emit(metrics []*Metric) {
+	for _, m := range metrics {
+		d.Output <- m
+		d.Stats.Emitted.Increment(1)
+	}
+}
+
+func (d *Downsampler) process(m *Metric) {
+	d.Stats.Received.Increment(1)
+	d.emit(d.Add(m))
+}
+
+func (d *Downsampler) Start() {
+	d.Wg.Add(1)
+	go func() {
+		defer d.Wg.Done()
+		tick := time.NewTicker(d.Resolution)
+		defer tick.Stop()
+		for {
+			select {
+			case m := <-d.Input:
+				d.process(m)
+			case now := <-tick.C:
+				d.emit(d.Flush(now, false))
+			case <-d.ExitChan:
+				for len(d.Input) > 0 {
+					d.process(<-d.Input)
+				}
+				d.emit(d.Flush(time.Now(), true))
+				return
+			}
+		}
+	}()
+
+	d.watchExit()
+}
+
+// Stop flushes all the buckets, including incomplete ones
+func (d *Downsampler) LogReport() {
+	d.lock.Lock()
+	buckets := len(d.buckets)
+	d.lock.Unlock()
+	d.Logger.Info("[downsampler] %d/%d (output/capacity), buckets: %d, metrics: %d/%d/%d (received/emitted/late)",
+		len(d.Output),
+		d.Size,
+		buckets,
+		d.Stats.Received.Total(),
+		d.Stats.Emitted.Total(),
+		d.Stats.Late.Total(),
+	)
+}
+
+type DownsamplerStats struct {
+	Received *StatsCounter
+	Emitted  *StatsCounter
+	Late     *StatsCounter
+}
+
+func NewDownsamplerStats() *DownsamplerStats {
+	now := time.Now()
+	return &DownsamplerStats{
+		Received: NewStatsCounter(now),
+		Emitted:  NewStatsCounter(now),
+		Late:     NewStatsCounter(now),
+	}
+}
+
+func (s *DownsamplerStats) Reset() {
+	s.Received.Reset()
+	s.Emitted.Reset()
+	s.Late.Reset()
+}
@@ -1,8 +1,13 @@
 package metcap
 
 import (
+	"bytes"
+	"context"
+	"fmt"
+	"net/http"
 	"os"
 	"os/signal"
+	"runtime/pprof"
 	"sync"
 	"syscall"
 	"time"
@@ -10,15 +15,19 @@ import (
 
 type Engine struct {
 	Config     Config
+	ConfigFile string
 	Workers    *sync.WaitGroup
 	ExitCode   chan int
 	SignalChan chan os.Signal
+	loaded     Config
+	reloaders  []func(prev *Config, next *Config)
 }
 
 func NewEngine(cfg Config) (Engine, chan int) {
 	exitChan := make(chan int, 1)
 	return Engine{
 		Config:     cfg,
+		loaded:     cfg,
 		Workers:    &sync.WaitGroup{},
 		ExitCode:   exitChan,
 		SignalChan: make(chan os.Signal, 1),
@@ -26,8 +35,8 @@ func NewEngine(cfg Config) (Engine, chan int) {
 }
 
 func (e *Engine) Run() {
-	debugFlag := &Flag{new(sync.Mutex), e.Config.Debug}
-	exitFlag := &Flag{new(sync.Mutex), false}
+	debugFlag := NewFlag(e.Config.Debug)
+	exitFlag := NewFlag(false)
 	signals := []os.Signal{
 		syscall.SIGINT,
 		syscall.SIGTERM,
@@ -37,16 +46,77 @@ func (e *Engine) Run() {
 	signal.Notify(e.SignalChan, signals...)
 
 	logger := NewLogger(&e.Config.Syslog, debugFlag)
+	formatErr := logger.SetFormat(e.Config.LogFormat)
 	go logger.Run()
+	if formatErr != nil {
+		logger.Alert("[engine] %v", formatErr)
+		e.ExitCode <- 1
+		return
+	}
+	level, levelErr := ParseLogLevel(e.Config.LogLevel)
+	if levelErr != nil {
+		logger.Alert("[engine] %v", levelErr)
+		e.ExitCode <- 1
+		return
+	}
+	logger.SetLevel(level)
+	e.onReload(func(prev *Config, next *Config) {
+		if next.Debug != prev.Debug {
+			if next.Debug {
+				debugFlag.Raise()
+			} else {
+				debugFlag.Lower()
+			}
+		}
+		if next.LogLevel != prev.LogLevel {
+			level, err := ParseLogLevel(next.LogLevel)
+			if err != nil {
+				logger.Error("[engine] %v", err)
+				return
+			}
+			logger.Info("[engine] Setting log level to %s", level)
+			logger.SetLevel(level)
+		}
+	})
 
 	logger.Info("[engine] Starting...")
 
+	// health server doesn't wait for the pipeline, so that liveness
+	// probe passes while transport connects
+	started := NewFlag(false)
+	var health *HealthServer
+	if e.Config.Health.ListenAddr != "" {
+		server, err := NewHealthServer(&e.Config.Health, exitFlag, logger)
+		if err != nil {
+			logger.Alert("[engine] Failed to start health server: %v", err)
+			e.ExitCode <- 1
+			return
+		}
+		server.RegisterCheck("engine", func() error {
+			switch {
+			case exitFlag.Get():
+				return fmt.Errorf("shutting down")
+			case !started.Get():
+				return fmt.Errorf("starting")
+			}
+			return nil
+		})
+		server.Start()
+		defer server.Stop()
+		health = server
+	}
+
 	var listenerEnabled, writerEnabled bool = false, false
 	var transport Transport
 	var listeners []*Listener
 	var writers []*Writer
+	// writers reading the pipeline output channel
+	var chanWriter interface {
+		Start()
+		LogReport()
+	}
 
-	if e.Config.Writer.URLs != nil {
+	if e.Config.Writer.URLs != nil || e.Config.Writer.InfluxURL != "" || len(e.Config.Writer.ESAddresses) > 0 || e.Config.Writer.CloudWatchNamespace != "" || e.Config.Writer.StatsDAddr != "" || e.Config.Writer.GraphiteAddr != "" || e.Config.Writer.WebhookURL != "" || e.Config.Writer.FilePath != "" {
 		writerEnabled = true
 	}
 	if len(e.Config.Listener) > 0 {
@@ -54,24 +124,15 @@ func (e *Engine) Run() {
 	}
 
 	// initialize transport
-	logger.Info("[engine] Using '%s' transport", e.Config.Transport.Type)
 	var err error
-	switch e.Config.Transport.Type {
-	case "channel":
-		if listenerEnabled == false || writerEnabled == false {
-			logger.Alert("[engine] Channel transport requires you to have both listener and writer enabled!")
-			e.ExitCode <- 1
-			return
-		}
-		transport = NewChannelTransport(&e.Config.Transport, logger)
-	case "redis":
-		transport, err = NewRedisTransport(&e.Config.Transport, listenerEnabled, writerEnabled, exitFlag, logger)
-	case "amqp":
-		transport, err = NewAMQPTransport(&e.Config.Transport, listenerEnabled, writerEnabled, exitFlag, logger)
-	default:
-		logger.Alert("[engine] Transport '%s' not implemented", e.Config.Transport.Type)
-		e.ExitCode <- 1
-		return
+	bufferSize := e.Config.Transport.BufferSize
+	if len(e.Config.Pipeline.Transports) > 0 {
+		logger.Info("[engine] Using pipeline of %d transports", len(e.Config.Pipeline.Transports))
+		transport, err = NewTransportGraph(&e.Config.Pipeline, listenerEnabled, writerEnabled, exitFlag, logger)
+		bufferSize = e.Config.Pipeline.BufferSize
+	} else {
+		logger.Info("[engine] Using '%s' transport", e.Config.Transport.Type)
+		transport, err = NewTransport(e.Config.Transport.Type, &e.Config.Transport, listenerEnabled, writerEnabled, exitFlag, logger)
 	}
 	if err != nil {
 		logger.Alert("[engine] Failed to set-up transport: %v", err)
@@ -79,8 +140,126 @@ func (e *Engine) Run() {
 		return
 	}
 
-	// initialize & start writer
+	if health != nil {
+		if checker, ok := transport.(ReadinessChecker); ok {
+			health.RegisterCheck("transport", checker.Ready)
+		}
+		if listenerEnabled {
+			health.RegisterCheck("transport_input", channelCheck(transport.InputChanLen, bufferSize))
+		}
+		if writerEnabled {
+			health.RegisterCheck("transport_output", channelCheck(transport.OutputChanLen, bufferSize))
+		}
+	}
+
+	// chain middlewares between transport and writer
+	var middlewares []Middleware
 	if writerEnabled {
+		middlewares, err = e.middlewares(transport.OutputChan(), exitFlag, logger)
+		if err != nil {
+			logger.Alert("[engine] Failed to set-up middlewares: %v", err)
+			e.ExitCode <- 1
+			return
+		}
+	}
+	// pipeline is described by /debug/pipeline.dot even without
+	// middlewares, but it's validated only when there are some
+	pipeline := newPipeline(transport, middlewares, writerEnabled)
+	if len(middlewares) > 0 {
+		if err := pipeline.Validate(); err != nil {
+			logger.Alert("[engine] Failed to set-up pipeline: %v", err)
+			e.ExitCode <- 1
+			return
+		}
+		transport = pipeline
+	}
+	if health != nil {
+		health.HandleFunc("/debug/pipeline.dot", func(w http.ResponseWriter, r *http.Request) {
+			w.Header().Set("Content-Type", "text/vnd.graphviz")
+			if err := pipeline.WriteDOT(w); err != nil {
+				logger.Warn("[health] Failed to write pipeline graph: %v", err)
+			}
+		})
+	}
+
+	// expose pipeline statistics
+	if e.Config.Prometheus.ListenAddr != "" {
+		server, err := NewMetricsServer(&e.Config.Prometheus, exitFlag, logger)
+		if err != nil {
+			logger.Alert("[engine] Failed to start metrics server: %v", err)
+			e.ExitCode <- 1
+			return
+		}
+		pipelineStats.RegisterChannel("transport_input", transport.InputChanLen)
+		pipelineStats.RegisterChannel("transport_output", transport.OutputChanLen)
+		server.Start()
+		defer server.Stop()
+	}
+
+	// initialize & start writer
+	if writerEnabled && e.Config.Writer.FilePath != "" {
+		chanWriter, err = NewFileWriter(&e.Config.Writer, transport.OutputChan(), e.Workers, logger, exitFlag)
+		if err != nil {
+			logger.Alert("[engine] Failed to initialize file writer: %v", err)
+			e.ExitCode <- 1
+			return
+		}
+		go chanWriter.Start()
+	} else if writerEnabled && e.Config.Writer.WebhookURL != "" {
+		chanWriter, err = NewWebhookWriter(&e.Config.Writer, transport.OutputChan(), e.Workers, logger, exitFlag)
+		if err != nil {
+			logger.Alert("[engine] Failed to initialize webhook writer: %v", err)
+			e.ExitCode <- 1
+			return
+		}
+		go chanWriter.Start()
+	} else if writerEnabled && e.Config.Writer.GraphiteAddr != "" {
+		chanWriter, err = NewGraphiteWriter(&e.Config.Writer, transport.OutputChan(), e.Workers, logger, exitFlag)
+		if err != nil {
+			logger.Alert("[engine] Failed to initialize Graphite writer: %v", err)
+			e.ExitCode <- 1
+			return
+		}
+		go chanWriter.Start()
+	} else if writerEnabled && e.Config.Writer.StatsDAddr != "" {
+		chanWriter, err = NewStatsDWriter(&e.Config.Writer, transport.OutputChan(), e.Workers, logger, exitFlag)
+		if err != nil {
+			logger.Alert("[engine] Failed to initialize StatsD writer: %v", err)
+			e.ExitCode <- 1
+			return
+		}
+		go chanWriter.Start()
+	} else if writerEnabled && e.Config.Writer.CloudWatchNamespace != "" {
+		chanWriter, err = NewCloudWatchWriter(&e.Config.Writer, transport.OutputChan(), e.Workers, logger, exitFlag)
+		if err != nil {
+			logger.Alert("[engine] Failed to initialize CloudWatch writer: %v", err)
+			e.ExitCode <- 1
+			return
+		}
+		go chanWriter.Start()
+	} else if writerEnabled && len(e.Config.Writer.ESAddresses) > 0 {
+		chanWriter, err = NewElasticsearchWriter(&e.Config.Writer, transport.OutputChan(), e.Workers, logger, exitFlag)
+		if err != nil {
+			logger.Alert("[engine] Failed to initialize Elasticsearch writer: %v", err)
+			e.ExitCode <- 1
+			return
+		}
+		go chanWriter.Start()
+	} else if writerEnabled && e.Config.Writer.InfluxURL != "" {
+		if e.Config.Writer.InfluxDB != "" {
+			chanWriter, err = NewInfluxDBv1Writer(&e.Config.Writer, transport.OutputChan(), e.Workers, logger, exitFlag)
+		} else if e.Config.Writer.InfluxShardCount > 1 {
+			chanWriter, err = NewShardedWriter(&e.Config.Writer, transport.OutputChan(), e.Workers, logger, exitFlag)
+		} else {
+			chanWriter, err = NewInfluxDBv2Writer(&e.Config.Writer, transport.OutputChan(), e.Workers, logger, exitFlag)
+		}
+		if err != nil {
+			logger.Alert("[engine] Failed to initialize InfluxDB writer: %v", err)
+			e.ExitCode <- 1
+			return
+		}
+		go chanWriter.Start()
+	} else if writerEnabled {
 		writer, err := NewWriter(&e.Config.Writer, transport, e.Workers, logger, exitFlag)
 		if err != nil {
 			logger.Alert("[engine] Failed to initialize writer. Exiting")
@@ -106,6 +285,14 @@ func (e *Engine) Run() {
 
 	// start transport
 	transport.Start()
+	started.Raise()
+
+	// watch for config changes
+	if e.ConfigFile != "" {
+		if err := e.watchConfig(logger); err != nil {
+			logger.Error("[engine] Failed to watch config file: %v", err)
+		}
+	}
 
 	stopReporter := make(chan struct{}, 1)
 	// stats report goroutine
@@ -119,6 +306,9 @@ func (e *Engine) Run() {
 			for _, writer := range writers {
 				writer.LogReport()
 			}
+			if chanWriter != nil {
+				chanWriter.LogReport()
+			}
 		}
 		// sleepTime between reports
 		var sleepTime time.Duration
@@ -161,11 +351,29 @@ func (e *Engine) Run() {
 				logger.Info("[engine] Received SIGTERM - shutting down")
 			}
 			exitFlag.Raise()
+			if chanWriter != nil {
+				// bulk-processor Writer stops the transport output on its own
+				transport.CloseOutput()
+			}
 
-			e.Workers.Wait()
-
-			logger.Debug("[engine] Waiting for transport to terminate")
-			transport.Stop()
+			timeout := e.Config.ShutdownTimeout.Duration
+			if timeout == 0 {
+				timeout = 30 * time.Second
+			}
+			ctx, cancel := context.WithTimeout(context.Background(), timeout)
+			err := waitContext(ctx, e.Workers)
+			if err == nil {
+				logger.Debug("[engine] Waiting for transport to terminate")
+				err = StopTransport(ctx, transport)
+			}
+			cancel()
+			if err != nil {
+				logger.Error("[engine] Shutdown didn't finish within %v, goroutines still running:\n%s", timeout, goroutines())
+				logger.Info("[engine] Exiting...")
+				time.Sleep(100 * time.Millisecond)
+				e.ExitCode <- 1
+				return
+			}
 
 			stopReporter <- struct{}{}
 			time.Sleep(100 * time.Millisecond)
@@ -193,3 +401,205 @@ func (e *Engine) Run() {
 		}
 	}
 }
+
+// goroutines returns stack traces of all goroutines
+func goroutines() string {
+	var buf bytes.Buffer
+	pprof.Lookup("goroutine").WriteTo(&buf, 1)
+	return buf.String()
+}
+
+// onReload registers function applying changed config
+func (e *Engine) onReload(reload func(prev *Config, next *Config)) {
+	e.reloaders = append(e.reloaders, reload)
+}
+
+// watchConfig applies changes of the config file to running components,
+// changes of options that can't be reloaded are only reported
+func (e *Engine) watchConfig(logger *Logger) error {
+	applied := e.loaded
+	return applied.Watch(e.ConfigFile, logger, func(next *Config) {
+		logger.Info("[engine] Config file changed - reloading")
+		for _, name := range applied.Diff(next) {
+			if !reloadableConfig[name] {
+				logger.Warn("[engine] Change of '%s' requires restart", name)
+			}
+		}
+		for _, reload := range e.reloaders {
+			reload(&applied, next)
+		}
+		applied = *next
+	})
+}
+
+// middlewares creates the configured middlewares, chained one after another
+func (e *Engine) middlewares(input <-chan *Metric, exitFlag *Flag, logger *Logger) ([]Middleware, error) {
+	var middlewares []Middleware
+
+	if e.Config.Sanitizer.Enabled() {
+		sanitizer, err := NewSanitizer(&e.Config.Sanitizer, input, exitFlag, logger)
+		if err != nil {
+			return nil, err
+		}
+		logger.Info("[engine] Sanitizing metrics")
+		middlewares = append(middlewares, sanitizer)
+		pipelineStats.RegisterChannel("sanitizer_output", func() int { return len(sanitizer.Output) })
+		input = sanitizer.OutputChan()
+	}
+
+	if e.Config.TimestampNormalizer.Enabled() {
+		logger.Info("[engine] Normalizing metric timestamps")
+		normalizer := NewTimestampNormalizer(&e.Config.TimestampNormalizer, input, exitFlag, logger)
+		middlewares = append(middlewares, normalizer)
+		pipelineStats.RegisterChannel("normalizer_output", func() int { return len(normalizer.Output) })
+		input = normalizer.OutputChan()
+	}
+
+	if e.Config.TypeCoercer.CoerceAllStringFields || len(e.Config.TypeCoercer.Fields) > 0 {
+		logger.Info("[engine] Converting numeric string values")
+		coercer := NewTypeCoercer(&e.Config.TypeCoercer, input, exitFlag, logger)
+		middlewares = append(middlewares, coercer)
+		pipelineStats.RegisterChannel("type_coercer_output", func() int { return len(coercer.Output) })
+		input = coercer.OutputChan()
+	}
+
+	if e.Config.Histogram.Enabled {
+		logger.Info("[engine] Unpacking histograms to quantiles")
+		unpacker := NewHistogramUnpacker(&e.Config.Histogram, input, exitFlag, logger)
+		middlewares = append(middlewares, unpacker)
+		pipelineStats.RegisterChannel("histogram_output", func() int { return len(unpacker.Output) })
+		input = unpacker.OutputChan()
+	}
+
+	if len(e.Config.Calculator.Rules) > 0 {
+		calculator, err := NewFieldCalculator(&e.Config.Calculator, input, exitFlag, logger)
+		if err != nil {
+			return nil, err
+		}
+		logger.Info("[engine] Calculating fields by %d rules", len(e.Config.Calculator.Rules))
+		middlewares = append(middlewares, calculator)
+		pipelineStats.RegisterChannel("calculator_output", func() int { return len(calculator.Output) })
+		input = calculator.OutputChan()
+	}
+
+	if len(e.Config.Enricher.Tags) > 0 {
+		enricher, err := NewEnricher(&e.Config.Enricher, input, exitFlag, logger)
+		if err != nil {
+			return nil, err
+		}
+		logger.Info("[engine] Adding %d tags to metrics", len(enricher.Tags))
+		middlewares = append(middlewares, enricher)
+		pipelineStats.RegisterChannel("enricher_output", func() int { return len(enricher.Output) })
+		input = enricher.OutputChan()
+	}
+
+	if len(e.Config.Relabel.Rules) > 0 {
+		relabeler, err := NewRelabeler(&e.Config.Relabel, input, exitFlag, logger)
+		if err != nil {
+			return nil, err
+		}
+		logger.Info("[engine] Relabeling metrics by %d rules", len(e.Config.Relabel.Rules))
+		middlewares = append(middlewares, relabeler)
+		pipelineStats.RegisterChannel("relabeler_output", func() int { return len(relabeler.Output) })
+		input = relabeler.OutputChan()
+	}
+
+	if len(e.Config.Alerter.Rules) > 0 {
+		alerter, err := NewAlerter(&e.Config.Alerter, input, exitFlag, logger)
+		if err != nil {
+			return nil, err
+		}
+		logger.Info("[engine] Evaluating %d alert rules", len(e.Config.Alerter.Rules))
+		middlewares = append(middlewares, alerter)
+		pipelineStats.RegisterChannel("alerter_output", func() int { return len(alerter.Output) })
+		input = alerter.OutputChan()
+	}
+
+	if e.Config.CardinalityGuard.Enabled() {
+		guard, err := NewCardinalityGuard(&e.Config.CardinalityGuard, input, exitFlag, logger)
+		if err != nil {
+			return nil, err
+		}
+		logger.Info("[engine] Limiting metrics to %d tag combinations per measurement", guard.MaxCardinality)
+		middlewares = append(middlewares, guard)
+		pipelineStats.RegisterChannel("cardinality_guard_output", func() int { return len(guard.Output) })
+		input = guard.OutputChan()
+	}
+
+	if e.Config.Sampler.Enabled() {
+		sampler, err := NewSampler(&e.Config.Sampler, input, exitFlag, logger)
+		if err != nil {
+			return nil, err
+		}
+		logger.Info("[engine] Sampling metrics, %d with own rate", len(sampler.SampleRate))
+		middlewares = append(middlewares, sampler)
+		pipelineStats.RegisterChannel("sampler_output", func() int { return len(sampler.Output) })
+		input = sampler.OutputChan()
+	}
+
+	if e.Config.Deduplicator.TTL.Duration > 0 {
+		logger.Info("[engine] Dropping duplicate metrics within %v", e.Config.Deduplicator.TTL.Duration)
+		deduplicator := NewDeduplicator(&e.Config.Deduplicator, input, exitFlag, logger)
+		middlewares = append(middlewares, deduplicator)
+		e.onReload(func(prev *Config, next *Config) {
+			if next.Deduplicator == prev.Deduplicator {
+				return
+			}
+			if err := deduplicator.Update(&next.Deduplicator); err != nil {
+				logger.Error("[engine] Failed to update deduplicator: %v", err)
+			}
+		})
+		pipelineStats.RegisterChannel("deduplicator_output", func() int { return len(deduplicator.Output) })
+		input = deduplicator.OutputChan()
+	}
+
+	if e.Config.Downsampler.Resolution.Duration > 0 {
+		downsampler, err := NewDownsampler(&e.Config.Downsampler, input, exitFlag, logger)
+		if err != nil {
+			return nil, err
+		}
+		logger.Info("[engine] Downsampling metrics to %v", downsampler.Resolution)
+		middlewares = append(middlewares, downsampler)
+		pipelineStats.RegisterChannel("downsampler_output", func() int { return len(downsampler.Output) })
+		input = downsampler.OutputChan()
+	}
+
+	if e.Config.Aggregator.FlushInterval.Duration > 0 {
+		logger.Info("[engine] Aggregating metrics every %v", e.Config.Aggregator.FlushInterval.Duration)
+		aggregator := NewAggregator(&e.Config.Aggregator, input, exitFlag, logger)
+		middlewares = append(middlewares, aggregator)
+		pipelineStats.RegisterChannel("aggregator_output", func() int { return len(aggregator.Output) })
+		input = aggregator.OutputChan()
+	}
+
+	if e.Config.RateLimiter.MaxMetricsPerSecond > 0 {
+		limiter, err := NewRateLimiter(&e.Config.RateLimiter, input, exitFlag, logger)
+		if err != nil {
+			return nil, err
+		}
+		logger.Info("[engine] Limiting writes to %d metrics per second (%s)", limiter.MaxMetricsPerSecond, limiter.Mode)
+		middlewares = append(middlewares, limiter)
+		e.onReload(func(prev *Config, next *Config) {
+			if next.RateLimiter == prev.RateLimiter {
+				return
+			}
+			if err := limiter.Update(&next.RateLimiter); err != nil {
+				logger.Error("[engine] Failed to update rate limiter: %v", err)
+				return
+			}
+			logger.Info("[engine] Limiting writes to %d metrics per second", next.RateLimiter.MaxMetricsPerSecond)
+		})
+		pipelineStats.RegisterChannel("rate_limiter_output", func() int { return len(limiter.Output) })
+		input = limiter.OutputChan()
+	}
+
+	if e.Config.ExpiryFilter.Enabled {
+		logger.Info("[engine] Dropping expired metrics")
+		filter := NewExpiryFilter(&e.Config.ExpiryFilter, input, exitFlag, logger)
+		middlewares = append(middlewares, filter)
+		pipelineStats.RegisterChannel("expiry_filter_output", func() int { return len(filter.Output) })
+		input = filter.OutputChan()
+	}
+
+	return middlewares, nil
+}
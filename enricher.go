@@ -0,0 +1,156 @@
+package metcap
+
+import (
+	"fmt"
+	"os"
+	"regexp"
+	"time"
+)
+
+// EnrichMode selects what happens when metric already has the tag
+type EnrichMode int
+
+const (
+	// EnrichOverwrite replaces the metric's tag value
+	EnrichOverwrite EnrichMode = iota
+	// EnrichKeep keeps the metric's tag value
+	EnrichKeep
+)
+
+// ParseEnrichMode parses "overwrite" or "keep", empty string means EnrichOverwrite
+func ParseEnrichMode(s string) (EnrichMode, error) {
+	switch s {
+	case "", "overwrite":
+		return EnrichOverwrite, nil
+	case "keep":
+		return EnrichKeep, nil
+	default:
+		return EnrichOverwrite, fmt.Errorf("unknown enrich mode '%s'", s)
+	}
+}
+
+func (m EnrichMode) String() string {
+	switch m {
+	case EnrichOverwrite:
+		return "overwrite"
+	case EnrichKeep:
+		return "keep"
+	default:
+		return fmt.Sprintf("EnrichMode(%d)", int(m))
+	}
+}
+
+var enricherEnvVar = regexp.MustCompile(`\$\{([A-Za-z_][A-Za-z0-9_]*)\}`)
+
+// expandEnv substitutes ${VAR} with value of the environment variable
+func expandEnv(s string) string {
+	return enricherEnvVar.ReplaceAllStringFunc(s, func(v string) string {
+		return os.Getenv(v[2 : len(v)-1])
+	})
+}
+
+// Enricher adds static tags to every metric
+type Enricher struct {
+	stage
+	Tags   map[string]string
+	Mode   EnrichMode
+	Size   int
+	Logger *Logger
+	Stats  *EnricherStats
+}
+
+// NewEnricher expands ${VAR} in tag values, tags that end up empty
+// are left out
+func NewEnricher(c *EnricherConfig, input <-chan *Metric, exitFlag *Flag, logger *Logger) (*Enricher, error) {
+	if c.BufferSize == 0 {
+		c.BufferSize = 1000
+	}
+
+	mode, err := ParseEnrichMode(c.OnConflict)
+	if err != nil {
+		return nil, err
+	}
+
+	tags := make(map[string]string, len(c.Tags))
+	for k, v := range c.Tags {
+		value := expandEnv(v)
+		if value == "" {
+			logger.Warn("[enricher] Tag '%s' is empty, skipping it", k)
+			continue
+		}
+		tags[k] = value
+	}
+
+	return &Enricher{
+		stage:  newStage(input, c.BufferSize, exitFlag),
+		Tags:   tags,
+		Mode:   mode,
+		Size:   c.BufferSize,
+		Logger: logger,
+		Stats:  NewEnricherStats(),
+	}, nil
+}
+
+// Enrich returns copy of the metric with the tags added
+func (e *Enricher) Enrich(m *Metric) *Metric {
+	enriched := m.Clone()
+	if enriched.Fields == nil {
+		enriched.Fields = make(map[string]string, len(e.Tags))
+	}
+	for k, v := range e.Tags {
+		if _, ok := enriched.Fields[k]; ok && e.Mode == EnrichKeep {
+			continue
+		}
+		enriched.Fields[k] = v
+	}
+	return enriched
+}
+
+func (e *Enricher) process(m *Metric) {
+	e.Output <- e.Enrich(m)
+	e.Stats.Enriched.Increment(1)
+}
+
+func (e *Enricher) Start() {
+	e.Wg.Add(1)
+	go func() {
+		defer e.Wg.Done()
+		for {
+			select {
+			case m := <-e.Input:
+				e.process(m)
+			case <-e.ExitChan:
+				for len(e.Input) > 0 {
+					e.process(<-e.Input)
+				}
+				return
+			}
+		}
+	}()
+
+	e.watchExit()
+}
+
+func (e *Enricher) LogReport() {
+	e.Logger.Info("[enricher] %d/%d (output/capacity), tags: %d (%s), metrics: %d enriched",
+		len(e.Output),
+		e.Size,
+		len(e.Tags),
+		e.Mode,
+		e.Stats.Enriched.Total(),
+	)
+}
+
+type EnricherStats struct {
+	Enriched *StatsCounter
+}
+
+func NewEnricherStats() *EnricherStats {
+	return &EnricherStats{
+		Enriched: NewStatsCounter(time.Now()),
+	}
+}
+
+func (s *EnricherStats) Reset() {
+	s.Enriched.Reset()
+}
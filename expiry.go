@@ -0,0 +1,90 @@
+package metcap
+
+import (
+	"time"
+)
+
+// ExpiryFilter drops metrics whose ExpiresAt has passed instead of
+// writing them stale; metrics without ExpiresAt always pass
+type ExpiryFilter struct {
+	stage
+	Size   int
+	Logger *Logger
+	Stats  *ExpiryFilterStats
+}
+
+// NewExpiryFilter
+func NewExpiryFilter(c *ExpiryFilterConfig, input <-chan *Metric, exitFlag *Flag, logger *Logger) *ExpiryFilter {
+	if c.BufferSize == 0 {
+		c.BufferSize = 1000
+	}
+
+	return &ExpiryFilter{
+		stage:  newStage(input, c.BufferSize, exitFlag),
+		Size:   c.BufferSize,
+		Logger: logger,
+		Stats:  NewExpiryFilterStats(),
+	}
+}
+
+// Expired reports whether the metric's ExpiresAt has passed
+func (m *Metric) Expired(now time.Time) bool {
+	return !m.ExpiresAt.IsZero() && now.After(m.ExpiresAt)
+}
+
+func (f *ExpiryFilter) process(m *Metric) {
+	if m.Expired(time.Now()) {
+		f.Stats.Expired.Increment(1)
+		pipelineStats.Dropped.Add("expired", 1)
+		return
+	}
+	f.Output <- m
+	f.Stats.Passed.Increment(1)
+}
+
+func (f *ExpiryFilter) Start() {
+	f.Wg.Add(1)
+	go func() {
+		defer f.Wg.Done()
+		for {
+			select {
+			case m := <-f.Input:
+				f.process(m)
+			case <-f.ExitChan:
+				for len(f.Input) > 0 {
+					f.process(<-f.Input)
+				}
+				return
+			}
+		}
+	}()
+
+	f.watchExit()
+}
+
+func (f *ExpiryFilter) LogReport() {
+	f.Logger.Info("[expiry] %d/%d (output/capacity), metrics: %d/%d (passed/expired)",
+		len(f.Output),
+		f.Size,
+		f.Stats.Passed.Total(),
+		f.Stats.Expired.Total(),
+	)
+}
+
+type ExpiryFilterStats struct {
+	Passed  *StatsCounter
+	Expired *StatsCounter
+}
+
+func NewExpiryFilterStats() *ExpiryFilterStats {
+	now := time.Now()
+	return &ExpiryFilterStats{
+		Passed:  NewStatsCounter(now),
+		Expired: NewStatsCounter(now),
+	}
+}
+
+func (s *ExpiryFilterStats) Reset() {
+	s.Passed.Reset()
+	s.Expired.Reset()
+}
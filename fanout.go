@@ -0,0 +1,152 @@
+package metcap
+
+import (
+	"bytes"
+	"fmt"
+	"sync"
+	"time"
+)
+
+// FanoutOutput is an output channel of Fanout with its backpressure mode
+type FanoutOutput struct {
+	Chan chan<- *Metric
+	Mode BackpressureMode
+}
+
+// Fanout writes clone of each metric from its input to every output,
+// e.g. to feed both real-time and long-term storage. Outputs in drop and
+// drop_oldest mode get their own queue of Size metrics, so a slow consumer
+// on them doesn't stall the others. Blocking outputs propagate the
+// backpressure to the input, and so to all the outputs.
+type Fanout struct {
+	Size     int
+	Input    <-chan *Metric
+	Outputs  []FanoutOutput
+	ExitChan chan struct{}
+	ExitFlag *Flag
+	Wg       *sync.WaitGroup
+	Logger   *Logger
+	Stats    *FanoutStats
+	queues   []*backpressureQueue
+	queueEnd chan bool
+	queueWg  *sync.WaitGroup
+	exitOnce *sync.Once
+}
+
+// NewFanout
+func NewFanout(input <-chan *Metric, size int, exitFlag *Flag, logger *Logger, outputs ...FanoutOutput) *Fanout {
+	if size == 0 {
+		size = 1000
+	}
+
+	queues := make([]*backpressureQueue, len(outputs))
+	for i, output := range outputs {
+		if output.Mode != BackpressureBlock {
+			queues[i] = newBackpressureQueue(fmt.Sprintf("fanout output %d", i), output.Mode, size, output.Chan)
+		}
+	}
+
+	return &Fanout{
+		Size:     size,
+		Input:    input,
+		Outputs:  outputs,
+		ExitChan: make(chan struct{}),
+		ExitFlag: exitFlag,
+		Wg:       &sync.WaitGroup{},
+		Logger:   logger,
+		Stats:    NewFanoutStats(),
+		queues:   queues,
+		queueEnd: make(chan bool),
+		queueWg:  &sync.WaitGroup{},
+		exitOnce: &sync.Once{},
+	}
+}
+
+func (f *Fanout) distribute(m *Metric) {
+	for i, output := range f.Outputs {
+		if f.queues[i] != nil {
+			f.queues[i].Input <- m.Clone()
+		} else {
+			output.Chan <- m.Clone()
+		}
+	}
+	f.Stats.Received.Increment(1)
+}
+
+func (f *Fanout) exit() {
+	f.exitOnce.Do(func() { close(f.ExitChan) })
+}
+
+func (f *Fanout) Start() {
+	for _, q := range f.queues {
+		if q == nil {
+			continue
+		}
+		f.queueWg.Add(1)
+		go func(q *backpressureQueue) {
+			defer f.queueWg.Done()
+			if err := q.run(f.queueEnd); err != nil {
+				f.Logger.Error("[fanout] Exiting: %v", err)
+			}
+		}(q)
+	}
+
+	f.Wg.Add(1)
+	go func() {
+		defer f.Wg.Done()
+		for {
+			select {
+			case m := <-f.Input:
+				f.distribute(m)
+			case <-f.ExitChan:
+				for len(f.Input) > 0 {
+					f.distribute(<-f.Input)
+				}
+				// queues flush once nothing more comes in
+				close(f.queueEnd)
+				f.queueWg.Wait()
+				return
+			}
+		}
+	}()
+
+	go func() {
+		select {
+		case <-f.ExitFlag.Done():
+			f.exit()
+		case <-f.ExitChan:
+		}
+	}()
+}
+
+func (f *Fanout) Stop() {
+	f.exit()
+	f.Wg.Wait()
+}
+
+func (f *Fanout) LogReport() {
+	var outputs bytes.Buffer
+	for i, q := range f.queues {
+		if q == nil {
+			fmt.Fprintf(&outputs, ", output %d: block", i)
+			continue
+		}
+		fmt.Fprintf(&outputs, ", output %d: %s %d/%d (queued/capacity) %d/%d (passed/dropped)",
+			i, q.Mode, q.Len(), q.Size, q.Passed.Total(), q.Dropped.Total())
+	}
+	f.Logger.Info("[fanout] metrics: %d received%s", f.Stats.Received.Total(), outputs.String())
+}
+
+type FanoutStats struct {
+	Received *StatsCounter
+}
+
+func NewFanoutStats() *FanoutStats {
+	return &FanoutStats{
+		Received: NewStatsCounter(time.Now()),
+	}
+}
+
+func (s *FanoutStats) Reset() {
+	s.Received.Reset()
+}
@@ -0,0 +1,142 @@
+package metcap
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net"
+	"net/http"
+	"sort"
+	"sync"
+	"time"
+)
+
+// ReadinessChecker is implemented by transports that can tell
+// whether they are connected to their backend
+type ReadinessChecker interface {
+	Ready() error
+}
+
+// HealthServer exposes /healthz (liveness) and /readyz (readiness)
+// for Kubernetes probes
+type HealthServer struct {
+	Server   *http.Server
+	Mux      *http.ServeMux
+	Socket   net.Listener
+	ExitFlag *Flag
+	Wg       *sync.WaitGroup
+	Logger   *Logger
+	checks   map[string]func() error
+	lock     *sync.RWMutex
+}
+
+// NewHealthServer
+func NewHealthServer(c *HealthConfig, exitFlag *Flag, logger *Logger) (*HealthServer, error) {
+	if c.ListenAddr == "" {
+		c.ListenAddr = ":8080"
+	}
+
+	sock, err := net.Listen("tcp", c.ListenAddr)
+	if err != nil {
+		return nil, err
+	}
+
+	s := &HealthServer{
+		Socket:   sock,
+		ExitFlag: exitFlag,
+		Wg:       &sync.WaitGroup{},
+		Logger:   logger,
+		checks:   make(map[string]func() error),
+		lock:     &sync.RWMutex{},
+	}
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("/healthz", func(w http.ResponseWriter, r *http.Request) {
+		healthResponse(w, http.StatusOK, map[string]interface{}{"status": "ok"})
+	})
+	mux.HandleFunc("/readyz", func(w http.ResponseWriter, r *http.Request) {
+		failed := s.Check()
+		if len(failed) > 0 {
+			healthResponse(w, http.StatusServiceUnavailable, map[string]interface{}{"status": "not ready", "failed": failed})
+			return
+		}
+		healthResponse(w, http.StatusOK, map[string]interface{}{"status": "ready"})
+	})
+	s.Mux = mux
+	s.Server = &http.Server{Handler: mux}
+
+	return s, nil
+}
+
+func healthResponse(w http.ResponseWriter, status int, body map[string]interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(body)
+}
+
+// RegisterCheck adds readiness check of the named subsystem,
+// it is ready when check returns nil
+func (s *HealthServer) RegisterCheck(name string, check func() error) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	s.checks[name] = check
+}
+
+// HandleFunc serves additional endpoint, e.g. debugging information
+func (s *HealthServer) HandleFunc(pattern string, handler func(http.ResponseWriter, *http.Request)) {
+	s.Mux.HandleFunc(pattern, handler)
+}
+
+// Check runs readiness checks and returns errors of those failed
+func (s *HealthServer) Check() map[string]string {
+	s.lock.RLock()
+	defer s.lock.RUnlock()
+	names := make([]string, 0, len(s.checks))
+	for name := range s.checks {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	failed := make(map[string]string)
+	for _, name := range names {
+		if err := s.checks[name](); err != nil {
+			failed[name] = err.Error()
+		}
+	}
+	return failed
+}
+
+// channelCheck returns readiness check failing while the channel is full
+func channelCheck(length func() int, capacity int) func() error {
+	return func() error {
+		if n := length(); n >= capacity {
+			return fmt.Errorf("channel full (%d/%d)", n, capacity)
+		}
+		return nil
+	}
+}
+
+func (s *HealthServer) Start() {
+	s.Logger.Info("[health] Serving /healthz and /readyz on %s", s.Socket.Addr().String())
+
+	s.Wg.Add(2)
+	go func() {
+		defer s.Wg.Done()
+		err := s.Server.Serve(s.Socket)
+		if err != nil && err != http.ErrServerClosed {
+			s.Logger.Error("[health] Server failed: %v", err)
+		}
+	}()
+
+	go func() {
+		defer s.Wg.Done()
+		<-s.ExitFlag.Done()
+		ctx, cancel := context.WithTimeout(context.Background(), 1*time.Second)
+		s.Server.Shutdown(ctx)
+		cancel()
+	}()
+}
+
+func (s *HealthServer) Stop() {
+	s.Wg.Wait()
+}
@@ -0,0 +1,211 @@
+package metcap
+
+import (
+	"math"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// histogramQuantiles are estimated from the buckets, by field suffix
+var histogramQuantiles = []struct {
+	field string
+	q     float64
+}{
+	{"p50", 0.5},
+	{"p90", 0.9},
+	{"p95", 0.95},
+	{"p99", 0.99},
+	{"p999", 0.999},
+}
+
+// HistogramUnpacker replaces Prometheus style histograms in metric fields
+// by quantile estimates. Histogram <base> consists of cumulative bucket
+// fields "<base>_bucket_<le>" (e.g. "latency_bucket_0.5",
+// "latency_bucket_+Inf") and optional "<base>_sum" and "<base>_count".
+// Buckets are replaced by "<base>_p50" up to "<base>_p999", or just "p50"
+// etc. when <base> is the metric name; sum and count are kept.
+type HistogramUnpacker struct {
+	stage
+	Size   int
+	Logger *Logger
+	Stats  *HistogramUnpackerStats
+}
+
+// NewHistogramUnpacker
+func NewHistogramUnpacker(c *HistogramUnpackerConfig, input <-chan *Metric, exitFlag *Flag, logger *Logger) *HistogramUnpacker {
+	if c.BufferSize == 0 {
+		c.BufferSize = 1000
+	}
+
+	return &HistogramUnpacker{
+		stage:  newStage(input, c.BufferSize, exitFlag),
+		Size:   c.BufferSize,
+		Logger: logger,
+		Stats:  NewHistogramUnpackerStats(),
+	}
+}
+
+// histogramBucket is cumulative count of observations less or equal to le
+type histogramBucket struct {
+	le    float64
+	count float64
+}
+
+// histogramQuantile estimates q-quantile from cumulative buckets by linear
+// interpolation within the bucket it falls into, the same way Prometheus'
+// histogram_quantile() does. Buckets have to be sorted by le
+func histogramQuantile(q float64, buckets []histogramBucket, total float64) float64 {
+	rank := q * total
+	lower, below := 0.0, 0.0
+	for i, b := range buckets {
+		if b.count < rank {
+			lower, below = b.le, b.count
+			continue
+		}
+		if math.IsInf(b.le, 1) {
+			// no upper bound to interpolate to
+			if i == 0 {
+				return math.NaN()
+			}
+			return lower
+		}
+		if i == 0 && b.le <= 0 {
+			return b.le
+		}
+		if b.count == below {
+			return b.le
+		}
+		return lower + (b.le-lower)*(rank-below)/(b.count-below)
+	}
+	return lower
+}
+
+// Unpack returns the metric with histograms replaced and number of them,
+// the metric is copied when modified
+func (h *HistogramUnpacker) Unpack(m *Metric) (*Metric, int) {
+	histograms := map[string][]histogramBucket{}
+	var fields []string
+	for k, v := range m.Values {
+		i := strings.LastIndex(k, "_bucket_")
+		if i <= 0 {
+			continue
+		}
+		le, err := strconv.ParseFloat(k[i+len("_bucket_"):], 64)
+		if err != nil {
+			continue
+		}
+		count, ok := histogramValue(v)
+		if !ok {
+			continue
+		}
+		base := k[:i]
+		histograms[base] = append(histograms[base], histogramBucket{le, count})
+		fields = append(fields, k)
+	}
+	if len(histograms) == 0 {
+		return m, 0
+	}
+
+	values := make(map[string]interface{}, len(m.Values))
+	for k, v := range m.Values {
+		values[k] = v
+	}
+	for _, k := range fields {
+		delete(values, k)
+	}
+	for base, buckets := range histograms {
+		sort.Slice(buckets, func(i, j int) bool { return buckets[i].le < buckets[j].le })
+
+		total := buckets[len(buckets)-1].count
+		if !math.IsInf(buckets[len(buckets)-1].le, 1) {
+			if count, ok := histogramValue(m.Values[base+"_count"]); ok {
+				total = count
+			}
+		}
+		if total <= 0 {
+			continue
+		}
+
+		prefix := base + "_"
+		if base == m.Name {
+			prefix = ""
+		}
+		for _, quantile := range histogramQuantiles {
+			if v := histogramQuantile(quantile.q, buckets, total); !math.IsNaN(v) {
+				values[prefix+quantile.field] = v
+			}
+		}
+	}
+
+	unpacked := *m
+	unpacked.Values = values
+	return &unpacked, len(histograms)
+}
+
+func histogramValue(v interface{}) (float64, bool) {
+	switch n := v.(type) {
+	case float64:
+		return n, true
+	case int64:
+		return float64(n), true
+	}
+	return 0, false
+}
+
+func (h *HistogramUnpacker) process(m *Metric) {
+	unpacked, n := h.Unpack(m)
+	if n > 0 {
+		h.Stats.Unpacked.Increment(n)
+	}
+	h.Output <- unpacked
+	h.Stats.Passed.Increment(1)
+}
+
+func (h *HistogramUnpacker) Start() {
+	h.Wg.Add(1)
+	go func() {
+		defer h.Wg.Done()
+		for {
+			select {
+			case m := <-h.Input:
+				h.process(m)
+			case <-h.ExitChan:
+				for len(h.Input) > 0 {
+					h.process(<-h.Input)
+				}
+				return
+			}
+		}
+	}()
+
+	h.watchExit()
+}
+
+func (h *HistogramUnpacker) LogReport() {
+	h.Logger.Info("[histogram] %d/%d (output/capacity), metrics: %d passed, histograms: %d unpacked",
+		len(h.Output),
+		h.Size,
+		h.Stats.Passed.Total(),
+		h.Stats.Unpacked.Total(),
+	)
+}
+
+type HistogramUnpackerStats struct {
+	Passed   *StatsCounter
+	Unpacked *StatsCounter
+}
+
+func NewHistogramUnpackerStats() *HistogramUnpackerStats {
+	now := time.Now()
+	return &HistogramUnpackerStats{
+		Passed:   NewStatsCounter(now),
+		Unpacked: NewStatsCounter(now),
+	}
+}
+
+func (s *HistogramUnpackerStats) Reset() {
+	s.Passed.Reset()
+	s.Unpacked.Reset()
+}
@@ -0,0 +1,99 @@
+//go:build integration
+
+package metcap_test
+
+import (
+	"context"
+	"fmt"
+	"math"
+	"testing"
+	"time"
+
+	"github.com/testcontainers/testcontainers-go"
+	"github.com/testcontainers/testcontainers-go/modules/rabbitmq"
+
+	"github.com/blufor/metcap"
+	"github.com/blufor/metcap/metcaptest"
+)
+
+// Integration tests start their brokers in docker:
+//
+//	go test -tags integration -run Integration
+
+// integrationMetric is the i-th metric sent, values are picked so that
+// lossy float formatting or dropped nanoseconds show up as a difference
+func integrationMetric(i int) *metcap.Metric {
+	return &metcap.Metric{
+		Name:      "integration.amqp",
+		Timestamp: time.Date(2016, 10, 1, 12, 0, 0, 123456789+i, time.UTC),
+		Value:     float64(i) + 1.0/3,
+		Fields: map[string]string{
+			"seq":  fmt.Sprintf("%04d", i),
+			"host": "web-01.example.com",
+			"env":  "integration",
+			"a":    "first",
+			"z":    "last",
+		},
+		Values: map[string]interface{}{
+			"pi":       math.Pi * float64(i),
+			"tiny":     math.SmallestNonzeroFloat64,
+			"huge":     math.MaxFloat64,
+			"negative": -0.1 * float64(i),
+			"count":    int64(i) * 1000003,
+		},
+		OK: true,
+	}
+}
+
+func TestIntegrationAMQPTransport(t *testing.T) {
+	ctx := context.Background()
+	broker, err := rabbitmq.Run(ctx, "rabbitmq:3.13-alpine")
+	testcontainers.CleanupContainer(t, broker)
+	if err != nil {
+		t.Fatal(err)
+	}
+	url, err := broker.AmqpURL(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	const count = 1000
+	syslog := false
+	logger := metcap.NewLogger(&syslog, metcap.NewFlag(false))
+	go logger.Run()
+	exitFlag := metcap.NewFlag(false)
+
+	// single worker, more consumers on the queue would reorder the metrics
+	tr, err := metcap.NewAMQPTransport(&metcap.TransportConfig{
+		AMQPURL:     url,
+		AMQPTag:     "integration",
+		AMQPWorkers: 1,
+		BufferSize:  count,
+	}, true, true, exitFlag, logger)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tr.Start()
+	defer func() {
+		exitFlag.Raise()
+		tr.Stop()
+	}()
+
+	go func() {
+		for i := 0; i < count; i++ {
+			tr.InputChan() <- integrationMetric(i)
+		}
+	}()
+
+	deadline := time.After(30 * time.Second)
+	for i := 0; i < count; i++ {
+		select {
+		case m := <-tr.OutputChan():
+			if diff := metcaptest.Diff(integrationMetric(i), m); diff != "" {
+				t.Errorf("metric %d differs:\n%s", i, diff)
+			}
+		case <-deadline:
+			t.Fatalf("received %d of %d metrics", i, count)
+		}
+	}
+}
@@ -234,8 +234,10 @@ func (l *Listener) decode(data *bytes.Buffer) {
 	for metric := range metrics {
 		l.Transport.InputChan() <- metric
 		l.Stats.CodecDecodedMetrics.Increment(1)
+		pipelineStats.Received.Add("listener:"+l.Name, 1)
 	}
 	if len(errs) > 0 {
+		pipelineStats.Dropped.Add("decode", len(errs))
 		l.Logger.Error("[listener:%s] Failed to decode %d metrics!", l.Name, len(errs))
 		// log the metric raw data?
 	}
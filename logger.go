@@ -1,23 +1,83 @@
 package metcap
 
 import (
+	"bytes"
+	"encoding/json"
 	"fmt"
 	"log"
 	"os"
+	"strings"
+	"sync/atomic"
 	"time"
 
 	syslog "github.com/RackSec/srslog"
 )
 
+// Log formats
+const (
+	LogFormatText = "text"
+	LogFormatJSON = "json"
+)
+
+// LogLevel is the minimal severity of messages that get logged
+type LogLevel int32
+
+const (
+	DEBUG LogLevel = iota
+	INFO
+	WARN
+	ERROR
+)
+
+// ParseLogLevel parses level name, case insensitive
+func ParseLogLevel(s string) (LogLevel, error) {
+	switch strings.ToLower(s) {
+	case "debug":
+		return DEBUG, nil
+	case "", "info":
+		return INFO, nil
+	case "warn", "warning":
+		return WARN, nil
+	case "error":
+		return ERROR, nil
+	default:
+		return INFO, fmt.Errorf("unknown log level '%s'", s)
+	}
+}
+
+func (lvl LogLevel) String() string {
+	switch lvl {
+	case DEBUG:
+		return "debug"
+	case INFO:
+		return "info"
+	case WARN:
+		return "warn"
+	case ERROR:
+		return "error"
+	default:
+		return fmt.Sprintf("LogLevel(%d)", int32(lvl))
+	}
+}
+
 type Logger struct {
-	chanDebug chan string
-	chanInfo  chan string
-	chanErr   chan string
-	chanAlert chan string
+	chanDebug chan logEntry
+	chanInfo  chan logEntry
+	chanWarn  chan logEntry
+	chanErr   chan logEntry
+	chanAlert chan logEntry
 	debug     *Flag
+	level     *int32
 	syslog    bool
 	syslogger *syslog.Writer
 	logger    *log.Logger
+	format    string
+	fields    []interface{}
+}
+
+type logEntry struct {
+	message string
+	fields  []interface{}
 }
 
 func NewLogger(syslog_enabled *bool, debugFlag *Flag) *Logger {
@@ -33,37 +93,89 @@ func NewLogger(syslog_enabled *bool, debugFlag *Flag) *Logger {
 			*syslog_enabled = false
 		}
 	}
+	level := int32(INFO)
 	return &Logger{
-		chanDebug: make(chan string),
-		chanInfo:  make(chan string),
-		chanErr:   make(chan string),
-		chanAlert: make(chan string),
+		chanDebug: make(chan logEntry),
+		chanInfo:  make(chan logEntry),
+		chanWarn:  make(chan logEntry),
+		chanErr:   make(chan logEntry),
+		chanAlert: make(chan logEntry),
 		debug:     debugFlag,
+		level:     &level,
 		syslog:    *syslog_enabled,
 		syslogger: syslogger,
 		logger:    log.New(os.Stdout, "", 0),
+		format:    LogFormatText,
 	}
 }
 
+// SetFormat selects "text" or "json" output, it has to be called before Run()
+func (l *Logger) SetFormat(format string) error {
+	switch format {
+	case "", LogFormatText:
+		l.format = LogFormatText
+	case LogFormatJSON:
+		l.format = LogFormatJSON
+	default:
+		return fmt.Errorf("unknown log format '%s'", format)
+	}
+	return nil
+}
+
+// SetLevel drops messages below level; debug messages are logged
+// regardless of the level while debug mode is on (see SIGUSR1)
+func (l *Logger) SetLevel(level LogLevel) {
+	atomic.StoreInt32(l.level, int32(level))
+}
+
+func (l *Logger) Level() LogLevel {
+	return LogLevel(atomic.LoadInt32(l.level))
+}
+
+func (l *Logger) enabled(level LogLevel) bool {
+	if level == DEBUG && l.debug.Get() {
+		return true
+	}
+	return level >= l.Level()
+}
+
+// With returns logger adding given key-value pairs to every message
+func (l *Logger) With(fields ...interface{}) *Logger {
+	child := *l
+	child.fields = append(append([]interface{}{}, l.fields...), fields...)
+	return &child
+}
+
 func (l *Logger) Run() error {
 	for {
 		select {
-		case line := <-l.chanAlert:
-			l.log(line, syslog.LOG_ALERT)
-		case line := <-l.chanErr:
-			l.log(line, syslog.LOG_ERR)
-		case line := <-l.chanInfo:
-			l.log(line, syslog.LOG_INFO)
-		case line := <-l.chanDebug:
-			if l.debug.Get() {
-				l.log(line, syslog.LOG_DEBUG)
-			}
+		case entry := <-l.chanAlert:
+			l.log(entry, syslog.LOG_ALERT)
+		case entry := <-l.chanErr:
+			l.log(entry, syslog.LOG_ERR)
+		case entry := <-l.chanWarn:
+			l.log(entry, syslog.LOG_WARNING)
+		case entry := <-l.chanInfo:
+			l.log(entry, syslog.LOG_INFO)
+		case entry := <-l.chanDebug:
+			l.log(entry, syslog.LOG_DEBUG)
 		}
 	}
 }
 
-func (l *Logger) log(message string, severity syslog.Priority) {
+func (l *Logger) log(entry logEntry, severity syslog.Priority) {
+	if l.format == LogFormatJSON {
+		line := l.json(entry, severity)
+		if l.syslog {
+			l.syslogger.WriteWithPriority(severity, append(line, '\n'))
+		} else {
+			l.logger.Print(string(line))
+		}
+		return
+	}
+
 	var txtSeverity string
+	message := entry.message + textFields(entry.fields)
 	if l.syslog {
 		l.syslogger.WriteWithPriority(severity, []byte(message+"\n"))
 	} else {
@@ -72,6 +184,8 @@ func (l *Logger) log(message string, severity syslog.Priority) {
 			txtSeverity = " DEBUG: "
 		case syslog.LOG_INFO:
 			txtSeverity = "  INFO: "
+		case syslog.LOG_WARNING:
+			txtSeverity = "  WARN: "
 		case syslog.LOG_ERR:
 			txtSeverity = " ERROR: "
 		case syslog.LOG_ALERT:
@@ -81,7 +195,88 @@ func (l *Logger) log(message string, severity syslog.Priority) {
 	}
 }
 
-func (l *Logger) Debug(f string, v ...interface{}) { l.chanDebug <- fmt.Sprintf(f, v...) }
-func (l *Logger) Info(f string, v ...interface{})  { l.chanInfo <- fmt.Sprintf(f, v...) }
-func (l *Logger) Error(f string, v ...interface{}) { l.chanErr <- fmt.Sprintf(f, v...) }
-func (l *Logger) Alert(f string, v ...interface{}) { l.chanAlert <- fmt.Sprintf(f, v...) }
+func severityName(severity syslog.Priority) string {
+	switch severity {
+	case syslog.LOG_DEBUG:
+		return "debug"
+	case syslog.LOG_INFO:
+		return "info"
+	case syslog.LOG_WARNING:
+		return "warn"
+	case syslog.LOG_ERR:
+		return "error"
+	case syslog.LOG_ALERT:
+		return "alert"
+	default:
+		return "unknown"
+	}
+}
+
+// json formats the entry as single line JSON object
+func (l *Logger) json(entry logEntry, severity syslog.Priority) []byte {
+	var buf bytes.Buffer
+	write := func(k string, v interface{}) {
+		key, _ := json.Marshal(k)
+		value, err := json.Marshal(v)
+		if err != nil {
+			value, _ = json.Marshal(fmt.Sprint(v))
+		}
+		if buf.Len() > 1 {
+			buf.WriteByte(',')
+		}
+		buf.Write(key)
+		buf.WriteByte(':')
+		buf.Write(value)
+	}
+
+	buf.WriteByte('{')
+	write("level", severityName(severity))
+	write("ts", time.Now().Format(time.RFC3339Nano))
+	write("msg", entry.message)
+	for i := 0; i < len(entry.fields); i += 2 {
+		if i+1 == len(entry.fields) {
+			write("_", entry.fields[i])
+			break
+		}
+		write(fmt.Sprint(entry.fields[i]), entry.fields[i+1])
+	}
+	buf.WriteByte('}')
+	return buf.Bytes()
+}
+
+// textFields formats key-value pairs as " key=value ..."
+func textFields(fields []interface{}) string {
+	var buf bytes.Buffer
+	for i := 0; i < len(fields); i += 2 {
+		if i+1 == len(fields) {
+			fmt.Fprintf(&buf, " _=%v", fields[i])
+			break
+		}
+		fmt.Fprintf(&buf, " %v=%v", fields[i], fields[i+1])
+	}
+	return buf.String()
+}
+
+func (l *Logger) Debug(f string, v ...interface{}) {
+	if l.enabled(DEBUG) {
+		l.chanDebug <- logEntry{fmt.Sprintf(f, v...), l.fields}
+	}
+}
+func (l *Logger) Info(f string, v ...interface{}) {
+	if l.enabled(INFO) {
+		l.chanInfo <- logEntry{fmt.Sprintf(f, v...), l.fields}
+	}
+}
+func (l *Logger) Warn(f string, v ...interface{}) {
+	if l.enabled(WARN) {
+		l.chanWarn <- logEntry{fmt.Sprintf(f, v...), l.fields}
+	}
+}
+func (l *Logger) Error(f string, v ...interface{}) {
+	if l.enabled(ERROR) {
+		l.chanErr <- logEntry{fmt.Sprintf(f, v...), l.fields}
+	}
+}
+func (l *Logger) Alert(f string, v ...interface{}) {
+	l.chanAlert <- logEntry{fmt.Sprintf(f, v...), l.fields}
+}
@@ -0,0 +1,119 @@
+package metcap
+
+import (
+	"sync"
+	"time"
+)
+
+// Merge multiplexes several input channels onto one output, e.g. to feed
+// metrics from multiple queues into a single writer. Each input is read by
+// its own goroutine, so a stalled input doesn't hold back the others, and
+// metrics are passed on in the order they arrive.
+type Merge struct {
+	Size      int
+	Inputs    []<-chan *Metric
+	Output    chan *Metric
+	ExitChan  chan struct{}
+	ExitFlag  *Flag
+	Wg        *sync.WaitGroup
+	Logger    *Logger
+	Stats     *MergeStats
+	exitOnce  *sync.Once
+	closeOnce *sync.Once
+}
+
+// NewMerge
+func NewMerge(size int, exitFlag *Flag, logger *Logger, inputs ...<-chan *Metric) *Merge {
+	if size == 0 {
+		size = 1000
+	}
+
+	return &Merge{
+		Size:      size,
+		Inputs:    inputs,
+		Output:    make(chan *Metric, size),
+		ExitChan:  make(chan struct{}),
+		ExitFlag:  exitFlag,
+		Wg:        &sync.WaitGroup{},
+		Logger:    logger,
+		Stats:     NewMergeStats(),
+		exitOnce:  &sync.Once{},
+		closeOnce: &sync.Once{},
+	}
+}
+
+func (m *Merge) exit() {
+	m.exitOnce.Do(func() { close(m.ExitChan) })
+}
+
+func (m *Merge) Start() {
+	for _, input := range m.Inputs {
+		m.Wg.Add(1)
+		go func(input <-chan *Metric) {
+			defer m.Wg.Done()
+			for {
+				select {
+				case metric, ok := <-input:
+					if !ok {
+						return
+					}
+					m.Output <- metric
+					m.Stats.Merged.Increment(1)
+				case <-m.ExitChan:
+					for len(input) > 0 {
+						m.Output <- <-input
+						m.Stats.Merged.Increment(1)
+					}
+					return
+				}
+			}
+		}(input)
+	}
+
+	go func() {
+		select {
+		case <-m.ExitFlag.Done():
+			m.exit()
+		case <-m.ExitChan:
+		}
+	}()
+}
+
+// Stop drains all the inputs and closes the output
+func (m *Merge) Stop() {
+	m.exit()
+	m.Wg.Wait()
+	m.closeOnce.Do(func() { close(m.Output) })
+}
+
+func (m *Merge) OutputChan() <-chan *Metric {
+	return m.Output
+}
+
+func (m *Merge) LogReport() {
+	waiting := 0
+	for _, input := range m.Inputs {
+		waiting += len(input)
+	}
+	m.Logger.Info("[merge] %d/%d (output/capacity), inputs: %d waiting in %d channels, metrics: %d merged",
+		len(m.Output),
+		m.Size,
+		waiting,
+		len(m.Inputs),
+		m.Stats.Merged.Total(),
+	)
+}
+
+type MergeStats struct {
+	Merged *StatsCounter
+}
+
+func NewMergeStats() *MergeStats {
+	return &MergeStats{
+		Merged: NewStatsCounter(time.Now()),
+	}
+}
+
+func (s *MergeStats) Reset() {
+	s.Merged.Reset()
+}
@@ -0,0 +1,80 @@
+// Package metcaptest provides helpers for testing code working with
+// metcap metrics. It's a separate package so that it doesn't end up in
+// the metcap binary.
+package metcaptest
+
+import (
+	"fmt"
+	"reflect"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/blufor/metcap"
+)
+
+// Equal reports whether the metrics have the same name, tags, values
+// and timestamp (with nanosecond precision)
+func Equal(a *metcap.Metric, b *metcap.Metric) bool {
+	return Diff(a, b) == ""
+}
+
+// Diff describes differences between the metrics, one per line,
+// it returns empty string for equal metrics
+func Diff(a *metcap.Metric, b *metcap.Metric) string {
+	if a == nil || b == nil {
+		if a == b {
+			return ""
+		}
+		return fmt.Sprintf("metric: %v != %v", a, b)
+	}
+
+	var diff []string
+	if a.Name != b.Name {
+		diff = append(diff, fmt.Sprintf("name: %q != %q", a.Name, b.Name))
+	}
+	if !a.Timestamp.Equal(b.Timestamp) {
+		diff = append(diff, fmt.Sprintf("timestamp: %s != %s", a.Timestamp.Format(time.RFC3339Nano), b.Timestamp.Format(time.RFC3339Nano)))
+	}
+	if a.Value != b.Value {
+		diff = append(diff, fmt.Sprintf("value: %v != %v", a.Value, b.Value))
+	}
+	for _, k := range keys(a.Fields, b.Fields) {
+		va, oka := a.Fields[k]
+		vb, okb := b.Fields[k]
+		if va != vb || oka != okb {
+			diff = append(diff, fmt.Sprintf("tag %s: %s != %s", k, describe(va, oka), describe(vb, okb)))
+		}
+	}
+	for _, k := range keys(a.Values, b.Values) {
+		va, oka := a.Values[k]
+		vb, okb := b.Values[k]
+		if !reflect.DeepEqual(va, vb) || oka != okb {
+			diff = append(diff, fmt.Sprintf("field %s: %s != %s", k, describe(va, oka), describe(vb, okb)))
+		}
+	}
+	return strings.Join(diff, "\n")
+}
+
+func describe(v interface{}, ok bool) string {
+	if !ok {
+		return "<missing>"
+	}
+	return fmt.Sprintf("%#v (%T)", v, v)
+}
+
+// keys returns sorted union of keys of the maps
+func keys(maps ...interface{}) []string {
+	seen := make(map[string]bool)
+	for _, m := range maps {
+		for _, k := range reflect.ValueOf(m).MapKeys() {
+			seen[k.String()] = true
+		}
+	}
+	sorted := make([]string, 0, len(seen))
+	for k := range seen {
+		sorted = append(sorted, k)
+	}
+	sort.Strings(sorted)
+	return sorted
+}
@@ -0,0 +1,98 @@
+package metcaptest
+
+import (
+	"sync"
+
+	"github.com/blufor/metcap"
+)
+
+// MockTransport is a metcap.Transport without network, for testing
+// middlewares and writers. Metrics sent to InputChan() are recorded once
+// it's started, metrics passed to Inject come out of OutputChan(). It's
+// safe for concurrent use.
+type MockTransport struct {
+	Size       int
+	Input      chan *metcap.Metric
+	Output     chan *metcap.Metric
+	lock       sync.Mutex
+	received   []*metcap.Metric
+	wg         sync.WaitGroup
+	inputOnce  sync.Once
+	outputOnce sync.Once
+}
+
+// NewMockTransport
+func NewMockTransport(size int) *MockTransport {
+	return &MockTransport{
+		Size:   size,
+		Input:  make(chan *metcap.Metric, size),
+		Output: make(chan *metcap.Metric, size),
+	}
+}
+
+// Inject sends the metric to OutputChan(), it blocks when the buffer is
+// full just like a real transport
+func (t *MockTransport) Inject(m *metcap.Metric) {
+	t.Output <- m
+}
+
+// Received returns copy of the metrics recorded so far, in order of
+// arrival
+func (t *MockTransport) Received() []*metcap.Metric {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+	received := make([]*metcap.Metric, len(t.received))
+	copy(received, t.received)
+	return received
+}
+
+// ReceivedCount returns number of the metrics recorded so far
+func (t *MockTransport) ReceivedCount() int {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+	return len(t.received)
+}
+
+func (t *MockTransport) Start() {
+	t.wg.Add(1)
+	go func() {
+		defer t.wg.Done()
+		for m := range t.Input {
+			t.lock.Lock()
+			t.received = append(t.received, m)
+			t.lock.Unlock()
+		}
+	}()
+}
+
+// Stop closes the input and waits until everything sent is recorded
+func (t *MockTransport) Stop() {
+	t.CloseInput()
+	t.wg.Wait()
+}
+
+func (t *MockTransport) CloseInput() {
+	t.inputOnce.Do(func() { close(t.Input) })
+}
+
+func (t *MockTransport) CloseOutput() {
+	t.outputOnce.Do(func() { close(t.Output) })
+}
+
+func (t *MockTransport) LogReport() {}
+
+func (t *MockTransport) InputChan() chan<- *metcap.Metric {
+	return t.Input
+}
+
+func (t *MockTransport) InputChanLen() int {
+	return len(t.Input)
+}
+
+func (t *MockTransport) OutputChan() <-chan *metcap.Metric {
+	return t.Output
+}
+
+func (t *MockTransport) OutputChanLen() int {
+	return len(t.Output)
+}
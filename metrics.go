@@ -1,8 +1,11 @@
 package metcap
 
 import (
+	"bytes"
+	"context"
 	"encoding/json"
 	"fmt"
+	"sync"
 	"time"
 
 	"gopkg.in/vmihailenco/msgpack.v2"
@@ -10,16 +13,85 @@ import (
 
 // Metric struct
 //
+// Fields hold the metric dimensions (InfluxDB tags), Value is the main value
+// and Values hold any additional named values (InfluxDB fields other than
+// "value") as float64, int64, string or bool.
 type Metric struct {
-	Name      string            `json:"name"`
-	Timestamp time.Time         `json:"@timestamp"`
-	Value     float64           `json:"value"`
-	Fields    map[string]string `json:"fields"`
-	OK        bool              `json:"ok"`
+	Name      string                 `json:"name"`
+	Timestamp time.Time              `json:"@timestamp"`
+	Value     float64                `json:"value"`
+	Fields    map[string]string      `json:"fields"`
+	Values    map[string]interface{} `json:"values,omitempty"`
+	OK        bool                   `json:"ok"`
+	ExpiresAt time.Time              `json:"-"`
+	Priority  uint8                  `json:"-"`
+	ctx       context.Context
+}
+
+// Context returns context of the metric, carrying e.g. trace span context
+// from ingestion to the writer; it's never nil. It isn't serialized, the
+// transports propagate it on their own.
+func (m *Metric) Context() context.Context {
+	if m.ctx == nil {
+		return context.Background()
+	}
+	return m.ctx
+}
+
+// SetContext sets the metric context
+func (m *Metric) SetContext(ctx context.Context) {
+	m.ctx = ctx
 }
 
 type Metrics []Metric
 
+// Clone returns deep copy of the metric, modifying it doesn't
+// affect the original
+func (m *Metric) Clone() *Metric {
+	clone := *m
+	if m.Fields != nil {
+		clone.Fields = make(map[string]string, len(m.Fields))
+		for k, v := range m.Fields {
+			clone.Fields[k] = v
+		}
+	}
+	if m.Values != nil {
+		clone.Values = make(map[string]interface{}, len(m.Values))
+		for k, v := range m.Values {
+			clone.Values[k] = cloneValue(v)
+		}
+	}
+	return &clone
+}
+
+// cloneValue copies slices and maps (e.g. decoded from msgpack)
+func cloneValue(v interface{}) interface{} {
+	switch value := v.(type) {
+	case []interface{}:
+		clone := make([]interface{}, len(value))
+		for i, item := range value {
+			clone[i] = cloneValue(item)
+		}
+		return clone
+	case map[string]interface{}:
+		clone := make(map[string]interface{}, len(value))
+		for k, item := range value {
+			clone[k] = cloneValue(item)
+		}
+		return clone
+	case map[interface{}]interface{}:
+		clone := make(map[interface{}]interface{}, len(value))
+		for k, item := range value {
+			clone[k] = cloneValue(item)
+		}
+		return clone
+	case []byte:
+		return append([]byte(nil), value...)
+	default:
+		return v
+	}
+}
+
 func (m *Metric) JSON() []byte {
 	out, err := json.Marshal(m)
 	if err != nil {
@@ -28,14 +100,135 @@ func (m *Metric) JSON() []byte {
 	return out
 }
 
+// MsgpackVersion is the schema version of msgpack encoded metrics and
+// batches. It's written as a positive fixint before the payload, which
+// can't be mistaken for v1 payloads starting with a map or array header.
+//
+// Schema evolution policy: metric fields are encoded by name and unknown
+// ones are skipped, so adding a field keeps the version, old readers just
+// ignore it and new readers get zero value from older writers. Renaming,
+// removing or changing type or meaning of a field requires a version
+// bump, and readers have to keep decoding all older versions at least
+// until the next major release. Readers reject versions newer than they
+// know, so they have to be upgraded before writers.
+const MsgpackVersion = 2
+
+// msgpackPayload strips the version prefix, v1 payloads have none
+func msgpackPayload(data []byte) ([]byte, error) {
+	if len(data) == 0 || data[0] > 0x7f {
+		return data, nil
+	}
+	if version := int(data[0]); version < 2 || version > MsgpackVersion {
+		return nil, fmt.Errorf("unsupported msgpack schema version %d", version)
+	}
+	return data[1:], nil
+}
+
+func unmarshalMsgpack(data []byte, v interface{}) error {
+	payload, err := msgpackPayload(data)
+	if err != nil {
+		return err
+	}
+	return msgpack.Unmarshal(payload, v)
+}
+
+// metricEncoder is msgpack encoder writing to its own buffer
+type metricEncoder struct {
+	buf *bytes.Buffer
+	enc *msgpack.Encoder
+}
+
+var encoderPool = sync.Pool{
+	New: func() interface{} {
+		buf := &bytes.Buffer{}
+		return &metricEncoder{buf, msgpack.NewEncoder(buf)}
+	},
+}
+
 func (m *Metric) Serialize() []byte {
-	out, err := msgpack.Marshal(m)
+	out, err := m.SerializeTo(nil)
 	if err != nil {
 		panic(err) // REFACTOR: throw error and do checking
 	}
 	return out
 }
 
+// SerializeTo appends msgpack encoded metric to buf and returns the
+// extended buffer, reusing buf with enough capacity doesn't allocate
+func (m *Metric) SerializeTo(buf []byte) ([]byte, error) {
+	e := encoderPool.Get().(*metricEncoder)
+	defer encoderPool.Put(e)
+	e.buf.Reset()
+	e.buf.WriteByte(MsgpackVersion)
+	if err := m.encode(e.enc); err != nil {
+		return buf, err
+	}
+	return append(buf, e.buf.Bytes()...), nil
+}
+
+// encode writes the same msgpack map as reflection based msgpack.Marshal,
+// without allocating for the usual value types
+func (m *Metric) encode(e *msgpack.Encoder) error {
+	if err := e.EncodeMapLen(8); err != nil {
+		return err
+	}
+
+	e.EncodeString("Name")
+	e.EncodeString(m.Name)
+	e.EncodeString("Timestamp")
+	e.EncodeTime(m.Timestamp)
+	e.EncodeString("Value")
+	e.EncodeFloat64(m.Value)
+
+	e.EncodeString("Fields")
+	if m.Fields == nil {
+		e.EncodeNil()
+	} else {
+		e.EncodeMapLen(len(m.Fields))
+		for k, v := range m.Fields {
+			e.EncodeString(k)
+			e.EncodeString(v)
+		}
+	}
+
+	e.EncodeString("Values")
+	if m.Values == nil {
+		e.EncodeNil()
+	} else {
+		e.EncodeMapLen(len(m.Values))
+		for k, v := range m.Values {
+			e.EncodeString(k)
+			if err := encodeValue(e, v); err != nil {
+				return err
+			}
+		}
+	}
+
+	e.EncodeString("OK")
+	e.EncodeBool(m.OK)
+	e.EncodeString("ExpiresAt")
+	e.EncodeTime(m.ExpiresAt)
+	e.EncodeString("Priority")
+	return e.EncodeUint8(m.Priority)
+}
+
+func encodeValue(e *msgpack.Encoder, v interface{}) error {
+	switch value := v.(type) {
+	case float64:
+		return e.EncodeFloat64(value)
+	case int64:
+		return e.EncodeInt64(value)
+	case string:
+		return e.EncodeString(value)
+	case bool:
+		return e.EncodeBool(value)
+	case nil:
+		return e.EncodeNil()
+	default:
+		return e.Encode(value)
+	}
+}
+
 func (m *Metric) Index(name string) string {
 	t := m.Timestamp.UTC()
 	return fmt.Sprintf("%s-%d.%02d.%02d", name, t.Year(), int(t.Month()), t.Day())
@@ -43,13 +236,32 @@ func (m *Metric) Index(name string) string {
 
 func DeserializeMetric(data string) (Metric, error) {
 	var m Metric
-	err := msgpack.Unmarshal([]byte(data), &m)
+	err := unmarshalMsgpack([]byte(data), &m)
 	if err != nil {
 		return Metric{}, err
 	}
 	return m, nil
 }
 
+// SerializeMetrics serializes a batch of metrics as a msgpack array
+func SerializeMetrics(batch []*Metric) []byte {
+	out, err := msgpack.Marshal(batch)
+	if err != nil {
+		panic(err) // REFACTOR: throw error and do checking
+	}
+	return append([]byte{MsgpackVersion}, out...)
+}
+
+// DeserializeMetrics reads a batch of metrics created by SerializeMetrics
+func DeserializeMetrics(data string) (Metrics, error) {
+	var m Metrics
+	err := unmarshalMsgpack([]byte(data), &m)
+	if err != nil {
+		return Metrics{}, err
+	}
+	return m, nil
+}
+
 /// generate Metric from JSON
 /// TODO: will be implemented within JSON codec
 // func NewMetricFromJSON(j []byte) (Metric, error) {
@@ -0,0 +1,86 @@
+package metcap
+
+import (
+	"fmt"
+	"testing"
+	"time"
+)
+
+// Run after dependency upgrades to catch regressions in the hot path:
+//
+//	go test -run - -bench .
+
+// benchMetric is a metric of realistic shape: 4 tags, 6 fields of mixed types
+func benchMetric() *Metric {
+	return &Metric{
+		Name:      "servers.cpu",
+		Timestamp: time.Date(2016, 10, 1, 12, 0, 0, 123456789, time.UTC),
+		Value:     0.45,
+		Fields: map[string]string{
+			"host":       "web-01.example.com",
+			"datacenter": "eu-west-1",
+			"cpu":        "cpu3",
+			"env":        "production",
+		},
+		Values: map[string]interface{}{
+			"user":    12.5,
+			"system":  3.25,
+			"iowait":  int64(4),
+			"ctxsw":   int64(123456),
+			"state":   "running",
+			"healthy": true,
+		},
+		OK: true,
+	}
+}
+
+// wideBenchMetric is a metric with many fields as sent to the transport
+// in bulk
+func wideBenchMetric() *Metric {
+	m := benchMetric()
+	for i := 0; i < 100; i++ {
+		m.Values[fmt.Sprintf("counter_%03d", i)] = int64(i * 1000)
+		m.Values[fmt.Sprintf("gauge_%03d", i)] = float64(i) / 3
+	}
+	return m
+}
+
+func BenchmarkSerialize(b *testing.B) {
+	m := benchMetric()
+	b.ReportAllocs()
+	for i := 0; i < b.N; i++ {
+		m.Serialize()
+	}
+}
+
+func BenchmarkSerializeTo(b *testing.B) {
+	m := benchMetric()
+	buf := m.Serialize()
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		var err error
+		if buf, err = m.SerializeTo(buf[:0]); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+func BenchmarkDeserialize(b *testing.B) {
+	data := string(benchMetric().Serialize())
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		if _, err := DeserializeMetric(data); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+func BenchmarkSerializeLineProtocol(b *testing.B) {
+	m := benchMetric()
+	b.ReportAllocs()
+	for i := 0; i < b.N; i++ {
+		m.SerializeLineProtocol()
+	}
+}
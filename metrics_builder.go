@@ -0,0 +1,127 @@
+package metcap
+
+import (
+	"fmt"
+	"time"
+)
+
+// MetricBuilder assembles a Metric and validates it on Build()
+type MetricBuilder struct {
+	name      string
+	timestamp time.Time
+	tags      map[string]string
+	fields    map[string]interface{}
+}
+
+type MetricError struct {
+	msg string
+	src interface{}
+}
+
+func (e *MetricError) Error() string {
+	return fmt.Sprintf("%s [%v]", e.msg, e.src)
+}
+
+// NewMetric starts building a metric with given name
+func NewMetric(name string) *MetricBuilder {
+	return &MetricBuilder{
+		name:   name,
+		tags:   make(map[string]string),
+		fields: make(map[string]interface{}),
+	}
+}
+
+// Tag sets a metric dimension (stored in Metric.Fields)
+func (b *MetricBuilder) Tag(k, v string) *MetricBuilder {
+	b.tags[k] = v
+	return b
+}
+
+// Field sets a metric value; field "value" becomes Metric.Value,
+// the rest is stored in Metric.Values
+func (b *MetricBuilder) Field(k string, v interface{}) *MetricBuilder {
+	b.fields[k] = v
+	return b
+}
+
+// Timestamp sets the metric time, defaults to time of Build()
+func (b *MetricBuilder) Timestamp(t time.Time) *MetricBuilder {
+	b.timestamp = t
+	return b
+}
+
+// Build validates and returns the metric
+func (b *MetricBuilder) Build() (*Metric, error) {
+	if b.name == "" {
+		return nil, &MetricError{"Metric name is empty", b.name}
+	}
+	if len(b.fields) == 0 {
+		return nil, &MetricError{"Metric has no fields", b.name}
+	}
+
+	m := &Metric{
+		Name:      b.name,
+		Timestamp: b.timestamp,
+		Fields:    make(map[string]string, len(b.tags)),
+	}
+	if m.Timestamp.IsZero() {
+		m.Timestamp = time.Now()
+	}
+	for k, v := range b.tags {
+		m.Fields[k] = v
+	}
+
+	for k, v := range b.fields {
+		value, err := normalizeValue(v)
+		if err != nil {
+			return nil, &MetricError{fmt.Sprintf("Invalid field '%s'", k), v}
+		}
+		if k != "value" {
+			if m.Values == nil {
+				m.Values = make(map[string]interface{})
+			}
+			m.Values[k] = value
+			continue
+		}
+		switch n := value.(type) {
+		case float64:
+			m.Value = n
+		case int64:
+			m.Value = float64(n)
+		default:
+			return nil, &MetricError{"Field 'value' has to be numeric", v}
+		}
+	}
+
+	return m, nil
+}
+
+// normalizeValue converts a field value to float64, int64, string or bool
+func normalizeValue(v interface{}) (interface{}, error) {
+	switch n := v.(type) {
+	case float64, int64, string, bool:
+		return n, nil
+	case float32:
+		return float64(n), nil
+	case int:
+		return int64(n), nil
+	case int8:
+		return int64(n), nil
+	case int16:
+		return int64(n), nil
+	case int32:
+		return int64(n), nil
+	case uint:
+		return int64(n), nil
+	case uint8:
+		return int64(n), nil
+	case uint16:
+		return int64(n), nil
+	case uint32:
+		return int64(n), nil
+	case uint64:
+		return int64(n), nil
+	default:
+		return nil, fmt.Errorf("unsupported type %T", v)
+	}
+}
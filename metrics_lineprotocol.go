@@ -0,0 +1,305 @@
+package metcap
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"math"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// ParseLineProtocol parses single line of InfluxDB line protocol:
+//
+//	measurement[,tag=value...] field=value[,field=value...] [timestamp]
+//
+// Tags end up in Metric.Fields, field "value" in Metric.Value and the other
+// fields in Metric.Values. Timestamp is in nanoseconds, current time is used
+// when it's missing.
+func ParseLineProtocol(line string) (*Metric, error) {
+	line = strings.TrimRight(line, "\r\n")
+	if strings.TrimSpace(line) == "" {
+		return nil, &CodecError{"Failed to parse line", fmt.Errorf("empty line"), line}
+	}
+
+	// quotes only matter in the fields section
+	i := indexUnescaped(line, ' ')
+	if i < 0 {
+		return nil, &CodecError{"Failed to parse line", fmt.Errorf("missing fields"), line}
+	}
+	sections := append([]string{line[:i]}, splitUnescaped(line[i+1:], ' ', true)...)
+	if len(sections) < 2 || len(sections) > 3 {
+		return nil, &CodecError{"Failed to parse line", fmt.Errorf("expected 2 or 3 space separated sections, got %d", len(sections)), line}
+	}
+
+	// measurement and tags
+	key := splitUnescaped(sections[0], ',', false)
+	b := NewMetric(unescapeLineProtocol(key[0], ", "))
+	for _, tag := range key[1:] {
+		kv := splitUnescaped(tag, '=', false)
+		if len(kv) != 2 || kv[0] == "" || kv[1] == "" {
+			return nil, &CodecError{"Failed to parse tag", fmt.Errorf("invalid tag '%s'", tag), line}
+		}
+		b.Tag(unescapeLineProtocol(kv[0], ",= "), unescapeLineProtocol(kv[1], ",= "))
+	}
+
+	// fields
+	for _, field := range splitUnescaped(sections[1], ',', true) {
+		kv := splitUnescaped(field, '=', true)
+		if len(kv) != 2 || kv[0] == "" || kv[1] == "" {
+			return nil, &CodecError{"Failed to parse field", fmt.Errorf("invalid field '%s'", field), line}
+		}
+		value, err := parseLineProtocolValue(kv[1])
+		if err != nil {
+			return nil, &CodecError{"Failed to parse field value", err, line}
+		}
+		b.Field(unescapeLineProtocol(kv[0], ",= "), value)
+	}
+
+	// timestamp
+	if len(sections) == 3 {
+		ns, err := strconv.ParseInt(sections[2], 10, 64)
+		if err != nil {
+			return nil, &CodecError{"Failed to parse timestamp", err, line}
+		}
+		b.Timestamp(time.Unix(0, ns))
+	}
+
+	m, err := b.Build()
+	if err != nil {
+		return nil, &CodecError{"Failed to build metric", err, line}
+	}
+	return m, nil
+}
+
+// ParseLineProtocolBatch parses newline separated line protocol, skipping
+// empty lines and comments. It returns all metrics it was able to parse,
+// the error describes the lines that failed.
+func ParseLineProtocolBatch(r io.Reader) ([]*Metric, error) {
+	var (
+		metrics  []*Metric
+		firstErr error
+		failed   int
+		n        int
+	)
+
+	scn := bufio.NewScanner(r)
+	scn.Buffer(make([]byte, 64*1024), 1024*1024)
+	for scn.Scan() {
+		n++
+		line := scn.Text()
+		if strings.TrimSpace(line) == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		m, err := ParseLineProtocol(line)
+		if err != nil {
+			if firstErr == nil {
+				firstErr = fmt.Errorf("line %d: %v", n, err)
+			}
+			failed++
+			continue
+		}
+		metrics = append(metrics, m)
+	}
+	if err := scn.Err(); err != nil {
+		return metrics, err
+	}
+	if failed > 0 {
+		return metrics, &CodecError{fmt.Sprintf("Failed to parse %d lines", failed), firstErr, nil}
+	}
+	return metrics, nil
+}
+
+// SerializeLineProtocol formats the metric as single line of InfluxDB line
+// protocol (without trailing newline). Field "value" is left out when it's
+// zero and the metric has other values, timestamp is left out when it's zero
+// so the server time is used. Metric with no value line protocol can
+// represent (only NaN or Inf floats) gives empty string.
+func (m *Metric) SerializeLineProtocol() string {
+	return m.SerializeLineProtocolPrecision(time.Nanosecond)
+}
+
+// SerializeLineProtocolPrecision is SerializeLineProtocol with timestamp
+// in given units, e.g. time.Second for "s" precision
+func (m *Metric) SerializeLineProtocolPrecision(precision time.Duration) string {
+	var buf []byte
+
+	buf = append(buf, escapeLineProtocol(m.Name, ", ")...)
+
+	tags := make([]string, 0, len(m.Fields))
+	for k := range m.Fields {
+		tags = append(tags, k)
+	}
+	sort.Strings(tags)
+	for _, k := range tags {
+		if k == "" || m.Fields[k] == "" {
+			// InfluxDB rejects empty tag keys and values
+			continue
+		}
+		buf = append(buf, ',')
+		buf = append(buf, escapeLineProtocol(k, ",= ")...)
+		buf = append(buf, '=')
+		buf = append(buf, escapeLineProtocol(m.Fields[k], ",= ")...)
+	}
+
+	buf = append(buf, ' ')
+	n := 0
+	if m.Value != 0 || len(m.Values) == 0 {
+		if field := appendLineProtocolField(nil, "value", m.Value); field != nil {
+			buf = append(buf, field...)
+			n++
+		}
+	}
+	fields := make([]string, 0, len(m.Values))
+	for k := range m.Values {
+		fields = append(fields, k)
+	}
+	sort.Strings(fields)
+	for _, k := range fields {
+		if k == "value" {
+			continue
+		}
+		field := appendLineProtocolField(nil, k, m.Values[k])
+		if field == nil {
+			continue
+		}
+		if n > 0 {
+			buf = append(buf, ',')
+		}
+		buf = append(buf, field...)
+		n++
+	}
+	if n == 0 {
+		return ""
+	}
+
+	if !m.Timestamp.IsZero() {
+		buf = append(buf, ' ')
+		buf = strconv.AppendInt(buf, m.Timestamp.UnixNano()/int64(precision), 10)
+	}
+
+	return string(buf)
+}
+
+// appendLineProtocolField appends key=value to buf, returns nil for values
+// that can't be represented in line protocol
+func appendLineProtocolField(buf []byte, k string, v interface{}) []byte {
+	start := len(buf)
+	buf = append(buf, escapeLineProtocol(k, ",= ")...)
+	buf = append(buf, '=')
+	switch n := v.(type) {
+	case float64:
+		if math.IsNaN(n) || math.IsInf(n, 0) {
+			return nil
+		}
+		return strconv.AppendFloat(buf, n, 'f', -1, 64)
+	case int64:
+		return append(strconv.AppendInt(buf, n, 10), 'i')
+	case string:
+		buf = append(buf, '"')
+		buf = append(buf, escapeLineProtocol(n, "\"\\")...)
+		return append(buf, '"')
+	case bool:
+		return strconv.AppendBool(buf, n)
+	default:
+		// decoded metrics may carry other numeric types
+		value, err := normalizeValue(v)
+		if err != nil {
+			return nil
+		}
+		return appendLineProtocolField(buf[:start], k, value)
+	}
+}
+
+// escapeLineProtocol puts backslash in front of given special chars
+func escapeLineProtocol(s string, special string) string {
+	if !strings.ContainsAny(s, special) {
+		return s
+	}
+	out := make([]byte, 0, len(s)+8)
+	for i := 0; i < len(s); i++ {
+		if strings.IndexByte(special, s[i]) >= 0 {
+			out = append(out, '\\')
+		}
+		out = append(out, s[i])
+	}
+	return string(out)
+}
+
+// indexUnescaped returns index of the first sep not escaped by a backslash
+func indexUnescaped(s string, sep byte) int {
+	for i := 0; i < len(s); i++ {
+		if s[i] == '\\' {
+			i++
+			continue
+		}
+		if s[i] == sep {
+			return i
+		}
+	}
+	return -1
+}
+
+// splitUnescaped splits s at every sep that isn't escaped by a backslash
+// (or inside double quotes, when quotes is set)
+func splitUnescaped(s string, sep byte, quotes bool) []string {
+	var (
+		parts   []string
+		start   int
+		escaped bool
+		quoted  bool
+	)
+	for i := 0; i < len(s); i++ {
+		switch {
+		case escaped:
+			escaped = false
+		case s[i] == '\\':
+			escaped = true
+		case quotes && s[i] == '"':
+			quoted = !quoted
+		case s[i] == sep && !quoted:
+			parts = append(parts, s[start:i])
+			start = i + 1
+		}
+	}
+	return append(parts, s[start:])
+}
+
+// unescapeLineProtocol removes backslashes in front of given special chars
+func unescapeLineProtocol(s string, special string) string {
+	if !strings.Contains(s, "\\") {
+		return s
+	}
+	out := make([]byte, 0, len(s))
+	for i := 0; i < len(s); i++ {
+		if s[i] == '\\' && i+1 < len(s) && strings.IndexByte(special, s[i+1]) >= 0 {
+			i++
+		}
+		out = append(out, s[i])
+	}
+	return string(out)
+}
+
+// parseLineProtocolValue parses field value into float64, int64, string or bool
+func parseLineProtocolValue(v string) (interface{}, error) {
+	switch {
+	case strings.HasPrefix(v, "\""):
+		if len(v) < 2 || !strings.HasSuffix(v, "\"") {
+			return nil, fmt.Errorf("unterminated string value %s", v)
+		}
+		return unescapeLineProtocol(v[1:len(v)-1], "\"\\"), nil
+	case v == "t" || v == "T" || v == "true" || v == "True" || v == "TRUE":
+		return true, nil
+	case v == "f" || v == "F" || v == "false" || v == "False" || v == "FALSE":
+		return false, nil
+	case strings.HasSuffix(v, "i"):
+		return strconv.ParseInt(v[:len(v)-1], 10, 64)
+	case strings.HasSuffix(v, "u"):
+		// unsigned integers are kept as int64 as long as they fit
+		return strconv.ParseInt(v[:len(v)-1], 10, 64)
+	default:
+		return strconv.ParseFloat(v, 64)
+	}
+}
@@ -0,0 +1,119 @@
+package metcap
+
+import (
+	"math"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestLineProtocolRoundTrip(t *testing.T) {
+	ts := time.Unix(1600000000, 123456789)
+	tests := []struct {
+		name   string
+		metric *Metric
+		line   string
+	}{
+		{
+			"value",
+			&Metric{Name: "cpu", Timestamp: ts, Value: 0.5, Fields: map[string]string{"host": "a"}},
+			"cpu,host=a value=0.5 1600000000123456789",
+		},
+		{
+			"escaped tags",
+			&Metric{Name: "disk usage,total", Timestamp: ts, Value: 1, Fields: map[string]string{"mount point": "/a,b=c"}},
+			`disk\ usage\,total,mount\ point=/a\,b\=c value=1 1600000000123456789`,
+		},
+		{
+			"typed fields",
+			&Metric{Name: "mem", Timestamp: ts, Value: 2, Fields: map[string]string{}, Values: map[string]interface{}{
+				"free":  int64(-42),
+				"ratio": 0.25,
+				"swap":  true,
+				"state": `say "hi" \ bye`,
+			}},
+			`mem value=2,free=-42i,ratio=0.25,state="say \"hi\" \\ bye",swap=true 1600000000123456789`,
+		},
+		{
+			"whole float",
+			&Metric{Name: "load", Timestamp: ts, Fields: map[string]string{}, Values: map[string]interface{}{"avg": 3.0}},
+			"load avg=3 1600000000123456789",
+		},
+		{
+			"zero timestamp",
+			&Metric{Name: "up", Value: 1, Fields: map[string]string{"job": "metcap"}},
+			"up,job=metcap value=1",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			line := tt.metric.SerializeLineProtocol()
+			if line != tt.line {
+				t.Errorf("SerializeLineProtocol() = %s, want %s", line, tt.line)
+			}
+
+			before := time.Now()
+			m, err := ParseLineProtocol(line)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if m.Name != tt.metric.Name || m.Value != tt.metric.Value {
+				t.Errorf("parsed %s=%v, want %s=%v", m.Name, m.Value, tt.metric.Name, tt.metric.Value)
+			}
+			if !reflect.DeepEqual(m.Fields, tt.metric.Fields) {
+				t.Errorf("parsed tags %v, want %v", m.Fields, tt.metric.Fields)
+			}
+			if !reflect.DeepEqual(m.Values, tt.metric.Values) {
+				t.Errorf("parsed fields %#v, want %#v", m.Values, tt.metric.Values)
+			}
+			if tt.metric.Timestamp.IsZero() {
+				// server time is used
+				if m.Timestamp.Before(before) {
+					t.Errorf("parsed timestamp %v, want current time", m.Timestamp)
+				}
+			} else if !m.Timestamp.Equal(tt.metric.Timestamp) {
+				t.Errorf("parsed timestamp %v, want %v", m.Timestamp, tt.metric.Timestamp)
+			}
+		})
+	}
+}
+
+func TestSerializeLineProtocolEmptyTags(t *testing.T) {
+	m := &Metric{Name: "cpu", Value: 1, Fields: map[string]string{"empty": "", "": "key"}}
+	if line := m.SerializeLineProtocol(); strings.Contains(line, "empty") || strings.Contains(line, "key") {
+		t.Errorf("SerializeLineProtocol() = %s, want empty tags left out", line)
+	}
+}
+
+func TestSerializeLineProtocolNonFinite(t *testing.T) {
+	ts := time.Unix(1600000000, 123456789)
+	tests := []struct {
+		name   string
+		metric *Metric
+		line   string
+	}{
+		{
+			"NaN value",
+			&Metric{Name: "cpu", Timestamp: ts, Value: math.NaN(), Fields: map[string]string{"host": "a"}, Values: map[string]interface{}{"idle": 0.5}},
+			"cpu,host=a idle=0.5 1600000000123456789",
+		},
+		{
+			"NaN value only",
+			&Metric{Name: "cpu", Timestamp: ts, Value: math.NaN(), Fields: map[string]string{"host": "a"}},
+			"",
+		},
+		{
+			"all values non-finite",
+			&Metric{Name: "cpu", Timestamp: ts, Fields: map[string]string{"host": "a"}, Values: map[string]interface{}{"idle": math.NaN(), "max": math.Inf(1)}},
+			"",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if line := tt.metric.SerializeLineProtocol(); line != tt.line {
+				t.Errorf("SerializeLineProtocol() = %q, want %q", line, tt.line)
+			}
+		})
+	}
+}
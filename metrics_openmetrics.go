@@ -0,0 +1,170 @@
+package metcap
+
+import (
+	"math"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// MetricTypeTag annotates type of the metric, e.g. "counter" or "gauge"
+const MetricTypeTag = "metric_type"
+
+// openMetricsTypes are types of OpenMetrics metric families
+var openMetricsTypes = map[string]bool{
+	"counter":        true,
+	"gauge":          true,
+	"histogram":      true,
+	"gaugehistogram": true,
+	"stateset":       true,
+	"info":           true,
+	"summary":        true,
+	"unknown":        true,
+}
+
+// openMetricsLabelReplacer escapes label values
+var openMetricsLabelReplacer = strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`)
+
+// SerializeOpenMetrics formats the metric in OpenMetrics text format, one
+// sample per value: "value" in family named after the metric, the other
+// values in families "<metric>_<field>" (string values are left out, bools
+// are 1 or 0). Tags become labels, timestamp is in seconds. Families get
+// "# TYPE" and "# HELP" lines if the metric has MetricTypeTag, samples of
+// counters get "_total" suffix. Lines end with newline, the exposition
+// has to be terminated by "# EOF" line.
+func (m *Metric) SerializeOpenMetrics() string {
+	var buf []byte
+
+	typ, annotated := m.Fields[MetricTypeTag]
+	if annotated && !openMetricsTypes[typ] {
+		typ = "unknown"
+	}
+	labels := m.openMetricsLabels()
+
+	sample := func(field string, value float64) {
+		family := openMetricsName(m.Name)
+		if field != "value" {
+			family += "_" + openMetricsName(field)
+		}
+		name := family
+		if typ == "counter" {
+			family = strings.TrimSuffix(family, "_total")
+			name = family + "_total"
+		}
+		if annotated {
+			buf = append(buf, "# TYPE "+family+" "+typ+"\n"...)
+			buf = append(buf, "# HELP "+family+" "+field+" of "+m.Name+"\n"...)
+		}
+		buf = append(buf, name...)
+		buf = append(buf, labels...)
+		buf = append(buf, ' ')
+		buf = appendOpenMetricsFloat(buf, value)
+		if !m.Timestamp.IsZero() {
+			buf = append(buf, ' ')
+			buf = appendOpenMetricsTimestamp(buf, m.Timestamp)
+		}
+		buf = append(buf, '\n')
+	}
+
+	if m.Value != 0 || len(m.Values) == 0 {
+		sample("value", m.Value)
+	}
+	fields := make([]string, 0, len(m.Values))
+	for k := range m.Values {
+		fields = append(fields, k)
+	}
+	sort.Strings(fields)
+	for _, k := range fields {
+		if k == "value" {
+			continue
+		}
+		switch v := m.Values[k].(type) {
+		case string:
+		case bool:
+			if v {
+				sample(k, 1)
+			} else {
+				sample(k, 0)
+			}
+		default:
+			// decoded metrics may carry other numeric types
+			if value, err := normalizeValue(v); err == nil {
+				if f, ok := value.(float64); ok {
+					sample(k, f)
+				} else if n, ok := value.(int64); ok {
+					sample(k, float64(n))
+				}
+			}
+		}
+	}
+
+	return string(buf)
+}
+
+// openMetricsLabels returns sorted tags as "{k="v",...}", empty if there
+// are none
+func (m *Metric) openMetricsLabels() string {
+	tags := make([]string, 0, len(m.Fields))
+	for k := range m.Fields {
+		if k != "" && k != MetricTypeTag {
+			tags = append(tags, k)
+		}
+	}
+	if len(tags) == 0 {
+		return ""
+	}
+	sort.Strings(tags)
+	var b strings.Builder
+	b.WriteByte('{')
+	for i, k := range tags {
+		if i > 0 {
+			b.WriteByte(',')
+		}
+		b.WriteString(openMetricsName(k))
+		b.WriteString(`="`)
+		b.WriteString(openMetricsLabelReplacer.Replace(m.Fields[k]))
+		b.WriteByte('"')
+	}
+	b.WriteByte('}')
+	return b.String()
+}
+
+// openMetricsName replaces chars not allowed in metric and label names by
+// underscores
+func openMetricsName(s string) string {
+	out := []byte(s)
+	for i, c := range out {
+		switch {
+		case c >= 'a' && c <= 'z', c >= 'A' && c <= 'Z', c == '_', c == ':':
+		case c >= '0' && c <= '9' && i > 0:
+		default:
+			out[i] = '_'
+		}
+	}
+	return string(out)
+}
+
+func appendOpenMetricsFloat(buf []byte, f float64) []byte {
+	switch {
+	case math.IsNaN(f):
+		return append(buf, "NaN"...)
+	case math.IsInf(f, 1):
+		return append(buf, "+Inf"...)
+	case math.IsInf(f, -1):
+		return append(buf, "-Inf"...)
+	}
+	return strconv.AppendFloat(buf, f, 'g', -1, 64)
+}
+
+// appendOpenMetricsTimestamp appends seconds since epoch, without losing
+// the nanoseconds to float rounding
+func appendOpenMetricsTimestamp(buf []byte, ts time.Time) []byte {
+	buf = strconv.AppendInt(buf, ts.Unix(), 10)
+	if ns := ts.Nanosecond(); ns != 0 {
+		frac := strconv.Itoa(1e9 + ns)[1:]
+		buf = append(buf, '.')
+		buf = append(buf, strings.TrimRight(frac, "0")...)
+	}
+	return buf
+}
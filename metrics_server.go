@@ -0,0 +1,223 @@
+package metcap
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"net"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// pipelineStats collects the statistics exposed by MetricsServer,
+// components update it alongside their own Stats
+var pipelineStats = NewPipelineStats()
+
+// PipelineStats are process-wide counters in Prometheus terms
+type PipelineStats struct {
+	Received              *LabeledCounter
+	Published             *LabeledCounter
+	Dropped               *LabeledCounter
+	DeserializationErrors *LabeledCounter
+	PublishDuration       *Histogram
+	depths                map[string]func() int
+	lock                  *sync.RWMutex
+}
+
+func NewPipelineStats() *PipelineStats {
+	return &PipelineStats{
+		Received:              NewLabeledCounter("source"),
+		Published:             NewLabeledCounter("transport"),
+		Dropped:               NewLabeledCounter("reason"),
+		DeserializationErrors: NewLabeledCounter("transport"),
+		PublishDuration:       NewHistogram([]float64{.001, .005, .01, .025, .05, .1, .25, .5, 1, 2.5, 5, 10}),
+		depths:                make(map[string]func() int),
+		lock:                  &sync.RWMutex{},
+	}
+}
+
+// RegisterChannel exposes length of a named channel as metcap_channel_depth
+func (s *PipelineStats) RegisterChannel(name string, length func() int) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	s.depths[name] = length
+}
+
+// WriteTo writes the statistics in Prometheus text format
+func (s *PipelineStats) WriteTo(buf *bytes.Buffer) {
+	s.Received.write(buf, "metcap_received_total", "Metrics received by listeners and ingress transports.")
+	s.Published.write(buf, "metcap_published_total", "Metrics published to the transport.")
+	s.Dropped.write(buf, "metcap_dropped_total", "Metrics dropped in the pipeline.")
+	s.DeserializationErrors.write(buf, "metcap_deserialization_errors_total", "Messages that failed to deserialize.")
+
+	s.lock.RLock()
+	names := make([]string, 0, len(s.depths))
+	for name := range s.depths {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	fmt.Fprintf(buf, "# HELP metcap_channel_depth Metrics waiting in the channel.\n# TYPE metcap_channel_depth gauge\n")
+	for _, name := range names {
+		fmt.Fprintf(buf, "metcap_channel_depth{channel=\"%s\"} %d\n", escapePromLabel(name), s.depths[name]())
+	}
+	s.lock.RUnlock()
+
+	s.PublishDuration.write(buf, "metcap_publish_duration_seconds", "Time it takes to publish to the transport.")
+}
+
+// LabeledCounter is a counter with a single label
+type LabeledCounter struct {
+	label  string
+	values map[string]uint64
+	lock   *sync.Mutex
+}
+
+func NewLabeledCounter(label string) *LabeledCounter {
+	return &LabeledCounter{
+		label:  label,
+		values: make(map[string]uint64),
+		lock:   &sync.Mutex{},
+	}
+}
+
+func (c *LabeledCounter) Add(value string, n int) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	c.values[value] += uint64(n)
+}
+
+func (c *LabeledCounter) Get(value string) uint64 {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	return c.values[value]
+}
+
+func (c *LabeledCounter) write(buf *bytes.Buffer, name string, help string) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	values := make([]string, 0, len(c.values))
+	for v := range c.values {
+		values = append(values, v)
+	}
+	sort.Strings(values)
+	fmt.Fprintf(buf, "# HELP %s %s\n# TYPE %s counter\n", name, help, name)
+	for _, v := range values {
+		fmt.Fprintf(buf, "%s{%s=\"%s\"} %d\n", name, c.label, escapePromLabel(v), c.values[v])
+	}
+}
+
+// Histogram counts observations in cumulative buckets
+type Histogram struct {
+	bounds []float64
+	counts []uint64
+	count  uint64
+	sum    float64
+	lock   *sync.Mutex
+}
+
+func NewHistogram(bounds []float64) *Histogram {
+	return &Histogram{
+		bounds: bounds,
+		counts: make([]uint64, len(bounds)),
+		lock:   &sync.Mutex{},
+	}
+}
+
+func (h *Histogram) Observe(d time.Duration) {
+	v := d.Seconds()
+	h.lock.Lock()
+	defer h.lock.Unlock()
+	for i, bound := range h.bounds {
+		if v <= bound {
+			h.counts[i]++
+		}
+	}
+	h.count++
+	h.sum += v
+}
+
+func (h *Histogram) write(buf *bytes.Buffer, name string, help string) {
+	h.lock.Lock()
+	defer h.lock.Unlock()
+	fmt.Fprintf(buf, "# HELP %s %s\n# TYPE %s histogram\n", name, help, name)
+	for i, bound := range h.bounds {
+		fmt.Fprintf(buf, "%s_bucket{le=\"%s\"} %d\n", name, strconv.FormatFloat(bound, 'f', -1, 64), h.counts[i])
+	}
+	fmt.Fprintf(buf, "%s_bucket{le=\"+Inf\"} %d\n", name, h.count)
+	fmt.Fprintf(buf, "%s_sum %s\n", name, strconv.FormatFloat(h.sum, 'f', -1, 64))
+	fmt.Fprintf(buf, "%s_count %d\n", name, h.count)
+}
+
+func escapePromLabel(s string) string {
+	return strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`).Replace(s)
+}
+
+// MetricsServer exposes pipeline statistics on /metrics for Prometheus
+type MetricsServer struct {
+	Server   *http.Server
+	Socket   net.Listener
+	Stats    *PipelineStats
+	ExitFlag *Flag
+	Wg       *sync.WaitGroup
+	Logger   *Logger
+}
+
+// NewMetricsServer
+func NewMetricsServer(c *PrometheusConfig, exitFlag *Flag, logger *Logger) (*MetricsServer, error) {
+	if c.ListenAddr == "" {
+		c.ListenAddr = ":9273"
+	}
+
+	sock, err := net.Listen("tcp", c.ListenAddr)
+	if err != nil {
+		return nil, err
+	}
+
+	s := &MetricsServer{
+		Socket:   sock,
+		Stats:    pipelineStats,
+		ExitFlag: exitFlag,
+		Wg:       &sync.WaitGroup{},
+		Logger:   logger,
+	}
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("/metrics", func(w http.ResponseWriter, r *http.Request) {
+		var buf bytes.Buffer
+		s.Stats.WriteTo(&buf)
+		w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+		w.Write(buf.Bytes())
+	})
+	s.Server = &http.Server{Handler: mux}
+
+	return s, nil
+}
+
+func (s *MetricsServer) Start() {
+	s.Logger.Info("[metrics] Serving /metrics on %s", s.Socket.Addr().String())
+
+	s.Wg.Add(2)
+	go func() {
+		defer s.Wg.Done()
+		err := s.Server.Serve(s.Socket)
+		if err != nil && err != http.ErrServerClosed {
+			s.Logger.Error("[metrics] Server failed: %v", err)
+		}
+	}()
+
+	go func() {
+		defer s.Wg.Done()
+		<-s.ExitFlag.Done()
+		ctx, cancel := context.WithTimeout(context.Background(), 1*time.Second)
+		s.Server.Shutdown(ctx)
+		cancel()
+	}()
+}
+
+func (s *MetricsServer) Stop() {
+	s.Wg.Wait()
+}
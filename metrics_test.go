@@ -0,0 +1,101 @@
+package metcap
+
+import (
+	"reflect"
+	"testing"
+	"time"
+)
+
+func FuzzMetricClone(f *testing.F) {
+	f.Add("cpu", "host", "a", "count", int64(1), 0.5, "idle", true)
+	f.Add("", "", "", "", int64(0), 0.0, "", false)
+	f.Add("disk usage", "mount point", "/a,b=c", "value", int64(-42), 1e300, `"quoted"`, false)
+
+	f.Fuzz(func(t *testing.T, name, tag, tagValue, field string, i int64, x float64, s string, b bool) {
+		build := func() *Metric {
+			return &Metric{
+				Name:      name,
+				Timestamp: time.Unix(0, i),
+				Value:     x,
+				Fields:    map[string]string{tag: tagValue, "const": "tag"},
+				Values: map[string]interface{}{
+					field:    i,
+					"float":  x,
+					"string": s,
+					"bool":   b,
+					"list":   []interface{}{i, s, []interface{}{b}},
+					"map":    map[string]interface{}{field: s, "nested": map[string]interface{}{tag: x}},
+				},
+				OK:       b,
+				Priority: uint8(i),
+			}
+		}
+		if x != x {
+			// NaN isn't DeepEqual to itself
+			t.Skip()
+		}
+		m := build()
+		clone := m.Clone()
+		if !reflect.DeepEqual(clone, m) {
+			t.Fatalf("Clone() = %+v, want %+v", clone, m)
+		}
+
+		clone.Name += "x"
+		clone.Value++
+		clone.Fields[tag] = tagValue + "x"
+		clone.Fields["added"] = "tag"
+		delete(clone.Fields, "const")
+		list := clone.Values["list"].([]interface{})
+		list[1] = "mutated"
+		list[2].([]interface{})[0] = !b
+		nested := clone.Values["map"].(map[string]interface{})
+		nested[field] = "mutated"
+		if inner, ok := nested["nested"].(map[string]interface{}); ok {
+			inner[tag] = x + 1
+		}
+		clone.Values[field] = "replaced"
+		clone.Values["added"] = int64(1)
+		delete(clone.Values, "bool")
+
+		if !reflect.DeepEqual(m, build()) {
+			t.Errorf("mutating the clone changed the original: %+v", m)
+		}
+	})
+}
+
+func TestMetricCloneNil(t *testing.T) {
+	m := &Metric{Name: "cpu", Value: 1}
+	clone := m.Clone()
+	if clone.Fields != nil || clone.Values != nil {
+		t.Errorf("Clone() = %+v, want nil maps kept nil", clone)
+	}
+	if clone == m {
+		t.Errorf("Clone() returned the original")
+	}
+}
+
+func TestSerializeToAllocs(t *testing.T) {
+	if raceEnabled {
+		t.Skip("pooled encoder is dropped at random with -race")
+	}
+	m := &Metric{
+		Name:      "servers.cpu",
+		Timestamp: time.Unix(1600000000, 123456789),
+		Value:     0.45,
+		Fields:    map[string]string{"host": "web-01", "env": "production"},
+		Values:    map[string]interface{}{"user": 12.5, "iowait": int64(4), "state": "running", "healthy": true},
+		OK:        true,
+		Priority:  5,
+	}
+	buf := m.Serialize()
+	// the pooled encoder may have been dropped by GC before, warm it up
+	if _, err := m.SerializeTo(buf[:0]); err != nil {
+		t.Fatal(err)
+	}
+	allocs := testing.AllocsPerRun(100, func() {
+		buf, _ = m.SerializeTo(buf[:0])
+	})
+	if allocs > 0 {
+		t.Errorf("SerializeTo() into buffer with enough capacity allocates %v times", allocs)
+	}
+}
@@ -0,0 +1,5 @@
+//go:build !race
+
+package metcap
+
+const raceEnabled = false
@@ -0,0 +1,122 @@
+package metcap
+
+import (
+	"time"
+)
+
+// TimestampNormalizer rounds timestamps of metrics to RoundTo, converts
+// them to UTC and drops metrics timestamped too far in the future or the
+// past, which usually come from hosts with a skewed clock. Metrics without
+// timestamp pass unchanged.
+type TimestampNormalizer struct {
+	stage
+	Size            int
+	RoundTo         time.Duration
+	ConvertToUTC    bool
+	MaxFutureOffset time.Duration
+	MaxPastOffset   time.Duration
+	Logger          *Logger
+	Stats           *TimestampNormalizerStats
+}
+
+// NewTimestampNormalizer
+func NewTimestampNormalizer(c *TimestampNormalizerConfig, input <-chan *Metric, exitFlag *Flag, logger *Logger) *TimestampNormalizer {
+	if c.BufferSize == 0 {
+		c.BufferSize = 1000
+	}
+
+	return &TimestampNormalizer{
+		stage:           newStage(input, c.BufferSize, exitFlag),
+		Size:            c.BufferSize,
+		RoundTo:         c.RoundTo.Duration,
+		ConvertToUTC:    c.ConvertToUTC,
+		MaxFutureOffset: c.MaxFutureOffset.Duration,
+		MaxPastOffset:   c.MaxPastOffset.Duration,
+		Logger:          logger,
+		Stats:           NewTimestampNormalizerStats(),
+	}
+}
+
+// Normalize adjusts timestamp of the metric, it returns false when the
+// metric is to be dropped; offsets are checked before rounding
+func (n *TimestampNormalizer) Normalize(m *Metric, now time.Time) bool {
+	if m.Timestamp.IsZero() {
+		return true
+	}
+	if n.MaxFutureOffset > 0 && m.Timestamp.Sub(now) > n.MaxFutureOffset {
+		n.Stats.Future.Increment(1)
+		pipelineStats.Dropped.Add("future_timestamp", 1)
+		return false
+	}
+	if n.MaxPastOffset > 0 && now.Sub(m.Timestamp) > n.MaxPastOffset {
+		n.Stats.Past.Increment(1)
+		pipelineStats.Dropped.Add("past_timestamp", 1)
+		return false
+	}
+	if n.RoundTo > 0 {
+		m.Timestamp = m.Timestamp.Round(n.RoundTo)
+	}
+	if n.ConvertToUTC {
+		m.Timestamp = m.Timestamp.UTC()
+	}
+	return true
+}
+
+func (n *TimestampNormalizer) process(m *Metric) {
+	if !n.Normalize(m, time.Now()) {
+		return
+	}
+	n.Output <- m
+	n.Stats.Passed.Increment(1)
+}
+
+func (n *TimestampNormalizer) Start() {
+	n.Wg.Add(1)
+	go func() {
+		defer n.Wg.Done()
+		for {
+			select {
+			case m := <-n.Input:
+				n.process(m)
+			case <-n.ExitChan:
+				for len(n.Input) > 0 {
+					n.process(<-n.Input)
+				}
+				return
+			}
+		}
+	}()
+
+	n.watchExit()
+}
+
+func (n *TimestampNormalizer) LogReport() {
+	n.Logger.Info("[normalizer] %d/%d (output/capacity), metrics: %d/%d/%d (passed/future/past)",
+		len(n.Output),
+		n.Size,
+		n.Stats.Passed.Total(),
+		n.Stats.Future.Total(),
+		n.Stats.Past.Total(),
+	)
+}
+
+type TimestampNormalizerStats struct {
+	Passed *StatsCounter
+	Future *StatsCounter
+	Past   *StatsCounter
+}
+
+func NewTimestampNormalizerStats() *TimestampNormalizerStats {
+	now := time.Now()
+	return &TimestampNormalizerStats{
+		Passed: NewStatsCounter(now),
+		Future: NewStatsCounter(now),
+		Past:   NewStatsCounter(now),
+	}
+}
+
+func (s *TimestampNormalizerStats) Reset() {
+	s.Passed.Reset()
+	s.Future.Reset()
+	s.Past.Reset()
+}
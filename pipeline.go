@@ -0,0 +1,356 @@
+package metcap
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"reflect"
+	"sort"
+	"strings"
+)
+
+// Middleware processes metrics on their way from transport to writer.
+// It reads from the channel it was created with and stops on exit flag
+// after processing what's left in its input.
+type Middleware interface {
+	Start()
+	Stop()
+	InputChan() <-chan *Metric
+	OutputChan() <-chan *Metric
+	LogReport()
+}
+
+// NodeRole tells which channels of a pipeline node have to be connected
+type NodeRole int
+
+const (
+	// NodeSource only writes, e.g. a transport
+	NodeSource NodeRole = iota
+	// NodeStage reads and writes, e.g. a middleware
+	NodeStage
+	// NodeSink only reads, e.g. the writer
+	NodeSink
+)
+
+// Pipeline is a transport with middlewares chained on its output. Its
+// nodes and edges (channels between them) are declared with AddNode and
+// Connect, so that the wiring can be checked by Validate.
+type Pipeline struct {
+	Transport
+	Middlewares []Middleware
+	nodes       map[string]NodeRole
+	edges       map[string][]string
+	labels      map[string]string
+	outputs     map[string]<-chan *Metric
+}
+
+// NewPipeline chains the middlewares after transport, each of them has to
+// be created with output of the previous one (or the transport) as input.
+// The wiring is validated by channel identity, so a middleware created
+// with a wrong input is reported before anything starts.
+// Transport is returned as-is when there are no middlewares.
+func NewPipeline(t Transport, middlewares []Middleware) (Transport, error) {
+	if len(middlewares) == 0 {
+		return t, nil
+	}
+
+	p := newPipeline(t, middlewares, true)
+	if err := p.Validate(); err != nil {
+		return nil, err
+	}
+	return p, nil
+}
+
+// newPipeline declares nodes and edges of the pipeline without validating
+// them, also when there are no middlewares so that it can be described by
+// WriteDOT; the writer node is declared only when writer is enabled
+func newPipeline(t Transport, middlewares []Middleware, writerEnabled bool) *Pipeline {
+	p := &Pipeline{
+		Transport:   t,
+		Middlewares: middlewares,
+		nodes:       make(map[string]NodeRole),
+		edges:       make(map[string][]string),
+		labels:      make(map[string]string),
+		outputs:     make(map[string]<-chan *Metric),
+	}
+
+	writers := map[<-chan *Metric]string{}
+	graph, isGraph := t.(*TransportGraph)
+	if isGraph {
+		p.addGraph(graph)
+	} else {
+		p.AddNode("transport", NodeSource)
+		p.describe("transport", typeName(t), t.OutputChan())
+		writers[t.OutputChan()] = "transport"
+	}
+	names := make([]string, len(middlewares))
+	for i, m := range middlewares {
+		names[i] = middlewareName(m)
+		if _, ok := p.nodes[names[i]]; ok {
+			names[i] = fmt.Sprintf("%s#%d", names[i], i)
+		}
+		p.AddNode(names[i], NodeStage)
+		p.describe(names[i], typeName(m), m.OutputChan())
+		writers[m.OutputChan()] = names[i]
+	}
+	for i, m := range middlewares {
+		if from, ok := writers[m.InputChan()]; ok {
+			p.Connect(from, names[i])
+		}
+		// output of the graph is merged from its sinks
+		if isGraph && m.InputChan() == graph.OutputChan() {
+			for _, name := range graph.Sinks {
+				p.Connect(graphNode(name), names[i])
+			}
+		}
+	}
+	if !writerEnabled {
+		return p
+	}
+
+	// writer reads output of the last middleware
+	p.AddNode("writer", NodeSink)
+	switch {
+	case len(middlewares) > 0:
+		p.Connect(names[len(names)-1], "writer")
+	case isGraph:
+		for _, name := range graph.Sinks {
+			p.Connect(graphNode(name), "writer")
+		}
+	default:
+		p.Connect("transport", "writer")
+	}
+	return p
+}
+
+// addGraph declares transports of the graph as nodes, fed by a listener
+// node
+func (p *Pipeline) addGraph(g *TransportGraph) {
+	p.AddNode("listener", NodeSource)
+	p.describe("listener", "listener", g.Input)
+	for name, cfg := range g.Configs {
+		p.AddNode(graphNode(name), NodeStage)
+		p.labels[graphNode(name)] = fmt.Sprintf("%s\ntype: %s\nbuffer_size: %d", name, cfg.Type, cfg.BufferSize)
+	}
+	for name, transport := range g.Transports {
+		p.outputs[graphNode(name)] = transport.OutputChan()
+	}
+	// whatever reads the sinks reads the merged output
+	for _, name := range g.Sinks {
+		p.outputs[graphNode(name)] = g.Output
+	}
+	for _, name := range g.Sources {
+		p.Connect("listener", graphNode(name))
+	}
+	for _, edge := range g.Edges {
+		p.Connect(graphNode(edge.From), graphNode(edge.To))
+	}
+}
+
+// middlewareName returns lowercase type name, e.g. "ratelimiter"
+func middlewareName(m Middleware) string {
+	return strings.ToLower(typeName(m))
+}
+
+// typeName returns name of the type, dereferencing pointers
+func typeName(v interface{}) string {
+	t := reflect.TypeOf(v)
+	if t.Kind() == reflect.Ptr {
+		t = t.Elem()
+	}
+	return t.Name()
+}
+
+// describe sets label of the node and the channel it writes to, for
+// WriteDOT
+func (p *Pipeline) describe(name string, label string, output <-chan *Metric) {
+	if output != nil {
+		label += fmt.Sprintf("\nbuffer_size: %d", cap(output))
+	}
+	p.labels[name] = label
+	p.outputs[name] = output
+}
+
+// AddNode declares node of the pipeline
+func (p *Pipeline) AddNode(name string, role NodeRole) {
+	p.nodes[name] = role
+}
+
+// Connect declares channel written by node from and read by node to
+func (p *Pipeline) Connect(from string, to string) {
+	p.edges[from] = append(p.edges[from], to)
+}
+
+// Validate checks the declared graph for unknown nodes, cycles, inputs
+// nobody writes to and outputs nobody reads
+func (p *Pipeline) Validate() error {
+	var problems []string
+	inputs := make(map[string]int)
+	for _, from := range p.sortedNodes() {
+		for _, to := range p.edges[from] {
+			if _, ok := p.nodes[to]; !ok {
+				problems = append(problems, fmt.Sprintf("'%s' is connected to unknown node '%s'", from, to))
+			}
+			inputs[to]++
+		}
+	}
+	for from := range p.edges {
+		if _, ok := p.nodes[from]; !ok {
+			problems = append(problems, fmt.Sprintf("unknown node '%s' is connected to %s", from, strings.Join(p.edges[from], ", ")))
+		}
+	}
+
+	if cycle := p.cycle(); cycle != nil {
+		problems = append(problems, fmt.Sprintf("cycle %s", strings.Join(cycle, " -> ")))
+	}
+
+	for _, name := range p.sortedNodes() {
+		role := p.nodes[name]
+		if role != NodeSource && inputs[name] == 0 {
+			problems = append(problems, fmt.Sprintf("input of '%s' is not connected", name))
+		}
+		if role != NodeSink && len(p.edges[name]) == 0 {
+			problems = append(problems, fmt.Sprintf("output of '%s' is never read", name))
+		}
+	}
+
+	if len(problems) > 0 {
+		return fmt.Errorf("invalid pipeline: %s", strings.Join(problems, "; "))
+	}
+	return nil
+}
+
+// cycle returns nodes of a cycle found by DFS, repeating the first one
+// or nil when the graph is acyclic
+func (p *Pipeline) cycle() []string {
+	const (
+		unvisited = iota
+		visiting
+		done
+	)
+	state := make(map[string]int)
+	var path []string
+
+	var visit func(name string) []string
+	visit = func(name string) []string {
+		state[name] = visiting
+		path = append(path, name)
+		for _, next := range p.edges[name] {
+			switch state[next] {
+			case visiting:
+				for i, n := range path {
+					if n == next {
+						return append(append([]string{}, path[i:]...), next)
+					}
+				}
+			case unvisited:
+				if cycle := visit(next); cycle != nil {
+					return cycle
+				}
+			}
+		}
+		path = path[:len(path)-1]
+		state[name] = done
+		return nil
+	}
+
+	for _, name := range p.sortedNodes() {
+		if state[name] == unvisited {
+			if cycle := visit(name); cycle != nil {
+				return cycle
+			}
+		}
+	}
+	return nil
+}
+
+// sortedNodes returns node names in stable order for reproducible errors
+func (p *Pipeline) sortedNodes() []string {
+	names := make([]string, 0, len(p.nodes))
+	for name := range p.nodes {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// WriteDOT writes the pipeline graph in Graphviz DOT format, nodes are
+// labeled by their type and buffer size, edges by current utilization of
+// the channel between the nodes
+func (p *Pipeline) WriteDOT(w io.Writer) error {
+	b := &bytes.Buffer{}
+	b.WriteString("digraph pipeline {\n\trankdir=LR;\n\tnode [shape=box];\n")
+	for _, name := range p.sortedNodes() {
+		label, ok := p.labels[name]
+		if !ok {
+			label = name
+		}
+		fmt.Fprintf(b, "\t%s [label=%s];\n", dotQuote(name), dotQuote(label))
+	}
+	for _, from := range p.sortedNodes() {
+		output := p.outputs[from]
+		for _, to := range p.edges[from] {
+			if output == nil || cap(output) == 0 {
+				fmt.Fprintf(b, "\t%s -> %s;\n", dotQuote(from), dotQuote(to))
+				continue
+			}
+			fmt.Fprintf(b, "\t%s -> %s [label=%s];\n", dotQuote(from), dotQuote(to),
+				dotQuote(fmt.Sprintf("%d/%d (%.0f%%)", len(output), cap(output), 100*float64(len(output))/float64(cap(output)))))
+		}
+	}
+	b.WriteString("}\n")
+	_, err := b.WriteTo(w)
+	return err
+}
+
+// dotQuote returns DOT string literal, line breaks are written as \n
+// escapes
+func dotQuote(s string) string {
+	return `"` + strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`).Replace(s) + `"`
+}
+
+func (p *Pipeline) Start() {
+	p.Transport.Start()
+	for _, m := range p.Middlewares {
+		m.Start()
+	}
+}
+
+func (p *Pipeline) Stop() {
+	p.Transport.Stop()
+	for _, m := range p.Middlewares {
+		m.Stop()
+	}
+}
+
+// StopWithTimeout implements GracefulStopper
+func (p *Pipeline) StopWithTimeout(ctx context.Context) error {
+	if err := StopTransport(ctx, p.Transport); err != nil {
+		return err
+	}
+	for _, m := range p.Middlewares {
+		if err := stopContext(ctx, m.Stop); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (p *Pipeline) OutputChan() <-chan *Metric {
+	if len(p.Middlewares) == 0 {
+		return p.Transport.OutputChan()
+	}
+	return p.Middlewares[len(p.Middlewares)-1].OutputChan()
+}
+
+func (p *Pipeline) OutputChanLen() int {
+	return len(p.OutputChan())
+}
+
+func (p *Pipeline) LogReport() {
+	p.Transport.LogReport()
+	for _, m := range p.Middlewares {
+		m.LogReport()
+	}
+}
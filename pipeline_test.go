@@ -0,0 +1,130 @@
+package metcap
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+)
+
+func TestPipelineWriteDOT(t *testing.T) {
+	logger := testLogger()
+	transport := NewChannelTransport(&TransportConfig{BufferSize: 10}, logger)
+	sampler, err := NewSampler(&SamplerConfig{BufferSize: 4}, transport.OutputChan(), NewFlag(false), logger)
+	if err != nil {
+		t.Fatal(err)
+	}
+	transport.Chan <- &Metric{Name: "test"}
+
+	tests := []struct {
+		name          string
+		middlewares   []Middleware
+		writerEnabled bool
+		expected      string
+	}{
+		{
+			name:          "middlewares",
+			middlewares:   []Middleware{sampler},
+			writerEnabled: true,
+			expected: `digraph pipeline {
+	rankdir=LR;
+	node [shape=box];
+	"sampler" [label="Sampler\nbuffer_size: 4"];
+	"transport" [label="ChannelTransport\nbuffer_size: 10"];
+	"writer" [label="writer"];
+	"sampler" -> "writer" [label="0/4 (0%)"];
+	"transport" -> "sampler" [label="1/10 (10%)"];
+}
+`,
+		},
+		{
+			name:          "no middlewares",
+			writerEnabled: true,
+			expected: `digraph pipeline {
+	rankdir=LR;
+	node [shape=box];
+	"transport" [label="ChannelTransport\nbuffer_size: 10"];
+	"writer" [label="writer"];
+	"transport" -> "writer" [label="1/10 (10%)"];
+}
+`,
+		},
+		{
+			name: "listener only",
+			expected: `digraph pipeline {
+	rankdir=LR;
+	node [shape=box];
+	"transport" [label="ChannelTransport\nbuffer_size: 10"];
+}
+`,
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			var b bytes.Buffer
+			if err := newPipeline(transport, test.middlewares, test.writerEnabled).WriteDOT(&b); err != nil {
+				t.Fatal(err)
+			}
+			if b.String() != test.expected {
+				t.Errorf("expected:\n%s\ngot:\n%s", test.expected, b.String())
+			}
+		})
+	}
+}
+
+func TestPipelineWriteDOTGraph(t *testing.T) {
+	c := &PipelineConfig{
+		BufferSize: 8,
+		Transports: map[string]TransportConfig{
+			"a": {Type: "channel"},
+			"b": {Type: "channel"},
+		},
+		Edges: []PipelineEdge{{From: "a", To: "b"}},
+	}
+	graph, err := NewTransportGraph(c, true, true, NewFlag(false), testLogger())
+	if err != nil {
+		t.Fatal(err)
+	}
+	graph.Output <- &Metric{Name: "test"}
+	graph.Output <- &Metric{Name: "test"}
+
+	var b bytes.Buffer
+	if err := newPipeline(graph, nil, true).WriteDOT(&b); err != nil {
+		t.Fatal(err)
+	}
+	for _, line := range []string{
+		`"transport.a" [label="a\ntype: channel\nbuffer_size: 8"];`,
+		`"listener" -> "transport.a" [label="0/8 (0%)"];`,
+		`"transport.a" -> "transport.b" [label="0/8 (0%)"];`,
+		// sink is read through the merged output of the graph
+		`"transport.b" -> "writer" [label="2/8 (25%)"];`,
+	} {
+		if !strings.Contains(b.String(), "\t"+line+"\n") {
+			t.Errorf("missing %s in:\n%s", line, b.String())
+		}
+	}
+}
+
+func TestDotQuote(t *testing.T) {
+	tests := map[string]string{
+		`plain`:      `"plain"`,
+		`say "hi"`:   `"say \"hi\""`,
+		`trailing\`:  `"trailing\\"`,
+		"two\nlines": `"two\nlines"`,
+		`literal \n`: `"literal \\n"`,
+	}
+	for s, expected := range tests {
+		if quoted := dotQuote(s); quoted != expected {
+			t.Errorf("dotQuote(%q) = %s, expected %s", s, quoted, expected)
+		}
+	}
+}
+
+// testLogger returns running logger, so that logging doesn't block
+func testLogger() *Logger {
+	syslog := false
+	logger := NewLogger(&syslog, NewFlag(false))
+	logger.SetLevel(WARN)
+	go logger.Run()
+	return logger
+}
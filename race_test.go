@@ -0,0 +1,7 @@
+//go:build race
+
+package metcap
+
+// raceEnabled is set when testing with -race, which makes sync.Pool drop
+// pooled objects at random
+const raceEnabled = true
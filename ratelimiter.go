@@ -0,0 +1,222 @@
+package metcap
+
+import (
+	"fmt"
+	"sync"
+	"time"
+)
+
+// RateLimitMode selects what happens to metrics over the limit
+type RateLimitMode int
+
+const (
+	// Drop discards metrics when there are no tokens left
+	Drop RateLimitMode = iota
+	// Block waits for the next token, pushing back on the transport
+	Block
+)
+
+// ParseRateLimitMode parses "drop" or "block", empty string means Drop
+func ParseRateLimitMode(s string) (RateLimitMode, error) {
+	switch s {
+	case "", "drop":
+		return Drop, nil
+	case "block":
+		return Block, nil
+	default:
+		return Drop, fmt.Errorf("unknown rate limit mode '%s'", s)
+	}
+}
+
+func (m RateLimitMode) String() string {
+	switch m {
+	case Drop:
+		return "drop"
+	case Block:
+		return "block"
+	default:
+		return fmt.Sprintf("RateLimitMode(%d)", int(m))
+	}
+}
+
+// RateLimiter passes at most MaxMetricsPerSecond metrics per second using
+// token bucket holding up to Burst tokens
+type RateLimiter struct {
+	stage
+	MaxMetricsPerSecond int
+	Burst               int
+	Mode                RateLimitMode
+	Size                int
+	Logger              *Logger
+	Stats               *RateLimiterStats
+	tokens              float64
+	last                time.Time
+	lock                *sync.Mutex
+}
+
+// NewRateLimiter
+func NewRateLimiter(c *RateLimiterConfig, input <-chan *Metric, exitFlag *Flag, logger *Logger) (*RateLimiter, error) {
+	if c.MaxMetricsPerSecond <= 0 {
+		return nil, fmt.Errorf("max_metrics_per_second has to be positive")
+	}
+
+	if c.Burst == 0 {
+		c.Burst = c.MaxMetricsPerSecond
+	}
+
+	if c.BufferSize == 0 {
+		c.BufferSize = 1000
+	}
+
+	mode, err := ParseRateLimitMode(c.Mode)
+	if err != nil {
+		return nil, err
+	}
+
+	return &RateLimiter{
+		stage:               newStage(input, c.BufferSize, exitFlag),
+		MaxMetricsPerSecond: c.MaxMetricsPerSecond,
+		Burst:               c.Burst,
+		Mode:                mode,
+		Size:                c.BufferSize,
+		Logger:              logger,
+		Stats:               NewRateLimiterStats(),
+		tokens:              float64(c.Burst),
+		last:                time.Now(),
+		lock:                &sync.Mutex{},
+	}, nil
+}
+
+// Update applies new limits from the config
+func (r *RateLimiter) Update(c *RateLimiterConfig) error {
+	if c.MaxMetricsPerSecond <= 0 {
+		return fmt.Errorf("max_metrics_per_second has to be positive")
+	}
+
+	mode, err := ParseRateLimitMode(c.Mode)
+	if err != nil {
+		return err
+	}
+
+	burst := c.Burst
+	if burst == 0 {
+		burst = c.MaxMetricsPerSecond
+	}
+
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	r.MaxMetricsPerSecond = c.MaxMetricsPerSecond
+	r.Burst = burst
+	r.Mode = mode
+	if r.tokens > float64(burst) {
+		r.tokens = float64(burst)
+	}
+	return nil
+}
+
+// take refills the bucket and takes a token if there's one, otherwise it
+// returns how long it takes until there is
+func (r *RateLimiter) take() (bool, time.Duration, RateLimitMode) {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+
+	now := time.Now()
+	r.tokens += now.Sub(r.last).Seconds() * float64(r.MaxMetricsPerSecond)
+	if r.tokens > float64(r.Burst) {
+		r.tokens = float64(r.Burst)
+	}
+	r.last = now
+
+	if r.tokens >= 1 {
+		r.tokens--
+		return true, 0, r.Mode
+	}
+	return false, time.Duration((1 - r.tokens) / float64(r.MaxMetricsPerSecond) * float64(time.Second)), r.Mode
+}
+
+// Allow reports whether the metric may pass; in Block mode it waits
+// for a token unless the limiter is stopping
+func (r *RateLimiter) Allow() bool {
+	for {
+		ok, wait, mode := r.take()
+		if ok {
+			return true
+		}
+		if mode == Drop {
+			r.Stats.Dropped.Increment(1)
+			pipelineStats.Dropped.Add("rate_limit", 1)
+			return false
+		}
+		select {
+		case <-time.After(wait):
+		case <-r.ExitChan:
+			// don't hold the shutdown, let the rest through
+			return true
+		}
+	}
+}
+
+// DroppedTotal returns count of metrics dropped over the limit
+func (r *RateLimiter) DroppedTotal() int64 {
+	return int64(r.Stats.Dropped.Total())
+}
+
+func (r *RateLimiter) process(m *Metric) {
+	if !r.Allow() {
+		return
+	}
+	r.Output <- m
+	r.Stats.Passed.Increment(1)
+}
+
+func (r *RateLimiter) Start() {
+	r.Wg.Add(1)
+	go func() {
+		defer r.Wg.Done()
+		for {
+			select {
+			case m := <-r.Input:
+				r.process(m)
+			case <-r.ExitChan:
+				for len(r.Input) > 0 {
+					r.process(<-r.Input)
+				}
+				return
+			}
+		}
+	}()
+
+	r.watchExit()
+}
+
+func (r *RateLimiter) LogReport() {
+	r.lock.Lock()
+	limit, mode := r.MaxMetricsPerSecond, r.Mode
+	r.lock.Unlock()
+	r.Logger.Info("[ratelimiter] %d/%d (output/capacity), limit: %d/s (%s), metrics: %d/%d (passed/dropped)",
+		len(r.Output),
+		r.Size,
+		limit,
+		mode,
+		r.Stats.Passed.Total(),
+		r.Stats.Dropped.Total(),
+	)
+}
+
+type RateLimiterStats struct {
+	Passed  *StatsCounter
+	Dropped *StatsCounter
+}
+
+func NewRateLimiterStats() *RateLimiterStats {
+	now := time.Now()
+	return &RateLimiterStats{
+		Passed:  NewStatsCounter(now),
+		Dropped: NewStatsCounter(now),
+	}
+}
+
+// Reset keeps Dropped, DroppedTotal() is meant to be monotonic
+func (s *RateLimiterStats) Reset() {
+	s.Passed.Reset()
+}
@@ -0,0 +1,256 @@
+package metcap
+
+import (
+	"fmt"
+	"regexp"
+	"time"
+)
+
+// RelabelAction selects what a relabel rule does when it matches
+type RelabelAction int
+
+const (
+	// RelabelReplace sets target label to the replacement
+	RelabelReplace RelabelAction = iota
+	// RelabelDrop drops metrics that match
+	RelabelDrop
+	// RelabelKeep drops metrics that don't match
+	RelabelKeep
+	// RelabelLabelMap copies tags with matching names under the replacement name
+	RelabelLabelMap
+)
+
+// relabelName is label referring to metric name instead of a tag
+const relabelName = "__name__"
+
+// ParseRelabelAction parses action name, empty string means RelabelReplace
+func ParseRelabelAction(s string) (RelabelAction, error) {
+	switch s {
+	case "", "replace":
+		return RelabelReplace, nil
+	case "drop":
+		return RelabelDrop, nil
+	case "keep":
+		return RelabelKeep, nil
+	case "labelmap":
+		return RelabelLabelMap, nil
+	default:
+		return RelabelReplace, fmt.Errorf("unknown relabel action '%s'", s)
+	}
+}
+
+func (a RelabelAction) String() string {
+	switch a {
+	case RelabelReplace:
+		return "replace"
+	case RelabelDrop:
+		return "drop"
+	case RelabelKeep:
+		return "keep"
+	case RelabelLabelMap:
+		return "labelmap"
+	default:
+		return fmt.Sprintf("RelabelAction(%d)", int(a))
+	}
+}
+
+type relabelRule struct {
+	RelabelRule
+	action RelabelAction
+	regex  *regexp.Regexp
+}
+
+// Relabeler applies relabel rules in order, the first rule dropping
+// the metric stops the processing
+type Relabeler struct {
+	stage
+	Rules  []RelabelRule
+	Size   int
+	Logger *Logger
+	Stats  *RelabelerStats
+	rules  []relabelRule
+}
+
+// NewRelabeler
+func NewRelabeler(c *RelabelConfig, input <-chan *Metric, exitFlag *Flag, logger *Logger) (*Relabeler, error) {
+	if c.BufferSize == 0 {
+		c.BufferSize = 1000
+	}
+
+	rules := make([]relabelRule, 0, len(c.Rules))
+	for i, rule := range c.Rules {
+		action, err := ParseRelabelAction(rule.Action)
+		if err != nil {
+			return nil, fmt.Errorf("relabel rule %d: %v", i+1, err)
+		}
+		// regex has to match whole value, same as in Prometheus
+		regex, err := regexp.Compile("^(?:" + rule.Source + ")$")
+		if err != nil {
+			return nil, fmt.Errorf("relabel rule %d: %v", i+1, err)
+		}
+		if rule.Label == "" {
+			rule.Label = relabelName
+		}
+		if rule.TargetLabel == "" {
+			rule.TargetLabel = rule.Label
+		}
+		if rule.Target == "" {
+			rule.Target = "$1"
+		}
+		rules = append(rules, relabelRule{rule, action, regex})
+	}
+
+	return &Relabeler{
+		stage:  newStage(input, c.BufferSize, exitFlag),
+		Rules:  c.Rules,
+		Size:   c.BufferSize,
+		Logger: logger,
+		Stats:  NewRelabelerStats(),
+		rules:  rules,
+	}, nil
+}
+
+func relabelGet(m *Metric, label string) string {
+	if label == relabelName {
+		return m.Name
+	}
+	return m.Fields[label]
+}
+
+// relabelSet sets the label, tags with empty value are removed
+func relabelSet(m *Metric, label string, value string) {
+	switch {
+	case label == relabelName:
+		m.Name = value
+	case value == "":
+		delete(m.Fields, label)
+	default:
+		m.Fields[label] = value
+	}
+}
+
+// Relabel returns relabeled copy of the metric, or nil when it's dropped.
+// Metric is returned as-is when no rule changes it
+func (r *Relabeler) Relabel(m *Metric) *Metric {
+	original := m
+	clone := func() {
+		if m != original {
+			return
+		}
+		m = m.Clone()
+		if m.Fields == nil {
+			m.Fields = make(map[string]string)
+		}
+	}
+
+	for _, rule := range r.rules {
+		switch rule.action {
+		case RelabelDrop:
+			if rule.regex.MatchString(relabelGet(m, rule.Label)) {
+				return nil
+			}
+		case RelabelKeep:
+			if !rule.regex.MatchString(relabelGet(m, rule.Label)) {
+				return nil
+			}
+		case RelabelReplace:
+			value := relabelGet(m, rule.Label)
+			match := rule.regex.FindStringSubmatchIndex(value)
+			if match == nil {
+				continue
+			}
+			target := string(rule.regex.ExpandString(nil, rule.Target, value, match))
+			if relabelGet(m, rule.TargetLabel) == target {
+				continue
+			}
+			clone()
+			relabelSet(m, rule.TargetLabel, target)
+		case RelabelLabelMap:
+			// names are collected first so that copied tags aren't matched again
+			mapped := make(map[string]string)
+			for k, v := range m.Fields {
+				match := rule.regex.FindStringSubmatchIndex(k)
+				if match == nil {
+					continue
+				}
+				name := string(rule.regex.ExpandString(nil, rule.Target, k, match))
+				if name != k && m.Fields[name] != v {
+					mapped[name] = v
+				}
+			}
+			if len(mapped) > 0 {
+				clone()
+				for k, v := range mapped {
+					m.Fields[k] = v
+				}
+			}
+		}
+	}
+	return m
+}
+
+func (r *Relabeler) process(m *Metric) {
+	relabeled := r.Relabel(m)
+	switch {
+	case relabeled == nil:
+		r.Stats.Dropped.Increment(1)
+		pipelineStats.Dropped.Add("relabel", 1)
+		return
+	case relabeled != m:
+		r.Stats.Relabeled.Increment(1)
+	}
+	r.Output <- relabeled
+	r.Stats.Passed.Increment(1)
+}
+
+func (r *Relabeler) Start() {
+	r.Wg.Add(1)
+	go func() {
+		defer r.Wg.Done()
+		for {
+			select {
+			case m := <-r.Input:
+				r.process(m)
+			case <-r.ExitChan:
+				for len(r.Input) > 0 {
+					r.process(<-r.Input)
+				}
+				return
+			}
+		}
+	}()
+
+	r.watchExit()
+}
+
+func (r *Relabeler) LogReport() {
+	r.Logger.Info("[relabeler] %d/%d (output/capacity), rules: %d, metrics: %d/%d/%d (passed/relabeled/dropped)",
+		len(r.Output),
+		r.Size,
+		len(r.rules),
+		r.Stats.Passed.Total(),
+		r.Stats.Relabeled.Total(),
+		r.Stats.Dropped.Total(),
+	)
+}
+
+type RelabelerStats struct {
+	Passed    *StatsCounter
+	Relabeled *StatsCounter
+	Dropped   *StatsCounter
+}
+
+func NewRelabelerStats() *RelabelerStats {
+	now := time.Now()
+	return &RelabelerStats{
+		Passed:    NewStatsCounter(now),
+		Relabeled: NewStatsCounter(now),
+		Dropped:   NewStatsCounter(now),
+	}
+}
+
+func (s *RelabelerStats) Reset() {
+	s.Passed.Reset()
+	s.Relabeled.Reset()
+	s.Dropped.Reset()
+}
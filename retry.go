@@ -0,0 +1,118 @@
+package metcap
+
+import (
+	"context"
+	"errors"
+	"math"
+	"math/rand"
+	"time"
+)
+
+// RetryPolicy retries failed operations with exponential backoff. Delay
+// before n-th retry is InitialDelay * Multiplier^(n-1), capped by MaxDelay
+// (zero means no cap), and then reduced by random part of up to Jitter
+// (0.0 to 1.0, 1.0 is full jitter) of it. MaxAttempts counts the first
+// attempt too, zero means no limit; zero Multiplier means 2.
+type RetryPolicy struct {
+	MaxAttempts  int
+	InitialDelay time.Duration
+	MaxDelay     time.Duration
+	Multiplier   float64
+	Jitter       float64
+	// OnRetry is called before waiting for the next attempt
+	OnRetry func(attempt int, delay time.Duration, err error)
+}
+
+// writerRetryPolicy is the policy of writers, MaxRetries of 5 means up to
+// 6 attempts
+func writerRetryPolicy(maxRetries int) RetryPolicy {
+	return RetryPolicy{
+		MaxAttempts:  maxRetries + 1,
+		InitialDelay: 1 * time.Second,
+		MaxDelay:     30 * time.Second,
+		Multiplier:   2,
+		Jitter:       0.5,
+	}
+}
+
+type permanentError struct {
+	err error
+}
+
+func (e *permanentError) Error() string { return e.err.Error() }
+func (e *permanentError) Unwrap() error { return e.err }
+
+// Permanent marks the error as not worth retrying, RetryPolicy.Do returns
+// it unwrapped right away
+func Permanent(err error) error {
+	return &permanentError{err}
+}
+
+type retryAfterError struct {
+	err   error
+	delay time.Duration
+}
+
+func (e *retryAfterError) Error() string { return e.err.Error() }
+func (e *retryAfterError) Unwrap() error { return e.err }
+
+// RetryAfter makes RetryPolicy.Do wait for the delay before next attempt
+// instead of the backoff, e.g. as requested by a rate limited server
+func RetryAfter(err error, delay time.Duration) error {
+	return &retryAfterError{err, delay}
+}
+
+// Delay returns delay before the retry following the attempt (counted
+// from 1), with the jitter applied
+func (p *RetryPolicy) Delay(attempt int) time.Duration {
+	multiplier := p.Multiplier
+	if multiplier == 0 {
+		multiplier = 2
+	}
+	delay := float64(p.InitialDelay) * math.Pow(multiplier, float64(attempt-1))
+	if p.MaxDelay > 0 && delay > float64(p.MaxDelay) {
+		delay = float64(p.MaxDelay)
+	}
+	// uncapped delay overflows Duration after enough attempts, the largest
+	// float below 2^63 still converts
+	if max := math.Nextafter(math.MaxInt64, 0); delay > max {
+		delay = max
+	}
+	delay -= delay * p.Jitter * rand.Float64()
+	return time.Duration(delay)
+}
+
+// Do calls fn until it succeeds, returns error marked by Permanent, runs
+// out of attempts or ctx is done; it returns nil or the last error of fn
+func (p *RetryPolicy) Do(ctx context.Context, fn func() error) error {
+	for attempt := 1; ; attempt++ {
+		err := fn()
+		if err == nil {
+			return nil
+		}
+
+		var permanent *permanentError
+		if errors.As(err, &permanent) {
+			return permanent.err
+		}
+		delay := p.Delay(attempt)
+		var retryAfter *retryAfterError
+		if errors.As(err, &retryAfter) {
+			err, delay = retryAfter.err, retryAfter.delay
+		}
+		if p.MaxAttempts > 0 && attempt >= p.MaxAttempts {
+			return err
+		}
+
+		if p.OnRetry != nil {
+			p.OnRetry(attempt, delay, err)
+		}
+		timer := time.NewTimer(delay)
+		select {
+		case <-timer.C:
+		case <-ctx.Done():
+			timer.Stop()
+			return err
+		}
+	}
+}
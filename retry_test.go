@@ -0,0 +1,117 @@
+package metcap
+
+import (
+	"context"
+	"errors"
+	"math"
+	"testing"
+	"time"
+)
+
+func TestRetryPolicyDelay(t *testing.T) {
+	tests := []struct {
+		name    string
+		policy  RetryPolicy
+		attempt int
+		want    time.Duration
+	}{
+		{"first", RetryPolicy{InitialDelay: time.Second}, 1, time.Second},
+		{"default multiplier", RetryPolicy{InitialDelay: time.Second}, 3, 4 * time.Second},
+		{"multiplier", RetryPolicy{InitialDelay: time.Second, Multiplier: 3}, 3, 9 * time.Second},
+		{"capped", RetryPolicy{InitialDelay: time.Second, MaxDelay: 5 * time.Second}, 10, 5 * time.Second},
+		{"uncapped overflow", RetryPolicy{InitialDelay: time.Second}, 100, time.Duration(math.Nextafter(math.MaxInt64, 0))},
+		{"uncapped infinity", RetryPolicy{InitialDelay: time.Second}, 10000, time.Duration(math.Nextafter(math.MaxInt64, 0))},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := tt.policy.Delay(tt.attempt); got != tt.want {
+				t.Errorf("Delay(%d) = %v, want %v", tt.attempt, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestRetryPolicyJitter(t *testing.T) {
+	tests := []struct {
+		name   string
+		jitter float64
+		min    time.Duration
+		max    time.Duration
+	}{
+		{"none", 0, 8 * time.Second, 8 * time.Second},
+		{"half", 0.5, 4 * time.Second, 8 * time.Second},
+		{"full", 1, 0, 8 * time.Second},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			p := RetryPolicy{InitialDelay: time.Second, MaxDelay: 8 * time.Second, Jitter: tt.jitter}
+			for i := 0; i < 1000; i++ {
+				if got := p.Delay(5); got < tt.min || got > tt.max {
+					t.Fatalf("Delay(5) = %v, want within [%v, %v]", got, tt.min, tt.max)
+				}
+			}
+		})
+	}
+
+	// huge uncapped delays stay positive with the jitter applied
+	p := RetryPolicy{InitialDelay: time.Second, Jitter: 0.5}
+	for i := 0; i < 1000; i++ {
+		if got := p.Delay(1000); got < math.MaxInt64/2-time.Microsecond {
+			t.Fatalf("Delay(1000) = %v, want at least half of max Duration", got)
+		}
+	}
+}
+
+func TestRetryPolicyDo(t *testing.T) {
+	failure := errors.New("failure")
+	tests := []struct {
+		name     string
+		attempts int
+		errs     []error
+		calls    int
+		err      error
+	}{
+		{"success", 3, []error{nil}, 1, nil},
+		{"retried", 3, []error{failure, failure, nil}, 3, nil},
+		{"exhausted", 3, []error{failure, failure, failure, nil}, 3, failure},
+		{"permanent", 3, []error{Permanent(failure), nil}, 1, failure},
+		{"permanent after retry", 5, []error{failure, Permanent(failure), nil}, 2, failure},
+		{"retry after", 2, []error{RetryAfter(failure, time.Millisecond), RetryAfter(failure, time.Millisecond)}, 2, failure},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var delays []time.Duration
+			p := RetryPolicy{
+				MaxAttempts:  tt.attempts,
+				InitialDelay: time.Millisecond,
+				OnRetry: func(attempt int, delay time.Duration, err error) {
+					delays = append(delays, delay)
+				},
+			}
+			calls := 0
+			err := p.Do(context.Background(), func() error {
+				err := tt.errs[calls]
+				calls++
+				return err
+			})
+			if err != tt.err {
+				t.Errorf("Do() = %v, want %v", err, tt.err)
+			}
+			if calls != tt.calls {
+				t.Errorf("fn called %d times, want %d", calls, tt.calls)
+			}
+			if len(delays) != tt.calls-1 {
+				t.Errorf("OnRetry called %d times, want %d", len(delays), tt.calls-1)
+			}
+		})
+	}
+
+	// done context stops the retries
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	p := RetryPolicy{InitialDelay: time.Hour}
+	calls := 0
+	if err := p.Do(ctx, func() error { calls++; return failure }); err != failure || calls != 1 {
+		t.Errorf("Do() with done context = %v after %d calls, want %v after 1", err, calls, failure)
+	}
+}
@@ -0,0 +1,269 @@
+package metcap
+
+import (
+	"fmt"
+	"path"
+	"sync"
+	"time"
+)
+
+func init() {
+	RegisterTransport("router", func(c *TransportConfig, listenerEnabled bool, writerEnabled bool, exitFlag *Flag, logger *Logger) (Transport, error) {
+		return NewRouter(c, listenerEnabled, writerEnabled, exitFlag, logger)
+	})
+}
+
+// Router sends each metric to transports of all rules whose pattern
+// matches its name, or to the default transport when none does.
+// Outputs of all the transports are merged into one.
+type Router struct {
+	Transports      map[string]Transport
+	Rules           []RouteRule
+	Default         string
+	Size            int
+	ListenerEnabled bool
+	WriterEnabled   bool
+	Input           chan *Metric
+	Output          chan *Metric
+	ExitChan        chan bool
+	ExitFlag        *Flag
+	Wg              *sync.WaitGroup
+	Logger          *Logger
+	Stats           *RouterStats
+	childFlag       *Flag
+	mergeExit       chan struct{}
+	mergeWg         *sync.WaitGroup
+}
+
+// NewRouter
+func NewRouter(c *TransportConfig, listenerEnabled bool, writerEnabled bool, exitFlag *Flag, logger *Logger) (*Router, error) {
+	if c.BufferSize == 0 {
+		c.BufferSize = 1000
+	}
+
+	if len(c.Router.Transports) == 0 {
+		return nil, &TransportError{"router", fmt.Errorf("no transports configured")}
+	}
+
+	for _, rule := range c.Router.Rules {
+		if _, err := path.Match(rule.Pattern, ""); err != nil {
+			return nil, &TransportError{"router", fmt.Errorf("invalid pattern '%s': %v", rule.Pattern, err)}
+		}
+		if _, ok := c.Router.Transports[rule.Transport]; !ok {
+			return nil, &TransportError{"router", fmt.Errorf("rule '%s' targets unknown transport '%s'", rule.Pattern, rule.Transport)}
+		}
+	}
+
+	if _, ok := c.Router.Transports[c.Router.Default]; c.Router.Default != "" && !ok {
+		return nil, &TransportError{"router", fmt.Errorf("unknown default transport '%s'", c.Router.Default)}
+	}
+
+	// routed transports are shut down only after the router flushed its input
+	childFlag := NewFlag(false)
+	transports := make(map[string]Transport)
+	for name, cfg := range c.Router.Transports {
+		cfg := cfg
+		if cfg.BufferSize == 0 {
+			cfg.BufferSize = c.BufferSize
+		}
+		logger.Info("[router] Using '%s' transport for '%s'", cfg.Type, name)
+		transport, err := NewTransport(cfg.Type, &cfg, listenerEnabled, writerEnabled, childFlag, logger)
+		if err != nil {
+			return nil, &TransportError{"router", fmt.Errorf("transport '%s': %v", name, err)}
+		}
+		transports[name] = transport
+	}
+
+	return &Router{
+		Transports:      transports,
+		Rules:           c.Router.Rules,
+		Default:         c.Router.Default,
+		Size:            c.BufferSize,
+		ListenerEnabled: listenerEnabled,
+		WriterEnabled:   writerEnabled,
+		Input:           make(chan *Metric, c.BufferSize),
+		Output:          make(chan *Metric, c.BufferSize),
+		ExitChan:        make(chan bool, 1),
+		ExitFlag:        exitFlag,
+		Wg:              &sync.WaitGroup{},
+		Logger:          logger,
+		Stats:           NewRouterStats(),
+		childFlag:       childFlag,
+		mergeExit:       make(chan struct{}),
+		mergeWg:         &sync.WaitGroup{},
+	}, nil
+}
+
+// targets returns names of transports the metric should be sent to
+func (r *Router) targets(m *Metric) []string {
+	var names []string
+	for _, rule := range r.Rules {
+		if ok, _ := path.Match(rule.Pattern, m.Name); !ok {
+			continue
+		}
+		dup := false
+		for _, name := range names {
+			if name == rule.Transport {
+				dup = true
+				break
+			}
+		}
+		if !dup {
+			names = append(names, rule.Transport)
+		}
+	}
+	if len(names) == 0 && r.Default != "" {
+		names = append(names, r.Default)
+	}
+	return names
+}
+
+// route passes the metric to the target transports; the metric is shared
+// between them, so it must not be modified afterwards
+func (r *Router) route(m *Metric) {
+	names := r.targets(m)
+	if len(names) == 0 {
+		r.Stats.Unmatched.Increment(1)
+		pipelineStats.Dropped.Add("unrouted", 1)
+		return
+	}
+	for _, name := range names {
+		r.Transports[name].InputChan() <- m
+	}
+	r.Stats.Routed.Increment(1)
+}
+
+func (r *Router) Start() {
+	for _, transport := range r.Transports {
+		transport.Start()
+	}
+
+	if r.ListenerEnabled {
+		r.Wg.Add(1)
+		go func() {
+			defer r.Wg.Done()
+			for {
+				select {
+				case m := <-r.Input:
+					r.route(m)
+				case <-r.ExitChan:
+					for len(r.Input) > 0 {
+						r.route(<-r.Input)
+					}
+					return
+				}
+			}
+		}()
+	}
+
+	if r.WriterEnabled {
+		for _, transport := range r.Transports {
+			r.mergeWg.Add(1)
+			go func(output <-chan *Metric) {
+				defer r.mergeWg.Done()
+				for {
+					select {
+					case m := <-output:
+						r.Output <- m
+					case <-r.mergeExit:
+						for len(output) > 0 {
+							r.Output <- <-output
+						}
+						return
+					}
+				}
+			}(transport.OutputChan())
+		}
+	}
+
+	go func() {
+		<-r.ExitFlag.Done()
+		if r.ListenerEnabled {
+			r.ExitChan <- true
+		}
+		r.Wg.Wait()
+		r.childFlag.Raise()
+	}()
+}
+
+func (r *Router) Stop() {
+	r.Wg.Wait()
+	r.childFlag.Raise()
+	for _, transport := range r.Transports {
+		transport.Stop()
+	}
+	close(r.mergeExit)
+	r.mergeWg.Wait()
+}
+
+func (r *Router) CloseOutput() {
+	for _, transport := range r.Transports {
+		transport.CloseOutput()
+	}
+}
+
+func (r *Router) CloseInput() {
+	for _, transport := range r.Transports {
+		transport.CloseInput()
+	}
+}
+
+// Ready implements ReadinessChecker, router is ready when all of its
+// transports are
+func (r *Router) Ready() error {
+	for name, transport := range r.Transports {
+		if checker, ok := transport.(ReadinessChecker); ok {
+			if err := checker.Ready(); err != nil {
+				return fmt.Errorf("%s: %v", name, err)
+			}
+		}
+	}
+	return nil
+}
+
+func (r *Router) InputChan() chan<- *Metric {
+	return r.Input
+}
+
+func (r *Router) OutputChan() <-chan *Metric {
+	return r.Output
+}
+
+func (r *Router) InputChanLen() int {
+	return len(r.Input)
+}
+
+func (r *Router) OutputChanLen() int {
+	return len(r.Output)
+}
+
+func (r *Router) LogReport() {
+	r.Logger.Info("[transport] router: %d/%d/%d (input/output/capacity), metrics: %d/%d (routed/unmatched)",
+		len(r.Input),
+		len(r.Output),
+		r.Size,
+		r.Stats.Routed.Total(),
+		r.Stats.Unmatched.Total(),
+	)
+	for _, transport := range r.Transports {
+		transport.LogReport()
+	}
+}
+
+type RouterStats struct {
+	Routed    *StatsCounter
+	Unmatched *StatsCounter
+}
+
+func NewRouterStats() *RouterStats {
+	now := time.Now()
+	return &RouterStats{
+		Routed:    NewStatsCounter(now),
+		Unmatched: NewStatsCounter(now),
+	}
+}
+
+func (s *RouterStats) Reset() {
+	s.Routed.Reset()
+	s.Unmatched.Reset()
+}
@@ -0,0 +1,122 @@
+package metcap
+
+import (
+	crand "crypto/rand"
+	"encoding/binary"
+	"fmt"
+	"math/rand"
+	"time"
+)
+
+// Sampler forwards each metric with probability given by the rate of its
+// name, or by Default for names without one, to reduce volume of high
+// frequency metrics
+type Sampler struct {
+	stage
+	SampleRate map[string]float64
+	Default    float64
+	Size       int
+	Logger     *Logger
+	Stats      *SamplerStats
+	rand       *rand.Rand
+}
+
+// NewSampler
+func NewSampler(c *SamplerConfig, input <-chan *Metric, exitFlag *Flag, logger *Logger) (*Sampler, error) {
+	if c.BufferSize == 0 {
+		c.BufferSize = 1000
+	}
+
+	if c.Default == 0 {
+		c.Default = 1
+	}
+
+	if c.Default < 0 || c.Default > 1 {
+		return nil, fmt.Errorf("sampler default has to be between 0 and 1")
+	}
+	for name, rate := range c.SampleRate {
+		if rate < 0 || rate > 1 {
+			return nil, fmt.Errorf("sample rate of '%s' has to be between 0 and 1", name)
+		}
+	}
+
+	var seed [8]byte
+	if _, err := crand.Read(seed[:]); err != nil {
+		return nil, err
+	}
+
+	return &Sampler{
+		stage:      newStage(input, c.BufferSize, exitFlag),
+		SampleRate: c.SampleRate,
+		Default:    c.Default,
+		Size:       c.BufferSize,
+		Logger:     logger,
+		Stats:      NewSamplerStats(),
+		rand:       rand.New(rand.NewSource(int64(binary.LittleEndian.Uint64(seed[:])))),
+	}, nil
+}
+
+// Rate returns the fraction of metrics with the name that is forwarded
+func (s *Sampler) Rate(name string) float64 {
+	if rate, ok := s.SampleRate[name]; ok {
+		return rate
+	}
+	return s.Default
+}
+
+func (s *Sampler) process(m *Metric) {
+	if rate := s.Rate(m.Name); rate < 1 && s.rand.Float64() >= rate {
+		s.Stats.Sampled.Increment(1)
+		pipelineStats.Dropped.Add("sampled", 1)
+		return
+	}
+	s.Output <- m
+	s.Stats.Passed.Increment(1)
+}
+
+func (s *Sampler) Start() {
+	s.Wg.Add(1)
+	go func() {
+		defer s.Wg.Done()
+		for {
+			select {
+			case m := <-s.Input:
+				s.process(m)
+			case <-s.ExitChan:
+				for len(s.Input) > 0 {
+					s.process(<-s.Input)
+				}
+				return
+			}
+		}
+	}()
+
+	s.watchExit()
+}
+
+func (s *Sampler) LogReport() {
+	s.Logger.Info("[sampler] %d/%d (output/capacity), metrics: %d/%d (passed/sampled_out)",
+		len(s.Output),
+		s.Size,
+		s.Stats.Passed.Total(),
+		s.Stats.Sampled.Total(),
+	)
+}
+
+type SamplerStats struct {
+	Passed  *StatsCounter
+	Sampled *StatsCounter
+}
+
+func NewSamplerStats() *SamplerStats {
+	now := time.Now()
+	return &SamplerStats{
+		Passed:  NewStatsCounter(now),
+		Sampled: NewStatsCounter(now),
+	}
+}
+
+func (s *SamplerStats) Reset() {
+	s.Passed.Reset()
+	s.Sampled.Reset()
+}
@@ -0,0 +1,183 @@
+package metcap
+
+import (
+	"fmt"
+	"strings"
+	"time"
+	"unicode/utf8"
+)
+
+// Sanitizer fixes tags that would break line protocol writes and drops
+// metrics with invalid names. Each rule can be turned on separately
+type Sanitizer struct {
+	stage
+	IllegalChars    string
+	Replacement     string
+	MaxTagValueLen  int
+	DropInvalidName bool
+	Size            int
+	Logger          *Logger
+	Stats           *SanitizerStats
+	replacer        *strings.Replacer
+}
+
+// characters with special meaning in line protocol tags
+var sanitizerIllegal = []string{",", "=", " ", "\n", "\r", "\t"}
+
+// NewSanitizer
+func NewSanitizer(c *SanitizerConfig, input <-chan *Metric, exitFlag *Flag, logger *Logger) (*Sanitizer, error) {
+	if c.BufferSize == 0 {
+		c.BufferSize = 1000
+	}
+
+	if c.Replacement == "" {
+		c.Replacement = "_"
+	}
+
+	var replacement string
+	switch c.IllegalChars {
+	case "":
+	case "replace":
+		replacement = c.Replacement
+	case "strip":
+		replacement = ""
+	default:
+		return nil, fmt.Errorf("unknown illegal_chars mode '%s'", c.IllegalChars)
+	}
+
+	var replacer *strings.Replacer
+	if c.IllegalChars != "" {
+		pairs := make([]string, 0, 2*len(sanitizerIllegal))
+		for _, char := range sanitizerIllegal {
+			pairs = append(pairs, char, replacement)
+		}
+		replacer = strings.NewReplacer(pairs...)
+	}
+
+	return &Sanitizer{
+		stage:           newStage(input, c.BufferSize, exitFlag),
+		IllegalChars:    c.IllegalChars,
+		Replacement:     c.Replacement,
+		MaxTagValueLen:  c.MaxTagValueLen,
+		DropInvalidName: c.DropInvalidName,
+		Size:            c.BufferSize,
+		Logger:          logger,
+		Stats:           NewSanitizerStats(),
+		replacer:        replacer,
+	}, nil
+}
+
+// tag returns sanitized tag value
+func (s *Sanitizer) tag(v string) string {
+	if s.replacer != nil {
+		v = s.replacer.Replace(v)
+	}
+	if s.MaxTagValueLen > 0 && len(v) > s.MaxTagValueLen {
+		cut := s.MaxTagValueLen
+		// don't split multi-byte characters
+		for cut > 0 && !utf8.RuneStart(v[cut]) {
+			cut--
+		}
+		v = v[:cut]
+	}
+	return v
+}
+
+// Sanitize returns the metric with tags fixed, or nil when it should
+// be dropped. Metric is copied when modified, the original stays intact
+func (s *Sanitizer) Sanitize(m *Metric) *Metric {
+	if s.DropInvalidName && (m.Name == "" || strings.HasPrefix(m.Name, "_")) {
+		return nil
+	}
+
+	var fields map[string]string
+	for k, v := range m.Fields {
+		key, value := k, s.tag(v)
+		if s.replacer != nil {
+			key = s.replacer.Replace(k)
+		}
+		if key == k && value == v && fields == nil {
+			continue
+		}
+		if fields == nil {
+			fields = make(map[string]string, len(m.Fields))
+			for k, v := range m.Fields {
+				fields[k] = v
+			}
+		}
+		delete(fields, k)
+		fields[key] = value
+	}
+	if fields == nil {
+		return m
+	}
+
+	sanitized := *m
+	sanitized.Fields = fields
+	return &sanitized
+}
+
+func (s *Sanitizer) process(m *Metric) {
+	sanitized := s.Sanitize(m)
+	switch {
+	case sanitized == nil:
+		s.Stats.Dropped.Increment(1)
+		pipelineStats.Dropped.Add("invalid_name", 1)
+		return
+	case sanitized != m:
+		s.Stats.Modified.Increment(1)
+	}
+	s.Output <- sanitized
+	s.Stats.Passed.Increment(1)
+}
+
+func (s *Sanitizer) Start() {
+	s.Wg.Add(1)
+	go func() {
+		defer s.Wg.Done()
+		for {
+			select {
+			case m := <-s.Input:
+				s.process(m)
+			case <-s.ExitChan:
+				for len(s.Input) > 0 {
+					s.process(<-s.Input)
+				}
+				return
+			}
+		}
+	}()
+
+	s.watchExit()
+}
+
+func (s *Sanitizer) LogReport() {
+	s.Logger.Info("[sanitizer] %d/%d (output/capacity), metrics: %d/%d/%d (passed/modified/dropped)",
+		len(s.Output),
+		s.Size,
+		s.Stats.Passed.Total(),
+		s.Stats.Modified.Total(),
+		s.Stats.Dropped.Total(),
+	)
+}
+
+type SanitizerStats struct {
+	Passed   *StatsCounter
+	Modified *StatsCounter
+	Dropped  *StatsCounter
+}
+
+func NewSanitizerStats() *SanitizerStats {
+	now := time.Now()
+	return &SanitizerStats{
+		Passed:   NewStatsCounter(now),
+		Modified: NewStatsCounter(now),
+		Dropped:  NewStatsCounter(now),
+	}
+}
+
+func (s *SanitizerStats) Reset() {
+	s.Passed.Reset()
+	s.Modified.Reset()
+	s.Dropped.Reset()
+}
@@ -0,0 +1,208 @@
+package metcap
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"strings"
+	"time"
+
+	"google.golang.org/protobuf/proto"
+
+	metcappb "github.com/blufor/metcap/proto"
+)
+
+// SerializationFormat encodes metrics passed between metcap instances
+// through the message brokers
+type SerializationFormat interface {
+	Marshal(*Metric) ([]byte, error)
+	Unmarshal([]byte) (*Metric, error)
+	ContentType() string
+}
+
+var serializationFormats = map[string]SerializationFormat{
+	"msgpack":  MsgpackFormat{},
+	"json":     JSONFormat{},
+	"protobuf": ProtobufFormat{},
+}
+
+// NewSerializationFormat returns format by its name, msgpack by default
+func NewSerializationFormat(name string) (SerializationFormat, error) {
+	if name == "" {
+		name = "msgpack"
+	}
+	format, ok := serializationFormats[name]
+	if !ok {
+		return nil, fmt.Errorf("unknown serialization format '%s'", name)
+	}
+	return format, nil
+}
+
+// serializationFormatFor returns format with given content type, or nil
+func serializationFormatFor(contentType string) SerializationFormat {
+	for _, format := range serializationFormats {
+		if format.ContentType() == contentType {
+			return format
+		}
+	}
+	return nil
+}
+
+// MsgpackFormat is the original format, see Metric.Serialize
+type MsgpackFormat struct{}
+
+func (MsgpackFormat) Marshal(m *Metric) ([]byte, error) {
+	return m.SerializeTo(nil)
+}
+
+func (MsgpackFormat) Unmarshal(data []byte) (*Metric, error) {
+	var m Metric
+	if err := unmarshalMsgpack(data, &m); err != nil {
+		return nil, err
+	}
+	return &m, nil
+}
+
+func (MsgpackFormat) ContentType() string {
+	return "application/msgpack"
+}
+
+// JSONFormat encodes metric as returned by Metric.JSON. JSON doesn't
+// distinguish integers from floats, so whole numbers in Values are
+// decoded as int64 and the rest as float64.
+type JSONFormat struct{}
+
+func (JSONFormat) Marshal(m *Metric) ([]byte, error) {
+	return json.Marshal(m)
+}
+
+func (JSONFormat) Unmarshal(data []byte) (*Metric, error) {
+	var m Metric
+	dec := json.NewDecoder(bytes.NewReader(data))
+	dec.UseNumber()
+	if err := dec.Decode(&m); err != nil {
+		return nil, err
+	}
+	for k, v := range m.Values {
+		number, ok := v.(json.Number)
+		if !ok {
+			continue
+		}
+		if !strings.ContainsAny(number.String(), ".eE") {
+			if i, err := number.Int64(); err == nil {
+				m.Values[k] = i
+				continue
+			}
+		}
+		f, err := number.Float64()
+		if err != nil {
+			return nil, fmt.Errorf("value '%s': %v", k, err)
+		}
+		m.Values[k] = f
+	}
+	return &m, nil
+}
+
+func (JSONFormat) ContentType() string {
+	return "application/json"
+}
+
+// ProtobufFormat encodes metric as the Metric message of proto/metric.proto
+type ProtobufFormat struct{}
+
+func (ProtobufFormat) Marshal(m *Metric) ([]byte, error) {
+	pb := &metcappb.Metric{
+		Name:        m.Name,
+		Tags:        m.Fields,
+		Fields:      make(map[string]*metcappb.FieldValue, len(m.Values)+1),
+		TimestampNs: protoTime(m.Timestamp),
+		Ok:          m.OK,
+		ExpiresAtNs: protoTime(m.ExpiresAt),
+	}
+	pb.Fields["value"] = &metcappb.FieldValue{Value: &metcappb.FieldValue_Float{Float: m.Value}}
+	for k, v := range m.Values {
+		value, err := protoFieldValue(v)
+		if err != nil {
+			return nil, fmt.Errorf("value '%s': %v", k, err)
+		}
+		pb.Fields[k] = value
+	}
+	return proto.Marshal(pb)
+}
+
+func (ProtobufFormat) Unmarshal(data []byte) (*Metric, error) {
+	var pb metcappb.Metric
+	if err := proto.Unmarshal(data, &pb); err != nil {
+		return nil, err
+	}
+
+	m := &Metric{
+		Name:      pb.Name,
+		Timestamp: metricTime(pb.TimestampNs),
+		Fields:    pb.Tags,
+		OK:        pb.Ok,
+		ExpiresAt: metricTime(pb.ExpiresAtNs),
+	}
+	for k, v := range pb.Fields {
+		var value interface{}
+		switch field := v.GetValue().(type) {
+		case *metcappb.FieldValue_Int:
+			value = field.Int
+		case *metcappb.FieldValue_Float:
+			value = field.Float
+		case *metcappb.FieldValue_String_:
+			value = field.String_
+		case *metcappb.FieldValue_Bool:
+			value = field.Bool
+		default:
+			return nil, fmt.Errorf("value '%s' is not set", k)
+		}
+		if k == "value" {
+			if f, ok := value.(float64); ok {
+				m.Value = f
+				continue
+			}
+		}
+		if m.Values == nil {
+			m.Values = make(map[string]interface{})
+		}
+		m.Values[k] = value
+	}
+	return m, nil
+}
+
+func (ProtobufFormat) ContentType() string {
+	return "application/x-protobuf"
+}
+
+// protoTime returns t in nanoseconds, zero time is 0
+func protoTime(t time.Time) int64 {
+	if t.IsZero() {
+		return 0
+	}
+	return t.UnixNano()
+}
+
+func metricTime(ns int64) time.Time {
+	if ns == 0 {
+		return time.Time{}
+	}
+	return time.Unix(0, ns)
+}
+
+func protoFieldValue(v interface{}) (*metcappb.FieldValue, error) {
+	switch value := v.(type) {
+	case int64:
+		return &metcappb.FieldValue{Value: &metcappb.FieldValue_Int{Int: value}}, nil
+	case int:
+		return &metcappb.FieldValue{Value: &metcappb.FieldValue_Int{Int: int64(value)}}, nil
+	case float64:
+		return &metcappb.FieldValue{Value: &metcappb.FieldValue_Float{Float: value}}, nil
+	case string:
+		return &metcappb.FieldValue{Value: &metcappb.FieldValue_String_{String_: value}}, nil
+	case bool:
+		return &metcappb.FieldValue{Value: &metcappb.FieldValue_Bool{Bool: value}}, nil
+	default:
+		return nil, fmt.Errorf("unsupported type %T", v)
+	}
+}
@@ -0,0 +1,223 @@
+package metcap
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/linkedin/goavro/v2"
+)
+
+// avroSchema is Avro schema of Metric, values of fields are union of the
+// types Values may hold
+const avroSchema = `{
+  "type": "record",
+  "name": "Metric",
+  "namespace": "metcap",
+  "fields": [
+    {"name": "name", "type": "string"},
+    {"name": "timestamp_ns", "type": "long"},
+    {"name": "value", "type": "double"},
+    {"name": "tags", "type": {"type": "map", "values": "string"}},
+    {"name": "fields", "type": {"type": "map", "values": ["long", "double", "string", "boolean"]}},
+    {"name": "ok", "type": "boolean"},
+    {"name": "expires_at_ns", "type": "long"}
+  ]
+}`
+
+// schemaRegistryContentType is media type of Schema Registry API v1
+const schemaRegistryContentType = "application/vnd.schemaregistry.v1+json"
+
+// AvroFormat encodes metrics in Avro, in Confluent wire format: magic byte
+// 0, big endian ID of the schema registered with Schema Registry at URL
+// under Subject, and the Avro binary. Metrics encoded with other schemas
+// are decoded by the schemas of their IDs, fetched from the registry.
+type AvroFormat struct {
+	URL     string
+	Subject string
+	ID      uint32
+	Client  *http.Client
+	codecs  map[uint32]*goavro.Codec
+	lock    *sync.RWMutex
+}
+
+// NewAvroFormat registers schema of Metric with the registry
+func NewAvroFormat(registryURL string, subject string, timeout time.Duration) (*AvroFormat, error) {
+	codec, err := goavro.NewCodec(avroSchema)
+	if err != nil {
+		return nil, err
+	}
+	f := &AvroFormat{
+		URL:     strings.TrimSuffix(registryURL, "/"),
+		Subject: subject,
+		Client:  &http.Client{Timeout: timeout},
+		codecs:  make(map[uint32]*goavro.Codec),
+		lock:    &sync.RWMutex{},
+	}
+
+	var registered struct {
+		ID uint32 `json:"id"`
+	}
+	if err := f.request("POST", "/subjects/"+url.PathEscape(subject)+"/versions", map[string]string{"schema": codec.Schema()}, &registered); err != nil {
+		return nil, fmt.Errorf("failed to register schema of '%s': %v", subject, err)
+	}
+	f.ID = registered.ID
+	f.codecs[f.ID] = codec
+	return f, nil
+}
+
+// request calls the registry API, decoding the response into v
+func (f *AvroFormat) request(method string, path string, body interface{}, v interface{}) error {
+	var data []byte
+	if body != nil {
+		data, _ = json.Marshal(body)
+	}
+	req, err := http.NewRequest(method, f.URL+path, bytes.NewReader(data))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Accept", schemaRegistryContentType)
+	if body != nil {
+		req.Header.Set("Content-Type", schemaRegistryContentType)
+	}
+
+	resp, err := f.Client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	data, err = ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return err
+	}
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("unexpected status %s: %s", resp.Status, bytes.TrimSpace(data))
+	}
+	return json.Unmarshal(data, v)
+}
+
+// codec returns codec of the schema ID, fetching the schema if it's not
+// known yet
+func (f *AvroFormat) codec(id uint32) (*goavro.Codec, error) {
+	f.lock.RLock()
+	codec, ok := f.codecs[id]
+	f.lock.RUnlock()
+	if ok {
+		return codec, nil
+	}
+
+	var schema struct {
+		Schema string `json:"schema"`
+	}
+	if err := f.request("GET", fmt.Sprintf("/schemas/ids/%d", id), nil, &schema); err != nil {
+		return nil, fmt.Errorf("failed to fetch schema %d: %v", id, err)
+	}
+	codec, err := goavro.NewCodec(schema.Schema)
+	if err != nil {
+		return nil, fmt.Errorf("invalid schema %d: %v", id, err)
+	}
+
+	f.lock.Lock()
+	f.codecs[id] = codec
+	f.lock.Unlock()
+	return codec, nil
+}
+
+func (f *AvroFormat) Marshal(m *Metric) ([]byte, error) {
+	tags := make(map[string]interface{}, len(m.Fields))
+	for k, v := range m.Fields {
+		tags[k] = v
+	}
+	fields := make(map[string]interface{}, len(m.Values))
+	for k, v := range m.Values {
+		value, err := normalizeValue(v)
+		if err != nil {
+			return nil, fmt.Errorf("value '%s': %v", k, err)
+		}
+		switch value.(type) {
+		case int64:
+			fields[k] = goavro.Union("long", value)
+		case float64:
+			fields[k] = goavro.Union("double", value)
+		case string:
+			fields[k] = goavro.Union("string", value)
+		case bool:
+			fields[k] = goavro.Union("boolean", value)
+		}
+	}
+
+	buf := make([]byte, 5, 128)
+	binary.BigEndian.PutUint32(buf[1:], f.ID)
+	return f.codecs[f.ID].BinaryFromNative(buf, map[string]interface{}{
+		"name":          m.Name,
+		"timestamp_ns":  protoTime(m.Timestamp),
+		"value":         m.Value,
+		"tags":          tags,
+		"fields":        fields,
+		"ok":            m.OK,
+		"expires_at_ns": protoTime(m.ExpiresAt),
+	})
+}
+
+func (f *AvroFormat) Unmarshal(data []byte) (*Metric, error) {
+	if len(data) < 5 || data[0] != 0 {
+		return nil, fmt.Errorf("not in Confluent wire format")
+	}
+	codec, err := f.codec(binary.BigEndian.Uint32(data[1:]))
+	if err != nil {
+		return nil, err
+	}
+	native, _, err := codec.NativeFromBinary(data[5:])
+	if err != nil {
+		return nil, err
+	}
+	record, ok := native.(map[string]interface{})
+	if !ok {
+		return nil, fmt.Errorf("schema %d isn't a record", binary.BigEndian.Uint32(data[1:]))
+	}
+
+	// fields missing in other schemas are left zero
+	m := &Metric{Fields: make(map[string]string)}
+	m.Name, _ = record["name"].(string)
+	m.Value, _ = record["value"].(float64)
+	m.OK, _ = record["ok"].(bool)
+	if ns, ok := record["timestamp_ns"].(int64); ok {
+		m.Timestamp = metricTime(ns)
+	}
+	if ns, ok := record["expires_at_ns"].(int64); ok {
+		m.ExpiresAt = metricTime(ns)
+	}
+	if tags, ok := record["tags"].(map[string]interface{}); ok {
+		for k, v := range tags {
+			if s, ok := v.(string); ok {
+				m.Fields[k] = s
+			}
+		}
+	}
+	if fields, ok := record["fields"].(map[string]interface{}); ok && len(fields) > 0 {
+		m.Values = make(map[string]interface{}, len(fields))
+		for k, v := range fields {
+			// unions are decoded as map of the type name to the value
+			if union, ok := v.(map[string]interface{}); ok {
+				for _, value := range union {
+					v = value
+				}
+			}
+			if value, err := normalizeValue(v); err == nil {
+				m.Values[k] = value
+			}
+		}
+	}
+	return m, nil
+}
+
+func (f *AvroFormat) ContentType() string {
+	return "application/vnd.apache.avro+binary"
+}
@@ -0,0 +1,84 @@
+package metcap
+
+import (
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestProtobufFormatRoundTrip(t *testing.T) {
+	ts := time.Unix(1600000000, 123456789)
+	tests := []struct {
+		name   string
+		metric *Metric
+		values map[string]interface{}
+	}{
+		{
+			"whole numbers",
+			&Metric{Name: "cpu", Timestamp: ts, Value: 1, Values: map[string]interface{}{"int": int64(1), "float": 1.0}},
+			map[string]interface{}{"int": int64(1), "float": 1.0},
+		},
+		{
+			"zeros",
+			&Metric{Name: "cpu", Timestamp: ts, Values: map[string]interface{}{"int": int64(0), "float": 0.0, "string": "", "bool": false}},
+			map[string]interface{}{"int": int64(0), "float": 0.0, "string": "", "bool": false},
+		},
+		{
+			"beyond float precision",
+			&Metric{Name: "counter", Timestamp: ts, Values: map[string]interface{}{"big": int64(1<<53 + 1), "min": int64(-1 << 63)}},
+			map[string]interface{}{"big": int64(1<<53 + 1), "min": int64(-1 << 63)},
+		},
+		{
+			"go int",
+			&Metric{Name: "mem", Timestamp: ts, Values: map[string]interface{}{"free": 42}},
+			map[string]interface{}{"free": int64(42)},
+		},
+		{
+			"strings and bools",
+			&Metric{Name: "svc", Timestamp: ts, Values: map[string]interface{}{"state": "up", "ok": true}},
+			map[string]interface{}{"state": "up", "ok": true},
+		},
+		{
+			"value only",
+			&Metric{Name: "up", Fields: map[string]string{"job": "metcap"}, Value: 0.5, OK: true, ExpiresAt: ts},
+			nil,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			format, err := NewSerializationFormat("protobuf")
+			if err != nil {
+				t.Fatal(err)
+			}
+			data, err := format.Marshal(tt.metric)
+			if err != nil {
+				t.Fatal(err)
+			}
+			m, err := format.Unmarshal(data)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			if m.Name != tt.metric.Name || m.Value != tt.metric.Value || m.OK != tt.metric.OK {
+				t.Errorf("decoded %+v, want %+v", m, tt.metric)
+			}
+			if !m.Timestamp.Equal(tt.metric.Timestamp) || !m.ExpiresAt.Equal(tt.metric.ExpiresAt) {
+				t.Errorf("decoded times %v/%v, want %v/%v", m.Timestamp, m.ExpiresAt, tt.metric.Timestamp, tt.metric.ExpiresAt)
+			}
+			if len(m.Fields) != len(tt.metric.Fields) || (len(m.Fields) > 0 && !reflect.DeepEqual(m.Fields, tt.metric.Fields)) {
+				t.Errorf("decoded tags %v, want %v", m.Fields, tt.metric.Fields)
+			}
+			// DeepEqual tells int64 from float64 of the same value
+			if !reflect.DeepEqual(m.Values, tt.values) {
+				t.Errorf("decoded values %#v, want %#v", m.Values, tt.values)
+			}
+		})
+	}
+}
+
+func TestProtobufFormatUnsupported(t *testing.T) {
+	m := &Metric{Name: "cpu", Values: map[string]interface{}{"list": []interface{}{1}}}
+	if _, err := (ProtobufFormat{}).Marshal(m); err == nil {
+		t.Errorf("Marshal() of unsupported value didn't fail")
+	}
+}
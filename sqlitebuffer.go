@@ -0,0 +1,104 @@
+package metcap
+
+import (
+	"context"
+	"database/sql"
+	"net/url"
+
+	_ "modernc.org/sqlite"
+)
+
+// SQLiteBuffer is a persistent FIFO of metrics stored in SQLite database
+// in WAL mode, a cheap durability layer for single-node deployments.
+// Metrics are kept serialized, ordered by autoincrement rowid, so they
+// survive restarts and come out in the order they were enqueued.
+type SQLiteBuffer struct {
+	DB     *sql.DB
+	notify chan struct{}
+}
+
+// NewSQLiteBuffer opens (or creates) the buffer at path, metrics left
+// there by previous run are kept
+func NewSQLiteBuffer(path string) (*SQLiteBuffer, error) {
+	dsn := "file:" + (&url.URL{Path: path}).EscapedPath() +
+		"?_pragma=journal_mode(WAL)&_pragma=synchronous(NORMAL)&_pragma=busy_timeout(5000)"
+	db, err := sql.Open("sqlite", dsn)
+	if err != nil {
+		return nil, err
+	}
+	// SQLite has a single writer anyway, one connection spares the retries
+	// on busy database
+	db.SetMaxOpenConns(1)
+
+	_, err = db.Exec(`CREATE TABLE IF NOT EXISTS metrics (
+		id INTEGER PRIMARY KEY AUTOINCREMENT,
+		data BLOB NOT NULL
+	)`)
+	if err != nil {
+		db.Close()
+		return nil, err
+	}
+
+	return &SQLiteBuffer{
+		DB:     db,
+		notify: make(chan struct{}, 1),
+	}, nil
+}
+
+// Enqueue appends the metric
+func (b *SQLiteBuffer) Enqueue(m *Metric) error {
+	if _, err := b.DB.Exec(`INSERT INTO metrics (data) VALUES (?)`, m.Serialize()); err != nil {
+		return err
+	}
+	b.wake()
+	return nil
+}
+
+// wake lets one of the waiting Dequeue calls look for metrics
+func (b *SQLiteBuffer) wake() {
+	select {
+	case b.notify <- struct{}{}:
+	default:
+	}
+}
+
+// Dequeue removes and returns the oldest metric, waiting for one while
+// the buffer is empty until ctx is done
+func (b *SQLiteBuffer) Dequeue(ctx context.Context) (*Metric, error) {
+	for {
+		var data []byte
+		err := b.DB.QueryRowContext(ctx, `DELETE FROM metrics
+			WHERE id = (SELECT MIN(id) FROM metrics)
+			RETURNING data`).Scan(&data)
+		switch err {
+		case nil:
+			// there may be more for other waiters
+			b.wake()
+			m, err := DeserializeMetric(string(data))
+			if err != nil {
+				return nil, err
+			}
+			return &m, nil
+		case sql.ErrNoRows:
+		default:
+			return nil, err
+		}
+
+		select {
+		case <-b.notify:
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		}
+	}
+}
+
+// Len returns number of the buffered metrics
+func (b *SQLiteBuffer) Len() (int, error) {
+	var n int
+	err := b.DB.QueryRow(`SELECT COUNT(*) FROM metrics`).Scan(&n)
+	return n, err
+}
+
+func (b *SQLiteBuffer) Close() error {
+	return b.DB.Close()
+}
@@ -0,0 +1,58 @@
+package metcap
+
+import (
+	"context"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestSQLiteBuffer(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "buffer.db")
+	b, err := NewSQLiteBuffer(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, name := range []string{"first", "second", "third"} {
+		if err := b.Enqueue(&Metric{Name: name, Timestamp: time.Unix(1, 0), Value: 1}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	b.Close()
+
+	// metrics survive reopening
+	if b, err = NewSQLiteBuffer(path); err != nil {
+		t.Fatal(err)
+	}
+	defer b.Close()
+	if n, err := b.Len(); err != nil || n != 3 {
+		t.Fatalf("Len() = %d, %v, want 3", n, err)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+	for _, name := range []string{"first", "second", "third"} {
+		m, err := b.Dequeue(ctx)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if m.Name != name {
+			t.Errorf("Dequeue() = %s, want %s", m.Name, name)
+		}
+	}
+
+	// empty buffer waits for the next metric
+	go func() {
+		time.Sleep(50 * time.Millisecond)
+		b.Enqueue(&Metric{Name: "late"})
+	}()
+	if m, err := b.Dequeue(ctx); err != nil || m.Name != "late" {
+		t.Errorf("Dequeue() = %v, %v, want late", m, err)
+	}
+
+	short, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	if _, err := b.Dequeue(short); err != context.DeadlineExceeded {
+		t.Errorf("Dequeue() = %v, want %v", err, context.DeadlineExceeded)
+	}
+}
@@ -0,0 +1,55 @@
+package metcap
+
+import (
+	"sync"
+)
+
+// stage holds the channels and exit handling shared by the middlewares,
+// ExitChan is closed once the exit flag is raised or Stop is called
+type stage struct {
+	Input    <-chan *Metric
+	Output   chan *Metric
+	ExitChan chan struct{}
+	ExitFlag *Flag
+	Wg       *sync.WaitGroup
+	exitOnce *sync.Once
+}
+
+func newStage(input <-chan *Metric, size int, exitFlag *Flag) stage {
+	return stage{
+		Input:    input,
+		Output:   make(chan *Metric, size),
+		ExitChan: make(chan struct{}),
+		ExitFlag: exitFlag,
+		Wg:       &sync.WaitGroup{},
+		exitOnce: &sync.Once{},
+	}
+}
+
+func (s *stage) exit() {
+	s.exitOnce.Do(func() { close(s.ExitChan) })
+}
+
+// watchExit closes ExitChan when the exit flag is raised
+func (s *stage) watchExit() {
+	go func() {
+		select {
+		case <-s.ExitFlag.Done():
+			s.exit()
+		case <-s.ExitChan:
+		}
+	}()
+}
+
+func (s *stage) Stop() {
+	s.exit()
+	s.Wg.Wait()
+}
+
+func (s *stage) InputChan() <-chan *Metric {
+	return s.Input
+}
+
+func (s *stage) OutputChan() <-chan *Metric {
+	return s.Output
+}
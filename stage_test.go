@@ -0,0 +1,30 @@
+package metcap
+
+import (
+	"testing"
+	"time"
+)
+
+func TestStageExit(t *testing.T) {
+	tests := []struct {
+		name string
+		exit func(*stage, *Flag)
+	}{
+		{"exit flag", func(s *stage, f *Flag) { f.Raise() }},
+		{"stop", func(s *stage, f *Flag) { s.Stop() }},
+		{"stop after exit flag", func(s *stage, f *Flag) { f.Raise(); s.Stop() }},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			f := NewFlag(false)
+			s := newStage(nil, 1, f)
+			s.watchExit()
+			tt.exit(&s, f)
+			select {
+			case <-s.ExitChan:
+			case <-time.After(1 * time.Second):
+				t.Fatal("ExitChan isn't closed")
+			}
+		})
+	}
+}
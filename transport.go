@@ -1,6 +1,10 @@
 package metcap
 
-import "fmt"
+import (
+	"context"
+	"fmt"
+	"sync"
+)
 
 type Transport interface {
 	Start()
@@ -14,11 +18,130 @@ type Transport interface {
 	OutputChanLen() int
 }
 
+// GracefulStopper is implemented by transports that can give up waiting
+// for their goroutines on shutdown
+type GracefulStopper interface {
+	StopWithTimeout(ctx context.Context) error
+}
+
+// StopTransport stops the transport, or returns ctx.Err() when it doesn't
+// stop before the context is done
+func StopTransport(ctx context.Context, t Transport) error {
+	if stopper, ok := t.(GracefulStopper); ok {
+		return stopper.StopWithTimeout(ctx)
+	}
+	return stopContext(ctx, t.Stop)
+}
+
+// StatsReporter is notified of transport events, for collecting them
+// with a metrics library other than the built-in Prometheus one
+type StatsReporter interface {
+	IncReceived(n int64)
+	IncPublished(n int64)
+	IncDropped(n int64)
+	IncErrors(n int64)
+	SetChannelDepth(name string, n int64)
+}
+
+// NoopStatsReporter is StatsReporter ignoring everything
+type NoopStatsReporter struct{}
+
+func (NoopStatsReporter) IncReceived(n int64)                  {}
+func (NoopStatsReporter) IncPublished(n int64)                 {}
+func (NoopStatsReporter) IncDropped(n int64)                   {}
+func (NoopStatsReporter) IncErrors(n int64)                    {}
+func (NoopStatsReporter) SetChannelDepth(name string, n int64) {}
+
+// TransportFactory creates a transport from its configuration
+type TransportFactory func(c *TransportConfig, listenerEnabled bool, writerEnabled bool, exitFlag *Flag, logger *Logger) (Transport, error)
+
+var (
+	transportsLock = &sync.RWMutex{}
+	transports     = map[string]TransportFactory{}
+)
+
+// RegisterTransport makes a transport available under given name
+// (the `type` option of the transport config). It's meant to be called
+// from init() and panics when the name is already taken.
+func RegisterTransport(name string, factory TransportFactory) {
+	transportsLock.Lock()
+	defer transportsLock.Unlock()
+	if _, exists := transports[name]; exists {
+		panic("metcap: transport '" + name + "' registered twice")
+	}
+	transports[name] = factory
+}
+
+// NewTransport creates a transport registered under given name,
+// wrapped in DiskBufferedTransport when disk buffer is configured or
+// in BackpressuredTransport when backpressure mode other than block is
+func NewTransport(name string, c *TransportConfig, listenerEnabled bool, writerEnabled bool, exitFlag *Flag, logger *Logger) (Transport, error) {
+	transportsLock.RLock()
+	factory, ok := transports[name]
+	transportsLock.RUnlock()
+	if !ok {
+		return nil, &TransportError{name, fmt.Errorf("transport not implemented")}
+	}
+
+	mode, err := ParseBackpressureMode(c.Backpressure)
+	if err != nil {
+		return nil, &TransportError{name, err}
+	}
+	if mode != BackpressureBlock && c.DiskBufferPath != "" {
+		return nil, &TransportError{name, fmt.Errorf("backpressure '%s' can't be used with disk_buffer_path", mode)}
+	}
+
+	t, err := factory(c, listenerEnabled, writerEnabled, exitFlag, logger)
+	if err != nil || !listenerEnabled {
+		return t, err
+	}
+	if c.DiskBufferPath != "" {
+		return NewDiskBufferedTransport(t, c, exitFlag, logger)
+	}
+	if mode != BackpressureBlock {
+		return NewBackpressuredTransport(t, mode, c, exitFlag, logger), nil
+	}
+	return t, nil
+}
+
+// SourceTag is the tag naming transport the metric came through, it's
+// set by transports with source_tagging enabled
+const SourceTag = "_source"
+
+// tagSource sets SourceTag of the metric, which has to be owned by the
+// caller
+func tagSource(m *Metric, source string) {
+	if m.Fields == nil {
+		m.Fields = make(map[string]string)
+	}
+	m.Fields[SourceTag] = source
+}
+
+// TransportError is error of the named transport, wrapping its cause
 type TransportError struct {
 	provider string
 	err      error
 }
 
 func (e *TransportError) Error() string {
-	return fmt.Sprintf("[%s] Error: %v", e.provider, e.err)
+	return fmt.Sprintf("%s transport error: %v", e.provider, e.err)
+}
+
+func (e *TransportError) String() string {
+	return e.Error()
+}
+
+func (e *TransportError) Unwrap() error {
+	return e.err
+}
+
+// ChannelOverflowError is returned when metrics are dropped because the
+// channel is full, which is a load problem, unlike TransportError
+type ChannelOverflowError struct {
+	ChannelName string
+	Dropped     int
+}
+
+func (e *ChannelOverflowError) Error() string {
+	return fmt.Sprintf("%s channel overflow: %d metrics dropped", e.ChannelName, e.Dropped)
 }
@@ -1,38 +1,96 @@
 package metcap
 
 import (
+	"bytes"
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"io/ioutil"
 	"net"
 	"strconv"
+	"strings"
 	"sync"
+	"sync/atomic"
+	"text/template"
 	"time"
 
 	"github.com/streadway/amqp"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/propagation"
+	"go.opentelemetry.io/otel/trace"
 )
 
+const (
+	// batches are always msgpack encoded, see SerializeMetrics
+	amqpContentTypeBatch = "application/msgpack-batch"
+	// header naming the algorithm the body is compressed with
+	amqpCompressionHeader = "x-compression"
+)
+
+func init() {
+	RegisterTransport("amqp", func(c *TransportConfig, listenerEnabled bool, writerEnabled bool, exitFlag *Flag, logger *Logger) (Transport, error) {
+		return NewAMQPTransport(c, listenerEnabled, writerEnabled, exitFlag, logger)
+	})
+}
+
 type AMQPTransport struct {
-	InputConn       *amqp.Connection
-	OutputConn      *amqp.Connection
-	InputChannel    *amqp.Channel
-	OutputChannel   *amqp.Channel
-	Size            int
-	Workers         int
-	Exchange        string
-	Queue           string
-	ListenerEnabled bool
-	WriterEnabled   bool
-	Input           chan *Metric
-	Output          chan *Metric
-	ExitChan        chan bool
-	ExitFlag        *Flag
-	Wg              *sync.WaitGroup
-	Logger          *Logger
-	Stats           *AMQPTransportStats
+	InputConn          *amqp.Connection
+	OutputConn         *amqp.Connection
+	InputChannel       *amqp.Channel
+	OutputChannel      *amqp.Channel
+	Size               int
+	Workers            int
+	BatchSize          int
+	BatchTimeout       time.Duration
+	PrefetchCount      int
+	PrefetchSize       int
+	Exchange           string
+	Queue              string
+	Queues             []string
+	ExchangeType       string
+	Key                string
+	KeyTemplate        *template.Template
+	Exchanges          []amqpExchange
+	QueueArgs          amqp.Table
+	DeadLetterExchange string
+	DeadLetterQueue    string
+	ReconnectMax       time.Duration
+	PublisherConfirms  bool
+	ConfirmTimeout     time.Duration
+	MaxRetries         int
+	Compression        string
+	Format             SerializationFormat
+	ShareConnection    bool
+	ChannelPerProducer bool
+	SourceTagging      bool
+	ListenerEnabled    bool
+	WriterEnabled      bool
+	Input              chan *Metric
+	Output             chan *Metric
+	ExitFlag           *Flag
+	Wg                 *sync.WaitGroup
+	Logger             *Logger
+	Stats              *AMQPTransportStats
+	Config             *TransportConfig
+	Tracer             trace.Tracer
+	Reporter           StatsReporter
+	OnChannelError     func(err *amqp.Error)
+	connLock           *sync.RWMutex
+	publisher          *amqpPublisher
+	producing          int32
+	consuming          int32
 }
 
 // NewAMQPTransport
 func NewAMQPTransport(c *TransportConfig, listenerEnabled bool, writerEnabled bool, exitFlag *Flag, logger *Logger) (*AMQPTransport, error) {
 	// connection
 
+	if c.Type == "" {
+		c.Type = "amqp"
+	}
+
 	if c.AMQPTag == "" {
 		c.AMQPTag = "default"
 	}
@@ -41,191 +99,1084 @@ func NewAMQPTransport(c *TransportConfig, listenerEnabled bool, writerEnabled bo
 		c.BufferSize = 1000
 	}
 
-	var (
-		inputConn     *amqp.Connection
-		inputChannel  *amqp.Channel
-		outputConn    *amqp.Connection
-		outputChannel *amqp.Channel
-		err           error
-	)
+	if c.AMQPWorkers == 0 {
+		c.AMQPWorkers = 1
+	}
+
+	if c.AMQPTimeout == 0 {
+		c.AMQPTimeout = 5
+	}
 
-	queue := "metcap:" + c.AMQPTag
-	exchange := "metcap:" + c.AMQPTag
-	key := "metcap:" + c.AMQPTag
+	if c.AMQPHeartbeat.Duration == 0 {
+		c.AMQPHeartbeat.Duration = 10 * time.Second
+	}
 
-	if listenerEnabled {
-		inputConn, inputChannel, err = amqpInit(c)
-		if err != nil {
+	if c.AMQPExchangeType == "" {
+		c.AMQPExchangeType = amqp.ExchangeDirect
+	}
+
+	if c.AMQPRoutingKey == "" {
+		c.AMQPRoutingKey = "metcap:" + c.AMQPTag
+	}
+
+	if c.AMQPBatchTimeout.Duration == 0 {
+		c.AMQPBatchTimeout.Duration = 1 * time.Second
+	}
+
+	if c.AMQPPrefetchCount == 0 {
+		c.AMQPPrefetchCount = 100
+	}
+
+	if c.AMQPReconnectMax.Duration == 0 {
+		c.AMQPReconnectMax.Duration = 30 * time.Second
+	}
+
+	if c.AMQPConfirmTimeout.Duration == 0 {
+		c.AMQPConfirmTimeout.Duration = 5 * time.Second
+	}
+
+	if c.AMQPMaxRetries == 0 {
+		c.AMQPMaxRetries = 3
+	}
+
+	if c.AMQPCompression == "" {
+		c.AMQPCompression = CompressionNone
+	}
+
+	for i := range c.AMQPExchanges {
+		if c.AMQPExchanges[i].Type == "" {
+			c.AMQPExchanges[i].Type = c.AMQPExchangeType
+		}
+	}
+
+	if errs := c.Validate(); len(errs) > 0 {
+		return nil, &TransportError{"amqp", joinErrors(errs)}
+	}
+
+	format, err := NewSerializationFormat(c.SerializationFormat)
+	if err != nil {
+		return nil, &TransportError{"amqp", err}
+	}
+
+	var keyTemplate *template.Template
+	if c.AMQPRoutingKeyTemplate != "" {
+		if keyTemplate, err = newAMQPRoutingKeyTemplate(c.AMQPRoutingKeyTemplate); err != nil {
 			return nil, &TransportError{"amqp", err}
 		}
+	}
 
-		err = inputChannel.ExchangeDeclare(
-			exchange, // exchange name
-			"direct", // exchange type
-			true,     // durable?
-			false,    // auto-delete?
-			false,    // internal?
-			false,    // no-wait?
-			nil,      // arguments
-		)
+	var exchanges []amqpExchange
+	for _, exchange := range c.AMQPExchanges {
+		e := amqpExchange{Name: exchange.Name, Type: exchange.Type}
+		if exchange.RoutingKeyTemplate != "" {
+			if e.KeyTemplate, err = newAMQPRoutingKeyTemplate(exchange.RoutingKeyTemplate); err != nil {
+				return nil, &TransportError{"amqp", err}
+			}
+		}
+		exchanges = append(exchanges, e)
+	}
+
+	queues := c.AMQPQueues
+	if len(queues) == 0 {
+		queues = []string{"metcap:" + c.AMQPTag}
+	}
+
+	queueArgs := amqp.Table{}
+	if c.AMQPDeadLetterExchange != "" {
+		queueArgs["x-dead-letter-exchange"] = c.AMQPDeadLetterExchange
+	}
+	if c.AMQPMaxPriority > 0 {
+		queueArgs["x-max-priority"] = int32(c.AMQPMaxPriority)
+	}
+
+	t := &AMQPTransport{
+		Size:               c.BufferSize,
+		Workers:            c.AMQPWorkers,
+		BatchSize:          c.AMQPBatchSize,
+		BatchTimeout:       c.AMQPBatchTimeout.Duration,
+		PrefetchCount:      c.AMQPPrefetchCount,
+		PrefetchSize:       c.AMQPPrefetchSize,
+		Exchange:           "metcap:" + c.AMQPTag,
+		Queue:              "metcap:" + c.AMQPTag,
+		Queues:             queues,
+		ExchangeType:       c.AMQPExchangeType,
+		Key:                c.AMQPRoutingKey,
+		KeyTemplate:        keyTemplate,
+		Exchanges:          exchanges,
+		QueueArgs:          queueArgs,
+		DeadLetterExchange: c.AMQPDeadLetterExchange,
+		DeadLetterQueue:    c.AMQPDeadLetterQueue,
+		ReconnectMax:       c.AMQPReconnectMax.Duration,
+		PublisherConfirms:  c.AMQPPublisherConfirms,
+		ConfirmTimeout:     c.AMQPConfirmTimeout.Duration,
+		MaxRetries:         c.AMQPMaxRetries,
+		Compression:        c.AMQPCompression,
+		Format:             format,
+		ShareConnection:    c.AMQPShareConnection && listenerEnabled && writerEnabled,
+		ChannelPerProducer: c.AMQPChannelPerProducer,
+		SourceTagging:      c.SourceTagging,
+		ListenerEnabled:    listenerEnabled,
+		WriterEnabled:      writerEnabled,
+		Input:              make(chan *Metric, c.BufferSize),
+		Output:             make(chan *Metric, c.BufferSize),
+		ExitFlag:           exitFlag,
+		Wg:                 &sync.WaitGroup{},
+		Logger:             logger,
+		Stats:              NewAMQPTransportStats(),
+		Config:             c,
+		Reporter:           NoopStatsReporter{},
+		connLock:           &sync.RWMutex{},
+	}
+
+	if listenerEnabled {
+		t.InputConn, t.InputChannel, err = amqpInit(c)
 		if err != nil {
 			return nil, &TransportError{"amqp", err}
 		}
-		_, err = inputChannel.QueueDeclare(
-			queue, // queue name
-			true,  // durable?
-			false, // auto-delete?
-			false, // exclusive?
-			false, // no-wait?
-			nil,   // arguments
-		)
+		err = t.declare(t.InputChannel, true)
 		if err != nil {
 			return nil, &TransportError{"amqp", err}
 		}
-
-		err = inputChannel.QueueBind(
-			queue,    // queue name
-			key,      // key name
-			exchange, // exchange name
-			false,    // no-wait?
-			nil,      // arguments
-		)
+		err = t.confirm()
 		if err != nil {
 			return nil, &TransportError{"amqp", err}
 		}
 	}
 
-	if writerEnabled {
-		outputConn, outputChannel, err = amqpInit(c)
+	if t.ShareConnection {
+		t.OutputConn = t.InputConn
+		t.OutputChannel, err = t.outputChannel(t.OutputConn)
+		if err != nil {
+			return nil, &TransportError{"amqp", err}
+		}
+	} else if writerEnabled {
+		t.OutputConn, t.OutputChannel, err = amqpInit(c)
+		if err != nil {
+			return nil, &TransportError{"amqp", err}
+		}
+		err = t.declare(t.OutputChannel, false)
 		if err != nil {
 			return nil, &TransportError{"amqp", err}
 		}
 	}
 
-	return &AMQPTransport{
-		InputConn:       inputConn,
-		OutputConn:      outputConn,
-		InputChannel:    inputChannel,
-		OutputChannel:   outputChannel,
-		Size:            c.BufferSize,
-		Workers:         c.AMQPWorkers,
-		Exchange:        exchange,
-		Queue:           queue,
-		ListenerEnabled: listenerEnabled,
-		WriterEnabled:   writerEnabled,
-		Input:           make(chan *Metric, c.BufferSize),
-		Output:          make(chan *Metric, c.BufferSize),
-		ExitChan:        make(chan bool, 1),
-		ExitFlag:        exitFlag,
-		Wg:              &sync.WaitGroup{},
-		Logger:          logger,
-		Stats:           NewAMQPTransportStats(),
-	}, nil
+	return t, nil
+}
+
+// outputChannel opens the consuming channel on the (shared) connection
+func (t *AMQPTransport) outputChannel(conn *amqp.Connection) (*amqp.Channel, error) {
+	channel, err := conn.Channel()
+	if err != nil {
+		return nil, err
+	}
+	if err := t.declare(channel, false); err != nil {
+		channel.Close()
+		return nil, err
+	}
+	return channel, nil
 }
 
 func amqpInit(c *TransportConfig) (*amqp.Connection, *amqp.Channel, error) {
+	tlsConfig, err := amqpTLSConfig(c)
+	if err != nil {
+		return nil, nil, err
+	}
+
 	conn, err := amqp.DialConfig(c.AMQPURL, amqp.Config{
 		Dial: func(network, addr string) (net.Conn, error) {
-			return net.DialTimeout(network, addr, time.Duration(c.AMQPTimeout)*time.Second)
+			conn, err := net.DialTimeout(network, addr, time.Duration(c.AMQPTimeout)*time.Second)
+			if err != nil || (c.AMQPReadTimeout.Duration == 0 && c.AMQPWriteTimeout.Duration == 0) {
+				return conn, err
+			}
+			return &amqpDeadlineConn{conn, c.AMQPReadTimeout.Duration, c.AMQPWriteTimeout.Duration}, nil
 		},
+		TLSClientConfig: tlsConfig,
+		Heartbeat:       c.AMQPHeartbeat.Duration,
+		Vhost:           c.AMQPVHost, // empty means the one of the URL
 	})
 	if err != nil {
-		return nil, nil, &TransportError{"amqp", err}
+		return nil, nil, err
 	}
 
 	channel, err := conn.Channel()
 	if err != nil {
-		return nil, nil, &TransportError{"amqp", err}
+		conn.Close()
+		return nil, nil, err
 	}
 
 	return conn, channel, nil
 }
 
-func (t *AMQPTransport) publish(m *Metric) error {
-	return t.InputChannel.Publish(
-		t.Exchange, // exchange
-		t.Exchange, // routing key
-		false,      // mandatory?
-		false,      // immediate?
+// amqpDeadlineConn sets deadline before every read and write, so that
+// a hung connection fails instead of blocking forever
+type amqpDeadlineConn struct {
+	net.Conn
+	readTimeout  time.Duration
+	writeTimeout time.Duration
+}
+
+func (c *amqpDeadlineConn) Read(b []byte) (int, error) {
+	if c.readTimeout > 0 {
+		c.Conn.SetReadDeadline(time.Now().Add(c.readTimeout))
+	}
+	return c.Conn.Read(b)
+}
+
+func (c *amqpDeadlineConn) Write(b []byte) (int, error) {
+	if c.writeTimeout > 0 {
+		c.Conn.SetWriteDeadline(time.Now().Add(c.writeTimeout))
+	}
+	return c.Conn.Write(b)
+}
+
+// amqpTLSConfig loads client certificate and CA pool when TLS is configured,
+// returns nil config otherwise
+func amqpTLSConfig(c *TransportConfig) (*tls.Config, error) {
+	if c.AMQPTLSCertFile == "" && c.AMQPTLSKeyFile == "" && c.AMQPTLSCAFile == "" {
+		return nil, nil
+	}
+
+	// the library does TLS handshake only for amqps:// URLs
+	if !strings.HasPrefix(c.AMQPURL, "amqps://") {
+		return nil, fmt.Errorf("TLS is configured, but amqp_url doesn't use amqps:// scheme")
+	}
+
+	tlsConfig := &tls.Config{}
+
+	if c.AMQPTLSCertFile != "" || c.AMQPTLSKeyFile != "" {
+		cert, err := tls.LoadX509KeyPair(c.AMQPTLSCertFile, c.AMQPTLSKeyFile)
+		if err != nil {
+			return nil, err
+		}
+		tlsConfig.Certificates = []tls.Certificate{cert}
+	}
+
+	if c.AMQPTLSCAFile != "" {
+		ca, err := ioutil.ReadFile(c.AMQPTLSCAFile)
+		if err != nil {
+			return nil, err
+		}
+		tlsConfig.RootCAs = x509.NewCertPool()
+		if !tlsConfig.RootCAs.AppendCertsFromPEM(ca) {
+			return nil, fmt.Errorf("no certificates found in %s", c.AMQPTLSCAFile)
+		}
+	}
+
+	return tlsConfig, nil
+}
+
+// amqpPublisher is a channel metrics are published on, with confirmations
+// of its own when publisher confirms are enabled
+type amqpPublisher struct {
+	conn        *amqp.Connection
+	channel     *amqp.Channel
+	closed      chan *amqp.Error
+	confirms    chan amqp.Confirmation
+	deliveryTag uint64
+	lock        *sync.Mutex
+}
+
+// newPublisher wraps the channel opened on the connection, putting it into
+// confirm mode when publisher confirms are enabled
+func (t *AMQPTransport) newPublisher(conn *amqp.Connection, channel *amqp.Channel) (*amqpPublisher, error) {
+	p := &amqpPublisher{
+		conn:    conn,
+		channel: channel,
+		closed:  channel.NotifyClose(make(chan *amqp.Error, 1)),
+		lock:    &sync.Mutex{},
+	}
+	if !t.PublisherConfirms {
+		return p, nil
+	}
+	if err := channel.Confirm(false); err != nil {
+		return p, err
+	}
+	// late confirmations of timed out messages are buffered until next publish
+	p.confirms = channel.NotifyPublish(make(chan amqp.Confirmation, 100))
+	return p, nil
+}
+
+// confirm sets the publisher of the input channel shared by producers,
+// connLock has to be held (or the transport not started yet)
+func (t *AMQPTransport) confirm() error {
+	var err error
+	t.publisher, err = t.newPublisher(t.InputConn, t.InputChannel)
+	return err
+}
+
+// producerPublisher returns publisher with channel of its own, p is the
+// one returned previously; channel is reopened on the current input
+// connection when it was closed or the connection was re-established
+func (t *AMQPTransport) producerPublisher(p *amqpPublisher) (*amqpPublisher, error) {
+	t.connLock.RLock()
+	conn := t.InputConn
+	t.connLock.RUnlock()
+	if p != nil {
+		select {
+		case <-p.closed:
+		default:
+			if p.conn == conn {
+				return p, nil
+			}
+			p.channel.Close()
+		}
+	}
+	channel, err := conn.Channel()
+	if err != nil {
+		return nil, err
+	}
+	p, err = t.newPublisher(conn, channel)
+	if err != nil {
+		channel.Close()
+		return nil, err
+	}
+	return p, nil
+}
+
+// declare declares the dead-letter exchange and queue when configured;
+// with input set it also declares the exchange and the queue and binds them
+// together
+func (t *AMQPTransport) declare(channel *amqp.Channel, input bool) error {
+	if t.DeadLetterExchange != "" {
+		err := amqpDeclare(channel, t.DeadLetterExchange, amqp.ExchangeFanout, t.DeadLetterQueue, "", nil)
+		if err != nil {
+			return err
+		}
+	}
+	if !input {
+		// queues of other tags are declared like their listeners would
+		if len(t.Config.AMQPQueues) > 0 {
+			for _, queue := range t.Queues {
+				if err := amqpDeclare(channel, queue, t.ExchangeType, queue, queue, t.QueueArgs); err != nil {
+					return err
+				}
+			}
+		}
+		// limit unacknowledged deliveries, broker would push the whole queue otherwise
+		return channel.Qos(t.PrefetchCount, t.PrefetchSize, false)
+	}
+	if err := amqpDeclare(channel, t.Exchange, t.ExchangeType, t.Queue, t.Key, t.QueueArgs); err != nil {
+		return err
+	}
+	// queues of the additional exchanges are up to their consumers
+	for _, exchange := range t.Exchanges {
+		err := channel.ExchangeDeclare(
+			exchange.Name, // exchange name
+			exchange.Type, // exchange type
+			true,          // durable?
+			false,         // auto-delete?
+			false,         // internal?
+			false,         // no-wait?
+			nil,           // arguments
+		)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// amqpDeclare declares the exchange and the queue and binds them together
+func amqpDeclare(channel *amqp.Channel, exchange, exchangeType, queue, key string, queueArgs amqp.Table) error {
+	err := channel.ExchangeDeclare(
+		exchange,     // exchange name
+		exchangeType, // exchange type
+		true,         // durable?
+		false,        // auto-delete?
+		false,        // internal?
+		false,        // no-wait?
+		nil,          // arguments
+	)
+	if err != nil {
+		return err
+	}
+
+	_, err = channel.QueueDeclare(
+		queue,     // queue name
+		true,      // durable?
+		false,     // auto-delete?
+		false,     // exclusive?
+		false,     // no-wait?
+		queueArgs, // arguments
+	)
+	if err != nil {
+		return err
+	}
+
+	return channel.QueueBind(
+		queue,    // queue name
+		key,      // key name
+		exchange, // exchange name
+		false,    // no-wait?
+		nil,      // arguments
+	)
+}
+
+// reconnect re-dials the broker with exponential backoff and jitter until
+// it succeeds or the transport is asked to exit
+func (t *AMQPTransport) reconnect(input bool) (*amqp.Connection, *amqp.Channel, bool) {
+	if t.ExitFlag.Get() {
+		return nil, nil, false
+	}
+	ctx, cancel := t.ExitFlag.Context()
+	defer cancel()
+
+	retry := RetryPolicy{
+		InitialDelay: 1 * time.Second,
+		MaxDelay:     t.ReconnectMax,
+		Jitter:       0.5,
+		OnRetry: func(attempt int, delay time.Duration, err error) {
+			t.Logger.Error("[amqp] Reconnect failed, retrying in %v: %v", delay, err)
+		},
+	}
+	var conn *amqp.Connection
+	var channel *amqp.Channel
+	err := retry.Do(ctx, func() error {
+		var err error
+		if conn, channel, err = amqpInit(t.Config); err != nil {
+			return err
+		}
+		if err = t.declare(channel, input); err != nil {
+			conn.Close()
+		}
+		return err
+	})
+	if err != nil {
+		return nil, nil, false
+	}
+	return conn, channel, true
+}
+
+// watch waits for the connection to be closed by the broker and reconnects
+func (t *AMQPTransport) watch(input bool) {
+	for {
+		t.connLock.RLock()
+		conn := t.OutputConn
+		if input {
+			conn = t.InputConn
+		}
+		t.connLock.RUnlock()
+
+		amqpErr, ok := <-conn.NotifyClose(make(chan *amqp.Error, 1))
+		if !ok || amqpErr == nil || t.ExitFlag.Get() {
+			// connection closed gracefully
+			return
+		}
+		t.Logger.Error("[amqp] Connection lost: %v", amqpErr)
+		t.Reporter.IncErrors(1)
+
+		newConn, newChannel, ok := t.reconnect(input)
+		if !ok {
+			return
+		}
+		t.connLock.Lock()
+		if input {
+			t.InputConn, t.InputChannel = newConn, newChannel
+			if err := t.confirm(); err != nil {
+				t.Logger.Error("[amqp] Failed to enable publisher confirms: %v", err)
+			}
+		} else {
+			t.OutputConn, t.OutputChannel = newConn, newChannel
+		}
+		t.connLock.Unlock()
+		go t.watchChannel(newChannel)
+		t.Logger.Info("[amqp] Connection re-established")
+	}
+}
+
+// watchShared is watch for the connection shared by both channels, which
+// are reopened together
+func (t *AMQPTransport) watchShared() {
+	for {
+		t.connLock.RLock()
+		conn := t.InputConn
+		t.connLock.RUnlock()
+
+		amqpErr, ok := <-conn.NotifyClose(make(chan *amqp.Error, 1))
+		if !ok || amqpErr == nil || t.ExitFlag.Get() {
+			// connection closed gracefully
+			return
+		}
+		t.Logger.Error("[amqp] Connection lost: %v", amqpErr)
+		t.Reporter.IncErrors(1)
+
+		var newConn *amqp.Connection
+		var newInput, newOutput *amqp.Channel
+		for {
+			newConn, newInput, ok = t.reconnect(true)
+			if !ok {
+				return
+			}
+			var err error
+			if newOutput, err = t.outputChannel(newConn); err == nil {
+				break
+			}
+			t.Logger.Error("[amqp] Failed to open output channel: %v", err)
+			newConn.Close()
+		}
+		t.connLock.Lock()
+		t.InputConn, t.InputChannel = newConn, newInput
+		t.OutputConn, t.OutputChannel = newConn, newOutput
+		if err := t.confirm(); err != nil {
+			t.Logger.Error("[amqp] Failed to enable publisher confirms: %v", err)
+		}
+		t.connLock.Unlock()
+		go t.watchChannel(newInput)
+		go t.watchChannel(newOutput)
+		t.Logger.Info("[amqp] Connection re-established")
+	}
+}
+
+// watchChannel waits for the channel to be closed by the broker (e.g. on
+// a deleted queue) and passes the error to OnChannelError if it's set,
+// logs it otherwise
+func (t *AMQPTransport) watchChannel(channel *amqp.Channel) {
+	amqpErr, ok := <-channel.NotifyClose(make(chan *amqp.Error, 1))
+	if !ok || amqpErr == nil || t.ExitFlag.Get() {
+		// channel closed gracefully
+		return
+	}
+	t.Reporter.IncErrors(1)
+	if t.OnChannelError != nil {
+		t.OnChannelError(amqpErr)
+		return
+	}
+	t.Logger.Error("[amqp] Channel closed by broker: %v", amqpErr)
+}
+
+// Ready implements ReadinessChecker
+func (t *AMQPTransport) Ready() error {
+	t.connLock.RLock()
+	defer t.connLock.RUnlock()
+	if t.ListenerEnabled && (t.InputConn == nil || t.InputConn.IsClosed()) {
+		return fmt.Errorf("input connection closed")
+	}
+	if t.WriterEnabled && (t.OutputConn == nil || t.OutputConn.IsClosed()) {
+		return fmt.Errorf("output connection closed")
+	}
+	return nil
+}
+
+// consumers returns number of consumer goroutines, each queue gets at least one
+func (t *AMQPTransport) consumers() int {
+	if len(t.Queues) > t.Workers {
+		return len(t.Queues)
+	}
+	return t.Workers
+}
+
+// queue returns queue of i-th consumer, queues are assigned round-robin
+func (t *AMQPTransport) queue(i int) string {
+	return t.Queues[(i-1)%len(t.Queues)]
+}
+
+// consume starts i-th consumer
+func (t *AMQPTransport) consume(i int) (<-chan amqp.Delivery, error) {
+	t.connLock.RLock()
+	defer t.connLock.RUnlock()
+	return t.OutputChannel.Consume(
+		t.queue(i), // queue name
+		t.Exchange+":writer:"+strconv.Itoa(i), // consumer tag
+		false, // autoAck? (auto acknowledge delivery)
+		false, // exclusive? (there are multiple consumers)
+		false, // no-local?
+		true,  // no-wait?
+		nil,   // arguments
+	)
+}
+
+func (t *AMQPTransport) deliver(queue string, message amqp.Delivery) {
+	ctx := propagation.TraceContext{}.Extract(context.Background(), amqpHeaderCarrier(message.Headers))
+	ctx, end := t.startSpan(ctx, "consume", trace.SpanKindConsumer, len(message.Body))
+	end(t.receive(ctx, queue, message))
+}
+
+// receive decodes the message consumed from the queue and passes its
+// metrics downstream
+func (t *AMQPTransport) receive(ctx context.Context, queue string, message amqp.Delivery) error {
+	// readers decompress regardless of their own compression setting
+	if compression, ok := message.Headers[amqpCompressionHeader].(string); ok {
+		body, err := Decompress(compression, message.Body)
+		if err != nil {
+			pipelineStats.DeserializationErrors.Add("amqp", 1)
+			t.Reporter.IncErrors(1)
+			t.Reporter.IncDropped(1)
+			message.Nack(false, false)
+			t.Logger.Error("[amqp] Failed to decompress message: %v", err)
+			return err
+		}
+		message.Body = body
+	}
+
+	if message.ContentType == amqpContentTypeBatch {
+		metrics, err := DeserializeMetrics(string(message.Body))
+		if err != nil {
+			pipelineStats.DeserializationErrors.Add("amqp", 1)
+			t.Reporter.IncErrors(1)
+			t.Reporter.IncDropped(1)
+			message.Nack(false, false)
+			t.Logger.Error("[amqp] Failed to deserialize metric batch: %v", err)
+			return err
+		}
+		expiresAt := amqpExpiresAt(message)
+		for i := range metrics {
+			if !expiresAt.IsZero() {
+				metrics[i].ExpiresAt = expiresAt
+			}
+			metrics[i].Priority = message.Priority
+			if t.SourceTagging {
+				tagSource(&metrics[i], "amqp:"+queue)
+			}
+			metrics[i].SetContext(ctx)
+			t.Output <- &metrics[i]
+		}
+		t.Reporter.IncReceived(int64(len(metrics)))
+		t.Reporter.SetChannelDepth("output", int64(len(t.Output)))
+		return message.Ack(false)
+	}
+
+	// messages are decoded by their content type, so that instances
+	// with different formats can share the queue
+	format := serializationFormatFor(message.ContentType)
+	if format == nil {
+		format = t.Format
+	}
+	metric, err := format.Unmarshal(message.Body)
+	if err != nil {
+		// rejected message is routed to the dead-letter exchange if configured
+		pipelineStats.DeserializationErrors.Add("amqp", 1)
+		t.Reporter.IncErrors(1)
+		t.Reporter.IncDropped(1)
+		message.Nack(false, false)
+		t.Logger.Error("[amqp] Failed to deserialize metric: %v", err)
+		return err
+	}
+	if expiresAt := amqpExpiresAt(message); !expiresAt.IsZero() {
+		metric.ExpiresAt = expiresAt
+	}
+	metric.Priority = message.Priority
+	if t.SourceTagging {
+		tagSource(metric, "amqp:"+queue)
+	}
+	metric.SetContext(ctx)
+	t.Output <- metric
+	t.Reporter.IncReceived(1)
+	t.Reporter.SetChannelDepth("output", int64(len(t.Output)))
+	return message.Ack(false)
+}
+
+// startSpan starts span of the messaging operation when tracing is
+// enabled, the returned function ends it recording the error if any
+func (t *AMQPTransport) startSpan(ctx context.Context, operation string, kind trace.SpanKind, size int) (context.Context, func(error)) {
+	if t.Tracer == nil {
+		return ctx, endNoSpan
+	}
+	ctx, span := t.Tracer.Start(ctx, t.Exchange+" "+operation,
+		trace.WithSpanKind(kind),
+		trace.WithAttributes(
+			attribute.String("messaging.system", "rabbitmq"),
+			attribute.String("messaging.destination", t.Exchange),
+			attribute.Int("messaging.message_payload_size_bytes", size),
+		),
+	)
+	return ctx, func(err error) {
+		if err != nil {
+			span.RecordError(err)
+			span.SetStatus(codes.Error, err.Error())
+		}
+		span.End()
+	}
+}
+
+func endNoSpan(error) {}
+
+// WithTracerProvider enables OpenTelemetry spans of publish and consume
+// operations, it has to be called before Start
+func (t *AMQPTransport) WithTracerProvider(tp trace.TracerProvider) *AMQPTransport {
+	t.Tracer = tp.Tracer("github.com/blufor/metcap")
+	return t
+}
+
+// WithStatsReporter makes the transport report its events to r, it has to
+// be called before Start
+func (t *AMQPTransport) WithStatsReporter(r StatsReporter) *AMQPTransport {
+	t.Reporter = r
+	return t
+}
+
+// amqpExpiresAt returns expiry of the message given by its expiration
+// property (TTL in milliseconds), zero time when it's not set
+func amqpExpiresAt(message amqp.Delivery) time.Time {
+	if message.Expiration == "" {
+		return time.Time{}
+	}
+	ttl, err := strconv.ParseInt(message.Expiration, 10, 64)
+	if err != nil || ttl < 0 {
+		return time.Time{}
+	}
+	// TTL counts from enqueueing, which is known only with timestamp set
+	since := message.Timestamp
+	if since.IsZero() {
+		since = time.Now()
+	}
+	return since.Add(time.Duration(ttl) * time.Millisecond)
+}
+
+// amqpHeaderCarrier adapts message headers to propagation.TextMapCarrier
+type amqpHeaderCarrier amqp.Table
+
+func (c amqpHeaderCarrier) Get(key string) string {
+	value, _ := c[key].(string)
+	return value
+}
+
+func (c amqpHeaderCarrier) Set(key string, value string) {
+	c[key] = value
+}
+
+func (c amqpHeaderCarrier) Keys() []string {
+	keys := make([]string, 0, len(c))
+	for k := range c {
+		keys = append(keys, k)
+	}
+	return keys
+}
+
+// amqpRoutingKeyData is the data AMQPRoutingKeyTemplate is rendered with
+type amqpRoutingKeyData struct {
+	Name string
+	Tags map[string]string
+}
+
+func newAMQPRoutingKeyTemplate(text string) (*template.Template, error) {
+	tmpl, err := template.New("amqp_routing_key").Option("missingkey=zero").Parse(text)
+	if err != nil {
+		return nil, fmt.Errorf("invalid amqp_routing_key_template: %v", err)
+	}
+	return tmpl, nil
+}
+
+// amqpExchange is an additional exchange the metrics are published to,
+// without KeyTemplate with routing keys of the transport
+type amqpExchange struct {
+	Name        string
+	Type        string
+	KeyTemplate *template.Template
+}
+
+// RoutingKey returns the key the metric is published with, rendered from
+// KeyTemplate if there's one
+func (t *AMQPTransport) RoutingKey(m *Metric) string {
+	if t.KeyTemplate == nil {
+		return t.Key
+	}
+	var buf bytes.Buffer
+	if err := t.KeyTemplate.Execute(&buf, amqpRoutingKeyData{m.Name, m.Fields}); err != nil {
+		t.Logger.Debug("[amqp] Failed to render routing key of '%s': %v", m.Name, err)
+		return t.Key
+	}
+	return buf.String()
+}
+
+// exchangeRoutingKey returns the key the metric is published to the
+// additional exchange with
+func (t *AMQPTransport) exchangeRoutingKey(exchange amqpExchange, m *Metric) string {
+	if exchange.KeyTemplate == nil {
+		return t.RoutingKey(m)
+	}
+	var buf bytes.Buffer
+	if err := exchange.KeyTemplate.Execute(&buf, amqpRoutingKeyData{m.Name, m.Fields}); err != nil {
+		t.Logger.Debug("[amqp] Failed to render routing key of '%s' for exchange '%s': %v", m.Name, exchange.Name, err)
+		return t.Key
+	}
+	return buf.String()
+}
+
+func (t *AMQPTransport) publish(p *amqpPublisher, exchange string, key string, m *Metric) error {
+	body, err := t.Format.Marshal(m)
+	if err != nil {
+		return err
+	}
+	ctx, end := t.startSpan(m.Context(), "publish", trace.SpanKindProducer, len(body))
+	headers := amqp.Table{}
+	propagation.TraceContext{}.Inject(ctx, amqpHeaderCarrier(headers))
+	err = t.publishBody(p, exchange, key, m.Priority, t.Format.ContentType(), body, headers)
+	end(err)
+	return err
+}
+
+// publishBatch publishes the metrics in one message, which can't carry
+// their trace contexts, so its span has no parent; it gets the highest
+// priority of the metrics
+func (t *AMQPTransport) publishBatch(p *amqpPublisher, exchange string, key string, batch []*Metric) error {
+	var priority uint8
+	for _, m := range batch {
+		if m.Priority > priority {
+			priority = m.Priority
+		}
+	}
+	body := SerializeMetrics(batch)
+	ctx, end := t.startSpan(context.Background(), "publish", trace.SpanKindProducer, len(body))
+	headers := amqp.Table{}
+	propagation.TraceContext{}.Inject(ctx, amqpHeaderCarrier(headers))
+	err := t.publishBody(p, exchange, key, priority, amqpContentTypeBatch, body, headers)
+	end(err)
+	return err
+}
+
+// publishBody publishes the message on the publisher, nil means the
+// shared one; with publisher confirms it waits for the broker to confirm
+// it and retries up to MaxRetries times
+func (t *AMQPTransport) publishBody(p *amqpPublisher, exchange string, key string, priority uint8, contentType string, body []byte, headers amqp.Table) error {
+	body, err := Compress(t.Compression, body)
+	if err != nil {
+		return err
+	}
+	if t.Compression != CompressionNone {
+		headers[amqpCompressionHeader] = t.Compression
+	}
+
+	if !t.PublisherConfirms {
+		return t.publishMessage(p, exchange, key, priority, contentType, body, headers)
+	}
+
+	// metrics drained on exit still get their retries
+	retry := writerRetryPolicy(t.MaxRetries)
+	retry.OnRetry = func(attempt int, delay time.Duration, err error) {
+		t.Logger.Debug("[amqp] Retrying publish (%d/%d) in %v: %v", attempt, t.MaxRetries, delay, err)
+	}
+	return retry.Do(context.Background(), func() error {
+		return t.publishConfirmed(p, exchange, key, priority, contentType, body, headers)
+	})
+}
+
+// publishConfirmed publishes the message and waits for its confirmation;
+// publishes are serialized so that confirmations match the messages
+func (t *AMQPTransport) publishConfirmed(p *amqpPublisher, exchange string, key string, priority uint8, contentType string, body []byte, headers amqp.Table) error {
+	t.connLock.RLock()
+	defer t.connLock.RUnlock()
+	if p == nil {
+		p = t.publisher
+	}
+	p.lock.Lock()
+	defer p.lock.Unlock()
+
+	if p.confirms == nil {
+		return fmt.Errorf("channel not in confirm mode")
+	}
+	if err := t.publishMessage(p, exchange, key, priority, contentType, body, headers); err != nil {
+		return err
+	}
+	p.deliveryTag++
+
+	timeout := time.After(t.ConfirmTimeout)
+	for {
+		select {
+		case confirm, ok := <-p.confirms:
+			if !ok {
+				p.confirms = nil
+				return fmt.Errorf("channel closed before confirmation")
+			}
+			if confirm.DeliveryTag < p.deliveryTag {
+				// confirmation of the message that already timed out
+				continue
+			}
+			if !confirm.Ack {
+				return fmt.Errorf("message rejected by broker")
+			}
+			return nil
+		case <-timeout:
+			return fmt.Errorf("confirmation timed out after %v", t.ConfirmTimeout)
+		}
+	}
+}
+
+// publishMessage publishes the message on the publisher (nil means the
+// shared one), connLock is taken by the caller when publisher confirms are
+// enabled
+func (t *AMQPTransport) publishMessage(p *amqpPublisher, exchange string, key string, priority uint8, contentType string, body []byte, headers amqp.Table) error {
+	if !t.PublisherConfirms {
+		t.connLock.RLock()
+		defer t.connLock.RUnlock()
+	}
+	if p == nil {
+		p = t.publisher
+	}
+	return p.channel.Publish(
+		exchange, // exchange
+		key,      // routing key
+		false,    // mandatory?
+		false,    // immediate?
 		amqp.Publishing{ // message definition
-			Headers:         amqp.Table{},          // AMQP message headers
-			ContentType:     "application/msgpack", // content type
-			ContentEncoding: "UTF-8",               // encoding
-			Body:            m.Serialize(),         // serialized metric data
-			DeliveryMode:    amqp.Transient,        // AMQP message delivery mode
-			Priority:        0,                     // AMQP message priority
+			Headers:         headers,        // AMQP message headers
+			ContentType:     contentType,    // content type
+			ContentEncoding: "UTF-8",        // encoding
+			Body:            body,           // serialized metric data
+			DeliveryMode:    amqp.Transient, // AMQP message delivery mode
+			Priority:        priority,       // AMQP message priority
 		},
 	)
 }
 
+// produce publishes metrics from the input channel, either one by one
+// or in batches when batching is enabled, until ctx is cancelled
+func (t *AMQPTransport) produce(ctx context.Context) {
+	var (
+		batch []*Metric
+		tick  <-chan time.Time // stays nil (blocking) unless batching
+	)
+
+	// producer's own channel with ChannelPerProducer, nil is the shared one
+	var own *amqpPublisher
+	defer func() {
+		if own != nil {
+			own.channel.Close()
+		}
+	}()
+
+	// send publishes n metrics to the exchange by fn and updates stats by
+	// the result, failures don't stop publishing to other exchanges
+	send := func(exchange string, n int, fn func(p *amqpPublisher) error) {
+		t0 := time.Now()
+		var err error
+		if t.ChannelPerProducer {
+			own, err = t.producerPublisher(own)
+		}
+		if err == nil {
+			err = fn(own)
+		}
+		if err != nil {
+			pipelineStats.Dropped.Add("publish_failed", n)
+			t.Reporter.IncErrors(1)
+			t.Reporter.IncDropped(int64(n))
+			t.Logger.Error("[amqp] Failed to publish %d metrics to '%s': %v", n, exchange, err)
+			return
+		}
+		pipelineStats.PublishDuration.Observe(time.Since(t0))
+		pipelineStats.Published.Add("amqp", n)
+		t.Reporter.IncPublished(int64(n))
+	}
+
+	// publish publishes the batch in one message per routing key rendered
+	// by routingKey
+	publish := func(exchange string, routingKey func(*Metric) string, batch []*Metric) {
+		var keys []string
+		batches := make(map[string][]*Metric)
+		for _, m := range batch {
+			key := routingKey(m)
+			if _, ok := batches[key]; !ok {
+				keys = append(keys, key)
+			}
+			batches[key] = append(batches[key], m)
+		}
+		for _, key := range keys {
+			key := key
+			send(exchange, len(batches[key]), func(p *amqpPublisher) error {
+				return t.publishBatch(p, exchange, key, batches[key])
+			})
+		}
+	}
+
+	flush := func() {
+		if len(batch) == 0 {
+			return
+		}
+		defer func() { batch = batch[:0] }()
+		publish(t.Exchange, t.RoutingKey, batch)
+		for _, exchange := range t.Exchanges {
+			exchange := exchange
+			publish(exchange.Name, func(m *Metric) string { return t.exchangeRoutingKey(exchange, m) }, batch)
+		}
+	}
+
+	add := func(m *Metric) {
+		if t.BatchSize <= 1 {
+			send(t.Exchange, 1, func(p *amqpPublisher) error {
+				return t.publish(p, t.Exchange, t.RoutingKey(m), m)
+			})
+			for _, exchange := range t.Exchanges {
+				exchange := exchange
+				send(exchange.Name, 1, func(p *amqpPublisher) error {
+					return t.publish(p, exchange.Name, t.exchangeRoutingKey(exchange, m), m)
+				})
+			}
+			return
+		}
+		batch = append(batch, m)
+		if len(batch) >= t.BatchSize {
+			flush()
+		}
+	}
+
+	if t.BatchSize > 1 {
+		batch = make([]*Metric, 0, t.BatchSize)
+		ticker := time.NewTicker(t.BatchTimeout)
+		defer ticker.Stop()
+		tick = ticker.C
+	}
+
+	for {
+		select {
+		case m := <-t.Input:
+			t.Reporter.SetChannelDepth("input", int64(len(t.Input)))
+			add(m)
+		case <-tick:
+			flush()
+		case <-ctx.Done():
+			time.Sleep(1 * time.Second)
+			// the other producers drain the input too, it may be empty
+			// by the time of receive
+			for {
+				select {
+				case m := <-t.Input:
+					add(m)
+				default:
+					flush()
+					return
+				}
+			}
+		}
+	}
+}
+
 func (t *AMQPTransport) Start() {
+	ctx, cancel := context.WithCancel(context.Background())
 
 	if t.ListenerEnabled {
 		for producerCount := 1; producerCount <= t.Workers; producerCount++ {
+			t.Wg.Add(1)
+			atomic.AddInt32(&t.producing, 1)
 			go func(i int) {
-				t.Wg.Add(1)
 				defer t.Wg.Done()
-				for {
-					select {
-					case m := <-t.Input:
-						err := t.publish(m)
-						if err != nil {
-							t.Logger.Error("[amqp] Failed to publish metric: %v", err)
-						}
-					case <-t.ExitChan:
-						time.Sleep(1 * time.Second)
-						for m := range t.Input {
-							err := t.publish(m)
-							if err != nil {
-								t.Logger.Error("[amqp] Failed to publish metric: %v", err)
-							}
-						}
-						return
-					}
-				}
+				defer atomic.AddInt32(&t.producing, -1)
+				t.produce(ctx)
 			}(producerCount)
 		}
 	}
 
 	if t.WriterEnabled {
-		for consumerCount := 1; consumerCount <= t.Workers; consumerCount++ {
+		for consumerCount := 1; consumerCount <= t.consumers(); consumerCount++ {
+			t.Wg.Add(1)
+			atomic.AddInt32(&t.consuming, 1)
 			go func(i int) {
-				t.Wg.Add(1)
 				defer t.Wg.Done()
-				delivery, err := t.OutputChannel.Consume(
-					t.Exchange, // queue name
-					t.Exchange+":writer:"+strconv.Itoa(i), // consumer tag
-					false, // autoAck? (auto acknowledge delivery)
-					false, // exclusive? (there are multiple consumers)
-					false, // no-local?
-					true,  // no-wait?
-					nil,   // arguments
-				)
-				if err != nil {
-					t.Logger.Error("[amqp] Failed to setup delivery channel: %v", err)
-				}
+				defer atomic.AddInt32(&t.consuming, -1)
 				for {
-					select {
-					case message := <-delivery:
-						metric, err := DeserializeMetric(string(message.Body))
-						if err != nil {
-							message.Nack(false, false)
-							t.Logger.Error("[amqp] Failed to deserialize metric: %v", err)
-						} else {
-							t.Output <- &metric
-							message.Ack(false)
-						}
-					case <-t.ExitChan:
-						for message := range delivery { // drain delivery channel
-							metric, err := DeserializeMetric(string(message.Body))
-							if err != nil {
-								message.Nack(false, false)
-								t.Logger.Error("[amqp] Failed to deserialize metric: %v", err)
-							} else {
-								t.Output <- &metric
-								message.Ack(false)
-							}
+					delivery, err := t.consume(i)
+					if err != nil {
+						if t.ExitFlag.Get() {
+							return
 						}
+						t.Logger.Error("[amqp] Failed to setup delivery channel: %v", err)
+						t.Reporter.IncErrors(1)
+						time.Sleep(1 * time.Second)
+						continue
+					}
+					// delivery channel gets closed on shutdown or on connection loss
+					for message := range delivery {
+						t.deliver(t.queue(i), message)
+					}
+					if t.ExitFlag.Get() {
 						return
 					}
 				}
@@ -233,33 +1184,59 @@ func (t *AMQPTransport) Start() {
 		}
 	}
 
-	go func() {
-		goroutines := 0
+	t.connLock.RLock()
+	if t.ListenerEnabled {
+		go t.watchChannel(t.InputChannel)
+	}
+	if t.WriterEnabled {
+		go t.watchChannel(t.OutputChannel)
+	}
+	t.connLock.RUnlock()
+
+	if t.ShareConnection {
+		go t.watchShared()
+	} else {
 		if t.ListenerEnabled {
-			goroutines += t.Workers
+			go t.watch(true)
 		}
 		if t.WriterEnabled {
-			goroutines += t.Workers
+			go t.watch(false)
 		}
+	}
 
-		for {
-			switch {
-			case t.ExitFlag.Get():
-				t.OutputChannel.Close()
-				for i := 0; i < goroutines; i++ {
-					t.ExitChan <- true
-				}
-				t.Wg.Wait()
-				return
-			default:
-				time.Sleep(10 * time.Millisecond)
-			}
+	go func() {
+		<-t.ExitFlag.Done()
+		if t.WriterEnabled {
+			t.connLock.RLock()
+			t.OutputChannel.Close()
+			t.connLock.RUnlock()
 		}
+		cancel()
 	}()
 }
 
 func (t *AMQPTransport) Stop() {
 	t.Wg.Wait()
+	t.close()
+}
+
+// StopWithTimeout implements GracefulStopper, the connections are left
+// open when the goroutines don't finish in time
+func (t *AMQPTransport) StopWithTimeout(ctx context.Context) error {
+	if err := waitContext(ctx, t.Wg); err != nil {
+		t.Logger.Warn("[amqp] Stop timed out with %d producers and %d consumers still running",
+			atomic.LoadInt32(&t.producing),
+			atomic.LoadInt32(&t.consuming),
+		)
+		return err
+	}
+	t.close()
+	return nil
+}
+
+func (t *AMQPTransport) close() {
+	t.connLock.Lock()
+	defer t.connLock.Unlock()
 	if t.ListenerEnabled {
 		// close(t.Input)
 		t.InputChannel.Close()
@@ -268,7 +1245,9 @@ func (t *AMQPTransport) Stop() {
 	if t.WriterEnabled {
 		// close(t.Output)
 		t.OutputChannel.Close()
-		t.OutputConn.Close()
+		if !t.ShareConnection {
+			t.OutputConn.Close()
+		}
 	}
 }
 
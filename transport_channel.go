@@ -1,5 +1,16 @@
 package metcap
 
+import "fmt"
+
+func init() {
+	RegisterTransport("channel", func(c *TransportConfig, listenerEnabled bool, writerEnabled bool, exitFlag *Flag, logger *Logger) (Transport, error) {
+		if !listenerEnabled || !writerEnabled {
+			return nil, &TransportError{"channel", fmt.Errorf("channel transport requires you to have both listener and writer enabled")}
+		}
+		return NewChannelTransport(c, logger), nil
+	})
+}
+
 type ChannelTransport struct {
 	Size   int
 	Chan   chan *Metric
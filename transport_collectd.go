@@ -0,0 +1,441 @@
+package metcap
+
+import (
+	"bufio"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/hmac"
+	"crypto/sha1"
+	"crypto/sha256"
+	"encoding/binary"
+	"fmt"
+	"math"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// collectd binary protocol part types
+const (
+	collectdHost           = 0x0000
+	collectdTime           = 0x0001
+	collectdPlugin         = 0x0002
+	collectdPluginInstance = 0x0003
+	collectdType           = 0x0004
+	collectdTypeInstance   = 0x0005
+	collectdValues         = 0x0006
+	collectdTimeHR         = 0x0008
+	collectdSignature      = 0x0200
+	collectdEncryption     = 0x0210
+)
+
+// collectd data source types
+const (
+	collectdCounter  = 0
+	collectdGauge    = 1
+	collectdDerive   = 2
+	collectdAbsolute = 3
+)
+
+// collectdLevels of security, values of parts below the level are rejected
+var collectdLevels = map[string]int{
+	"none":    0,
+	"sign":    1,
+	"encrypt": 2,
+}
+
+func init() {
+	RegisterTransport("collectd", func(c *TransportConfig, listenerEnabled bool, writerEnabled bool, exitFlag *Flag, logger *Logger) (Transport, error) {
+		if !writerEnabled {
+			return nil, &TransportError{"collectd", fmt.Errorf("collectd transport requires you to have writer enabled")}
+		}
+		return NewCollectdTransport(c, exitFlag, logger)
+	})
+}
+
+// CollectdTransport receives packets of collectd network plugin and hands
+// each value list over to the writer as metric named by its plugin, tagged
+// by "host", "plugin_instance", "type" and "type_instance". Value lists
+// with more values (e.g. load) get the first one as value and all of them
+// as "value0", "value1"... fields. Signed and encrypted packets are
+// verified with credentials of the Users, SecurityLevel says which of them
+// are accepted the same way as collectd does.
+type CollectdTransport struct {
+	Socket        net.PacketConn
+	SecurityLevel int
+	Users         map[string]string
+	Size          int
+	Chan          chan *Metric
+	ExitFlag      *Flag
+	Wg            *sync.WaitGroup
+	Logger        *Logger
+	Stats         *CollectdTransportStats
+}
+
+// NewCollectdTransport
+func NewCollectdTransport(c *TransportConfig, exitFlag *Flag, logger *Logger) (*CollectdTransport, error) {
+	if c.BufferSize == 0 {
+		c.BufferSize = 1000
+	}
+
+	if c.CollectdListenAddr == "" {
+		c.CollectdListenAddr = ":25826"
+	}
+
+	if c.CollectdSecurityLevel == "" {
+		c.CollectdSecurityLevel = "None"
+	}
+
+	level, ok := collectdLevels[strings.ToLower(c.CollectdSecurityLevel)]
+	if !ok {
+		return nil, &TransportError{"collectd", fmt.Errorf("unknown collectd_security_level '%s'", c.CollectdSecurityLevel)}
+	}
+
+	users := make(map[string]string)
+	if c.CollectdAuthFile != "" {
+		var err error
+		if users, err = loadCollectdUsers(c.CollectdAuthFile); err != nil {
+			return nil, &TransportError{"collectd", err}
+		}
+	} else if level > 0 {
+		return nil, &TransportError{"collectd", fmt.Errorf("collectd_auth_file is required by collectd_security_level '%s'", c.CollectdSecurityLevel)}
+	}
+
+	sock, err := net.ListenPacket("udp", c.CollectdListenAddr)
+	if err != nil {
+		return nil, &TransportError{"collectd", err}
+	}
+
+	return &CollectdTransport{
+		Socket:        sock,
+		SecurityLevel: level,
+		Users:         users,
+		Size:          c.BufferSize,
+		Chan:          make(chan *Metric, c.BufferSize),
+		ExitFlag:      exitFlag,
+		Wg:            &sync.WaitGroup{},
+		Logger:        logger,
+		Stats:         NewCollectdTransportStats(),
+	}, nil
+}
+
+// loadCollectdUsers reads "user: password" lines of collectd AuthFile
+func loadCollectdUsers(path string) (map[string]string, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	users := make(map[string]string)
+	scn := bufio.NewScanner(f)
+	for n := 1; scn.Scan(); n++ {
+		line := strings.TrimSpace(scn.Text())
+		if line == "" || line[0] == '#' {
+			continue
+		}
+		kv := strings.SplitN(line, ":", 2)
+		if len(kv) != 2 {
+			return nil, fmt.Errorf("%s:%d: expected 'user: password'", path, n)
+		}
+		users[strings.TrimSpace(kv[0])] = strings.TrimSpace(kv[1])
+	}
+	return users, scn.Err()
+}
+
+// collectdValueList is state of the packet, parts set it for the next ones
+type collectdValueList struct {
+	host           string
+	plugin         string
+	pluginInstance string
+	typ            string
+	typeInstance   string
+	timestamp      time.Time
+}
+
+func (v *collectdValueList) metric(values []float64) *Metric {
+	m := &Metric{
+		Name:      v.plugin,
+		Timestamp: v.timestamp,
+		Value:     values[0],
+		Fields:    map[string]string{"type": v.typ},
+		Values:    make(map[string]interface{}),
+		OK:        true,
+	}
+	if v.timestamp.IsZero() {
+		m.Timestamp = time.Now()
+	}
+	if v.host != "" {
+		m.Fields["host"] = v.host
+	}
+	if v.pluginInstance != "" {
+		m.Fields["plugin_instance"] = v.pluginInstance
+	}
+	if v.typeInstance != "" {
+		m.Fields["type_instance"] = v.typeInstance
+	}
+	if len(values) > 1 {
+		for i, value := range values {
+			m.Values["value"+strconv.Itoa(i)] = value
+		}
+	}
+	return m
+}
+
+// collectdString returns null terminated string of the part
+func collectdString(part []byte) (string, error) {
+	if len(part) == 0 || part[len(part)-1] != 0 {
+		return "", fmt.Errorf("string part isn't null terminated")
+	}
+	return string(part[:len(part)-1]), nil
+}
+
+// collectdNumbers returns values of the values part
+func collectdNumbers(part []byte) ([]float64, error) {
+	if len(part) < 2 {
+		return nil, fmt.Errorf("truncated values part")
+	}
+	n := int(binary.BigEndian.Uint16(part))
+	if n == 0 || len(part) != 2+n*9 {
+		return nil, fmt.Errorf("invalid values part of %d values", n)
+	}
+	types, data := part[2:2+n], part[2+n:]
+	values := make([]float64, n)
+	for i, t := range types {
+		raw := data[i*8 : i*8+8]
+		switch t {
+		case collectdCounter, collectdAbsolute:
+			values[i] = float64(binary.BigEndian.Uint64(raw))
+		case collectdGauge:
+			values[i] = math.Float64frombits(binary.LittleEndian.Uint64(raw))
+		case collectdDerive:
+			values[i] = float64(int64(binary.BigEndian.Uint64(raw)))
+		default:
+			return nil, fmt.Errorf("unknown data source type %d", t)
+		}
+	}
+	return values, nil
+}
+
+// Parse returns metrics of the packet, values of parts that aren't signed
+// or encrypted as required by SecurityLevel are an error
+func (t *CollectdTransport) Parse(packet []byte) ([]*Metric, error) {
+	return t.parse(packet, 0)
+}
+
+func (t *CollectdTransport) parse(b []byte, level int) ([]*Metric, error) {
+	var (
+		metrics []*Metric
+		vl      collectdValueList
+		err     error
+	)
+	for len(b) > 0 {
+		if len(b) < 4 {
+			return metrics, fmt.Errorf("truncated part header")
+		}
+		typ, length := binary.BigEndian.Uint16(b), int(binary.BigEndian.Uint16(b[2:]))
+		if length < 4 || length > len(b) {
+			return metrics, fmt.Errorf("invalid length %d of part %#04x", length, typ)
+		}
+		part, rest := b[4:length], b[length:]
+
+		switch typ {
+		case collectdHost:
+			vl.host, err = collectdString(part)
+		case collectdPlugin:
+			vl.plugin, err = collectdString(part)
+		case collectdPluginInstance:
+			vl.pluginInstance, err = collectdString(part)
+		case collectdType:
+			vl.typ, err = collectdString(part)
+		case collectdTypeInstance:
+			vl.typeInstance, err = collectdString(part)
+		case collectdTime, collectdTimeHR:
+			if len(part) != 8 {
+				return metrics, fmt.Errorf("invalid time part")
+			}
+			ts := binary.BigEndian.Uint64(part)
+			if typ == collectdTime {
+				vl.timestamp = time.Unix(int64(ts), 0)
+			} else {
+				// 2^-30 seconds
+				vl.timestamp = time.Unix(int64(ts>>30), int64((ts&(1<<30-1))*1e9>>30))
+			}
+		case collectdValues:
+			if level < t.SecurityLevel {
+				return metrics, fmt.Errorf("values aren't protected as required by collectd_security_level")
+			}
+			var values []float64
+			if values, err = collectdNumbers(part); err == nil {
+				metrics = append(metrics, vl.metric(values))
+			}
+		case collectdSignature:
+			if err = t.verify(part, rest); err == nil && level < 1 {
+				level = 1
+			}
+		case collectdEncryption:
+			var plain []byte
+			if plain, err = t.decrypt(part); err == nil {
+				var decrypted []*Metric
+				decrypted, err = t.parse(plain, 2)
+				metrics = append(metrics, decrypted...)
+			}
+		}
+		if err != nil {
+			return metrics, err
+		}
+		b = rest
+	}
+	return metrics, nil
+}
+
+// verify checks HMAC-SHA256 of the signature part, signing user name
+// followed by the rest of the packet
+func (t *CollectdTransport) verify(part []byte, rest []byte) error {
+	if len(part) <= sha256.Size {
+		return fmt.Errorf("truncated signature part")
+	}
+	user := part[sha256.Size:]
+	password, ok := t.Users[string(user)]
+	if !ok {
+		return fmt.Errorf("unknown user '%s'", user)
+	}
+	mac := hmac.New(sha256.New, []byte(password))
+	mac.Write(user)
+	mac.Write(rest)
+	if !hmac.Equal(mac.Sum(nil), part[:sha256.Size]) {
+		return fmt.Errorf("invalid signature of user '%s'", user)
+	}
+	return nil
+}
+
+// decrypt returns packet of the encryption part, encrypted by AES-256 in
+// OFB mode with SHA256 of the password and prefixed by its SHA1
+func (t *CollectdTransport) decrypt(part []byte) ([]byte, error) {
+	if len(part) < 2 {
+		return nil, fmt.Errorf("truncated encryption part")
+	}
+	n := int(binary.BigEndian.Uint16(part))
+	if len(part) < 2+n+aes.BlockSize+sha1.Size {
+		return nil, fmt.Errorf("truncated encryption part")
+	}
+	user := string(part[2 : 2+n])
+	password, ok := t.Users[user]
+	if !ok {
+		return nil, fmt.Errorf("unknown user '%s'", user)
+	}
+	iv, data := part[2+n:2+n+aes.BlockSize], part[2+n+aes.BlockSize:]
+
+	key := sha256.Sum256([]byte(password))
+	block, err := aes.NewCipher(key[:])
+	if err != nil {
+		return nil, err
+	}
+	plain := make([]byte, len(data))
+	cipher.NewOFB(block, iv).XORKeyStream(plain, data)
+
+	sum := sha1.Sum(plain[sha1.Size:])
+	if !hmac.Equal(sum[:], plain[:sha1.Size]) {
+		return nil, fmt.Errorf("failed to decrypt packet of user '%s'", user)
+	}
+	return plain[sha1.Size:], nil
+}
+
+func (t *CollectdTransport) decode(data []byte, addr net.Addr) {
+	metrics, err := t.Parse(data)
+	for _, m := range metrics {
+		t.Chan <- m
+	}
+	t.Stats.Received.Increment(len(metrics))
+	pipelineStats.Received.Add("collectd", len(metrics))
+	if err != nil {
+		t.Stats.Failed.Increment(1)
+		pipelineStats.Dropped.Add("decode", 1)
+		t.Logger.Debug("[collectd] %s: %v", addr.String(), err)
+	}
+}
+
+func (t *CollectdTransport) Start() {
+	t.Logger.Info("[collectd] Reading packets on %s", t.Socket.LocalAddr().String())
+
+	t.Wg.Add(1)
+	go func() {
+		defer t.Wg.Done()
+		buf := make([]byte, 64*1024)
+		for {
+			n, addr, err := t.Socket.ReadFrom(buf)
+			if err != nil {
+				if t.ExitFlag.Get() {
+					return
+				}
+				t.Logger.Error("[collectd] Failed to read packet: %v", err)
+				continue
+			}
+			t.decode(buf[:n], addr)
+		}
+	}()
+
+	go func() {
+		<-t.ExitFlag.Done()
+		t.Socket.Close()
+	}()
+}
+
+func (t *CollectdTransport) Stop() {
+	t.Wg.Wait()
+}
+
+func (t *CollectdTransport) CloseOutput() {
+	return
+}
+
+func (t *CollectdTransport) CloseInput() {
+	return
+}
+
+func (t *CollectdTransport) InputChan() chan<- *Metric {
+	return t.Chan
+}
+
+func (t *CollectdTransport) OutputChan() <-chan *Metric {
+	return t.Chan
+}
+
+func (t *CollectdTransport) InputChanLen() int {
+	return len(t.Chan)
+}
+
+func (t *CollectdTransport) OutputChanLen() int {
+	return len(t.Chan)
+}
+
+func (t *CollectdTransport) LogReport() {
+	t.Logger.Info("[transport] collectd: %d/%d (length/capacity), metrics: %d/%d/%.3f (total_received/failed_packets/rate_per_sec)",
+		len(t.Chan),
+		t.Size,
+		t.Stats.Received.Total(),
+		t.Stats.Failed.Total(),
+		t.Stats.Received.Rate(time.Second),
+	)
+}
+
+type CollectdTransportStats struct {
+	Received *StatsCounter
+	Failed   *StatsCounter
+}
+
+func NewCollectdTransportStats() *CollectdTransportStats {
+	now := time.Now()
+	return &CollectdTransportStats{
+		Received: NewStatsCounter(now),
+		Failed:   NewStatsCounter(now),
+	}
+}
+
+func (s *CollectdTransportStats) Reset() {
+	s.Received.Reset()
+	s.Failed.Reset()
+}
@@ -0,0 +1,189 @@
+package metcap
+
+import (
+	"bufio"
+	"compress/gzip"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+func init() {
+	RegisterTransport("file", func(c *TransportConfig, listenerEnabled bool, writerEnabled bool, exitFlag *Flag, logger *Logger) (Transport, error) {
+		if !writerEnabled {
+			return nil, &TransportError{"file", fmt.Errorf("file transport requires you to have writer enabled")}
+		}
+		return NewFileReader(c, exitFlag, logger)
+	})
+}
+
+// FileReader replays line protocol metrics from a file (gzipped if it ends
+// with ".gz"), e.g. one written by FileWriter, to the writer. Metrics are
+// sent at Rate per second, as fast as possible if it's 0.
+type FileReader struct {
+	Path     string
+	Rate     float64
+	Size     int
+	Chan     chan *Metric
+	ExitFlag *Flag
+	Wg       *sync.WaitGroup
+	Logger   *Logger
+	Stats    *FileReaderStats
+}
+
+// NewFileReader
+func NewFileReader(c *TransportConfig, exitFlag *Flag, logger *Logger) (*FileReader, error) {
+	if c.BufferSize == 0 {
+		c.BufferSize = 1000
+	}
+
+	if c.ReplayRate < 0 {
+		return nil, &TransportError{"file", fmt.Errorf("replay_rate can't be negative")}
+	}
+
+	if _, err := os.Stat(c.ReplayPath); err != nil {
+		return nil, &TransportError{"file", err}
+	}
+
+	return &FileReader{
+		Path:     c.ReplayPath,
+		Rate:     c.ReplayRate,
+		Size:     c.BufferSize,
+		Chan:     make(chan *Metric, c.BufferSize),
+		ExitFlag: exitFlag,
+		Wg:       &sync.WaitGroup{},
+		Logger:   logger,
+		Stats:    NewFileReaderStats(),
+	}, nil
+}
+
+func (t *FileReader) open() (io.ReadCloser, error) {
+	f, err := os.Open(t.Path)
+	if err != nil {
+		return nil, err
+	}
+	if !strings.HasSuffix(t.Path, ".gz") {
+		return f, nil
+	}
+	zr, err := gzip.NewReader(f)
+	if err != nil {
+		f.Close()
+		return nil, err
+	}
+	return struct {
+		io.Reader
+		io.Closer
+	}{zr, f}, nil
+}
+
+func (t *FileReader) Start() {
+	t.Logger.Info("[file] Replaying metrics from %s", t.Path)
+
+	t.Wg.Add(1)
+	go func() {
+		defer t.Wg.Done()
+		r, err := t.open()
+		if err != nil {
+			t.Logger.Error("[file] Failed to open %s: %v", t.Path, err)
+			return
+		}
+		defer r.Close()
+
+		start, n := time.Now(), 0
+		scn := bufio.NewScanner(r)
+		scn.Buffer(make([]byte, 64*1024), 1024*1024)
+		for scn.Scan() {
+			if t.ExitFlag.Get() {
+				return
+			}
+			line := strings.TrimSpace(scn.Text())
+			if line == "" || line[0] == '#' {
+				continue
+			}
+			m, err := ParseLineProtocol(line)
+			if err != nil {
+				t.Stats.Failed.Increment(1)
+				pipelineStats.Dropped.Add("decode", 1)
+				t.Logger.Debug("[file] %v", err)
+				continue
+			}
+			t.Chan <- m
+			t.Stats.Received.Increment(1)
+			pipelineStats.Received.Add("file", 1)
+			n++
+
+			// keep the pace by the total count, so sleeping granularity
+			// doesn't slow down high rates
+			if t.Rate > 0 {
+				due := start.Add(time.Duration(float64(n) / t.Rate * float64(time.Second)))
+				if wait := time.Until(due); wait > 0 {
+					time.Sleep(wait)
+				}
+			}
+		}
+		if err := scn.Err(); err != nil {
+			t.Logger.Error("[file] Failed to read %s: %v", t.Path, err)
+			return
+		}
+		t.Logger.Info("[file] Replay of %s finished, %d metrics", t.Path, n)
+	}()
+}
+
+func (t *FileReader) Stop() {
+	t.Wg.Wait()
+}
+
+func (t *FileReader) CloseOutput() {
+	return
+}
+
+func (t *FileReader) CloseInput() {
+	return
+}
+
+func (t *FileReader) InputChan() chan<- *Metric {
+	return t.Chan
+}
+
+func (t *FileReader) OutputChan() <-chan *Metric {
+	return t.Chan
+}
+
+func (t *FileReader) InputChanLen() int {
+	return len(t.Chan)
+}
+
+func (t *FileReader) OutputChanLen() int {
+	return len(t.Chan)
+}
+
+func (t *FileReader) LogReport() {
+	t.Logger.Info("[transport] file: %d/%d (length/capacity), metrics: %d/%d/%.3f (total_received/failed/rate_per_sec)",
+		len(t.Chan),
+		t.Size,
+		t.Stats.Received.Total(),
+		t.Stats.Failed.Total(),
+		t.Stats.Received.Rate(time.Second),
+	)
+}
+
+type FileReaderStats struct {
+	Received *StatsCounter
+	Failed   *StatsCounter
+}
+
+func NewFileReaderStats() *FileReaderStats {
+	now := time.Now()
+	return &FileReaderStats{
+		Received: NewStatsCounter(now),
+		Failed:   NewStatsCounter(now),
+	}
+}
+
+func (s *FileReaderStats) Reset() {
+	s.Received.Reset()
+	s.Failed.Reset()
+}
@@ -0,0 +1,347 @@
+package metcap
+
+import (
+	"fmt"
+	"sort"
+	"sync"
+)
+
+// TransportGraph is a transport made of named transports connected by
+// edges, output of each transport is fed to inputs of all the transports
+// its edges lead to, e.g. to consume from one broker and publish to
+// another. Metrics written to the graph go to every transport without
+// incoming edges (sources), outputs of transports without outgoing edges
+// (sinks) are merged into the output of the graph. On exit the transports
+// are stopped in topological order, each one only after everything
+// upstream of it was flushed into it.
+type TransportGraph struct {
+	Transports      map[string]Transport
+	Configs         map[string]TransportConfig
+	Edges           []PipelineEdge
+	Sources         []string
+	Sinks           []string
+	Order           []string
+	Size            int
+	ListenerEnabled bool
+	WriterEnabled   bool
+	Input           chan *Metric
+	Output          chan *Metric
+	ExitFlag        *Flag
+	Logger          *Logger
+	targets         map[string][]string
+	flags           map[string]*Flag
+	inputExit       chan struct{}
+	inputWg         *sync.WaitGroup
+	forwardExit     map[string]chan struct{}
+	forwardWg       map[string]*sync.WaitGroup
+	mergeExit       chan struct{}
+	mergeWg         *sync.WaitGroup
+	stopped         chan struct{}
+	shutdownOnce    *sync.Once
+}
+
+// NewTransportGraph
+func NewTransportGraph(c *PipelineConfig, listenerEnabled bool, writerEnabled bool, exitFlag *Flag, logger *Logger) (*TransportGraph, error) {
+	if c.BufferSize == 0 {
+		c.BufferSize = 1000
+	}
+
+	if len(c.Transports) == 0 {
+		return nil, &TransportError{"pipeline", fmt.Errorf("no transports configured")}
+	}
+
+	g := &TransportGraph{
+		Transports:      make(map[string]Transport),
+		Configs:         make(map[string]TransportConfig),
+		Edges:           c.Edges,
+		Size:            c.BufferSize,
+		ListenerEnabled: listenerEnabled,
+		WriterEnabled:   writerEnabled,
+		Input:           make(chan *Metric, c.BufferSize),
+		Output:          make(chan *Metric, c.BufferSize),
+		ExitFlag:        exitFlag,
+		Logger:          logger,
+		targets:         make(map[string][]string),
+		flags:           make(map[string]*Flag),
+		inputExit:       make(chan struct{}),
+		inputWg:         &sync.WaitGroup{},
+		forwardExit:     make(map[string]chan struct{}),
+		forwardWg:       make(map[string]*sync.WaitGroup),
+		mergeExit:       make(chan struct{}),
+		mergeWg:         &sync.WaitGroup{},
+		stopped:         make(chan struct{}),
+		shutdownOnce:    &sync.Once{},
+	}
+
+	for name, cfg := range c.Transports {
+		if cfg.BufferSize == 0 {
+			cfg.BufferSize = c.BufferSize
+		}
+		g.Configs[name] = cfg
+	}
+
+	inputs := make(map[string]int)
+	for _, edge := range c.Edges {
+		for _, name := range []string{edge.From, edge.To} {
+			if _, ok := c.Transports[name]; !ok {
+				return nil, &TransportError{"pipeline", fmt.Errorf("edge %s -> %s refers to unknown transport '%s'", edge.From, edge.To, name)}
+			}
+		}
+		g.targets[edge.From] = append(g.targets[edge.From], edge.To)
+		inputs[edge.To]++
+	}
+	for name := range c.Transports {
+		if inputs[name] == 0 {
+			g.Sources = append(g.Sources, name)
+		}
+		if len(g.targets[name]) == 0 {
+			g.Sinks = append(g.Sinks, name)
+		}
+	}
+	sort.Strings(g.Sources)
+	sort.Strings(g.Sinks)
+
+	// wiring is checked before any transport connects anywhere
+	p := &Pipeline{
+		nodes:   make(map[string]NodeRole),
+		edges:   make(map[string][]string),
+		labels:  make(map[string]string),
+		outputs: make(map[string]<-chan *Metric),
+	}
+	p.addGraph(g)
+	p.AddNode("writer", NodeSink)
+	for _, name := range g.Sinks {
+		p.Connect(graphNode(name), "writer")
+	}
+	if err := p.Validate(); err != nil {
+		return nil, &TransportError{"pipeline", err}
+	}
+	g.Order = g.topologicalOrder()
+
+	for _, name := range g.Order {
+		cfg := g.Configs[name]
+		// hops in the middle both read and write
+		listener := inputs[name] > 0 || listenerEnabled
+		writer := len(g.targets[name]) > 0 || writerEnabled
+		logger.Info("[pipeline] Using '%s' transport for '%s'", cfg.Type, name)
+		g.flags[name] = NewFlag(false)
+		transport, err := NewTransport(cfg.Type, &cfg, listener, writer, g.flags[name], logger)
+		if err != nil {
+			g.stopCreated()
+			return nil, &TransportError{"pipeline", fmt.Errorf("transport '%s': %v", name, err)}
+		}
+		g.Transports[name] = transport
+	}
+
+	return g, nil
+}
+
+// stopCreated stops transports created before one of them failed, in
+// reverse order
+func (g *TransportGraph) stopCreated() {
+	for i := len(g.Order) - 1; i >= 0; i-- {
+		name := g.Order[i]
+		if t, ok := g.Transports[name]; ok {
+			g.flags[name].Raise()
+			t.Stop()
+		}
+	}
+}
+
+// graphNode is name of pipeline node of the transport
+func graphNode(name string) string {
+	return "transport." + name
+}
+
+// topologicalOrder returns transport names with each one after all the
+// transports it reads from, the graph has to be acyclic
+func (g *TransportGraph) topologicalOrder() []string {
+	inputs := make(map[string]int)
+	for _, edge := range g.Edges {
+		inputs[edge.To]++
+	}
+	order := append([]string{}, g.Sources...)
+	for i := 0; i < len(order); i++ {
+		for _, to := range g.targets[order[i]] {
+			if inputs[to]--; inputs[to] == 0 {
+				order = append(order, to)
+			}
+		}
+	}
+	return order
+}
+
+// forward feeds output of the transport to its targets until exit, then
+// passes on what's left in the output
+func (g *TransportGraph) forward(name string) {
+	defer g.forwardWg[name].Done()
+	output := g.Transports[name].OutputChan()
+	send := func(m *Metric) {
+		for _, to := range g.targets[name] {
+			g.Transports[to].InputChan() <- m
+		}
+	}
+	for {
+		select {
+		case m := <-output:
+			send(m)
+		case <-g.forwardExit[name]:
+			for {
+				select {
+				case m := <-output:
+					send(m)
+				default:
+					return
+				}
+			}
+		}
+	}
+}
+
+func (g *TransportGraph) Start() {
+	for _, name := range g.Order {
+		g.Transports[name].Start()
+	}
+
+	for name := range g.targets {
+		g.forwardExit[name] = make(chan struct{})
+		g.forwardWg[name] = &sync.WaitGroup{}
+		g.forwardWg[name].Add(1)
+		go g.forward(name)
+	}
+
+	if g.ListenerEnabled {
+		g.inputWg.Add(1)
+		go func() {
+			defer g.inputWg.Done()
+			send := func(m *Metric) {
+				for _, name := range g.Sources {
+					g.Transports[name].InputChan() <- m
+				}
+			}
+			for {
+				select {
+				case m := <-g.Input:
+					send(m)
+				case <-g.inputExit:
+					for {
+						select {
+						case m := <-g.Input:
+							send(m)
+						default:
+							return
+						}
+					}
+				}
+			}
+		}()
+	}
+
+	if g.WriterEnabled {
+		for _, name := range g.Sinks {
+			g.mergeWg.Add(1)
+			go func(output <-chan *Metric) {
+				defer g.mergeWg.Done()
+				for {
+					select {
+					case m := <-output:
+						g.Output <- m
+					case <-g.mergeExit:
+						for {
+							select {
+							case m := <-output:
+								g.Output <- m
+							default:
+								return
+							}
+						}
+					}
+				}
+			}(g.Transports[name].OutputChan())
+		}
+	}
+
+	go func() {
+		<-g.ExitFlag.Done()
+		g.shutdown()
+	}()
+}
+
+// shutdown stops the transports in topological order, once everything
+// upstream was passed to the transport
+func (g *TransportGraph) shutdown() {
+	g.shutdownOnce.Do(func() {
+		close(g.inputExit)
+		g.inputWg.Wait()
+		for _, name := range g.Order {
+			g.flags[name].Raise()
+			g.Transports[name].Stop()
+			if exit, ok := g.forwardExit[name]; ok {
+				close(exit)
+				g.forwardWg[name].Wait()
+			}
+		}
+		close(g.stopped)
+	})
+}
+
+func (g *TransportGraph) Stop() {
+	g.shutdown()
+	<-g.stopped
+	close(g.mergeExit)
+	g.mergeWg.Wait()
+}
+
+func (g *TransportGraph) CloseOutput() {
+	for _, name := range g.Sinks {
+		g.Transports[name].CloseOutput()
+	}
+}
+
+func (g *TransportGraph) CloseInput() {
+	for _, name := range g.Sources {
+		g.Transports[name].CloseInput()
+	}
+}
+
+// Ready implements ReadinessChecker, graph is ready when all of its
+// transports are
+func (g *TransportGraph) Ready() error {
+	for _, name := range g.Order {
+		if checker, ok := g.Transports[name].(ReadinessChecker); ok {
+			if err := checker.Ready(); err != nil {
+				return fmt.Errorf("%s: %v", name, err)
+			}
+		}
+	}
+	return nil
+}
+
+func (g *TransportGraph) InputChan() chan<- *Metric {
+	return g.Input
+}
+
+func (g *TransportGraph) OutputChan() <-chan *Metric {
+	return g.Output
+}
+
+func (g *TransportGraph) InputChanLen() int {
+	return len(g.Input)
+}
+
+func (g *TransportGraph) OutputChanLen() int {
+	return len(g.Output)
+}
+
+func (g *TransportGraph) LogReport() {
+	g.Logger.Info("[transport] pipeline: %d/%d/%d (input/output/capacity), %d transports, %d edges",
+		len(g.Input),
+		len(g.Output),
+		g.Size,
+		len(g.Transports),
+		len(g.Edges),
+	)
+	for _, name := range g.Order {
+		g.Transports[name].LogReport()
+	}
+}
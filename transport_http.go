@@ -0,0 +1,239 @@
+package metcap
+
+import (
+	"compress/gzip"
+	"context"
+	"encoding/json"
+	"fmt"
+	"net"
+	"net/http"
+	"sync"
+	"time"
+
+	"go.opentelemetry.io/otel/propagation"
+)
+
+func init() {
+	RegisterTransport("http", func(c *TransportConfig, listenerEnabled bool, writerEnabled bool, exitFlag *Flag, logger *Logger) (Transport, error) {
+		if !writerEnabled {
+			return nil, &TransportError{"http", fmt.Errorf("http transport requires you to have writer enabled")}
+		}
+		return NewHTTPTransport(c, exitFlag, logger)
+	})
+}
+
+// HTTPTransport accepts InfluxDB v1 write API requests and hands the metrics
+// over to the writer, like the channel transport does for listeners
+type HTTPTransport struct {
+	Server        *http.Server
+	Socket        net.Listener
+	Size          int
+	MaxBodyBytes  int64
+	SourceTagging bool
+	Chan          chan *Metric
+	ExitFlag      *Flag
+	Wg            *sync.WaitGroup
+	Logger        *Logger
+	Stats         *HTTPTransportStats
+}
+
+// NewHTTPTransport
+func NewHTTPTransport(c *TransportConfig, exitFlag *Flag, logger *Logger) (*HTTPTransport, error) {
+	if c.BufferSize == 0 {
+		c.BufferSize = 1000
+	}
+
+	if c.HTTPListenAddr == "" {
+		c.HTTPListenAddr = ":8086"
+	}
+
+	if c.HTTPMaxBodyBytes == 0 {
+		c.HTTPMaxBodyBytes = 25 * 1024 * 1024
+	}
+
+	if c.HTTPTimeout == 0 {
+		c.HTTPTimeout = 30
+	}
+
+	sock, err := net.Listen("tcp", c.HTTPListenAddr)
+	if err != nil {
+		return nil, &TransportError{"http", err}
+	}
+
+	t := &HTTPTransport{
+		Socket:        sock,
+		Size:          c.BufferSize,
+		MaxBodyBytes:  c.HTTPMaxBodyBytes,
+		SourceTagging: c.SourceTagging,
+		Chan:          make(chan *Metric, c.BufferSize),
+		ExitFlag:      exitFlag,
+		Wg:            &sync.WaitGroup{},
+		Logger:        logger,
+		Stats:         NewHTTPTransportStats(),
+	}
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("/write", t.write)
+	mux.HandleFunc("/ping", func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusNoContent)
+	})
+	t.Server = &http.Server{
+		Handler:     mux,
+		ReadTimeout: time.Duration(c.HTTPTimeout) * time.Second,
+	}
+
+	return t, nil
+}
+
+// write handles POST /write
+func (t *HTTPTransport) write(w http.ResponseWriter, r *http.Request) {
+	t.Stats.Requests.Increment(1)
+
+	if r.Method != http.MethodPost {
+		w.Header().Set("Allow", http.MethodPost)
+		t.fail(w, http.StatusMethodNotAllowed, fmt.Errorf("method %s not allowed", r.Method))
+		return
+	}
+
+	// timestamps are always parsed as nanoseconds
+	switch r.URL.Query().Get("precision") {
+	case "", "n", "ns":
+	default:
+		t.fail(w, http.StatusBadRequest, fmt.Errorf("unsupported precision '%s'", r.URL.Query().Get("precision")))
+		return
+	}
+
+	body := http.MaxBytesReader(w, r.Body, t.MaxBodyBytes)
+	if r.Header.Get("Content-Encoding") == "gzip" {
+		gz, err := gzip.NewReader(body)
+		if err != nil {
+			t.fail(w, http.StatusBadRequest, err)
+			return
+		}
+		// limit the decompressed size as well
+		body = http.MaxBytesReader(w, gz, t.MaxBodyBytes)
+	}
+	defer body.Close()
+
+	metrics, err := ParseLineProtocolBatch(body)
+	if _, ok := err.(*http.MaxBytesError); ok {
+		t.fail(w, http.StatusRequestEntityTooLarge, fmt.Errorf("request body exceeds %d bytes", t.MaxBodyBytes))
+		return
+	}
+
+	// trace context of the request (W3C traceparent) travels with the
+	// metrics; request context itself is canceled once it's served
+	ctx := propagation.TraceContext{}.Extract(context.Background(), propagation.HeaderCarrier(r.Header))
+
+	// like InfluxDB, points that parsed fine are written even if others failed
+	for _, m := range metrics {
+		if t.SourceTagging {
+			tagSource(m, "http:"+r.RemoteAddr)
+		}
+		m.SetContext(ctx)
+		t.Chan <- m
+	}
+	t.Stats.Received.Increment(len(metrics))
+	pipelineStats.Received.Add("http", len(metrics))
+
+	if err != nil {
+		t.fail(w, http.StatusBadRequest, err)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// fail responds with InfluxDB style JSON error body
+func (t *HTTPTransport) fail(w http.ResponseWriter, code int, err error) {
+	t.Stats.Failed.Increment(1)
+	t.Logger.Debug("[http] Request failed with %d: %v", code, err)
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(code)
+	json.NewEncoder(w).Encode(map[string]string{"error": err.Error()})
+}
+
+func (t *HTTPTransport) Start() {
+	t.Logger.Info("[http] Accepting writes on %s", t.Socket.Addr().String())
+
+	t.Wg.Add(1)
+	go func() {
+		defer t.Wg.Done()
+		err := t.Server.Serve(t.Socket)
+		if err != nil && err != http.ErrServerClosed {
+			t.Logger.Error("[http] Server failed: %v", err)
+		}
+	}()
+
+	// Stop waits for the shutdown, Serve returns right as it starts
+	t.Wg.Add(1)
+	go func() {
+		defer t.Wg.Done()
+		<-t.ExitFlag.Done()
+		// let in-flight requests finish pushing their metrics
+		ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+		if err := t.Server.Shutdown(ctx); err != nil {
+			t.Logger.Error("[http] Failed to shutdown server: %v", err)
+		}
+		cancel()
+	}()
+}
+
+func (t *HTTPTransport) Stop() {
+	t.Wg.Wait()
+}
+
+func (t *HTTPTransport) CloseOutput() {
+	return
+}
+
+func (t *HTTPTransport) CloseInput() {
+	return
+}
+
+func (t *HTTPTransport) InputChan() chan<- *Metric {
+	return t.Chan
+}
+
+func (t *HTTPTransport) OutputChan() <-chan *Metric {
+	return t.Chan
+}
+
+func (t *HTTPTransport) InputChanLen() int {
+	return len(t.Chan)
+}
+
+func (t *HTTPTransport) OutputChanLen() int {
+	return len(t.Chan)
+}
+
+func (t *HTTPTransport) LogReport() {
+	t.Logger.Info("[transport] http: %d/%d (length/capacity), requests: %d/%d (total/failed), metrics: %d/%.3f (total_received/rate_per_sec)",
+		len(t.Chan),
+		t.Size,
+		t.Stats.Requests.Total(),
+		t.Stats.Failed.Total(),
+		t.Stats.Received.Total(),
+		t.Stats.Received.Rate(time.Second),
+	)
+}
+
+type HTTPTransportStats struct {
+	Requests *StatsCounter
+	Failed   *StatsCounter
+	Received *StatsCounter
+}
+
+func NewHTTPTransportStats() *HTTPTransportStats {
+	now := time.Now()
+	return &HTTPTransportStats{
+		Requests: NewStatsCounter(now),
+		Failed:   NewStatsCounter(now),
+		Received: NewStatsCounter(now),
+	}
+}
+
+func (s *HTTPTransportStats) Reset() {
+	s.Requests.Reset()
+	s.Failed.Reset()
+	s.Received.Reset()
+}
@@ -0,0 +1,325 @@
+package metcap
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+func init() {
+	RegisterTransport("jolokia", func(c *TransportConfig, listenerEnabled bool, writerEnabled bool, exitFlag *Flag, logger *Logger) (Transport, error) {
+		if !writerEnabled {
+			return nil, &TransportError{"jolokia", fmt.Errorf("jolokia transport requires you to have writer enabled")}
+		}
+		return NewJolokiaReader(c, exitFlag, logger)
+	})
+}
+
+// JolokiaReader scrapes JMX attributes through Jolokia agent at URL every
+// Interval. Requests are sent in one bulk POST, without them the URL (e.g.
+// ".../jolokia/read/java.lang:type=Memory") is read by GET. Each MBean
+// becomes metric named by its domain, tagged by its key properties, with
+// attribute paths (e.g. "HeapMemoryUsage.used") as fields, timestamp of
+// the response and value of 1.
+type JolokiaReader struct {
+	URL      string
+	Requests []JolokiaRequest
+	Interval time.Duration
+	Client   *http.Client
+	Size     int
+	Chan     chan *Metric
+	ExitFlag *Flag
+	Wg       *sync.WaitGroup
+	Logger   *Logger
+	Stats    *JolokiaReaderStats
+	body     []byte
+}
+
+// jolokiaRequest is read request of the bulk
+type jolokiaRequest struct {
+	Type      string   `json:"type"`
+	MBean     string   `json:"mbean"`
+	Attribute []string `json:"attribute,omitempty"`
+}
+
+// jolokiaResponse is response to a single read
+type jolokiaResponse struct {
+	Request   jolokiaRequest `json:"request"`
+	Value     interface{}    `json:"value"`
+	Timestamp int64          `json:"timestamp"`
+	Status    int            `json:"status"`
+	Error     string         `json:"error"`
+}
+
+// NewJolokiaReader
+func NewJolokiaReader(c *TransportConfig, exitFlag *Flag, logger *Logger) (*JolokiaReader, error) {
+	if c.BufferSize == 0 {
+		c.BufferSize = 1000
+	}
+
+	if c.JolokiaURL == "" {
+		return nil, &TransportError{"jolokia", fmt.Errorf("jolokia_url is required")}
+	}
+
+	if c.JolokiaScrapeInterval.Duration == 0 {
+		c.JolokiaScrapeInterval.Duration = 10 * time.Second
+	}
+
+	if c.JolokiaTimeout.Duration == 0 {
+		c.JolokiaTimeout.Duration = 5 * time.Second
+	}
+
+	t := &JolokiaReader{
+		URL:      c.JolokiaURL,
+		Requests: c.JolokiaRequests,
+		Interval: c.JolokiaScrapeInterval.Duration,
+		Client:   &http.Client{Timeout: c.JolokiaTimeout.Duration},
+		Size:     c.BufferSize,
+		Chan:     make(chan *Metric, c.BufferSize),
+		ExitFlag: exitFlag,
+		Wg:       &sync.WaitGroup{},
+		Logger:   logger,
+		Stats:    NewJolokiaReaderStats(),
+	}
+
+	if len(t.Requests) > 0 {
+		bulk := make([]jolokiaRequest, len(t.Requests))
+		for i, r := range t.Requests {
+			if r.MBean == "" {
+				return nil, &TransportError{"jolokia", fmt.Errorf("mbean of jolokia_request %d is required", i)}
+			}
+			bulk[i] = jolokiaRequest{Type: "read", MBean: r.MBean, Attribute: r.Attributes}
+		}
+		t.body, _ = json.Marshal(bulk)
+	}
+	return t, nil
+}
+
+// scrape reads the attributes
+func (t *JolokiaReader) scrape() ([]jolokiaResponse, error) {
+	var (
+		resp *http.Response
+		err  error
+	)
+	if t.body != nil {
+		resp, err = t.Client.Post(t.URL, "application/json", bytes.NewReader(t.body))
+	} else {
+		resp, err = t.Client.Get(t.URL)
+	}
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	data, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("unexpected status %s", resp.Status)
+	}
+
+	var responses []jolokiaResponse
+	if t.body == nil {
+		responses = make([]jolokiaResponse, 1)
+		err = json.Unmarshal(data, &responses[0])
+	} else {
+		err = json.Unmarshal(data, &responses)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("invalid response: %v", err)
+	}
+	return responses, nil
+}
+
+// JolokiaMetrics returns metrics of the read response, one per MBean
+func JolokiaMetrics(r jolokiaResponse) ([]*Metric, error) {
+	if r.Status != http.StatusOK {
+		return nil, fmt.Errorf("reading '%s' failed with status %d: %s", r.Request.MBean, r.Status, r.Error)
+	}
+	ts := time.Unix(r.Timestamp, 0)
+	if r.Timestamp == 0 {
+		ts = time.Now()
+	}
+
+	// values of patterns are keyed by the matching MBeans
+	values := map[string]interface{}{r.Request.MBean: r.Value}
+	if strings.ContainsAny(r.Request.MBean, "*?") {
+		var ok bool
+		if values, ok = r.Value.(map[string]interface{}); !ok {
+			return nil, fmt.Errorf("unexpected value of '%s'", r.Request.MBean)
+		}
+	}
+
+	var metrics []*Metric
+	for mbean, value := range values {
+		domain, tags := parseMBean(mbean)
+		m := &Metric{
+			Name:      domain,
+			Timestamp: ts,
+			Value:     1,
+			Fields:    tags,
+			Values:    make(map[string]interface{}),
+			OK:        true,
+		}
+		attributes, ok := value.(map[string]interface{})
+		if !ok && len(r.Request.Attribute) == 1 {
+			attributes = map[string]interface{}{r.Request.Attribute[0]: value}
+		}
+		for name, v := range attributes {
+			flattenJolokia(m.Values, name, v)
+		}
+		metrics = append(metrics, m)
+	}
+	return metrics, nil
+}
+
+// flattenJolokia stores the value under its path, composite values are
+// flattened to paths separated by dots
+func flattenJolokia(values map[string]interface{}, path string, value interface{}) {
+	switch v := value.(type) {
+	case map[string]interface{}:
+		for k, item := range v {
+			flattenJolokia(values, path+"."+k, item)
+		}
+	case []interface{}:
+		for i, item := range v {
+			flattenJolokia(values, path+"."+strconv.Itoa(i), item)
+		}
+	case float64, string, bool:
+		values[path] = v
+	}
+}
+
+// parseMBean splits MBean name into its domain and key properties
+func parseMBean(name string) (string, map[string]string) {
+	tags := make(map[string]string)
+	i := strings.IndexByte(name, ':')
+	if i < 0 {
+		return name, tags
+	}
+	domain, props := name[:i], name[i+1:]
+	for props != "" {
+		// quoted values may contain commas
+		end, quoted := 0, false
+		for ; end < len(props); end++ {
+			if props[end] == '"' && (end == 0 || props[end-1] != '\\') {
+				quoted = !quoted
+			} else if props[end] == ',' && !quoted {
+				break
+			}
+		}
+		if kv := strings.SplitN(props[:end], "=", 2); len(kv) == 2 {
+			tags[kv[0]] = strings.Trim(kv[1], `"`)
+		}
+		if end == len(props) {
+			break
+		}
+		props = props[end+1:]
+	}
+	return domain, tags
+}
+
+func (t *JolokiaReader) read() {
+	responses, err := t.scrape()
+	if err != nil {
+		t.Stats.Failed.Increment(1)
+		t.Logger.Error("[jolokia] Failed to scrape %s: %v", redactURL(t.URL), err)
+		return
+	}
+	for _, r := range responses {
+		metrics, err := JolokiaMetrics(r)
+		if err != nil {
+			t.Stats.Failed.Increment(1)
+			pipelineStats.Dropped.Add("decode", 1)
+			t.Logger.Debug("[jolokia] %v", err)
+			continue
+		}
+		for _, m := range metrics {
+			t.Chan <- m
+		}
+		t.Stats.Received.Increment(len(metrics))
+		pipelineStats.Received.Add("jolokia", len(metrics))
+	}
+}
+
+func (t *JolokiaReader) Start() {
+	t.Logger.Info("[jolokia] Scraping %s every %v", redactURL(t.URL), t.Interval)
+
+	t.Wg.Add(1)
+	go func() {
+		defer t.Wg.Done()
+		ticker := time.NewTicker(t.Interval)
+		defer ticker.Stop()
+		for {
+			t.read()
+			select {
+			case <-ticker.C:
+			case <-t.ExitFlag.Done():
+				return
+			}
+		}
+	}()
+}
+
+func (t *JolokiaReader) Stop() {
+	t.Wg.Wait()
+}
+
+func (t *JolokiaReader) CloseOutput() {
+	return
+}
+
+func (t *JolokiaReader) CloseInput() {
+	return
+}
+
+func (t *JolokiaReader) InputChan() chan<- *Metric {
+	return t.Chan
+}
+
+func (t *JolokiaReader) OutputChan() <-chan *Metric {
+	return t.Chan
+}
+
+func (t *JolokiaReader) InputChanLen() int {
+	return len(t.Chan)
+}
+
+func (t *JolokiaReader) OutputChanLen() int {
+	return len(t.Chan)
+}
+
+func (t *JolokiaReader) LogReport() {
+	t.Logger.Info("[transport] jolokia: %d/%d (length/capacity), metrics: %d/%d/%.3f (total_received/failed/rate_per_sec)",
+		len(t.Chan),
+		t.Size,
+		t.Stats.Received.Total(),
+		t.Stats.Failed.Total(),
+		t.Stats.Received.Rate(time.Second),
+	)
+}
+
+type JolokiaReaderStats struct {
+	Received *StatsCounter
+	Failed   *StatsCounter
+}
+
+func NewJolokiaReaderStats() *JolokiaReaderStats {
+	now := time.Now()
+	return &JolokiaReaderStats{
+		Received: NewStatsCounter(now),
+		Failed:   NewStatsCounter(now),
+	}
+}
+
+func (s *JolokiaReaderStats) Reset() {
+	s.Received.Reset()
+	s.Failed.Reset()
+}
@@ -0,0 +1,389 @@
+package metcap
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/Shopify/sarama"
+)
+
+func init() {
+	RegisterTransport("kafka", func(c *TransportConfig, listenerEnabled bool, writerEnabled bool, exitFlag *Flag, logger *Logger) (Transport, error) {
+		return NewKafkaTransport(c, listenerEnabled, writerEnabled, exitFlag, logger)
+	})
+}
+
+type KafkaTransport struct {
+	Producer        sarama.SyncProducer
+	Consumer        sarama.ConsumerGroup
+	Size            int
+	Brokers         []string
+	Topic           string
+	GroupID         string
+	BatchSize       int
+	BatchWait       time.Duration
+	Format          SerializationFormat
+	ListenerEnabled bool
+	WriterEnabled   bool
+	Input           chan *Metric
+	Output          chan *Metric
+	ExitFlag        *Flag
+	Wg              *sync.WaitGroup
+	Logger          *Logger
+	Stats           *KafkaTransportStats
+	joined          *Flag
+}
+
+// NewKafkaTransport
+func NewKafkaTransport(c *TransportConfig, listenerEnabled bool, writerEnabled bool, exitFlag *Flag, logger *Logger) (*KafkaTransport, error) {
+	if len(c.KafkaBrokers) == 0 {
+		c.KafkaBrokers = []string{"127.0.0.1:9092"}
+	}
+
+	if c.KafkaTopic == "" {
+		c.KafkaTopic = "default"
+	}
+
+	if c.KafkaGroupID == "" {
+		c.KafkaGroupID = "default"
+	}
+
+	if c.KafkaPartitions == 0 {
+		c.KafkaPartitions = 1
+	}
+
+	if c.KafkaBatchSize == 0 {
+		c.KafkaBatchSize = 1000
+	}
+
+	if c.KafkaBatchWait.Duration == 0 {
+		c.KafkaBatchWait.Duration = 1 * time.Second
+	}
+
+	if c.BufferSize == 0 {
+		c.BufferSize = 1000
+	}
+
+	var (
+		producer sarama.SyncProducer
+		consumer sarama.ConsumerGroup
+		err      error
+	)
+
+	topic := "metcap." + c.KafkaTopic
+	group := "metcap." + c.KafkaGroupID
+
+	if c.KafkaSchemaSubject == "" {
+		c.KafkaSchemaSubject = topic + "-value"
+	}
+
+	var format SerializationFormat
+	if c.KafkaSerializationFormat == "avro" {
+		format, err = NewAvroFormat(c.KafkaSchemaRegistryURL, c.KafkaSchemaSubject, 30*time.Second)
+	} else if c.KafkaSerializationFormat != "" {
+		format, err = NewSerializationFormat(c.KafkaSerializationFormat)
+	} else {
+		format, err = NewSerializationFormat(c.SerializationFormat)
+	}
+	if err != nil {
+		return nil, &TransportError{"kafka", err}
+	}
+
+	config := sarama.NewConfig()
+	config.ClientID = "metcap"
+	config.Net.DialTimeout = time.Duration(c.KafkaTimeout) * time.Second
+	config.Producer.Return.Successes = true
+	config.Producer.RequiredAcks = sarama.WaitForAll
+	config.Consumer.Return.Errors = true
+	switch c.KafkaOffset {
+	case "", "newest":
+		config.Consumer.Offsets.Initial = sarama.OffsetNewest
+	case "oldest":
+		config.Consumer.Offsets.Initial = sarama.OffsetOldest
+	default:
+		return nil, &TransportError{"kafka", fmt.Errorf("unknown kafka_offset '%s'", c.KafkaOffset)}
+	}
+	if config.Net.DialTimeout == 0 {
+		config.Net.DialTimeout = 30 * time.Second
+	}
+
+	err = kafkaInit(c.KafkaBrokers, topic, c.KafkaPartitions, config)
+	if err != nil {
+		return nil, &TransportError{"kafka", err}
+	}
+
+	if listenerEnabled {
+		producer, err = sarama.NewSyncProducer(c.KafkaBrokers, config)
+		if err != nil {
+			return nil, &TransportError{"kafka", err}
+		}
+	}
+
+	if writerEnabled {
+		consumer, err = sarama.NewConsumerGroup(c.KafkaBrokers, group, config)
+		if err != nil {
+			return nil, &TransportError{"kafka", err}
+		}
+	}
+
+	return &KafkaTransport{
+		Producer:        producer,
+		Consumer:        consumer,
+		Size:            c.BufferSize,
+		Brokers:         c.KafkaBrokers,
+		Topic:           topic,
+		GroupID:         group,
+		BatchSize:       c.KafkaBatchSize,
+		BatchWait:       c.KafkaBatchWait.Duration,
+		Format:          format,
+		ListenerEnabled: listenerEnabled,
+		WriterEnabled:   writerEnabled,
+		Input:           make(chan *Metric, c.BufferSize),
+		Output:          make(chan *Metric, c.BufferSize),
+		ExitFlag:        exitFlag,
+		Wg:              &sync.WaitGroup{},
+		Logger:          logger,
+		Stats:           NewKafkaTransportStats(),
+		joined:          NewFlag(false),
+	}, nil
+}
+
+// kafkaInit creates the topic with requested number of partitions
+// if it doesn't exist yet
+func kafkaInit(brokers []string, topic string, partitions int, config *sarama.Config) error {
+	admin, err := sarama.NewClusterAdmin(brokers, config)
+	if err != nil {
+		return err
+	}
+	defer admin.Close()
+
+	topics, err := admin.ListTopics()
+	if err != nil {
+		return err
+	}
+	if _, ok := topics[topic]; ok {
+		return nil
+	}
+
+	return admin.CreateTopic(topic, &sarama.TopicDetail{
+		NumPartitions:     int32(partitions),
+		ReplicationFactor: 1,
+	}, false)
+}
+
+func (t *KafkaTransport) flush(batch []*Metric) {
+	messages := make([]*sarama.ProducerMessage, 0, len(batch))
+	for _, m := range batch {
+		body, err := t.Format.Marshal(m)
+		if err != nil {
+			pipelineStats.Dropped.Add("serialize", 1)
+			t.Logger.Error("[kafka] Failed to serialize metric: %v", err)
+			continue
+		}
+		messages = append(messages, &sarama.ProducerMessage{
+			Topic: t.Topic,
+			Key:   sarama.StringEncoder(m.Name),
+			Value: sarama.ByteEncoder(body),
+		})
+	}
+	if len(messages) == 0 {
+		return
+	}
+	t0 := time.Now()
+	err := t.Producer.SendMessages(messages)
+	if err != nil {
+		// ProducerErrors lists only the messages that failed, the rest were sent
+		failed := len(messages)
+		if errs, ok := err.(sarama.ProducerErrors); ok {
+			failed = len(errs)
+		}
+		pipelineStats.Dropped.Add("publish_failed", failed)
+		t.Logger.Error("[kafka] Failed to publish %d metrics: %v", failed, err)
+		if sent := len(messages) - failed; sent > 0 {
+			pipelineStats.Published.Add("kafka", sent)
+			t.Stats.Published.Increment(sent)
+		}
+		return
+	}
+	pipelineStats.PublishDuration.Observe(time.Since(t0))
+	pipelineStats.Published.Add("kafka", len(messages))
+	t.Stats.Published.Increment(len(messages))
+}
+
+func (t *KafkaTransport) Start() {
+
+	if t.ListenerEnabled {
+		t.Wg.Add(1)
+		go func() {
+			defer t.Wg.Done()
+			batch := make([]*Metric, 0, t.BatchSize)
+			tick := time.NewTicker(t.BatchWait)
+			defer tick.Stop()
+			for {
+				select {
+				case m := <-t.Input:
+					batch = append(batch, m)
+					if len(batch) >= t.BatchSize {
+						t.flush(batch)
+						batch = batch[:0]
+					}
+				case <-tick.C:
+					t.flush(batch)
+					batch = batch[:0]
+				case <-t.ExitFlag.Done():
+					for len(t.Input) > 0 {
+						batch = append(batch, <-t.Input)
+						if len(batch) >= t.BatchSize {
+							t.flush(batch)
+							batch = batch[:0]
+						}
+					}
+					t.flush(batch)
+					return
+				}
+			}
+		}()
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+
+	if t.WriterEnabled {
+		t.Wg.Add(1)
+		go func() {
+			defer t.Wg.Done()
+			for {
+				// Consume returns on every group rebalance, so it has to be called in a loop
+				err := t.Consumer.Consume(ctx, []string{t.Topic}, t)
+				if err != nil {
+					t.Logger.Error("[kafka] Consumer group error: %v", err)
+					select {
+					case <-time.After(1 * time.Second):
+					case <-ctx.Done():
+					}
+				}
+				if ctx.Err() != nil {
+					return
+				}
+			}
+		}()
+
+		go func() {
+			for err := range t.Consumer.Errors() {
+				t.Logger.Error("[kafka] Consumer error: %v", err)
+			}
+		}()
+	}
+
+	go func() {
+		<-t.ExitFlag.Done()
+		cancel()
+	}()
+}
+
+// Setup implements sarama.ConsumerGroupHandler
+func (t *KafkaTransport) Setup(s sarama.ConsumerGroupSession) error {
+	t.Logger.Debug("[kafka] Joined consumer group %s, claims: %v", t.GroupID, s.Claims())
+	t.joined.Raise()
+	return nil
+}
+
+// Cleanup implements sarama.ConsumerGroupHandler
+func (t *KafkaTransport) Cleanup(s sarama.ConsumerGroupSession) error {
+	t.Logger.Debug("[kafka] Leaving consumer group session %s", t.GroupID)
+	t.joined.Lower()
+	return nil
+}
+
+// Ready implements ReadinessChecker, reader is ready once it joins
+// the consumer group
+func (t *KafkaTransport) Ready() error {
+	if t.WriterEnabled && !t.joined.Get() {
+		return fmt.Errorf("not joined to consumer group %s", t.GroupID)
+	}
+	return nil
+}
+
+// ConsumeClaim implements sarama.ConsumerGroupHandler
+func (t *KafkaTransport) ConsumeClaim(s sarama.ConsumerGroupSession, claim sarama.ConsumerGroupClaim) error {
+	for message := range claim.Messages() {
+		metric, err := t.Format.Unmarshal(message.Value)
+		if err != nil {
+			pipelineStats.DeserializationErrors.Add("kafka", 1)
+			t.Logger.Error("[kafka] Failed to deserialize metric: %v", err)
+		} else {
+			select {
+			case t.Output <- metric:
+			case <-s.Context().Done():
+				// unmarked, the message is consumed again in the next session
+				return nil
+			}
+			t.Stats.Consumed.Increment(1)
+		}
+		s.MarkMessage(message, "")
+	}
+	return nil
+}
+
+func (t *KafkaTransport) Stop() {
+	t.Wg.Wait()
+	if t.ListenerEnabled {
+		t.Producer.Close()
+	}
+	if t.WriterEnabled {
+		t.Consumer.Close()
+	}
+}
+
+func (t *KafkaTransport) CloseOutput() {
+
+}
+
+func (t *KafkaTransport) CloseInput() {
+
+}
+
+func (t *KafkaTransport) LogReport() {
+	t.Logger.Info("[transport] kafka: %d/%d/%d (input/output/capacity), metrics: %d/%d (published/consumed)",
+		len(t.Input),
+		len(t.Output),
+		t.Size,
+		t.Stats.Published.Total(),
+		t.Stats.Consumed.Total(),
+	)
+}
+
+func (t *KafkaTransport) InputChan() chan<- *Metric {
+	return t.Input
+}
+
+func (t *KafkaTransport) OutputChan() <-chan *Metric {
+	return t.Output
+}
+
+func (t *KafkaTransport) InputChanLen() int {
+	return len(t.Input)
+}
+
+func (t *KafkaTransport) OutputChanLen() int {
+	return len(t.Output)
+}
+
+type KafkaTransportStats struct {
+	Published *StatsCounter
+	Consumed  *StatsCounter
+}
+
+func NewKafkaTransportStats() *KafkaTransportStats {
+	now := time.Now()
+	return &KafkaTransportStats{
+		Published: NewStatsCounter(now),
+		Consumed:  NewStatsCounter(now),
+	}
+}
+
+func (s *KafkaTransportStats) Reset() {
+	s.Published.Reset()
+	s.Consumed.Reset()
+}
@@ -0,0 +1,280 @@
+package metcap
+
+import (
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/nats-io/nats.go"
+)
+
+func init() {
+	RegisterTransport("nats", func(c *TransportConfig, listenerEnabled bool, writerEnabled bool, exitFlag *Flag, logger *Logger) (Transport, error) {
+		return NewNATSTransport(c, listenerEnabled, writerEnabled, exitFlag, logger)
+	})
+}
+
+type NATSTransport struct {
+	Conn            *nats.Conn
+	JetStream       nats.JetStreamContext
+	Subscription    *nats.Subscription
+	Size            int
+	Subject         string
+	Stream          string
+	ConsumerName    string
+	MaxInflight     int
+	Format          SerializationFormat
+	ListenerEnabled bool
+	WriterEnabled   bool
+	Input           chan *Metric
+	Output          chan *Metric
+	ExitFlag        *Flag
+	Wg              *sync.WaitGroup
+	Logger          *Logger
+	Stats           *NATSTransportStats
+}
+
+// NewNATSTransport
+func NewNATSTransport(c *TransportConfig, listenerEnabled bool, writerEnabled bool, exitFlag *Flag, logger *Logger) (*NATSTransport, error) {
+	if len(c.NATSServers) == 0 {
+		c.NATSServers = []string{nats.DefaultURL}
+	}
+
+	if c.NATSSubject == "" {
+		c.NATSSubject = "metcap.default"
+	}
+
+	if c.NATSStream == "" {
+		c.NATSStream = "metcap"
+	}
+
+	if c.NATSConsumerName == "" {
+		c.NATSConsumerName = "metcap-writer"
+	}
+
+	if c.NATSTimeout == 0 {
+		c.NATSTimeout = 5
+	}
+
+	if c.NATSMaxInflight == 0 {
+		c.NATSMaxInflight = 1000
+	}
+
+	if c.BufferSize == 0 {
+		c.BufferSize = 1000
+	}
+
+	format, err := NewSerializationFormat(c.SerializationFormat)
+	if err != nil {
+		return nil, &TransportError{"nats", err}
+	}
+
+	conn, err := nats.Connect(
+		strings.Join(c.NATSServers, ","),
+		nats.Name("metcap"),
+		nats.Timeout(time.Duration(c.NATSTimeout)*time.Second),
+		nats.MaxReconnects(-1),
+		nats.DisconnectErrHandler(func(_ *nats.Conn, err error) {
+			if err != nil {
+				logger.Error("[nats] Disconnected: %v", err)
+			}
+		}),
+		nats.ReconnectHandler(func(nc *nats.Conn) {
+			logger.Info("[nats] Reconnected to %s", nc.ConnectedUrl())
+		}),
+	)
+	if err != nil {
+		return nil, &TransportError{"nats", err}
+	}
+
+	js, err := conn.JetStream()
+	if err != nil {
+		return nil, &TransportError{"nats", err}
+	}
+
+	// create the stream capturing our subject if it doesn't exist
+	_, err = js.StreamInfo(c.NATSStream)
+	if err == nats.ErrStreamNotFound {
+		_, err = js.AddStream(&nats.StreamConfig{
+			Name:     c.NATSStream,
+			Subjects: []string{c.NATSSubject},
+			Storage:  nats.FileStorage,
+		})
+	}
+	if err != nil {
+		return nil, &TransportError{"nats", err}
+	}
+
+	return &NATSTransport{
+		Conn:            conn,
+		JetStream:       js,
+		Size:            c.BufferSize,
+		Subject:         c.NATSSubject,
+		Stream:          c.NATSStream,
+		ConsumerName:    c.NATSConsumerName,
+		MaxInflight:     c.NATSMaxInflight,
+		Format:          format,
+		ListenerEnabled: listenerEnabled,
+		WriterEnabled:   writerEnabled,
+		Input:           make(chan *Metric, c.BufferSize),
+		Output:          make(chan *Metric, c.BufferSize),
+		ExitFlag:        exitFlag,
+		Wg:              &sync.WaitGroup{},
+		Logger:          logger,
+		Stats:           NewNATSTransportStats(),
+	}, nil
+}
+
+func (t *NATSTransport) publish(m *Metric) {
+	body, err := t.Format.Marshal(m)
+	if err != nil {
+		pipelineStats.Dropped.Add("serialize", 1)
+		t.Logger.Error("[nats] Failed to serialize metric: %v", err)
+		return
+	}
+	t0 := time.Now()
+	_, err = t.JetStream.Publish(t.Subject, body)
+	if err != nil {
+		t.Logger.Error("[nats] Failed to publish metric: %v", err)
+		return
+	}
+	pipelineStats.PublishDuration.Observe(time.Since(t0))
+	pipelineStats.Published.Add("nats", 1)
+	t.Stats.Published.Increment(1)
+}
+
+func (t *NATSTransport) deliver(msg *nats.Msg) {
+	metric, err := t.Format.Unmarshal(msg.Data)
+	if err != nil {
+		// redelivery won't help, so terminate it
+		pipelineStats.DeserializationErrors.Add("nats", 1)
+		msg.Term()
+		t.Logger.Error("[nats] Failed to deserialize metric: %v", err)
+		return
+	}
+	select {
+	case t.Output <- metric:
+	case <-t.ExitFlag.Done():
+		// let the server redeliver it after restart
+		msg.Nak()
+		return
+	}
+	msg.Ack()
+	t.Stats.Consumed.Increment(1)
+}
+
+func (t *NATSTransport) Start() {
+
+	if t.ListenerEnabled {
+		t.Wg.Add(1)
+		go func() {
+			defer t.Wg.Done()
+			for {
+				select {
+				case m := <-t.Input:
+					t.publish(m)
+				case <-t.ExitFlag.Done():
+					for len(t.Input) > 0 {
+						t.publish(<-t.Input)
+					}
+					return
+				}
+			}
+		}()
+	}
+
+	if t.WriterEnabled {
+		// unacknowledged messages are capped by MaxAckPending on the server
+		// side, so the delivery channel doesn't need to be bigger than that
+		delivery := make(chan *nats.Msg, t.MaxInflight)
+		sub, err := t.JetStream.ChanSubscribe(t.Subject, delivery,
+			nats.Durable(t.ConsumerName),
+			nats.BindStream(t.Stream),
+			nats.ManualAck(),
+			nats.AckExplicit(),
+			nats.MaxAckPending(t.MaxInflight),
+		)
+		if err != nil {
+			t.Logger.Error("[nats] Failed to setup delivery channel: %v", err)
+		} else {
+			t.Subscription = sub
+			t.Wg.Add(1)
+			go func() {
+				defer t.Wg.Done()
+				for {
+					select {
+					case msg := <-delivery:
+						t.deliver(msg)
+					case <-t.ExitFlag.Done():
+						return
+					}
+				}
+			}()
+		}
+	}
+
+	go func() {
+		<-t.ExitFlag.Done()
+		if t.Subscription != nil {
+			// stop the server pushing, the consumer stays durable
+			t.Subscription.Unsubscribe()
+		}
+	}()
+}
+
+func (t *NATSTransport) Stop() {
+	t.Wg.Wait()
+	t.Conn.Drain()
+}
+
+func (t *NATSTransport) CloseOutput() {
+
+}
+
+func (t *NATSTransport) CloseInput() {
+
+}
+
+func (t *NATSTransport) LogReport() {
+	t.Logger.Info("[transport] nats: %d/%d/%d (input/output/capacity), metrics: %d/%d (published/consumed)",
+		len(t.Input),
+		len(t.Output),
+		t.Size,
+		t.Stats.Published.Total(),
+		t.Stats.Consumed.Total(),
+	)
+}
+
+func (t *NATSTransport) InputChan() chan<- *Metric {
+	return t.Input
+}
+
+func (t *NATSTransport) OutputChan() <-chan *Metric {
+	return t.Output
+}
+
+func (t *NATSTransport) InputChanLen() int {
+	return len(t.Input)
+}
+
+func (t *NATSTransport) OutputChanLen() int {
+	return len(t.Output)
+}
+
+type NATSTransportStats struct {
+	Published *StatsCounter
+	Consumed  *StatsCounter
+}
+
+func NewNATSTransportStats() *NATSTransportStats {
+	now := time.Now()
+	return &NATSTransportStats{
+		Published: NewStatsCounter(now),
+		Consumed:  NewStatsCounter(now),
+	}
+}
+
+func (s *NATSTransportStats) Reset() {
+	s.Published.Reset()
+	s.Consumed.Reset()
+}
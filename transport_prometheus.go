@@ -0,0 +1,247 @@
+package metcap
+
+import (
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"sync"
+	"time"
+
+	dto "github.com/prometheus/client_model/go"
+	"github.com/prometheus/common/expfmt"
+	"github.com/prometheus/common/model"
+)
+
+// prometheusAccept prefers the text format, timestamps of OpenMetrics are
+// in seconds and the text parser would take them for milliseconds
+const prometheusAccept = "text/plain;version=0.0.4;q=1,*/*;q=0.1"
+
+func init() {
+	RegisterTransport("prometheus", func(c *TransportConfig, listenerEnabled bool, writerEnabled bool, exitFlag *Flag, logger *Logger) (Transport, error) {
+		if !writerEnabled {
+			return nil, &TransportError{"prometheus", fmt.Errorf("prometheus transport requires you to have writer enabled")}
+		}
+		return NewPrometheusScraper(c, exitFlag, logger)
+	})
+}
+
+// PrometheusScraper scrapes Prometheus /metrics endpoints of Targets every
+// Interval and hands the samples over to the writer as "prometheus"
+// metrics, with the value in field named after the metric and labels (and
+// "instance" of the target, unless there's such label) as tags. Histograms
+// and summaries are split into their _bucket, _sum and _count samples.
+// Timestamps of the samples are kept only if HonorTimestamps is set.
+type PrometheusScraper struct {
+	Targets         []string
+	Interval        time.Duration
+	HonorTimestamps bool
+	Client          *http.Client
+	Size            int
+	Chan            chan *Metric
+	ExitFlag        *Flag
+	Wg              *sync.WaitGroup
+	Logger          *Logger
+	Stats           *PrometheusScraperStats
+}
+
+// NewPrometheusScraper
+func NewPrometheusScraper(c *TransportConfig, exitFlag *Flag, logger *Logger) (*PrometheusScraper, error) {
+	if c.BufferSize == 0 {
+		c.BufferSize = 1000
+	}
+
+	if len(c.PrometheusTargets) == 0 {
+		return nil, &TransportError{"prometheus", fmt.Errorf("prometheus_targets are required")}
+	}
+	for _, target := range c.PrometheusTargets {
+		if _, err := url.Parse(target); err != nil {
+			return nil, &TransportError{"prometheus", fmt.Errorf("invalid target: %v", err)}
+		}
+	}
+
+	if c.PrometheusScrapeInterval.Duration == 0 {
+		c.PrometheusScrapeInterval.Duration = 15 * time.Second
+	}
+
+	if c.PrometheusHTTPTimeout.Duration == 0 {
+		c.PrometheusHTTPTimeout.Duration = 10 * time.Second
+	}
+
+	return &PrometheusScraper{
+		Targets:         c.PrometheusTargets,
+		Interval:        c.PrometheusScrapeInterval.Duration,
+		HonorTimestamps: c.PrometheusHonorTimestamps,
+		Client:          &http.Client{Timeout: c.PrometheusHTTPTimeout.Duration},
+		Size:            c.BufferSize,
+		Chan:            make(chan *Metric, c.BufferSize),
+		ExitFlag:        exitFlag,
+		Wg:              &sync.WaitGroup{},
+		Logger:          logger,
+		Stats:           NewPrometheusScraperStats(),
+	}, nil
+}
+
+// PrometheusMetrics decodes metric families of the exposition in format,
+// samples without timestamp (or all of them unless honorTimestamps) get ts
+func PrometheusMetrics(r io.Reader, format expfmt.Format, ts time.Time, honorTimestamps bool) ([]*Metric, error) {
+	dec := expfmt.NewDecoder(r, format)
+	opts := &expfmt.DecodeOptions{Timestamp: model.TimeFromUnixNano(ts.UnixNano())}
+
+	var metrics []*Metric
+	for {
+		var family dto.MetricFamily
+		if err := dec.Decode(&family); err == io.EOF {
+			break
+		} else if err != nil {
+			return metrics, err
+		}
+		samples, err := expfmt.ExtractSamples(opts, &family)
+		if err != nil {
+			return metrics, err
+		}
+		for _, s := range samples {
+			name := string(s.Metric[model.MetricNameLabel])
+			m := &Metric{
+				Name:      "prometheus",
+				Timestamp: ts,
+				Value:     float64(s.Value),
+				Fields:    make(map[string]string, len(s.Metric)),
+				Values:    map[string]interface{}{name: float64(s.Value)},
+				OK:        true,
+			}
+			if honorTimestamps {
+				m.Timestamp = s.Timestamp.Time()
+			}
+			for k, v := range s.Metric {
+				if k != model.MetricNameLabel {
+					m.Fields[string(k)] = string(v)
+				}
+			}
+			metrics = append(metrics, m)
+		}
+	}
+	return metrics, nil
+}
+
+// scrape reads metrics of the target
+func (t *PrometheusScraper) scrape(target string) ([]*Metric, error) {
+	req, err := http.NewRequest("GET", target, nil)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Accept", prometheusAccept)
+
+	ts := time.Now()
+	resp, err := t.Client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("unexpected status %s", resp.Status)
+	}
+
+	metrics, err := PrometheusMetrics(resp.Body, expfmt.ResponseFormat(resp.Header), ts, t.HonorTimestamps)
+	if err != nil {
+		return nil, fmt.Errorf("invalid exposition: %v", err)
+	}
+	for _, m := range metrics {
+		if _, ok := m.Fields["instance"]; !ok {
+			m.Fields["instance"] = req.URL.Host
+		}
+	}
+	return metrics, nil
+}
+
+func (t *PrometheusScraper) read(target string) {
+	metrics, err := t.scrape(target)
+	if err != nil {
+		t.Stats.Failed.Increment(1)
+		t.Logger.Error("[prometheus] Failed to scrape %s: %v", redactURL(target), err)
+		return
+	}
+	for _, m := range metrics {
+		t.Chan <- m
+	}
+	t.Stats.Received.Increment(len(metrics))
+	pipelineStats.Received.Add("prometheus", len(metrics))
+}
+
+func (t *PrometheusScraper) Start() {
+	t.Logger.Info("[prometheus] Scraping %d targets every %v", len(t.Targets), t.Interval)
+
+	// slow targets don't hold up the others
+	for _, target := range t.Targets {
+		t.Wg.Add(1)
+		go func(target string) {
+			defer t.Wg.Done()
+			ticker := time.NewTicker(t.Interval)
+			defer ticker.Stop()
+			for {
+				t.read(target)
+				select {
+				case <-ticker.C:
+				case <-t.ExitFlag.Done():
+					return
+				}
+			}
+		}(target)
+	}
+}
+
+func (t *PrometheusScraper) Stop() {
+	t.Wg.Wait()
+}
+
+func (t *PrometheusScraper) CloseOutput() {
+	return
+}
+
+func (t *PrometheusScraper) CloseInput() {
+	return
+}
+
+func (t *PrometheusScraper) InputChan() chan<- *Metric {
+	return t.Chan
+}
+
+func (t *PrometheusScraper) OutputChan() <-chan *Metric {
+	return t.Chan
+}
+
+func (t *PrometheusScraper) InputChanLen() int {
+	return len(t.Chan)
+}
+
+func (t *PrometheusScraper) OutputChanLen() int {
+	return len(t.Chan)
+}
+
+func (t *PrometheusScraper) LogReport() {
+	t.Logger.Info("[transport] prometheus: %d/%d (length/capacity), metrics: %d/%d/%.3f (total_received/failed_scrapes/rate_per_sec)",
+		len(t.Chan),
+		t.Size,
+		t.Stats.Received.Total(),
+		t.Stats.Failed.Total(),
+		t.Stats.Received.Rate(time.Second),
+	)
+}
+
+type PrometheusScraperStats struct {
+	Received *StatsCounter
+	Failed   *StatsCounter
+}
+
+func NewPrometheusScraperStats() *PrometheusScraperStats {
+	now := time.Now()
+	return &PrometheusScraperStats{
+		Received: NewStatsCounter(now),
+		Failed:   NewStatsCounter(now),
+	}
+}
+
+func (s *PrometheusScraperStats) Reset() {
+	s.Received.Reset()
+	s.Failed.Reset()
+}
@@ -9,11 +9,18 @@ import (
 	"gopkg.in/redis.v4"
 )
 
+func init() {
+	RegisterTransport("redis", func(c *TransportConfig, listenerEnabled bool, writerEnabled bool, exitFlag *Flag, logger *Logger) (Transport, error) {
+		return NewRedisTransport(c, listenerEnabled, writerEnabled, exitFlag, logger)
+	})
+}
+
 type RedisTransport struct {
 	Redis           *redis.Client
 	Size            int
 	Wait            int
 	Queue           string
+	Format          SerializationFormat
 	ListenerEnabled bool
 	WriterEnabled   bool
 	Input           chan *Metric
@@ -27,39 +34,20 @@ type RedisTransport struct {
 
 // NewRedisTransport
 func NewRedisTransport(c *TransportConfig, listenerEnabled bool, writerEnabled bool, exitFlag *Flag, logger *Logger) (*RedisTransport, error) {
-	connRe := regexp.MustCompile(`^(?P<network>(tcp|unix)):/{2,3}(?P<addr>[0-9a-zA-Z\._]+:[0-9]+)|(?P<db>1?[0-9])?$`)
-	connMatch := connRe.FindStringSubmatch(c.RedisURL)
-	connData := map[string]string{}
-	for i, n := range connRe.SubexpNames() {
-		connData[n] = connMatch[i]
-	}
-
 	if c.BufferSize == 0 {
 		c.BufferSize = 1000
 	}
 
-	if connData["db"] == "" {
-		connData["db"] = "0"
-	}
-	dbNum, err := strconv.Atoi(connData["db"])
-	if err != nil {
-		return nil, &TransportError{"redis", err}
-	}
-
 	if c.RedisQueue == "" {
 		c.RedisQueue = "default"
 	}
 
-	conn := redis.NewClient(&redis.Options{
-		Network:     connData["network"],
-		Addr:        connData["addr"],
-		DB:          dbNum,
-		MaxRetries:  c.RedisRetries,
-		PoolSize:    c.RedisConnections,
-		PoolTimeout: time.Duration(c.RedisTimeout) * time.Second},
-	)
+	format, err := NewSerializationFormat(c.SerializationFormat)
+	if err != nil {
+		return nil, &TransportError{"redis", err}
+	}
 
-	_, err = conn.Ping().Result()
+	conn, err := redisInit(c)
 	if err != nil {
 		return nil, &TransportError{"redis", err}
 	}
@@ -69,6 +57,7 @@ func NewRedisTransport(c *TransportConfig, listenerEnabled bool, writerEnabled b
 		Size:            c.BufferSize,
 		Queue:           "metcap:" + c.RedisQueue,
 		Wait:            c.RedisWait,
+		Format:          format,
 		ListenerEnabled: listenerEnabled,
 		WriterEnabled:   writerEnabled,
 		Input:           make(chan *Metric, c.BufferSize),
@@ -81,23 +70,72 @@ func NewRedisTransport(c *TransportConfig, listenerEnabled bool, writerEnabled b
 	}, nil
 }
 
+// redisInit parses the connection URL and connects to Redis
+func redisInit(c *TransportConfig) (*redis.Client, error) {
+	connRe := regexp.MustCompile(`^(?P<network>(tcp|unix)):/{2,3}(?P<addr>[0-9a-zA-Z\._]+:[0-9]+)|(?P<db>1?[0-9])?$`)
+	connMatch := connRe.FindStringSubmatch(c.RedisURL)
+	connData := map[string]string{}
+	for i, n := range connRe.SubexpNames() {
+		connData[n] = connMatch[i]
+	}
+
+	if connData["db"] == "" {
+		connData["db"] = "0"
+	}
+	dbNum, err := strconv.Atoi(connData["db"])
+	if err != nil {
+		return nil, err
+	}
+
+	conn := redis.NewClient(&redis.Options{
+		Network:     connData["network"],
+		Addr:        connData["addr"],
+		DB:          dbNum,
+		MaxRetries:  c.RedisRetries,
+		PoolSize:    c.RedisConnections,
+		PoolTimeout: time.Duration(c.RedisTimeout) * time.Second},
+	)
+
+	_, err = conn.Ping().Result()
+	if err != nil {
+		return nil, err
+	}
+
+	return conn, nil
+}
+
 func (t *RedisTransport) Start() {
 
 	if t.ListenerEnabled {
+		t.Wg.Add(1)
 		go func() {
-			t.Wg.Add(1)
 			defer t.Wg.Done()
 			for {
 				select {
 				case m := <-t.Input:
-					err := t.Redis.RPush(t.Queue, m.Serialize()).Err()
+					body, err := t.Format.Marshal(m)
+					if err != nil {
+						pipelineStats.Dropped.Add("serialize", 1)
+						t.Logger.Error("[redis] Failed to serialize metric: %v", err)
+						continue
+					}
+					t0 := time.Now()
+					err = t.Redis.RPush(t.Queue, body).Err()
 					if err != nil {
 						t.Logger.Error("[redis] Failed to push metric: %v - %v", err, err.Error())
 						continue
 					}
+					pipelineStats.PublishDuration.Observe(time.Since(t0))
+					pipelineStats.Published.Add("redis", 1)
 				case <-t.ExitChan:
 					for m := range t.Input {
-						err := t.Redis.RPush(t.Queue, m.Serialize()).Err()
+						body, err := t.Format.Marshal(m)
+						if err != nil {
+							pipelineStats.Dropped.Add("serialize", 1)
+							t.Logger.Error("[redis] Failed to serialize metric: %v", err)
+							continue
+						}
+						err = t.Redis.RPush(t.Queue, body).Err()
 						if err != nil {
 							t.Logger.Error("[redis] Failed to push metric: %v - %v", err, err.Error())
 							continue
@@ -110,8 +148,8 @@ func (t *RedisTransport) Start() {
 	}
 
 	if t.WriterEnabled {
+		t.Wg.Add(1)
 		go func() {
-			t.Wg.Add(1)
 			defer t.Wg.Done()
 			for {
 				if t.ExitFlag.Get() {
@@ -123,11 +161,12 @@ func (t *RedisTransport) Start() {
 					t.Logger.Error("[redis] Failed to get metric: %v - %v", err, err.Error())
 				}
 				if m != nil {
-					metric, err := DeserializeMetric(m[1])
+					metric, err := t.Format.Unmarshal([]byte(m[1]))
 					if err == nil {
-						t.Output <- &metric
+						t.Output <- metric
 					} else {
-						t.Logger.Error("[redis] failed to DeserializeMetric(): %v - %v", err, err.Error())
+						pipelineStats.DeserializationErrors.Add("redis", 1)
+						t.Logger.Error("[redis] Failed to deserialize metric: %v", err)
 					}
 				}
 			}
@@ -0,0 +1,341 @@
+package metcap
+
+import (
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"gopkg.in/redis.v4"
+)
+
+func init() {
+	RegisterTransport("redis-stream", func(c *TransportConfig, listenerEnabled bool, writerEnabled bool, exitFlag *Flag, logger *Logger) (Transport, error) {
+		return NewRedisStreamTransport(c, listenerEnabled, writerEnabled, exitFlag, logger)
+	})
+}
+
+type RedisStreamTransport struct {
+	Redis           *redis.Client
+	Size            int
+	Wait            int
+	Stream          string
+	Group           string
+	ConsumerID      string
+	Format          SerializationFormat
+	ListenerEnabled bool
+	WriterEnabled   bool
+	Input           chan *Metric
+	Output          chan *Metric
+	ExitFlag        *Flag
+	Wg              *sync.WaitGroup
+	Stats           *RedisStreamTransportStats
+	Logger          *Logger
+}
+
+// redisStreamEntry is a single message read from the stream
+type redisStreamEntry struct {
+	id   string
+	data string
+}
+
+// NewRedisStreamTransport
+func NewRedisStreamTransport(c *TransportConfig, listenerEnabled bool, writerEnabled bool, exitFlag *Flag, logger *Logger) (*RedisStreamTransport, error) {
+	if c.BufferSize == 0 {
+		c.BufferSize = 1000
+	}
+
+	if c.RedisStream == "" {
+		c.RedisStream = "default"
+	}
+
+	if c.RedisGroup == "" {
+		c.RedisGroup = "default"
+	}
+
+	if c.RedisConsumerID == "" {
+		// consumer ID has to be stable across restarts to recover pending entries
+		hostname, err := os.Hostname()
+		if err != nil {
+			return nil, &TransportError{"redis-stream", err}
+		}
+		c.RedisConsumerID = hostname
+	}
+
+	if c.RedisWait == 0 {
+		c.RedisWait = 1
+	}
+
+	format, err := NewSerializationFormat(c.SerializationFormat)
+	if err != nil {
+		return nil, &TransportError{"redis-stream", err}
+	}
+
+	conn, err := redisInit(c)
+	if err != nil {
+		return nil, &TransportError{"redis-stream", err}
+	}
+
+	stream := "metcap:" + c.RedisStream
+	group := "metcap:" + c.RedisGroup
+
+	if writerEnabled {
+		// create consumer group (and the stream) on first run
+		cmd := redis.NewCmd("XGROUP", "CREATE", stream, group, "$", "MKSTREAM")
+		conn.Process(cmd)
+		if err := cmd.Err(); err != nil && !strings.HasPrefix(err.Error(), "BUSYGROUP") {
+			return nil, &TransportError{"redis-stream", err}
+		}
+	}
+
+	return &RedisStreamTransport{
+		Redis:           conn,
+		Size:            c.BufferSize,
+		Wait:            c.RedisWait,
+		Stream:          stream,
+		Group:           group,
+		ConsumerID:      c.RedisConsumerID,
+		Format:          format,
+		ListenerEnabled: listenerEnabled,
+		WriterEnabled:   writerEnabled,
+		Input:           make(chan *Metric, c.BufferSize),
+		Output:          make(chan *Metric, c.BufferSize),
+		ExitFlag:        exitFlag,
+		Wg:              &sync.WaitGroup{},
+		Stats:           NewRedisStreamTransportStats(),
+		Logger:          logger,
+	}, nil
+}
+
+func (t *RedisStreamTransport) add(m *Metric) error {
+	body, err := t.Format.Marshal(m)
+	if err != nil {
+		return err
+	}
+	t0 := time.Now()
+	cmd := redis.NewCmd("XADD", t.Stream, "*", "m", body)
+	t.Redis.Process(cmd)
+	if err := cmd.Err(); err != nil {
+		return err
+	}
+	pipelineStats.PublishDuration.Observe(time.Since(t0))
+	pipelineStats.Published.Add("redis-stream", 1)
+	return nil
+}
+
+// read calls XREADGROUP starting at given ID; ">" reads new entries, any
+// other ID reads entries after it delivered to this consumer but never
+// acknowledged
+func (t *RedisStreamTransport) read(id string) ([]redisStreamEntry, error) {
+	args := []interface{}{"XREADGROUP", "GROUP", t.Group, t.ConsumerID, "COUNT", t.Size}
+	if id == ">" {
+		args = append(args, "BLOCK", t.Wait*1000)
+	}
+	args = append(args, "STREAMS", t.Stream, id)
+	cmd := redis.NewCmd(args...)
+	t.Redis.Process(cmd)
+	reply, err := cmd.Result()
+	if err == redis.Nil {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	// reply: [[stream, [[id, [field, value, ...]], ...]], ...]
+	var entries []redisStreamEntry
+	streams, _ := reply.([]interface{})
+	for _, s := range streams {
+		stream, ok := s.([]interface{})
+		if !ok || len(stream) < 2 {
+			continue
+		}
+		messages, _ := stream[1].([]interface{})
+		for _, msg := range messages {
+			message, ok := msg.([]interface{})
+			if !ok || len(message) < 2 {
+				continue
+			}
+			entry := redisStreamEntry{}
+			entry.id, _ = message[0].(string)
+			kv, _ := message[1].([]interface{})
+			for i := 0; i+1 < len(kv); i += 2 {
+				if k, _ := kv[i].(string); k == "m" {
+					entry.data, _ = kv[i+1].(string)
+				}
+			}
+			entries = append(entries, entry)
+		}
+	}
+	return entries, nil
+}
+
+func (t *RedisStreamTransport) ack(id string) error {
+	cmd := redis.NewCmd("XACK", t.Stream, t.Group, id)
+	t.Redis.Process(cmd)
+	return cmd.Err()
+}
+
+// deliver sends the entries downstream and acknowledges them, it stops
+// at the first entry it couldn't send before exit and leaves it pending
+func (t *RedisStreamTransport) deliver(entries []redisStreamEntry) bool {
+	for _, entry := range entries {
+		if entry.data == "" {
+			// entry was trimmed from the stream while pending
+			t.ack(entry.id)
+			continue
+		}
+		metric, err := t.Format.Unmarshal([]byte(entry.data))
+		if err != nil {
+			pipelineStats.DeserializationErrors.Add("redis-stream", 1)
+			t.Logger.Error("[redis-stream] Failed to deserialize metric: %v", err)
+		} else {
+			select {
+			case t.Output <- metric:
+			case <-t.ExitFlag.Done():
+				return false
+			}
+		}
+		if err := t.ack(entry.id); err != nil {
+			t.Logger.Error("[redis-stream] Failed to acknowledge entry %s: %v", entry.id, err)
+		}
+	}
+	return true
+}
+
+func (t *RedisStreamTransport) Start() {
+
+	if t.ListenerEnabled {
+		t.Wg.Add(1)
+		go func() {
+			defer t.Wg.Done()
+			for {
+				select {
+				case m := <-t.Input:
+					if err := t.add(m); err != nil {
+						t.Logger.Error("[redis-stream] Failed to add metric: %v", err)
+					}
+				case <-t.ExitFlag.Done():
+					for len(t.Input) > 0 {
+						if err := t.add(<-t.Input); err != nil {
+							t.Logger.Error("[redis-stream] Failed to add metric: %v", err)
+						}
+					}
+					return
+				}
+			}
+		}()
+	}
+
+	if t.WriterEnabled {
+		t.Wg.Add(1)
+		go func() {
+			defer t.Wg.Done()
+
+			// recover entries left pending by the previous run, reading past
+			// the last returned ID so entries that failed to ack don't come
+			// back until the next restart
+			pending := "0"
+			for !t.ExitFlag.Get() {
+				entries, err := t.read(pending)
+				if err != nil {
+					t.Logger.Error("[redis-stream] Failed to read pending entries: %v", err)
+					break
+				}
+				if len(entries) == 0 {
+					break
+				}
+				t.Logger.Info("[redis-stream] Recovering %d pending entries", len(entries))
+				if !t.deliver(entries) {
+					return
+				}
+				pending = entries[len(entries)-1].id
+			}
+
+			for !t.ExitFlag.Get() {
+				entries, err := t.read(">")
+				if err != nil {
+					t.Logger.Error("[redis-stream] Failed to read entries: %v", err)
+					select {
+					case <-time.After(time.Duration(t.Wait) * time.Second):
+					case <-t.ExitFlag.Done():
+					}
+					continue
+				}
+				if !t.deliver(entries) {
+					return
+				}
+			}
+		}()
+	}
+
+	go func() {
+		tick := time.NewTicker(1 * time.Second)
+		defer tick.Stop()
+		for {
+			cmd := redis.NewCmd("XLEN", t.Stream)
+			t.Redis.Process(cmd)
+			if n, err := cmd.Result(); err == nil {
+				if l, ok := n.(int64); ok {
+					t.Stats.StreamLength.Set(l)
+				}
+			}
+			select {
+			case <-tick.C:
+			case <-t.ExitFlag.Done():
+				return
+			}
+		}
+	}()
+}
+
+func (t *RedisStreamTransport) Stop() {
+	t.Wg.Wait()
+	t.Redis.Close()
+}
+
+func (t *RedisStreamTransport) CloseOutput() {
+	return
+}
+
+func (t *RedisStreamTransport) CloseInput() {
+	return
+}
+
+func (t *RedisStreamTransport) InputChan() chan<- *Metric {
+	return t.Input
+}
+
+func (t *RedisStreamTransport) OutputChan() <-chan *Metric {
+	return t.Output
+}
+
+func (t *RedisStreamTransport) InputChanLen() int {
+	return len(t.Input)
+}
+
+func (t *RedisStreamTransport) OutputChanLen() int {
+	return len(t.Output)
+}
+
+func (t *RedisStreamTransport) LogReport() {
+	t.Logger.Info("[transport] redis-stream: %d/%d/%d (input/output/capacity), stream %s: %d entries",
+		len(t.Input),
+		len(t.Output),
+		t.Size,
+		t.Stream,
+		t.Stats.StreamLength.Get(),
+	)
+}
+
+type RedisStreamTransportStats struct {
+	StreamLength *StatsGauge
+}
+
+func NewRedisStreamTransportStats() *RedisStreamTransportStats {
+	return &RedisStreamTransportStats{
+		StreamLength: NewStatsGauge(),
+	}
+}
+
+func (s *RedisStreamTransportStats) Reset() {}
@@ -0,0 +1,265 @@
+package metcap
+
+import (
+	"fmt"
+	"io/ioutil"
+	"net"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gosnmp/gosnmp"
+	"gopkg.in/yaml.v3"
+)
+
+// snmpTrapOID is the varbind of v2c and v3 traps naming the trap
+const snmpTrapOID = ".1.3.6.1.6.3.1.1.4.1.0"
+
+func init() {
+	RegisterTransport("snmp", func(c *TransportConfig, listenerEnabled bool, writerEnabled bool, exitFlag *Flag, logger *Logger) (Transport, error) {
+		if !writerEnabled {
+			return nil, &TransportError{"snmp", fmt.Errorf("snmp transport requires you to have writer enabled")}
+		}
+		return NewSNMPTrapTransport(c, exitFlag, logger)
+	})
+}
+
+// SNMPTrapTransport receives SNMPv2c and SNMPv3 (without authentication)
+// traps and hands each of them over to the writer as "snmp_trap" metric
+// tagged by "host" of the agent and "trap" name. Varbinds become fields
+// named by their OIDs mapped by the file at SNMPMIBPath, the longest
+// mapped prefix of the OID is replaced by its name, e.g. "ifIndex.3".
+type SNMPTrapTransport struct {
+	Socket    net.PacketConn
+	Community string
+	Names     map[string]string
+	Size      int
+	Chan      chan *Metric
+	ExitFlag  *Flag
+	Wg        *sync.WaitGroup
+	Logger    *Logger
+	Stats     *SNMPTrapTransportStats
+	params    *gosnmp.GoSNMP
+}
+
+// NewSNMPTrapTransport
+func NewSNMPTrapTransport(c *TransportConfig, exitFlag *Flag, logger *Logger) (*SNMPTrapTransport, error) {
+	if c.BufferSize == 0 {
+		c.BufferSize = 1000
+	}
+
+	if c.SNMPListenAddr == "" {
+		c.SNMPListenAddr = ":1162"
+	}
+
+	names := make(map[string]string)
+	if c.SNMPMIBPath != "" {
+		var err error
+		if names, err = loadSNMPNames(c.SNMPMIBPath); err != nil {
+			return nil, &TransportError{"snmp", err}
+		}
+	}
+
+	sock, err := net.ListenPacket("udp", c.SNMPListenAddr)
+	if err != nil {
+		return nil, &TransportError{"snmp", err}
+	}
+
+	return &SNMPTrapTransport{
+		Socket:    sock,
+		Community: c.SNMPCommunity,
+		Names:     names,
+		Size:      c.BufferSize,
+		Chan:      make(chan *Metric, c.BufferSize),
+		ExitFlag:  exitFlag,
+		Wg:        &sync.WaitGroup{},
+		Logger:    logger,
+		Stats:     NewSNMPTrapTransportStats(),
+		params: &gosnmp.GoSNMP{
+			SecurityModel:      gosnmp.UserSecurityModel,
+			SecurityParameters: &gosnmp.UsmSecurityParameters{},
+		},
+	}, nil
+}
+
+// loadSNMPNames reads YAML map of OIDs to names, OIDs get the leading dot
+// gosnmp uses
+func loadSNMPNames(path string) (map[string]string, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	var mapping map[string]string
+	if err := yaml.Unmarshal(data, &mapping); err != nil {
+		return nil, fmt.Errorf("invalid OID mapping %s: %v", path, err)
+	}
+	names := make(map[string]string, len(mapping))
+	for oid, name := range mapping {
+		names["."+strings.TrimPrefix(oid, ".")] = name
+	}
+	return names, nil
+}
+
+// Name returns name of the OID by its longest mapped prefix, followed by
+// the rest of the OID; unmapped OIDs are returned without the leading dot
+func (t *SNMPTrapTransport) Name(oid string) string {
+	for prefix := oid; prefix != ""; {
+		if name, ok := t.Names[prefix]; ok {
+			return name + oid[len(prefix):]
+		}
+		i := strings.LastIndexByte(prefix, '.')
+		if i < 0 {
+			break
+		}
+		prefix = prefix[:i]
+	}
+	return strings.TrimPrefix(oid, ".")
+}
+
+// snmpValue converts value of the varbind to a field value
+func snmpValue(pdu gosnmp.SnmpPDU) (interface{}, bool) {
+	switch v := pdu.Value.(type) {
+	case []byte:
+		return string(v), true
+	case string:
+		return v, true
+	case float32:
+		return float64(v), true
+	case float64:
+		return v, true
+	case uint64:
+		if v > 1<<63-1 {
+			return float64(v), true
+		}
+		return int64(v), true
+	}
+	if pdu.Value == nil {
+		return nil, false
+	}
+	return gosnmp.ToBigInt(pdu.Value).Int64(), true
+}
+
+// Convert returns metric of the trap received from the address
+func (t *SNMPTrapTransport) Convert(packet *gosnmp.SnmpPacket, addr net.Addr) *Metric {
+	m := &Metric{
+		Name:      "snmp_trap",
+		Timestamp: time.Now(),
+		Value:     1,
+		Fields:    map[string]string{"trap": "unknown"},
+		Values:    make(map[string]interface{}),
+		OK:        true,
+	}
+	if host, _, err := net.SplitHostPort(addr.String()); err == nil {
+		m.Fields["host"] = host
+	}
+	for _, pdu := range packet.Variables {
+		if pdu.Name == snmpTrapOID {
+			if oid, ok := pdu.Value.(string); ok {
+				m.Fields["trap"] = t.Name(oid)
+			}
+			continue
+		}
+		if v, ok := snmpValue(pdu); ok {
+			m.Values[t.Name(pdu.Name)] = v
+		}
+	}
+	return m
+}
+
+func (t *SNMPTrapTransport) decode(data []byte, addr net.Addr) {
+	packet, err := t.params.UnmarshalTrap(data, false)
+	if err == nil && packet.Version != gosnmp.Version3 && t.Community != "" && packet.Community != t.Community {
+		err = fmt.Errorf("wrong community '%s'", packet.Community)
+	}
+	if err != nil {
+		t.Stats.Failed.Increment(1)
+		pipelineStats.Dropped.Add("decode", 1)
+		t.Logger.Debug("[snmp] %s: %v", addr.String(), err)
+		return
+	}
+	t.Chan <- t.Convert(packet, addr)
+	t.Stats.Received.Increment(1)
+	pipelineStats.Received.Add("snmp", 1)
+}
+
+func (t *SNMPTrapTransport) Start() {
+	t.Logger.Info("[snmp] Receiving traps on %s", t.Socket.LocalAddr().String())
+
+	t.Wg.Add(1)
+	go func() {
+		defer t.Wg.Done()
+		buf := make([]byte, 64*1024)
+		for {
+			n, addr, err := t.Socket.ReadFrom(buf)
+			if err != nil {
+				if t.ExitFlag.Get() {
+					return
+				}
+				t.Logger.Error("[snmp] Failed to read datagram: %v", err)
+				continue
+			}
+			t.decode(append([]byte{}, buf[:n]...), addr)
+		}
+	}()
+
+	go func() {
+		<-t.ExitFlag.Done()
+		t.Socket.Close()
+	}()
+}
+
+func (t *SNMPTrapTransport) Stop() {
+	t.Wg.Wait()
+}
+
+func (t *SNMPTrapTransport) CloseOutput() {
+	return
+}
+
+func (t *SNMPTrapTransport) CloseInput() {
+	return
+}
+
+func (t *SNMPTrapTransport) InputChan() chan<- *Metric {
+	return t.Chan
+}
+
+func (t *SNMPTrapTransport) OutputChan() <-chan *Metric {
+	return t.Chan
+}
+
+func (t *SNMPTrapTransport) InputChanLen() int {
+	return len(t.Chan)
+}
+
+func (t *SNMPTrapTransport) OutputChanLen() int {
+	return len(t.Chan)
+}
+
+func (t *SNMPTrapTransport) LogReport() {
+	t.Logger.Info("[transport] snmp: %d/%d (length/capacity), traps: %d/%d/%.3f (total_received/failed/rate_per_sec)",
+		len(t.Chan),
+		t.Size,
+		t.Stats.Received.Total(),
+		t.Stats.Failed.Total(),
+		t.Stats.Received.Rate(time.Second),
+	)
+}
+
+type SNMPTrapTransportStats struct {
+	Received *StatsCounter
+	Failed   *StatsCounter
+}
+
+func NewSNMPTrapTransportStats() *SNMPTrapTransportStats {
+	now := time.Now()
+	return &SNMPTrapTransportStats{
+		Received: NewStatsCounter(now),
+		Failed:   NewStatsCounter(now),
+	}
+}
+
+func (s *SNMPTrapTransportStats) Reset() {
+	s.Received.Reset()
+	s.Failed.Reset()
+}
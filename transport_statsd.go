@@ -0,0 +1,406 @@
+package metcap
+
+import (
+	"fmt"
+	"math"
+	"net"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+func init() {
+	RegisterTransport("statsd", func(c *TransportConfig, listenerEnabled bool, writerEnabled bool, exitFlag *Flag, logger *Logger) (Transport, error) {
+		if !writerEnabled {
+			return nil, &TransportError{"statsd", fmt.Errorf("statsd transport requires you to have writer enabled")}
+		}
+		return NewStatsDServer(c, exitFlag, logger)
+	})
+}
+
+// statsdTypes names metric types of StatsD, for the "metric_type" tag
+var statsdTypes = map[string]string{
+	"c":  "counter",
+	"g":  "gauge",
+	"ms": "timing",
+	"h":  "histogram",
+	"s":  "set",
+}
+
+// StatsDServer receives StatsD datagrams, aggregates them the way StatsD
+// does and hands the aggregates over to the writer every FlushInterval.
+// Counters are summed (with "rate" per second field), gauges keep their
+// last value, sets count unique values and timers and histograms emit
+// mean value with count, min, max, mean, stddev, p95 and p99 fields.
+// Metrics are tagged by "metric_type", and with DogStatsD tags
+// ("|#tag:value,...") if Tags is set.
+type StatsDServer struct {
+	Socket        net.PacketConn
+	FlushInterval time.Duration
+	Tags          bool
+	Size          int
+	Chan          chan *Metric
+	ExitFlag      *Flag
+	Wg            *sync.WaitGroup
+	Logger        *Logger
+	Stats         *StatsDServerStats
+	metrics       map[string]*statsdMetric
+	lock          *sync.Mutex
+}
+
+// statsdSample is a single value of the datagram line
+type statsdSample struct {
+	name     string
+	kind     string
+	value    float64
+	member   string
+	relative bool
+	rate     float64
+	tags     map[string]string
+}
+
+// statsdMetric aggregates samples of the interval
+type statsdMetric struct {
+	name    string
+	kind    string
+	tags    map[string]string
+	value   float64
+	count   float64
+	samples []float64
+	members map[string]struct{}
+	updated bool
+}
+
+// NewStatsDServer
+func NewStatsDServer(c *TransportConfig, exitFlag *Flag, logger *Logger) (*StatsDServer, error) {
+	if c.BufferSize == 0 {
+		c.BufferSize = 1000
+	}
+
+	if c.StatsDListenAddr == "" {
+		c.StatsDListenAddr = ":8125"
+	}
+
+	if c.StatsDFlushInterval.Duration == 0 {
+		c.StatsDFlushInterval.Duration = 10 * time.Second
+	}
+
+	sock, err := net.ListenPacket("udp", c.StatsDListenAddr)
+	if err != nil {
+		return nil, &TransportError{"statsd", err}
+	}
+
+	return &StatsDServer{
+		Socket:        sock,
+		FlushInterval: c.StatsDFlushInterval.Duration,
+		Tags:          c.StatsDMTags,
+		Size:          c.BufferSize,
+		Chan:          make(chan *Metric, c.BufferSize),
+		ExitFlag:      exitFlag,
+		Wg:            &sync.WaitGroup{},
+		Logger:        logger,
+		Stats:         NewStatsDServerStats(),
+		metrics:       make(map[string]*statsdMetric),
+		lock:          &sync.Mutex{},
+	}, nil
+}
+
+// parseStatsD parses "<name>:<value>|<type>[|@<rate>][|#<tags>]" line,
+// tags are parsed only if dogTags is set
+func parseStatsD(line string, dogTags bool) (*statsdSample, error) {
+	// tags may contain colons, but the name can't
+	i := strings.IndexByte(line, ':')
+	if i <= 0 {
+		return nil, fmt.Errorf("invalid line '%s'", line)
+	}
+	sections := strings.Split(line[i+1:], "|")
+	if len(sections) < 2 || sections[0] == "" {
+		return nil, fmt.Errorf("invalid line '%s'", line)
+	}
+	s := &statsdSample{
+		name: line[:i],
+		kind: sections[1],
+		rate: 1,
+		tags: make(map[string]string),
+	}
+	if _, ok := statsdTypes[s.kind]; !ok {
+		return nil, fmt.Errorf("unknown type '%s' of '%s'", s.kind, s.name)
+	}
+
+	raw := sections[0]
+	if s.kind == "s" {
+		s.member = raw
+	} else {
+		s.relative = s.kind == "g" && (raw[0] == '+' || raw[0] == '-')
+		var err error
+		if s.value, err = strconv.ParseFloat(raw, 64); err != nil {
+			return nil, fmt.Errorf("invalid value '%s' of '%s'", raw, s.name)
+		}
+	}
+
+	for _, section := range sections[2:] {
+		switch {
+		case strings.HasPrefix(section, "@"):
+			rate, err := strconv.ParseFloat(section[1:], 64)
+			if err != nil || rate <= 0 || rate > 1 {
+				return nil, fmt.Errorf("invalid sample rate '%s' of '%s'", section, s.name)
+			}
+			s.rate = rate
+		case strings.HasPrefix(section, "#") && dogTags:
+			for _, tag := range strings.Split(section[1:], ",") {
+				if tag == "" {
+					continue
+				}
+				if kv := strings.SplitN(tag, ":", 2); len(kv) == 2 {
+					s.tags[kv[0]] = kv[1]
+				} else {
+					s.tags[tag] = "true"
+				}
+			}
+		}
+	}
+	return s, nil
+}
+
+// statsdKey identifies the metric by its type, name and sorted tags
+func statsdKey(s *statsdSample) string {
+	tags := make([]string, 0, len(s.tags))
+	for k, v := range s.tags {
+		tags = append(tags, k+"="+v)
+	}
+	sort.Strings(tags)
+	return s.kind + "|" + s.name + "," + strings.Join(tags, ",")
+}
+
+// Add accounts the sample to its metric of the interval
+func (t *StatsDServer) Add(s *statsdSample) {
+	key := statsdKey(s)
+
+	t.lock.Lock()
+	defer t.lock.Unlock()
+
+	m, ok := t.metrics[key]
+	if !ok {
+		m = &statsdMetric{name: s.name, kind: s.kind, tags: s.tags}
+		t.metrics[key] = m
+	}
+	switch s.kind {
+	case "c":
+		m.value += s.value / s.rate
+	case "g":
+		if s.relative {
+			m.value += s.value
+		} else {
+			m.value = s.value
+		}
+	case "ms", "h":
+		m.samples = append(m.samples, s.value)
+		m.count += 1 / s.rate
+	case "s":
+		if m.members == nil {
+			m.members = make(map[string]struct{})
+		}
+		m.members[s.member] = struct{}{}
+	}
+	m.updated = true
+}
+
+// statsdPercentile returns nearest-rank percentile of sorted samples
+func statsdPercentile(sorted []float64, p float64) float64 {
+	i := int(math.Ceil(p/100*float64(len(sorted)))) - 1
+	if i < 0 {
+		i = 0
+	}
+	return sorted[i]
+}
+
+// metric returns the aggregate as metric
+func (m *statsdMetric) metric(ts time.Time, interval time.Duration) *Metric {
+	tags := make(map[string]string, len(m.tags)+1)
+	for k, v := range m.tags {
+		tags[k] = v
+	}
+	tags[MetricTypeTag] = statsdTypes[m.kind]
+	metric := &Metric{
+		Name:      m.name,
+		Timestamp: ts,
+		Value:     m.value,
+		Fields:    tags,
+		Values:    make(map[string]interface{}),
+		OK:        true,
+	}
+
+	switch m.kind {
+	case "c":
+		metric.Values["rate"] = m.value / interval.Seconds()
+	case "s":
+		metric.Value = float64(len(m.members))
+	case "ms", "h":
+		sorted := append([]float64{}, m.samples...)
+		sort.Float64s(sorted)
+		var sum float64
+		for _, v := range sorted {
+			sum += v
+		}
+		mean := sum / float64(len(sorted))
+		var variance float64
+		for _, v := range sorted {
+			variance += (v - mean) * (v - mean)
+		}
+		metric.Value = mean
+		metric.Values["count"] = m.count
+		metric.Values["min"] = sorted[0]
+		metric.Values["max"] = sorted[len(sorted)-1]
+		metric.Values["mean"] = mean
+		metric.Values["stddev"] = math.Sqrt(variance / float64(len(sorted)))
+		metric.Values["p95"] = statsdPercentile(sorted, 95)
+		metric.Values["p99"] = statsdPercentile(sorted, 99)
+	}
+	return metric
+}
+
+// Flush hands metrics updated in the interval over to the writer, gauges
+// are kept for relative updates
+func (t *StatsDServer) Flush() {
+	now := time.Now()
+	var metrics []*Metric
+
+	t.lock.Lock()
+	for key, m := range t.metrics {
+		if m.updated {
+			metrics = append(metrics, m.metric(now, t.FlushInterval))
+		}
+		if m.kind == "g" {
+			m.updated = false
+		} else {
+			delete(t.metrics, key)
+		}
+	}
+	t.lock.Unlock()
+
+	for _, m := range metrics {
+		t.Chan <- m
+	}
+	t.Stats.Flushed.Increment(len(metrics))
+	pipelineStats.Received.Add("statsd", len(metrics))
+}
+
+func (t *StatsDServer) decode(data []byte, addr net.Addr) {
+	for _, line := range strings.Split(string(data), "\n") {
+		line = strings.TrimSpace(line)
+		if line == "" {
+			continue
+		}
+		s, err := parseStatsD(line, t.Tags)
+		if err != nil {
+			t.Stats.Failed.Increment(1)
+			pipelineStats.Dropped.Add("decode", 1)
+			t.Logger.Debug("[statsd] %s: %v", addr.String(), err)
+			continue
+		}
+		t.Add(s)
+		t.Stats.Received.Increment(1)
+	}
+}
+
+func (t *StatsDServer) Start() {
+	t.Logger.Info("[statsd] Reading datagrams on %s, flushing every %v", t.Socket.LocalAddr().String(), t.FlushInterval)
+
+	read := make(chan struct{})
+	t.Wg.Add(2)
+	go func() {
+		defer t.Wg.Done()
+		defer close(read)
+		buf := make([]byte, 64*1024)
+		for {
+			n, addr, err := t.Socket.ReadFrom(buf)
+			if err != nil {
+				if t.ExitFlag.Get() {
+					return
+				}
+				t.Logger.Error("[statsd] Failed to read datagram: %v", err)
+				continue
+			}
+			t.decode(buf[:n], addr)
+		}
+	}()
+
+	go func() {
+		defer t.Wg.Done()
+		tick := time.NewTicker(t.FlushInterval)
+		defer tick.Stop()
+		for {
+			select {
+			case <-tick.C:
+				t.Flush()
+			case <-t.ExitFlag.Done():
+				t.Socket.Close()
+				<-read
+				t.Flush()
+				return
+			}
+		}
+	}()
+}
+
+func (t *StatsDServer) Stop() {
+	t.Wg.Wait()
+}
+
+func (t *StatsDServer) CloseOutput() {
+	return
+}
+
+func (t *StatsDServer) CloseInput() {
+	return
+}
+
+func (t *StatsDServer) InputChan() chan<- *Metric {
+	return t.Chan
+}
+
+func (t *StatsDServer) OutputChan() <-chan *Metric {
+	return t.Chan
+}
+
+func (t *StatsDServer) InputChanLen() int {
+	return len(t.Chan)
+}
+
+func (t *StatsDServer) OutputChanLen() int {
+	return len(t.Chan)
+}
+
+func (t *StatsDServer) LogReport() {
+	t.Logger.Info("[transport] statsd: %d/%d (length/capacity), samples: %d/%d/%.3f (total_received/failed/rate_per_sec), metrics: %d (total_flushed)",
+		len(t.Chan),
+		t.Size,
+		t.Stats.Received.Total(),
+		t.Stats.Failed.Total(),
+		t.Stats.Received.Rate(time.Second),
+		t.Stats.Flushed.Total(),
+	)
+}
+
+type StatsDServerStats struct {
+	Received *StatsCounter
+	Failed   *StatsCounter
+	Flushed  *StatsCounter
+}
+
+func NewStatsDServerStats() *StatsDServerStats {
+	now := time.Now()
+	return &StatsDServerStats{
+		Received: NewStatsCounter(now),
+		Failed:   NewStatsCounter(now),
+		Flushed:  NewStatsCounter(now),
+	}
+}
+
+func (s *StatsDServerStats) Reset() {
+	s.Received.Reset()
+	s.Failed.Reset()
+	s.Flushed.Reset()
+}
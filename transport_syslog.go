@@ -0,0 +1,405 @@
+package metcap
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+func init() {
+	RegisterTransport("syslog", func(c *TransportConfig, listenerEnabled bool, writerEnabled bool, exitFlag *Flag, logger *Logger) (Transport, error) {
+		if !writerEnabled {
+			return nil, &TransportError{"syslog", fmt.Errorf("syslog transport requires you to have writer enabled")}
+		}
+		return NewSyslogTransport(c, exitFlag, logger)
+	})
+}
+
+// SyslogTransport receives RFC 5424 syslog messages over UDP or TCP and
+// hands them over to the writer as metrics named by their APP-NAME, with
+// timestamp of the message, "host" tag of its HOSTNAME and severity as
+// the value. Parameters of structured data elements become fields, or
+// tags for elements listed in SDToTags.
+type SyslogTransport struct {
+	Socket   net.Listener
+	Packets  net.PacketConn
+	Protocol string
+	Size     int
+	SDToTags map[string]bool
+	Chan     chan *Metric
+	ExitFlag *Flag
+	Wg       *sync.WaitGroup
+	Logger   *Logger
+	Stats    *SyslogTransportStats
+	conns    map[net.Conn]struct{}
+	connLock *sync.Mutex
+}
+
+// NewSyslogTransport
+func NewSyslogTransport(c *TransportConfig, exitFlag *Flag, logger *Logger) (*SyslogTransport, error) {
+	if c.BufferSize == 0 {
+		c.BufferSize = 1000
+	}
+
+	if c.SyslogAddr == "" {
+		c.SyslogAddr = ":5140"
+	}
+
+	if c.SyslogProtocol == "" {
+		c.SyslogProtocol = "udp4"
+	}
+
+	t := &SyslogTransport{
+		Protocol: c.SyslogProtocol,
+		Size:     c.BufferSize,
+		SDToTags: make(map[string]bool),
+		Chan:     make(chan *Metric, c.BufferSize),
+		ExitFlag: exitFlag,
+		Wg:       &sync.WaitGroup{},
+		Logger:   logger,
+		Stats:    NewSyslogTransportStats(),
+		conns:    make(map[net.Conn]struct{}),
+		connLock: &sync.Mutex{},
+	}
+	for _, id := range c.SyslogSDToTags {
+		t.SDToTags[id] = true
+	}
+
+	var err error
+	switch c.SyslogProtocol {
+	case "udp", "udp4", "udp6":
+		t.Packets, err = net.ListenPacket(c.SyslogProtocol, c.SyslogAddr)
+	case "tcp", "tcp4", "tcp6":
+		t.Socket, err = net.Listen(c.SyslogProtocol, c.SyslogAddr)
+	default:
+		err = fmt.Errorf("unknown syslog_protocol '%s'", c.SyslogProtocol)
+	}
+	if err != nil {
+		return nil, &TransportError{"syslog", err}
+	}
+	return t, nil
+}
+
+// ParseSyslog parses RFC 5424 message into metric, parameters of the
+// structured data elements with IDs in sdToTags become tags
+func ParseSyslog(msg string, sdToTags map[string]bool) (*Metric, error) {
+	p := &syslogParser{s: strings.TrimRight(msg, "\r\n")}
+
+	if !p.consume('<') {
+		return nil, fmt.Errorf("missing PRI")
+	}
+	pri, err := strconv.Atoi(p.until('>'))
+	if err != nil || pri < 0 || pri > 191 || !p.consume('>') {
+		return nil, fmt.Errorf("invalid PRI")
+	}
+	if p.field() != "1" {
+		return nil, fmt.Errorf("unsupported syslog version, only RFC 5424 messages are accepted")
+	}
+
+	m := &Metric{
+		Timestamp: time.Now(),
+		Value:     float64(pri % 8),
+		Fields:    make(map[string]string),
+		Values:    make(map[string]interface{}),
+		OK:        true,
+	}
+	if ts := p.field(); ts != "-" {
+		if m.Timestamp, err = time.Parse(time.RFC3339Nano, ts); err != nil {
+			return nil, fmt.Errorf("invalid TIMESTAMP '%s'", ts)
+		}
+	}
+	if host := p.field(); host != "-" {
+		m.Fields["host"] = host
+	}
+	if m.Name = p.field(); m.Name == "-" || m.Name == "" {
+		return nil, fmt.Errorf("missing APP-NAME")
+	}
+	p.field() // PROCID
+	p.field() // MSGID
+
+	if p.consume('-') {
+		return m, nil
+	}
+	for p.peek() == '[' {
+		p.consume('[')
+		id := p.name()
+		if id == "" {
+			return nil, fmt.Errorf("missing SD-ID")
+		}
+		for p.consume(' ') {
+			name := p.name()
+			if name == "" || !p.consume('=') || !p.consume('"') {
+				return nil, fmt.Errorf("invalid SD-PARAM of '%s'", id)
+			}
+			value, ok := p.quoted()
+			if !ok {
+				return nil, fmt.Errorf("unterminated SD-PARAM '%s' of '%s'", name, id)
+			}
+			if sdToTags[id] {
+				m.Fields[name] = value
+			} else if f, err := strconv.ParseFloat(value, 64); err == nil {
+				m.Values[name] = f
+			} else {
+				m.Values[name] = value
+			}
+		}
+		if !p.consume(']') {
+			return nil, fmt.Errorf("unterminated SD-ELEMENT '%s'", id)
+		}
+	}
+	if p.peek() != ' ' && p.peek() != 0 {
+		return nil, fmt.Errorf("invalid STRUCTURED-DATA")
+	}
+	return m, nil
+}
+
+// syslogParser reads the message from the start
+type syslogParser struct {
+	s string
+}
+
+func (p *syslogParser) peek() byte {
+	if len(p.s) == 0 {
+		return 0
+	}
+	return p.s[0]
+}
+
+func (p *syslogParser) consume(c byte) bool {
+	if p.peek() != c {
+		return false
+	}
+	p.s = p.s[1:]
+	return true
+}
+
+// until returns everything up to the byte, without consuming it
+func (p *syslogParser) until(c byte) string {
+	i := strings.IndexByte(p.s, c)
+	if i < 0 {
+		i = len(p.s)
+	}
+	v := p.s[:i]
+	p.s = p.s[i:]
+	return v
+}
+
+// field returns header field up to the next space, consuming the space
+func (p *syslogParser) field() string {
+	v := p.until(' ')
+	p.consume(' ')
+	return v
+}
+
+// name returns SD-ID or PARAM-NAME
+func (p *syslogParser) name() string {
+	i := strings.IndexAny(p.s, " =]\"")
+	if i < 0 {
+		i = len(p.s)
+	}
+	v := p.s[:i]
+	p.s = p.s[i:]
+	return v
+}
+
+// quoted returns PARAM-VALUE after the opening quote, with \", \\ and \]
+// unescaped
+func (p *syslogParser) quoted() (string, bool) {
+	var b strings.Builder
+	for i := 0; i < len(p.s); i++ {
+		switch c := p.s[i]; {
+		case c == '"':
+			p.s = p.s[i+1:]
+			return b.String(), true
+		case c == '\\' && i+1 < len(p.s) && strings.IndexByte(`"\]`, p.s[i+1]) >= 0:
+			i++
+			b.WriteByte(p.s[i])
+		default:
+			b.WriteByte(c)
+		}
+	}
+	return "", false
+}
+
+func (t *SyslogTransport) decode(msg string, addr net.Addr) {
+	if strings.TrimSpace(msg) == "" {
+		return
+	}
+	m, err := ParseSyslog(msg, t.SDToTags)
+	if err != nil {
+		t.Stats.Failed.Increment(1)
+		pipelineStats.Dropped.Add("decode", 1)
+		t.Logger.Debug("[syslog] %s: %v", addr.String(), err)
+		return
+	}
+	t.Chan <- m
+	t.Stats.Received.Increment(1)
+	pipelineStats.Received.Add("syslog", 1)
+}
+
+// readFrame reads message framed by octet counting, or terminated by
+// newline otherwise (RFC 6587)
+func readFrame(r *bufio.Reader) (string, error) {
+	c, err := r.Peek(1)
+	if err != nil {
+		return "", err
+	}
+	if c[0] < '0' || c[0] > '9' {
+		return r.ReadString('\n')
+	}
+	length, err := r.ReadString(' ')
+	if err != nil {
+		return "", err
+	}
+	n, err := strconv.Atoi(strings.TrimSuffix(length, " "))
+	if err != nil || n <= 0 || n > 1024*1024 {
+		return "", fmt.Errorf("invalid frame length '%s'", strings.TrimSpace(length))
+	}
+	buf := make([]byte, n)
+	if _, err := io.ReadFull(r, buf); err != nil {
+		return "", err
+	}
+	return string(buf), nil
+}
+
+// handle reads messages until the client disconnects
+func (t *SyslogTransport) handle(conn net.Conn) {
+	defer t.Wg.Done()
+	defer func() {
+		t.connLock.Lock()
+		delete(t.conns, conn)
+		t.connLock.Unlock()
+		conn.Close()
+	}()
+
+	r := bufio.NewReader(conn)
+	for {
+		msg, err := readFrame(r)
+		if msg != "" {
+			t.decode(msg, conn.RemoteAddr())
+		}
+		if err != nil {
+			if err != io.EOF && !t.ExitFlag.Get() {
+				t.Logger.Debug("[syslog] Closing connection from %s: %v", conn.RemoteAddr().String(), err)
+			}
+			return
+		}
+	}
+}
+
+func (t *SyslogTransport) Start() {
+	t.Wg.Add(1)
+	if t.Packets != nil {
+		t.Logger.Info("[syslog] Reading datagrams on %s", t.Packets.LocalAddr().String())
+		go func() {
+			defer t.Wg.Done()
+			buf := make([]byte, 64*1024)
+			for {
+				n, addr, err := t.Packets.ReadFrom(buf)
+				if err != nil {
+					if t.ExitFlag.Get() {
+						return
+					}
+					t.Logger.Error("[syslog] Failed to read datagram: %v", err)
+					continue
+				}
+				t.decode(string(buf[:n]), addr)
+			}
+		}()
+	} else {
+		t.Logger.Info("[syslog] Accepting connections on %s", t.Socket.Addr().String())
+		go func() {
+			defer t.Wg.Done()
+			for {
+				conn, err := t.Socket.Accept()
+				if err != nil {
+					if !t.ExitFlag.Get() {
+						t.Logger.Error("[syslog] Can't accept connection: %v", err)
+					}
+					return
+				}
+				t.connLock.Lock()
+				t.conns[conn] = struct{}{}
+				t.connLock.Unlock()
+				t.Wg.Add(1)
+				go t.handle(conn)
+			}
+		}()
+	}
+
+	go func() {
+		<-t.ExitFlag.Done()
+		if t.Packets != nil {
+			t.Packets.Close()
+			return
+		}
+		t.Socket.Close()
+		// unblock the readers
+		t.connLock.Lock()
+		for conn := range t.conns {
+			conn.Close()
+		}
+		t.connLock.Unlock()
+	}()
+}
+
+func (t *SyslogTransport) Stop() {
+	t.Wg.Wait()
+}
+
+func (t *SyslogTransport) CloseOutput() {
+	return
+}
+
+func (t *SyslogTransport) CloseInput() {
+	return
+}
+
+func (t *SyslogTransport) InputChan() chan<- *Metric {
+	return t.Chan
+}
+
+func (t *SyslogTransport) OutputChan() <-chan *Metric {
+	return t.Chan
+}
+
+func (t *SyslogTransport) InputChanLen() int {
+	return len(t.Chan)
+}
+
+func (t *SyslogTransport) OutputChanLen() int {
+	return len(t.Chan)
+}
+
+func (t *SyslogTransport) LogReport() {
+	t.Logger.Info("[transport] syslog: %d/%d (length/capacity), metrics: %d/%d/%.3f (total_received/failed/rate_per_sec)",
+		len(t.Chan),
+		t.Size,
+		t.Stats.Received.Total(),
+		t.Stats.Failed.Total(),
+		t.Stats.Received.Rate(time.Second),
+	)
+}
+
+type SyslogTransportStats struct {
+	Received *StatsCounter
+	Failed   *StatsCounter
+}
+
+func NewSyslogTransportStats() *SyslogTransportStats {
+	now := time.Now()
+	return &SyslogTransportStats{
+		Received: NewStatsCounter(now),
+		Failed:   NewStatsCounter(now),
+	}
+}
+
+func (s *SyslogTransportStats) Reset() {
+	s.Received.Reset()
+	s.Failed.Reset()
+}
@@ -0,0 +1,217 @@
+package metcap
+
+import (
+	"bufio"
+	"fmt"
+	"net"
+	"strings"
+	"sync"
+	"time"
+)
+
+func init() {
+	RegisterTransport("tcp", func(c *TransportConfig, listenerEnabled bool, writerEnabled bool, exitFlag *Flag, logger *Logger) (Transport, error) {
+		if !writerEnabled {
+			return nil, &TransportError{"tcp", fmt.Errorf("tcp transport requires you to have writer enabled")}
+		}
+		return NewTCPTransport(c, exitFlag, logger)
+	})
+}
+
+// TCPTransport reads newline delimited line protocol from TCP clients
+// and hands the metrics over to the writer
+type TCPTransport struct {
+	Socket      net.Listener
+	Size        int
+	MaxConns    int
+	ReadTimeout time.Duration
+	Chan        chan *Metric
+	ExitFlag    *Flag
+	Wg          *sync.WaitGroup
+	Logger      *Logger
+	Stats       *TCPTransportStats
+	conns       map[net.Conn]struct{}
+	connLock    *sync.Mutex
+}
+
+// NewTCPTransport
+func NewTCPTransport(c *TransportConfig, exitFlag *Flag, logger *Logger) (*TCPTransport, error) {
+	if c.BufferSize == 0 {
+		c.BufferSize = 1000
+	}
+
+	if c.TCPListenAddr == "" {
+		c.TCPListenAddr = ":8094"
+	}
+
+	if c.TCPMaxConns == 0 {
+		c.TCPMaxConns = 250
+	}
+
+	if c.TCPReadTimeout.Duration == 0 {
+		c.TCPReadTimeout.Duration = 30 * time.Second
+	}
+
+	sock, err := net.Listen("tcp", c.TCPListenAddr)
+	if err != nil {
+		return nil, &TransportError{"tcp", err}
+	}
+
+	return &TCPTransport{
+		Socket:      sock,
+		Size:        c.BufferSize,
+		MaxConns:    c.TCPMaxConns,
+		ReadTimeout: c.TCPReadTimeout.Duration,
+		Chan:        make(chan *Metric, c.BufferSize),
+		ExitFlag:    exitFlag,
+		Wg:          &sync.WaitGroup{},
+		Logger:      logger,
+		Stats:       NewTCPTransportStats(),
+		conns:       make(map[net.Conn]struct{}),
+		connLock:    &sync.Mutex{},
+	}, nil
+}
+
+// handle reads lines until the client disconnects or stays idle
+// longer than ReadTimeout
+func (t *TCPTransport) handle(conn net.Conn) {
+	defer t.Wg.Done()
+	defer func() {
+		t.connLock.Lock()
+		delete(t.conns, conn)
+		t.connLock.Unlock()
+		conn.Close()
+		t.Stats.ConnOpen.Decrement(1)
+	}()
+
+	scn := bufio.NewScanner(conn)
+	scn.Buffer(make([]byte, 64*1024), 1024*1024)
+	for {
+		conn.SetReadDeadline(time.Now().Add(t.ReadTimeout))
+		if !scn.Scan() {
+			break
+		}
+		line := scn.Text()
+		if strings.TrimSpace(line) == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		m, err := ParseLineProtocol(line)
+		if err != nil {
+			t.Stats.Failed.Increment(1)
+			pipelineStats.Dropped.Add("decode", 1)
+			t.Logger.Debug("[tcp] %s: %v", conn.RemoteAddr().String(), err)
+			continue
+		}
+		t.Chan <- m
+		t.Stats.Received.Increment(1)
+		pipelineStats.Received.Add("tcp", 1)
+	}
+	if err := scn.Err(); err != nil && !t.ExitFlag.Get() {
+		t.Logger.Debug("[tcp] Closing connection from %s: %v", conn.RemoteAddr().String(), err)
+	}
+}
+
+func (t *TCPTransport) Start() {
+	t.Logger.Info("[tcp] Accepting connections on %s", t.Socket.Addr().String())
+
+	t.Wg.Add(1)
+	go func() {
+		defer t.Wg.Done()
+		for {
+			conn, err := t.Socket.Accept()
+			if err != nil {
+				if !t.ExitFlag.Get() {
+					t.Logger.Error("[tcp] Can't accept connection: %v", err)
+				}
+				return
+			}
+			t.connLock.Lock()
+			if len(t.conns) >= t.MaxConns {
+				t.connLock.Unlock()
+				t.Stats.Refused.Increment(1)
+				t.Logger.Error("[tcp] Refusing connection from %s, %d connections open", conn.RemoteAddr().String(), t.MaxConns)
+				conn.Close()
+				continue
+			}
+			t.conns[conn] = struct{}{}
+			t.connLock.Unlock()
+			t.Stats.ConnOpen.Increment(1)
+			t.Wg.Add(1)
+			go t.handle(conn)
+		}
+	}()
+
+	go func() {
+		<-t.ExitFlag.Done()
+		t.Socket.Close()
+		// unblock the readers
+		t.connLock.Lock()
+		for conn := range t.conns {
+			conn.Close()
+		}
+		t.connLock.Unlock()
+	}()
+}
+
+func (t *TCPTransport) Stop() {
+	t.Wg.Wait()
+}
+
+func (t *TCPTransport) CloseOutput() {
+	return
+}
+
+func (t *TCPTransport) CloseInput() {
+	return
+}
+
+func (t *TCPTransport) InputChan() chan<- *Metric {
+	return t.Chan
+}
+
+func (t *TCPTransport) OutputChan() <-chan *Metric {
+	return t.Chan
+}
+
+func (t *TCPTransport) InputChanLen() int {
+	return len(t.Chan)
+}
+
+func (t *TCPTransport) OutputChanLen() int {
+	return len(t.Chan)
+}
+
+func (t *TCPTransport) LogReport() {
+	t.Logger.Info("[transport] tcp: %d/%d (length/capacity), connections: %d/%d (open/refused), metrics: %d/%d/%.3f (total_received/failed/rate_per_sec)",
+		len(t.Chan),
+		t.Size,
+		t.Stats.ConnOpen.Get(),
+		t.Stats.Refused.Total(),
+		t.Stats.Received.Total(),
+		t.Stats.Failed.Total(),
+		t.Stats.Received.Rate(time.Second),
+	)
+}
+
+type TCPTransportStats struct {
+	ConnOpen *StatsGauge
+	Refused  *StatsCounter
+	Received *StatsCounter
+	Failed   *StatsCounter
+}
+
+func NewTCPTransportStats() *TCPTransportStats {
+	now := time.Now()
+	return &TCPTransportStats{
+		ConnOpen: NewStatsGauge(),
+		Refused:  NewStatsCounter(now),
+		Received: NewStatsCounter(now),
+		Failed:   NewStatsCounter(now),
+	}
+}
+
+func (s *TCPTransportStats) Reset() {
+	s.Refused.Reset()
+	s.Received.Reset()
+	s.Failed.Reset()
+}
@@ -0,0 +1,132 @@
+package metcap
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"testing"
+)
+
+func TestTransportError(t *testing.T) {
+	dial := &net.OpError{Op: "dial", Net: "tcp", Err: os.ErrDeadlineExceeded}
+	tests := []struct {
+		name string
+		err  error
+		msg  string
+	}{
+		{"plain", &TransportError{"amqp", fmt.Errorf("connection refused")}, "amqp transport error: connection refused"},
+		{"net", &TransportError{"kafka", dial}, "kafka transport error: " + dial.Error()},
+		{"wrapped", fmt.Errorf("starting: %w", &TransportError{"nats", dial}), "starting: nats transport error: " + dial.Error()},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := tt.err.Error(); got != tt.msg {
+				t.Errorf("Error() = %q, want %q", got, tt.msg)
+			}
+			if got := fmt.Sprintf("%v", tt.err); got != tt.msg {
+				t.Errorf("%%v = %q, want %q", got, tt.msg)
+			}
+
+			var te *TransportError
+			if !errors.As(tt.err, &te) {
+				t.Fatalf("errors.As didn't find TransportError in %v", tt.err)
+			}
+			if te.String() != te.Error() {
+				t.Errorf("String() = %q, want %q", te.String(), te.Error())
+			}
+			if errors.Unwrap(te) != te.err {
+				t.Errorf("Unwrap() = %v, want %v", errors.Unwrap(te), te.err)
+			}
+		})
+	}
+
+	err := fmt.Errorf("starting: %w", &TransportError{"tcp", dial})
+	if !errors.Is(err, os.ErrDeadlineExceeded) {
+		t.Errorf("errors.Is didn't find the cause in %v", err)
+	}
+	var opErr *net.OpError
+	if !errors.As(err, &opErr) || opErr != dial {
+		t.Errorf("errors.As didn't find *net.OpError in %v", err)
+	}
+	if errors.Is(&TransportError{"udp", fmt.Errorf("closed")}, os.ErrDeadlineExceeded) {
+		t.Errorf("errors.Is matched unrelated cause")
+	}
+
+	// constructors wrap the cause exactly once
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	addr := l.Addr().String()
+	l.Close()
+	_, dialErr := net.Dial("tcp", addr)
+	_, listenErr := net.Listen("tcp", "256.0.0.1:0")
+	constructors := []struct {
+		name string
+		new  func() error
+		msg  string
+	}{
+		{"amqp", func() error {
+			_, err := NewAMQPTransport(&TransportConfig{AMQPURL: "amqp://guest:guest@" + addr + "/"}, true, false, NewFlag(false), testLogger())
+			return err
+		}, "amqp transport error: " + dialErr.Error()},
+		{"tcp", func() error {
+			_, err := NewTCPTransport(&TransportConfig{TCPListenAddr: "256.0.0.1:0"}, NewFlag(false), testLogger())
+			return err
+		}, "tcp transport error: " + listenErr.Error()},
+	}
+	for _, tt := range constructors {
+		t.Run(tt.name, func(t *testing.T) {
+			err := tt.new()
+			if err == nil {
+				t.Fatal("constructor didn't fail")
+			}
+			if err.Error() != tt.msg {
+				t.Errorf("Error() = %q, want %q", err.Error(), tt.msg)
+			}
+		})
+	}
+}
+
+func TestChannelOverflowError(t *testing.T) {
+	tests := []struct {
+		mode BackpressureMode
+		kept string
+	}{
+		{BackpressureDrop, "first"},
+		{BackpressureDropOldest, "second"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.mode.String(), func(t *testing.T) {
+			output := make(chan *Metric)
+			q := newBackpressureQueue("test", tt.mode, 1, output)
+			if err := q.enqueue(&Metric{Name: "first"}); err != nil {
+				t.Fatalf("enqueue() = %v, want nil", err)
+			}
+
+			err := q.enqueue(&Metric{Name: "second"})
+			var overflow *ChannelOverflowError
+			if !errors.As(err, &overflow) {
+				t.Fatalf("enqueue() = %v, want ChannelOverflowError", err)
+			}
+			if overflow.ChannelName != "test" || overflow.Dropped != 1 {
+				t.Errorf("enqueue() = %+v, want 1 dropped from test", overflow)
+			}
+			var te *TransportError
+			if errors.As(err, &te) {
+				t.Errorf("overflow is TransportError")
+			}
+			if q.queue[0].Name != tt.kept {
+				t.Errorf("kept %s, want %s", q.queue[0].Name, tt.kept)
+			}
+
+			// nobody reads the output, so the flush drops the queue
+			q.Input <- &Metric{Name: "third"}
+			err = q.flush()
+			if !errors.As(err, &overflow) || overflow.Dropped != 2 {
+				t.Errorf("flush() = %v, want 2 dropped", err)
+			}
+		})
+	}
+}
@@ -0,0 +1,169 @@
+package metcap
+
+import (
+	"bytes"
+	"fmt"
+	"net"
+	"sync"
+	"time"
+)
+
+func init() {
+	RegisterTransport("udp", func(c *TransportConfig, listenerEnabled bool, writerEnabled bool, exitFlag *Flag, logger *Logger) (Transport, error) {
+		if !writerEnabled {
+			return nil, &TransportError{"udp", fmt.Errorf("udp transport requires you to have writer enabled")}
+		}
+		return NewUDPTransport(c, exitFlag, logger)
+	})
+}
+
+// UDPTransport reads line protocol datagrams, each holding one or more
+// newline delimited lines, and hands the metrics over to the writer
+type UDPTransport struct {
+	Socket          net.PacketConn
+	Size            int
+	MaxDatagramSize int
+	Chan            chan *Metric
+	ExitFlag        *Flag
+	Wg              *sync.WaitGroup
+	Logger          *Logger
+	Stats           *UDPTransportStats
+}
+
+// NewUDPTransport
+func NewUDPTransport(c *TransportConfig, exitFlag *Flag, logger *Logger) (*UDPTransport, error) {
+	if c.BufferSize == 0 {
+		c.BufferSize = 1000
+	}
+
+	if c.UDPListenAddr == "" {
+		c.UDPListenAddr = ":8089"
+	}
+
+	if c.UDPMaxDatagramSize == 0 {
+		c.UDPMaxDatagramSize = 64 * 1024
+	}
+
+	sock, err := net.ListenPacket("udp", c.UDPListenAddr)
+	if err != nil {
+		return nil, &TransportError{"udp", err}
+	}
+
+	return &UDPTransport{
+		Socket:          sock,
+		Size:            c.BufferSize,
+		MaxDatagramSize: c.UDPMaxDatagramSize,
+		Chan:            make(chan *Metric, c.BufferSize),
+		ExitFlag:        exitFlag,
+		Wg:              &sync.WaitGroup{},
+		Logger:          logger,
+		Stats:           NewUDPTransportStats(),
+	}, nil
+}
+
+func (t *UDPTransport) decode(data []byte, addr net.Addr) {
+	for _, line := range bytes.Split(data, []byte("\n")) {
+		line = bytes.TrimSpace(line)
+		if len(line) == 0 || line[0] == '#' {
+			continue
+		}
+		m, err := ParseLineProtocol(string(line))
+		if err != nil {
+			t.Stats.Failed.Increment(1)
+			pipelineStats.Dropped.Add("decode", 1)
+			t.Logger.Debug("[udp] %s: %v", addr.String(), err)
+			continue
+		}
+		t.Chan <- m
+		t.Stats.Received.Increment(1)
+		pipelineStats.Received.Add("udp", 1)
+	}
+}
+
+func (t *UDPTransport) Start() {
+	t.Logger.Info("[udp] Reading datagrams on %s", t.Socket.LocalAddr().String())
+
+	t.Wg.Add(1)
+	go func() {
+		defer t.Wg.Done()
+		// datagrams bigger than the buffer get truncated
+		buf := make([]byte, t.MaxDatagramSize)
+		for {
+			n, addr, err := t.Socket.ReadFrom(buf)
+			if err != nil {
+				if t.ExitFlag.Get() {
+					return
+				}
+				t.Logger.Error("[udp] Failed to read datagram: %v", err)
+				continue
+			}
+			t.Stats.Datagrams.Increment(1)
+			t.decode(buf[:n], addr)
+		}
+	}()
+
+	go func() {
+		<-t.ExitFlag.Done()
+		t.Socket.Close()
+	}()
+}
+
+func (t *UDPTransport) Stop() {
+	t.Wg.Wait()
+}
+
+func (t *UDPTransport) CloseOutput() {
+	return
+}
+
+func (t *UDPTransport) CloseInput() {
+	return
+}
+
+func (t *UDPTransport) InputChan() chan<- *Metric {
+	return t.Chan
+}
+
+func (t *UDPTransport) OutputChan() <-chan *Metric {
+	return t.Chan
+}
+
+func (t *UDPTransport) InputChanLen() int {
+	return len(t.Chan)
+}
+
+func (t *UDPTransport) OutputChanLen() int {
+	return len(t.Chan)
+}
+
+func (t *UDPTransport) LogReport() {
+	t.Logger.Info("[transport] udp: %d/%d (length/capacity), datagrams: %d, metrics: %d/%d/%.3f (total_received/failed/rate_per_sec)",
+		len(t.Chan),
+		t.Size,
+		t.Stats.Datagrams.Total(),
+		t.Stats.Received.Total(),
+		t.Stats.Failed.Total(),
+		t.Stats.Received.Rate(time.Second),
+	)
+}
+
+type UDPTransportStats struct {
+	Datagrams *StatsCounter
+	Received  *StatsCounter
+	Failed    *StatsCounter
+}
+
+func NewUDPTransportStats() *UDPTransportStats {
+	now := time.Now()
+	return &UDPTransportStats{
+		Datagrams: NewStatsCounter(now),
+		Received:  NewStatsCounter(now),
+		Failed:    NewStatsCounter(now),
+	}
+}
+
+func (s *UDPTransportStats) Reset() {
+	s.Datagrams.Reset()
+	s.Received.Reset()
+	s.Failed.Reset()
+}
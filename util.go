@@ -1,34 +1,106 @@
 package metcap
 
 import (
+	"context"
 	"sync"
+	"sync/atomic"
 )
 
+// Flag is a boolean safe for concurrent use, it's polled by every module
+// waiting for shutdown so it doesn't take a lock
 type Flag struct {
-	*sync.Mutex
-	val bool
+	val    int32
+	init   sync.Once
+	closed sync.Once
+	done   chan struct{}
+}
+
+// NewFlag
+func NewFlag(val bool) *Flag {
+	f := &Flag{}
+	if val {
+		f.Raise()
+	}
+	return f
 }
 
 func (f *Flag) Get() bool {
-	f.Lock()
-	defer f.Unlock()
-	return f.val
+	return atomic.LoadInt32(&f.val) == 1
 }
 
 func (f *Flag) Raise() {
-	f.Lock()
-	defer f.Unlock()
-	f.val = true
+	atomic.StoreInt32(&f.val, 1)
+	f.closeDone()
 }
 
 func (f *Flag) Lower() {
-	f.Lock()
-	defer f.Unlock()
-	f.val = false
+	atomic.StoreInt32(&f.val, 0)
 }
 
 func (f *Flag) Flip() {
-	f.Lock()
-	defer f.Unlock()
-	f.val = !f.val
+	for {
+		val := atomic.LoadInt32(&f.val)
+		if atomic.CompareAndSwapInt32(&f.val, val, 1-val) {
+			if val == 0 {
+				f.closeDone()
+			}
+			return
+		}
+	}
+}
+
+// Done returns a channel closed once the flag is raised for the first
+// time, for waiting on it without polling; lowering the flag doesn't
+// reopen it
+func (f *Flag) Done() <-chan struct{} {
+	f.init.Do(f.makeDone)
+	if f.Get() {
+		f.closeDone()
+	}
+	return f.done
+}
+
+// Context returns a context canceled once the flag is raised, or by the
+// returned cancel func
+func (f *Flag) Context() (context.Context, context.CancelFunc) {
+	ctx, cancel := context.WithCancel(context.Background())
+	go func() {
+		select {
+		case <-f.Done():
+			cancel()
+		case <-ctx.Done():
+		}
+	}()
+	return ctx, cancel
+}
+
+func (f *Flag) makeDone() {
+	f.done = make(chan struct{})
+}
+
+func (f *Flag) closeDone() {
+	f.init.Do(f.makeDone)
+	f.closed.Do(func() { close(f.done) })
+}
+
+// waitContext waits for the WaitGroup, it returns ctx.Err() if the
+// context is done first
+func waitContext(ctx context.Context, wg *sync.WaitGroup) error {
+	return stopContext(ctx, wg.Wait)
+}
+
+// stopContext runs stop in background and waits for it to return,
+// it returns ctx.Err() if the context is done first
+func stopContext(ctx context.Context, stop func()) error {
+	done := make(chan struct{})
+	go func() {
+		stop()
+		close(done)
+	}()
+	select {
+	case <-done:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
 }
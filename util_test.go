@@ -0,0 +1,84 @@
+package metcap
+
+import (
+	"sync"
+	"testing"
+	"time"
+)
+
+// TestFlagConcurrent is meant to be run with -race: the test flips the
+// flag while the goroutines poll it and wait on Done
+func TestFlagConcurrent(t *testing.T) {
+	f := NewFlag(false)
+	wg := &sync.WaitGroup{}
+
+	for i := 0; i < 8; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for !f.Get() {
+			}
+		}()
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			<-f.Done()
+		}()
+	}
+
+	for i := 0; i < 1000; i++ {
+		f.Flip()
+		f.Flip()
+	}
+	f.Raise()
+
+	done := make(chan struct{})
+	go func() {
+		wg.Wait()
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatal("goroutines didn't notice the raised flag")
+	}
+}
+
+func TestFlag(t *testing.T) {
+	tests := []struct {
+		name string
+		init bool
+		ops  []func(*Flag)
+		want bool
+		done bool
+	}{
+		{"lowered", false, nil, false, false},
+		{"raised", true, nil, true, true},
+		{"raise", false, []func(*Flag){(*Flag).Raise}, true, true},
+		{"flip", false, []func(*Flag){(*Flag).Flip}, true, true},
+		{"flip twice", false, []func(*Flag){(*Flag).Flip, (*Flag).Flip}, false, true},
+		{"lower", true, []func(*Flag){(*Flag).Lower}, false, true},
+		{"raise again", false, []func(*Flag){(*Flag).Raise, (*Flag).Lower, (*Flag).Raise}, true, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			f := NewFlag(tt.init)
+			for _, op := range tt.ops {
+				op(f)
+			}
+			if f.Get() != tt.want {
+				t.Errorf("Get() = %v, want %v", f.Get(), tt.want)
+			}
+			select {
+			case <-f.Done():
+				if !tt.done {
+					t.Errorf("Done() is closed, flag was never raised")
+				}
+			default:
+				if tt.done {
+					t.Errorf("Done() isn't closed, flag was raised")
+				}
+			}
+		})
+	}
+}
@@ -16,6 +16,8 @@ type Writer struct {
 	Logger    *Logger
 	ExitFlag  *Flag
 	Stats     *WriterStats
+	Breaker   *CircuitBreaker
+	Spill     *MetricRing
 }
 
 func NewWriter(c *WriterConfig, t Transport, module_wg *sync.WaitGroup, logger *Logger, exitFlag *Flag) (Writer, error) {
@@ -59,6 +61,18 @@ func NewWriter(c *WriterConfig, t Transport, module_wg *sync.WaitGroup, logger *
 		logger.Info("[writer] New index mapping template acknowledged")
 	}
 
+	// with circuit breaker enabled metrics are kept in memory while
+	// ElasticSearch keeps failing
+	var breaker *CircuitBreaker
+	var spill *MetricRing
+	if c.CircuitFailureThreshold > 0 {
+		if c.CircuitBufferSize == 0 {
+			c.CircuitBufferSize = 100000
+		}
+		breaker = NewCircuitBreaker("writer", c.CircuitFailureThreshold, c.CircuitSuccessThreshold, c.CircuitTimeout.Duration, logger)
+		spill = NewMetricRing(c.CircuitBufferSize)
+	}
+
 	return Writer{
 		Config:    c,
 		ModuleWg:  module_wg,
@@ -67,6 +81,8 @@ func NewWriter(c *WriterConfig, t Transport, module_wg *sync.WaitGroup, logger *
 		Logger:    logger,
 		ExitFlag:  exitFlag,
 		Stats:     NewWriterStats(),
+		Breaker:   breaker,
+		Spill:     spill,
 	}, nil
 }
 
@@ -97,6 +113,14 @@ func (w *Writer) Start() {
 
 	w.Logger.Info("[writer] Writer module started")
 
+	// replays spilled metrics once the circuit lets us
+	var replayTick <-chan time.Time
+	if w.Breaker != nil {
+		ticker := time.NewTicker(1 * time.Second)
+		defer ticker.Stop()
+		replayTick = ticker.C
+	}
+
 	go func() {
 		for {
 			select {
@@ -104,6 +128,10 @@ func (w *Writer) Start() {
 				if ok {
 					w.add(metric)
 				}
+			case <-replayTick:
+				if w.Breaker.Allow() {
+					w.replay()
+				}
 			case <-exitTrigger:
 				w.Logger.Debug("[writer] Calling transport to stop retrieve loop...") // doesn't apply to channel transport
 				w.Transport.CloseOutput()
@@ -135,6 +163,14 @@ func (w *Writer) Start() {
 					select {
 					case <-drainingDone:
 						w.Logger.Info("[writer] Draining done")
+						if w.Breaker != nil {
+							if w.Breaker.Allow() {
+								w.replay()
+							}
+							if w.Spill.Len() > 0 {
+								w.Logger.Error("[writer] Circuit is open, dropping %d spilled metrics", w.Spill.Len())
+							}
+						}
 						w.Logger.Info("[writer] Flushing bulk-processors...")
 						w.Processor.Close()
 						exitFinished <- struct{}{}
@@ -164,6 +200,27 @@ func (w *Writer) Start() {
 }
 
 func (w *Writer) add(m *Metric) {
+	if w.Breaker != nil {
+		if !w.Breaker.Allow() {
+			if w.Spill.Len() == w.Spill.Cap() {
+				pipelineStats.Dropped.Add("circuit_open", 1)
+			}
+			w.Spill.Push(m)
+			return
+		}
+		w.replay()
+	}
+	w.index(m)
+}
+
+// replay indexes the spilled metrics, oldest first
+func (w *Writer) replay() {
+	for m := w.Spill.Pop(); m != nil; m = w.Spill.Pop() {
+		w.index(m)
+	}
+}
+
+func (w *Writer) index(m *Metric) {
 	w.Stats.Queued.Increment(1)
 	w.Processor.Add(elastic.NewBulkIndexRequest().
 		Index(m.Index(w.Config.Index)).
@@ -180,11 +237,27 @@ func (w *Writer) hookBeforeCommit(id int64, reqs []elastic.BulkableRequest) {
 
 func (w *Writer) hookAfterCommit(id int64, reqs []elastic.BulkableRequest, res *elastic.BulkResponse, err error) {
 	w.Stats.Running.Decrement(1)
+	if w.Breaker != nil {
+		// only failed requests count, rejected documents don't mean ES is down
+		if err != nil {
+			w.Breaker.Failure()
+		} else {
+			w.Breaker.Success()
+		}
+	}
+	if res == nil {
+		w.Logger.Error("[writer] Failed to commit %d metrics: %v", len(reqs), err)
+		w.Stats.Failed.Increment(len(reqs))
+		pipelineStats.Dropped.Add("write_failed", len(reqs))
+		w.Stats.Flushed.Increment(1)
+		return
+	}
 	w.Stats.Succeeded.Increment(len(res.Succeeded()))
 	w.Stats.Duration.Add(time.Duration(res.Took) * time.Millisecond)
 	w.Logger.Debug("[writer] Successfully indexed %d metrics", len(res.Succeeded()))
 	if len(res.Failed()) > 0 {
 		w.Stats.Failed.Increment(len(res.Failed()))
+		pipelineStats.Dropped.Add("write_failed", len(res.Failed()))
 		w.Logger.Error("[writer] Failed to index %d metrics", len(res.Failed()))
 	}
 	if err != nil {
@@ -205,6 +278,14 @@ func (w *Writer) LogReport() {
 		w.Stats.Duration.Avg(),
 		w.Stats.Duration.Max(),
 	)
+	if w.Breaker != nil {
+		w.Logger.Info("[writer] circuit: %s, spilled: %d/%d/%d (length/capacity/overwritten)",
+			w.Breaker.State(),
+			w.Spill.Len(),
+			w.Spill.Cap(),
+			w.Spill.Overwritten(),
+		)
+	}
 }
 
 type WriterStats struct {
@@ -0,0 +1,236 @@
+package metcap
+
+import (
+	"fmt"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/credentials"
+	"github.com/aws/aws-sdk-go/aws/credentials/ec2rolecreds"
+	"github.com/aws/aws-sdk-go/aws/session"
+	"github.com/aws/aws-sdk-go/service/cloudwatch"
+)
+
+// CloudWatch API limits
+const (
+	cloudWatchMaxBatchSize  = 20
+	cloudWatchMaxDimensions = 10
+)
+
+// CloudWatchWriter puts numeric fields of metrics to CloudWatch, tags
+// become dimensions. Main value is named after the metric, the other
+// fields "<metric>.<field>".
+type CloudWatchWriter struct {
+	Config        *WriterConfig
+	ModuleWg      *sync.WaitGroup
+	Input         <-chan *Metric
+	Client        *cloudwatch.CloudWatch
+	BatchSize     int
+	FlushInterval time.Duration
+	Logger        *Logger
+	ExitFlag      *Flag
+	Stats         *CloudWatchWriterStats
+	batch         []*cloudwatch.MetricDatum
+	truncated     map[string]bool
+}
+
+// NewCloudWatchWriter
+func NewCloudWatchWriter(c *WriterConfig, input <-chan *Metric, module_wg *sync.WaitGroup, logger *Logger, exitFlag *Flag) (*CloudWatchWriter, error) {
+	logger.Info("[cloudwatch] Initializing module")
+
+	if c.CloudWatchBatchSize == 0 {
+		c.CloudWatchBatchSize = cloudWatchMaxBatchSize
+	}
+	if c.CloudWatchBatchSize > cloudWatchMaxBatchSize {
+		return nil, fmt.Errorf("cloudwatch_batch_size can't exceed %d", cloudWatchMaxBatchSize)
+	}
+
+	if c.BulkWait.Duration == 0 {
+		c.BulkWait.Duration = 5 * time.Second
+	}
+
+	sess, err := session.NewSession(&aws.Config{Region: aws.String(c.AWSRegion)})
+	if err != nil {
+		return nil, err
+	}
+
+	// empty source keeps the SDK default chain
+	switch c.AWSCredentialSource {
+	case "":
+	case "env":
+		sess.Config.Credentials = credentials.NewEnvCredentials()
+	case "iam":
+		sess.Config.Credentials = ec2rolecreds.NewCredentials(sess)
+	case "profile":
+		sess.Config.Credentials = credentials.NewSharedCredentials("", "")
+	default:
+		return nil, fmt.Errorf("unknown aws_credential_source '%s'", c.AWSCredentialSource)
+	}
+
+	return &CloudWatchWriter{
+		Config:        c,
+		ModuleWg:      module_wg,
+		Input:         input,
+		Client:        cloudwatch.New(sess),
+		BatchSize:     c.CloudWatchBatchSize,
+		FlushInterval: c.BulkWait.Duration,
+		Logger:        logger,
+		ExitFlag:      exitFlag,
+		Stats:         NewCloudWatchWriterStats(),
+		batch:         make([]*cloudwatch.MetricDatum, 0, c.CloudWatchBatchSize),
+		truncated:     make(map[string]bool),
+	}, nil
+}
+
+// Datums converts the metric, string and bool fields are left out
+func (w *CloudWatchWriter) Datums(m *Metric) []*cloudwatch.MetricDatum {
+	keys := make([]string, 0, len(m.Fields))
+	for k, v := range m.Fields {
+		// CloudWatch rejects empty dimension values
+		if k != "" && v != "" {
+			keys = append(keys, k)
+		}
+	}
+	sort.Strings(keys)
+	if len(keys) > cloudWatchMaxDimensions {
+		if !w.truncated[m.Name] {
+			w.truncated[m.Name] = true
+			w.Logger.Warn("[cloudwatch] Metric '%s' has %d tags, keeping first %d as dimensions", m.Name, len(keys), cloudWatchMaxDimensions)
+		}
+		keys = keys[:cloudWatchMaxDimensions]
+	}
+	dimensions := make([]*cloudwatch.Dimension, len(keys))
+	for i, k := range keys {
+		dimensions[i] = &cloudwatch.Dimension{Name: aws.String(k), Value: aws.String(m.Fields[k])}
+	}
+
+	var ts *time.Time
+	if !m.Timestamp.IsZero() {
+		ts = aws.Time(m.Timestamp)
+	}
+	datum := func(name string, value float64) *cloudwatch.MetricDatum {
+		return &cloudwatch.MetricDatum{
+			MetricName: aws.String(name),
+			Dimensions: dimensions,
+			Timestamp:  ts,
+			Value:      aws.Float64(value),
+		}
+	}
+
+	datums := make([]*cloudwatch.MetricDatum, 0, len(m.Values)+1)
+	if m.Value != 0 || len(m.Values) == 0 {
+		datums = append(datums, datum(m.Name, m.Value))
+	}
+	for k, v := range m.Values {
+		switch value := v.(type) {
+		case float64:
+			datums = append(datums, datum(m.Name+"."+k, value))
+		case int64:
+			datums = append(datums, datum(m.Name+"."+k, float64(value)))
+		}
+	}
+	return datums
+}
+
+func (w *CloudWatchWriter) Start() {
+	w.ModuleWg.Add(1)
+	defer w.ModuleWg.Done()
+	w.Logger.Info("[cloudwatch] Putting metrics to '%s' namespace in %s", w.Config.CloudWatchNamespace, w.Config.AWSRegion)
+
+	ticker := time.NewTicker(w.FlushInterval)
+	defer ticker.Stop()
+
+	exitCheck := time.NewTicker(10 * time.Millisecond)
+	defer exitCheck.Stop()
+
+	for {
+		select {
+		case m := <-w.Input:
+			w.add(m)
+		case <-ticker.C:
+			w.flush()
+		case <-exitCheck.C:
+			if !w.ExitFlag.Get() {
+				continue
+			}
+			w.Logger.Info("[cloudwatch] Draining buffer...")
+			for empty := 0; empty < 10; {
+				select {
+				case m := <-w.Input:
+					w.add(m)
+					empty = 0
+				case <-time.After(100 * time.Millisecond):
+					empty++
+				}
+			}
+			w.flush()
+			w.Logger.Info("[cloudwatch] Stopped")
+			return
+		}
+	}
+}
+
+func (w *CloudWatchWriter) add(m *Metric) {
+	for _, datum := range w.Datums(m) {
+		w.batch = append(w.batch, datum)
+		if len(w.batch) >= w.BatchSize {
+			w.flush()
+		}
+	}
+}
+
+func (w *CloudWatchWriter) flush() {
+	if len(w.batch) == 0 {
+		return
+	}
+	n := len(w.batch)
+	defer func() { w.batch = w.batch[:0] }()
+
+	start := time.Now()
+	_, err := w.Client.PutMetricData(&cloudwatch.PutMetricDataInput{
+		Namespace:  aws.String(w.Config.CloudWatchNamespace),
+		MetricData: w.batch,
+	})
+	w.Stats.Duration.Add(time.Since(start))
+	w.Stats.Flushed.Increment(1)
+	if err != nil {
+		w.Logger.Error("[cloudwatch] Failed to put %d data points: %v", n, err)
+		w.Stats.Failed.Increment(n)
+		pipelineStats.Dropped.Add("write_failed", n)
+		return
+	}
+	w.Stats.Sent.Increment(n)
+}
+
+func (w *CloudWatchWriter) LogReport() {
+	w.Logger.Info("[cloudwatch] flushes: %d/%.3f (total/rate_per_m), data points: %d/%d/%.3f (sent/failed/rate_per_sec), duration: %s/%s (avg/max)",
+		w.Stats.Flushed.Total(),
+		w.Stats.Flushed.Rate(time.Minute),
+		w.Stats.Sent.Total(),
+		w.Stats.Failed.Total(),
+		w.Stats.Sent.Rate(time.Second),
+		w.Stats.Duration.Avg(),
+		w.Stats.Duration.Max(),
+	)
+}
+
+type CloudWatchWriterStats struct {
+	Flushed  *StatsCounter
+	Sent     *StatsCounter
+	Failed   *StatsCounter
+	Duration *StatsTimer
+}
+
+func NewCloudWatchWriterStats() *CloudWatchWriterStats {
+	now := time.Now()
+	return &CloudWatchWriterStats{
+		Flushed:  NewStatsCounter(now),
+		Sent:     NewStatsCounter(now),
+		Failed:   NewStatsCounter(now),
+		Duration: NewStatsTimer(1000),
+	}
+}
+
+func (s *CloudWatchWriterStats) Reset() {}
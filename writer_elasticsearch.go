@@ -0,0 +1,294 @@
+package metcap
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+)
+
+// ElasticsearchWriter bulk indexes metrics as flat JSON documents, e.g. to
+// search them in Kibana next to logs. Unlike Writer it doesn't manage the
+// index template and works with current Elasticsearch versions.
+type ElasticsearchWriter struct {
+	Config        *WriterConfig
+	ModuleWg      *sync.WaitGroup
+	Input         <-chan *Metric
+	Client        *http.Client
+	Addresses     []string
+	BulkSize      int
+	FlushInterval time.Duration
+	Logger        *Logger
+	ExitFlag      *Flag
+	Stats         *ElasticsearchWriterStats
+	batch         bytes.Buffer
+	batched       int
+	address       int
+}
+
+// elasticsearchDocument is the indexed form of a metric
+type elasticsearchDocument struct {
+	Timestamp   string                 `json:"@timestamp"`
+	Measurement string                 `json:"measurement"`
+	Tags        map[string]string      `json:"tags"`
+	Fields      map[string]interface{} `json:"fields"`
+}
+
+// bulk API response, only parts needed to count failed documents
+type elasticsearchBulkResponse struct {
+	Errors bool `json:"errors"`
+	Items  []map[string]struct {
+		Status int             `json:"status"`
+		Error  json.RawMessage `json:"error"`
+	} `json:"items"`
+}
+
+// NewElasticsearchWriter
+func NewElasticsearchWriter(c *WriterConfig, input <-chan *Metric, module_wg *sync.WaitGroup, logger *Logger, exitFlag *Flag) (*ElasticsearchWriter, error) {
+	logger.Info("[elasticsearch] Initializing module")
+
+	if len(c.ESAddresses) == 0 {
+		return nil, fmt.Errorf("no es_addresses configured")
+	}
+
+	if c.ESIndex == "" {
+		c.ESIndex = "metcap"
+	}
+
+	if c.ESBulkSize == 0 {
+		c.ESBulkSize = 5000
+	}
+
+	if c.BulkWait.Duration == 0 {
+		c.BulkWait.Duration = 5 * time.Second
+	}
+
+	addresses := make([]string, len(c.ESAddresses))
+	for i, address := range c.ESAddresses {
+		addresses[i] = strings.TrimRight(address, "/") + "/_bulk"
+	}
+
+	return &ElasticsearchWriter{
+		Config:        c,
+		ModuleWg:      module_wg,
+		Input:         input,
+		Client:        &http.Client{Timeout: time.Duration(c.Timeout) * time.Second},
+		Addresses:     addresses,
+		BulkSize:      c.ESBulkSize,
+		FlushInterval: c.BulkWait.Duration,
+		Logger:        logger,
+		ExitFlag:      exitFlag,
+		Stats:         NewElasticsearchWriterStats(),
+	}, nil
+}
+
+// Index returns name of the index the metric belongs to
+func (w *ElasticsearchWriter) Index(m *Metric) string {
+	if w.Config.ESIndexTimePattern == "" {
+		return w.Config.ESIndex
+	}
+	ts := m.Timestamp
+	if ts.IsZero() {
+		ts = time.Now()
+	}
+	return ts.UTC().Format(w.Config.ESIndexTimePattern)
+}
+
+// Document returns the metric as flat JSON object
+func (w *ElasticsearchWriter) Document(m *Metric) ([]byte, error) {
+	fields := make(map[string]interface{}, len(m.Values)+1)
+	for k, v := range m.Values {
+		fields[k] = v
+	}
+	if m.Value != 0 || len(m.Values) == 0 {
+		fields["value"] = m.Value
+	}
+	tags := m.Fields
+	if tags == nil {
+		tags = map[string]string{}
+	}
+	ts := m.Timestamp
+	if ts.IsZero() {
+		ts = time.Now()
+	}
+	return json.Marshal(elasticsearchDocument{
+		Timestamp:   ts.UTC().Format(time.RFC3339Nano),
+		Measurement: m.Name,
+		Tags:        tags,
+		Fields:      fields,
+	})
+}
+
+func (w *ElasticsearchWriter) Start() {
+	w.ModuleWg.Add(1)
+	defer w.ModuleWg.Done()
+	w.Logger.Info("[elasticsearch] Indexing to %v", w.Config.ESAddresses)
+
+	ticker := time.NewTicker(w.FlushInterval)
+	defer ticker.Stop()
+
+	exitCheck := time.NewTicker(10 * time.Millisecond)
+	defer exitCheck.Stop()
+
+	for {
+		select {
+		case m := <-w.Input:
+			w.add(m)
+		case <-ticker.C:
+			w.flush()
+		case <-exitCheck.C:
+			if !w.ExitFlag.Get() {
+				continue
+			}
+			w.Logger.Info("[elasticsearch] Draining buffer...")
+			for empty := 0; empty < 10; {
+				select {
+				case m := <-w.Input:
+					w.add(m)
+					empty = 0
+				case <-time.After(100 * time.Millisecond):
+					empty++
+				}
+			}
+			w.flush()
+			w.Logger.Info("[elasticsearch] Stopped")
+			return
+		}
+	}
+}
+
+func (w *ElasticsearchWriter) add(m *Metric) {
+	doc, err := w.Document(m)
+	if err != nil {
+		w.Logger.Debug("[elasticsearch] Failed to serialize metric '%s': %v", m.Name, err)
+		w.Stats.Failed.Increment(1)
+		pipelineStats.Dropped.Add("serialize", 1)
+		return
+	}
+	action, _ := json.Marshal(map[string]map[string]string{"index": {"_index": w.Index(m)}})
+	w.batch.Write(action)
+	w.batch.WriteByte('\n')
+	w.batch.Write(doc)
+	w.batch.WriteByte('\n')
+	w.batched++
+	if w.batched >= w.BulkSize {
+		w.flush()
+	}
+}
+
+// flush sends the bulk request, addresses are tried in turn until one
+// of them responds
+func (w *ElasticsearchWriter) flush() {
+	if w.batched == 0 {
+		return
+	}
+	n := w.batched
+	defer func() {
+		w.batch.Reset()
+		w.batched = 0
+	}()
+
+	start := time.Now()
+	var (
+		res *http.Response
+		err error
+	)
+	for i := 0; i < len(w.Addresses); i++ {
+		res, err = w.post(w.Addresses[w.address], w.batch.Bytes())
+		if err == nil {
+			break
+		}
+		w.Logger.Warn("[elasticsearch] Bulk request to %s failed: %v", w.Addresses[w.address], err)
+		w.address = (w.address + 1) % len(w.Addresses)
+	}
+	if err != nil {
+		w.Logger.Error("[elasticsearch] Failed to index %d metrics: %v", n, err)
+		w.Stats.Failed.Increment(n)
+		pipelineStats.Dropped.Add("write_failed", n)
+		return
+	}
+	defer res.Body.Close()
+	data, _ := ioutil.ReadAll(res.Body)
+	w.Stats.Duration.Add(time.Since(start))
+	w.Stats.Flushed.Increment(1)
+
+	if res.StatusCode/100 != 2 {
+		w.Logger.Error("[elasticsearch] Failed to index %d metrics: %s: %s", n, res.Status, strings.TrimSpace(string(data)))
+		w.Stats.Failed.Increment(n)
+		pipelineStats.Dropped.Add("write_failed", n)
+		return
+	}
+
+	var bulk elasticsearchBulkResponse
+	if err := json.Unmarshal(data, &bulk); err != nil {
+		w.Logger.Error("[elasticsearch] Failed to parse bulk response: %v", err)
+		w.Stats.Indexed.Increment(n)
+		return
+	}
+	failed := 0
+	if bulk.Errors {
+		for _, item := range bulk.Items {
+			for _, result := range item {
+				if result.Status/100 != 2 {
+					if failed == 0 {
+						w.Logger.Debug("[elasticsearch] Document rejected: %s", string(result.Error))
+					}
+					failed++
+				}
+			}
+		}
+	}
+	w.Stats.Indexed.Increment(n - failed)
+	if failed > 0 {
+		w.Logger.Error("[elasticsearch] Failed to index %d metrics", failed)
+		w.Stats.Failed.Increment(failed)
+		pipelineStats.Dropped.Add("write_failed", failed)
+	}
+}
+
+func (w *ElasticsearchWriter) post(url string, body []byte) (*http.Response, error) {
+	req, err := http.NewRequest("POST", url, bytes.NewReader(body))
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Content-Type", "application/x-ndjson")
+	if w.Config.ESUsername != "" {
+		req.SetBasicAuth(w.Config.ESUsername, w.Config.ESPassword)
+	}
+	return w.Client.Do(req)
+}
+
+func (w *ElasticsearchWriter) LogReport() {
+	w.Logger.Info("[elasticsearch] flushes: %d/%.3f (total/rate_per_m), metrics: %d/%d/%.3f (indexed/failed/rate_per_sec), duration: %s/%s (avg/max)",
+		w.Stats.Flushed.Total(),
+		w.Stats.Flushed.Rate(time.Minute),
+		w.Stats.Indexed.Total(),
+		w.Stats.Failed.Total(),
+		w.Stats.Indexed.Rate(time.Second),
+		w.Stats.Duration.Avg(),
+		w.Stats.Duration.Max(),
+	)
+}
+
+type ElasticsearchWriterStats struct {
+	Flushed  *StatsCounter
+	Indexed  *StatsCounter
+	Failed   *StatsCounter
+	Duration *StatsTimer
+}
+
+func NewElasticsearchWriterStats() *ElasticsearchWriterStats {
+	now := time.Now()
+	return &ElasticsearchWriterStats{
+		Flushed:  NewStatsCounter(now),
+		Indexed:  NewStatsCounter(now),
+		Failed:   NewStatsCounter(now),
+		Duration: NewStatsTimer(1000),
+	}
+}
+
+func (s *ElasticsearchWriterStats) Reset() {}
@@ -0,0 +1,158 @@
+package metcap
+
+import (
+	"bufio"
+	"io"
+	"os"
+	"sync"
+	"time"
+
+	"gopkg.in/natefinch/lumberjack.v2"
+)
+
+// FileWriter writes metrics in line protocol to a file, or to stdout when
+// path is "-", e.g. to inspect output of the middlewares. The file is
+// rotated once it grows over FileMaxSizeMB.
+type FileWriter struct {
+	Config        *WriterConfig
+	ModuleWg      *sync.WaitGroup
+	Input         <-chan *Metric
+	Output        io.WriteCloser
+	FlushInterval time.Duration
+	Logger        *Logger
+	ExitFlag      *Flag
+	Stats         *FileWriterStats
+	buf           *bufio.Writer
+}
+
+// NewFileWriter
+func NewFileWriter(c *WriterConfig, input <-chan *Metric, module_wg *sync.WaitGroup, logger *Logger, exitFlag *Flag) (*FileWriter, error) {
+	logger.Info("[file] Initializing module")
+
+	if c.FileMaxSizeMB == 0 {
+		c.FileMaxSizeMB = 100
+	}
+
+	if c.BulkWait.Duration == 0 {
+		c.BulkWait.Duration = 1 * time.Second
+	}
+
+	var output io.WriteCloser
+	if c.FilePath == "-" {
+		output = os.Stdout
+	} else {
+		// fail early on unwritable path, lumberjack opens the file lazily
+		f, err := os.OpenFile(c.FilePath, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0644)
+		if err != nil {
+			return nil, err
+		}
+		f.Close()
+		output = &lumberjack.Logger{
+			Filename:   c.FilePath,
+			MaxSize:    c.FileMaxSizeMB,
+			MaxBackups: c.FileMaxBackups,
+			Compress:   c.FileCompress,
+		}
+	}
+
+	return &FileWriter{
+		Config:        c,
+		ModuleWg:      module_wg,
+		Input:         input,
+		Output:        output,
+		FlushInterval: c.BulkWait.Duration,
+		Logger:        logger,
+		ExitFlag:      exitFlag,
+		Stats:         NewFileWriterStats(),
+		buf:           bufio.NewWriter(output),
+	}, nil
+}
+
+func (w *FileWriter) Start() {
+	w.ModuleWg.Add(1)
+	defer w.ModuleWg.Done()
+	w.Logger.Info("[file] Writing metrics to %s", w.Config.FilePath)
+
+	ticker := time.NewTicker(w.FlushInterval)
+	defer ticker.Stop()
+
+	exitCheck := time.NewTicker(10 * time.Millisecond)
+	defer exitCheck.Stop()
+
+	for {
+		select {
+		case m := <-w.Input:
+			w.write(m)
+		case <-ticker.C:
+			w.flush()
+		case <-exitCheck.C:
+			if !w.ExitFlag.Get() {
+				continue
+			}
+			w.Logger.Info("[file] Draining buffer...")
+			for empty := 0; empty < 10; {
+				select {
+				case m := <-w.Input:
+					w.write(m)
+					empty = 0
+				case <-time.After(100 * time.Millisecond):
+					empty++
+				}
+			}
+			w.flush()
+			if w.Output != os.Stdout {
+				w.Output.Close()
+			}
+			w.Logger.Info("[file] Stopped")
+			return
+		}
+	}
+}
+
+func (w *FileWriter) write(m *Metric) {
+	line := m.SerializeLineProtocol()
+	if line == "" {
+		pipelineStats.Dropped.Add("serialize", 1)
+		return
+	}
+	w.buf.WriteString(line)
+	if err := w.buf.WriteByte('\n'); err != nil {
+		w.Logger.Error("[file] Failed to write metric: %v", err)
+		w.Stats.Failed.Increment(1)
+		pipelineStats.Dropped.Add("write_failed", 1)
+		// bufio.Writer keeps failing once it got an error
+		w.buf.Reset(w.Output)
+		return
+	}
+	w.Stats.Written.Increment(1)
+}
+
+func (w *FileWriter) flush() {
+	if err := w.buf.Flush(); err != nil {
+		w.Logger.Error("[file] Failed to flush: %v", err)
+		w.buf.Reset(w.Output)
+	}
+}
+
+func (w *FileWriter) LogReport() {
+	w.Logger.Info("[file] metrics: %d/%d/%.3f (written/failed/rate_per_sec)",
+		w.Stats.Written.Total(),
+		w.Stats.Failed.Total(),
+		w.Stats.Written.Rate(time.Second),
+	)
+}
+
+type FileWriterStats struct {
+	Written *StatsCounter
+	Failed  *StatsCounter
+}
+
+func NewFileWriterStats() *FileWriterStats {
+	now := time.Now()
+	return &FileWriterStats{
+		Written: NewStatsCounter(now),
+		Failed:  NewStatsCounter(now),
+	}
+}
+
+func (s *FileWriterStats) Reset() {}
@@ -0,0 +1,290 @@
+package metcap
+
+import (
+	"bytes"
+	"net"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"text/template"
+	"time"
+)
+
+// graphiteBufferSize is how much is buffered before being sent regardless
+// of the flush interval
+const graphiteBufferSize = 64 * 1024
+
+// graphiteDots collapses dots left by empty template parts
+var graphiteDots = regexp.MustCompile(`\.{2,}`)
+
+// GraphiteWriter sends metrics in plaintext protocol to a Graphite relay.
+// Path of the main value is rendered from Template, the other fields
+// get ".<field>" appended.
+type GraphiteWriter struct {
+	Config        *WriterConfig
+	ModuleWg      *sync.WaitGroup
+	Input         <-chan *Metric
+	Conn          net.Conn
+	Template      *template.Template
+	ConnTimeout   time.Duration
+	Reconnect     time.Duration
+	FlushInterval time.Duration
+	Logger        *Logger
+	ExitFlag      *Flag
+	Stats         *GraphiteWriterStats
+	buf           bytes.Buffer
+	lines         int
+}
+
+// graphitePath is the data GraphiteTemplate is rendered with
+type graphitePath struct {
+	Name string
+	Tags map[string]string
+}
+
+// NewGraphiteWriter
+func NewGraphiteWriter(c *WriterConfig, input <-chan *Metric, module_wg *sync.WaitGroup, logger *Logger, exitFlag *Flag) (*GraphiteWriter, error) {
+	logger.Info("[graphite] Initializing module")
+
+	if c.GraphiteTemplate == "" {
+		c.GraphiteTemplate = "{{.Name}}"
+	}
+
+	if c.GraphiteConnTimeout.Duration == 0 {
+		c.GraphiteConnTimeout.Duration = 5 * time.Second
+	}
+
+	if c.GraphiteReconnectDelay.Duration == 0 {
+		c.GraphiteReconnectDelay.Duration = 1 * time.Second
+	}
+
+	if c.BulkWait.Duration == 0 {
+		c.BulkWait.Duration = 1 * time.Second
+	}
+
+	tmpl, err := template.New("graphite").Option("missingkey=zero").Parse(c.GraphiteTemplate)
+	if err != nil {
+		return nil, err
+	}
+
+	w := &GraphiteWriter{
+		Config:        c,
+		ModuleWg:      module_wg,
+		Input:         input,
+		Template:      tmpl,
+		ConnTimeout:   c.GraphiteConnTimeout.Duration,
+		Reconnect:     c.GraphiteReconnectDelay.Duration,
+		FlushInterval: c.BulkWait.Duration,
+		Logger:        logger,
+		ExitFlag:      exitFlag,
+		Stats:         NewGraphiteWriterStats(),
+	}
+
+	if err := w.connect(); err != nil {
+		return nil, err
+	}
+	return w, nil
+}
+
+func (w *GraphiteWriter) connect() error {
+	conn, err := net.DialTimeout("tcp", w.Config.GraphiteAddr, w.ConnTimeout)
+	if err != nil {
+		return err
+	}
+	w.Conn = conn
+	return nil
+}
+
+// Path renders the path of the metric, whitespace is replaced and empty
+// parts are left out
+func (w *GraphiteWriter) Path(m *Metric) (string, error) {
+	var buf bytes.Buffer
+	if err := w.Template.Execute(&buf, graphitePath{m.Name, m.Fields}); err != nil {
+		return "", err
+	}
+	path := strings.Join(strings.Fields(buf.String()), "_")
+	path = graphiteDots.ReplaceAllString(path, ".")
+	return w.Config.GraphitePrefix + strings.Trim(path, "."), nil
+}
+
+// Lines formats the metric in plaintext protocol, string and bool fields
+// are left out
+func (w *GraphiteWriter) Lines(m *Metric) ([]string, error) {
+	path, err := w.Path(m)
+	if err != nil {
+		return nil, err
+	}
+	ts := m.Timestamp
+	if ts.IsZero() {
+		ts = time.Now()
+	}
+	suffix := " " + strconv.FormatInt(ts.Unix(), 10)
+
+	var lines []string
+	if m.Value != 0 || len(m.Values) == 0 {
+		lines = append(lines, path+" "+strconv.FormatFloat(m.Value, 'f', -1, 64)+suffix)
+	}
+	fields := make([]string, 0, len(m.Values))
+	for k := range m.Values {
+		fields = append(fields, k)
+	}
+	sort.Strings(fields)
+	for _, k := range fields {
+		name := path + "." + strings.Join(strings.Fields(k), "_")
+		switch value := m.Values[k].(type) {
+		case float64:
+			lines = append(lines, name+" "+strconv.FormatFloat(value, 'f', -1, 64)+suffix)
+		case int64:
+			lines = append(lines, name+" "+strconv.FormatInt(value, 10)+suffix)
+		}
+	}
+	return lines, nil
+}
+
+func (w *GraphiteWriter) Start() {
+	w.ModuleWg.Add(1)
+	defer w.ModuleWg.Done()
+	defer func() {
+		if w.Conn != nil {
+			w.Conn.Close()
+		}
+	}()
+	w.Logger.Info("[graphite] Sending metrics to %s", w.Config.GraphiteAddr)
+
+	ticker := time.NewTicker(w.FlushInterval)
+	defer ticker.Stop()
+
+	exitCheck := time.NewTicker(10 * time.Millisecond)
+	defer exitCheck.Stop()
+
+	for {
+		select {
+		case m := <-w.Input:
+			w.add(m)
+		case <-ticker.C:
+			w.flush()
+		case <-exitCheck.C:
+			if !w.ExitFlag.Get() {
+				continue
+			}
+			w.Logger.Info("[graphite] Draining buffer...")
+			for empty := 0; empty < 10; {
+				select {
+				case m := <-w.Input:
+					w.add(m)
+					empty = 0
+				case <-time.After(100 * time.Millisecond):
+					empty++
+				}
+			}
+			w.flush()
+			w.Logger.Info("[graphite] Stopped")
+			return
+		}
+	}
+}
+
+func (w *GraphiteWriter) add(m *Metric) {
+	lines, err := w.Lines(m)
+	if err != nil {
+		w.Logger.Debug("[graphite] Failed to render path of '%s': %v", m.Name, err)
+		w.Stats.Failed.Increment(1)
+		pipelineStats.Dropped.Add("serialize", 1)
+		return
+	}
+	for _, line := range lines {
+		w.buf.WriteString(line)
+		w.buf.WriteByte('\n')
+		w.lines++
+	}
+	if w.buf.Len() >= graphiteBufferSize {
+		w.flush()
+	}
+}
+
+// flush sends the buffered lines, on failure it reconnects with exponential
+// backoff and jitter and sends them again (write reconnects when the
+// connection is gone); it gives up only when shutting down
+func (w *GraphiteWriter) flush() {
+	if w.buf.Len() == 0 {
+		return
+	}
+	defer func() {
+		w.buf.Reset()
+		w.lines = 0
+	}()
+
+	ctx, cancel := w.ExitFlag.Context()
+	defer cancel()
+
+	retry := RetryPolicy{
+		InitialDelay: w.Reconnect,
+		MaxDelay:     1 * time.Minute,
+		Jitter:       0.5,
+		OnRetry: func(attempt int, delay time.Duration, err error) {
+			w.Logger.Error("[graphite] Failed to send %d lines, reconnecting in %v: %v", w.lines, delay, err)
+			w.Stats.Reconnects.Increment(1)
+		},
+	}
+	err := retry.Do(ctx, func() error {
+		err := w.write()
+		if err != nil && w.ExitFlag.Get() {
+			return Permanent(err)
+		}
+		return err
+	})
+	if err != nil {
+		w.Logger.Error("[graphite] Dropping %d lines: %v", w.lines, err)
+		w.Stats.Failed.Increment(w.lines)
+		pipelineStats.Dropped.Add("write_failed", w.lines)
+		return
+	}
+	w.Stats.Flushed.Increment(1)
+	w.Stats.Sent.Increment(w.lines)
+}
+
+func (w *GraphiteWriter) write() error {
+	if w.Conn == nil {
+		if err := w.connect(); err != nil {
+			return err
+		}
+	}
+	w.Conn.SetWriteDeadline(time.Now().Add(w.ConnTimeout))
+	if _, err := w.Conn.Write(w.buf.Bytes()); err != nil {
+		w.Conn.Close()
+		w.Conn = nil
+		return err
+	}
+	return nil
+}
+
+func (w *GraphiteWriter) LogReport() {
+	w.Logger.Info("[graphite] flushes: %d, reconnects: %d, lines: %d/%d/%.3f (sent/failed/rate_per_sec)",
+		w.Stats.Flushed.Total(),
+		w.Stats.Reconnects.Total(),
+		w.Stats.Sent.Total(),
+		w.Stats.Failed.Total(),
+		w.Stats.Sent.Rate(time.Second),
+	)
+}
+
+type GraphiteWriterStats struct {
+	Flushed    *StatsCounter
+	Reconnects *StatsCounter
+	Sent       *StatsCounter
+	Failed     *StatsCounter
+}
+
+func NewGraphiteWriterStats() *GraphiteWriterStats {
+	now := time.Now()
+	return &GraphiteWriterStats{
+		Flushed:    NewStatsCounter(now),
+		Reconnects: NewStatsCounter(now),
+		Sent:       NewStatsCounter(now),
+		Failed:     NewStatsCounter(now),
+	}
+}
+
+func (s *GraphiteWriterStats) Reset() {}
@@ -0,0 +1,238 @@
+package metcap
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	influxdb2 "github.com/influxdata/influxdb-client-go/v2"
+	"github.com/influxdata/influxdb-client-go/v2/api"
+	ihttp "github.com/influxdata/influxdb-client-go/v2/api/http"
+)
+
+// InfluxDBv2Writer batches metrics to line protocol and writes them to
+// the InfluxDB v2 /api/v2/write endpoint. BucketRouter picks bucket of
+// each metric (empty means the configured one), batch is split by bucket
+// when written.
+type InfluxDBv2Writer struct {
+	Config        *WriterConfig
+	ModuleWg      *sync.WaitGroup
+	Input         <-chan *Metric
+	Client        influxdb2.Client
+	BucketRouter  func(*Metric) string
+	BatchSize     int
+	FlushInterval time.Duration
+	MaxRetries    int
+	Logger        *Logger
+	ExitFlag      *Flag
+	Stats         *InfluxDBWriterStats
+	apis          map[string]api.WriteAPIBlocking
+	batch         map[string][]string
+	batched       int
+}
+
+// NewInfluxDBv2Writer
+func NewInfluxDBv2Writer(c *WriterConfig, input <-chan *Metric, module_wg *sync.WaitGroup, logger *Logger, exitFlag *Flag) (*InfluxDBv2Writer, error) {
+	logger.Info("[influxdb] Initializing module")
+
+	if c.InfluxOrg == "" || c.InfluxBucket == "" {
+		return nil, fmt.Errorf("influx_org and influx_bucket have to be set")
+	}
+
+	if c.InfluxBatchSize == 0 {
+		c.InfluxBatchSize = 5000
+	}
+
+	if c.InfluxFlushInterval.Duration == 0 {
+		c.InfluxFlushInterval.Duration = 1 * time.Second
+	}
+
+	if c.InfluxMaxRetries == 0 {
+		c.InfluxMaxRetries = 5
+	}
+
+	options := influxdb2.DefaultOptions()
+	if c.Timeout > 0 {
+		options.SetHTTPRequestTimeout(uint(c.Timeout))
+	}
+	client := influxdb2.NewClientWithOptions(c.InfluxURL, c.InfluxToken, options)
+	bucket := c.InfluxBucket
+
+	return &InfluxDBv2Writer{
+		Config:        c,
+		ModuleWg:      module_wg,
+		Input:         input,
+		Client:        client,
+		BucketRouter:  func(*Metric) string { return bucket },
+		BatchSize:     c.InfluxBatchSize,
+		FlushInterval: c.InfluxFlushInterval.Duration,
+		MaxRetries:    c.InfluxMaxRetries,
+		Logger:        logger,
+		ExitFlag:      exitFlag,
+		Stats:         NewInfluxDBWriterStats(),
+		apis:          make(map[string]api.WriteAPIBlocking),
+		batch:         make(map[string][]string),
+	}, nil
+}
+
+func (w *InfluxDBv2Writer) Start() {
+	w.ModuleWg.Add(1)
+	defer w.ModuleWg.Done()
+	defer w.Client.Close()
+	w.Logger.Info("[influxdb] Writing to %s (org: %s, bucket: %s)", w.Config.InfluxURL, w.Config.InfluxOrg, w.Config.InfluxBucket)
+
+	ticker := time.NewTicker(w.FlushInterval)
+	defer ticker.Stop()
+
+	exitCheck := time.NewTicker(10 * time.Millisecond)
+	defer exitCheck.Stop()
+
+	for {
+		select {
+		case m := <-w.Input:
+			w.add(m)
+		case <-ticker.C:
+			w.flush()
+		case <-exitCheck.C:
+			if !w.ExitFlag.Get() {
+				continue
+			}
+			w.Logger.Info("[influxdb] Draining buffer...")
+			// middlewares keep flushing into the input while stopping,
+			// so it has to stay empty for a while
+			for empty := 0; empty < 10; {
+				select {
+				case m := <-w.Input:
+					w.add(m)
+					empty = 0
+				case <-time.After(100 * time.Millisecond):
+					empty++
+				}
+			}
+			w.flush()
+			w.Logger.Info("[influxdb] Stopped")
+			return
+		}
+	}
+}
+
+func (w *InfluxDBv2Writer) add(m *Metric) {
+	bucket := w.BucketRouter(m)
+	if bucket == "" {
+		bucket = w.Config.InfluxBucket
+	}
+	line := m.SerializeLineProtocol()
+	if line == "" {
+		pipelineStats.Dropped.Add("serialize", 1)
+		return
+	}
+	w.batch[bucket] = append(w.batch[bucket], line)
+	w.batched++
+	if w.batched >= w.BatchSize {
+		w.flush()
+	}
+}
+
+// flush writes the batch, one request per bucket
+func (w *InfluxDBv2Writer) flush() {
+	for bucket, lines := range w.batch {
+		if len(lines) > 0 {
+			w.write(bucket, lines)
+		}
+		w.batch[bucket] = lines[:0]
+	}
+	w.batched = 0
+}
+
+// write sends the lines to the bucket, failed writes are retried with
+// exponential backoff and jitter (or after Retry-After of a rate limited
+// one), rejected ones are dropped
+func (w *InfluxDBv2Writer) write(bucket string, lines []string) {
+	writeAPI, ok := w.apis[bucket]
+	if !ok {
+		writeAPI = w.Client.WriteAPIBlocking(w.Config.InfluxOrg, bucket)
+		w.apis[bucket] = writeAPI
+	}
+	n := len(lines)
+	payload := strings.Join(lines, "\n")
+
+	retries, rejected := 0, false
+	retry := writerRetryPolicy(w.MaxRetries)
+	retry.OnRetry = func(attempt int, delay time.Duration, err error) {
+		w.Logger.Warn("[influxdb] Failed to write %d metrics to '%s', retrying in %v: %v", n, bucket, delay, err)
+		w.Stats.Retried.Increment(1)
+		retries++
+	}
+	err := retry.Do(context.Background(), func() error {
+		start := time.Now()
+		err := writeAPI.WriteRecord(context.Background(), payload)
+		w.Stats.Duration.Add(time.Since(start))
+		if err == nil {
+			pipelineStats.PublishDuration.Observe(time.Since(start))
+			return nil
+		}
+		var httpErr *ihttp.Error
+		if !errors.As(err, &httpErr) {
+			return err
+		}
+		switch {
+		case httpErr.StatusCode == http.StatusBadRequest:
+			rejected = true
+			return Permanent(err)
+		case httpErr.StatusCode == http.StatusTooManyRequests && httpErr.RetryAfter > 0:
+			return RetryAfter(err, time.Duration(httpErr.RetryAfter)*time.Second)
+		}
+		return err
+	})
+
+	switch {
+	case err == nil:
+		w.Stats.Flushed.Increment(1)
+		w.Stats.Written.Increment(n)
+	case rejected:
+		w.Logger.Error("[influxdb] Dropping %d metrics for '%s' rejected by server: %v", n, bucket, err)
+		w.Stats.Failed.Increment(n)
+		pipelineStats.Dropped.Add("write_rejected", n)
+	default:
+		w.Logger.Error("[influxdb] Failed to write %d metrics to '%s' after %d retries: %v", n, bucket, retries, err)
+		w.Stats.Failed.Increment(n)
+		pipelineStats.Dropped.Add("write_failed", n)
+	}
+}
+
+func (w *InfluxDBv2Writer) LogReport() {
+	w.Logger.Info("[influxdb] flushes: %d/%d (total/retried), metrics: %d/%d/%.3f (written/failed/rate_per_sec), duration: %s/%s (avg/max)",
+		w.Stats.Flushed.Total(),
+		w.Stats.Retried.Total(),
+		w.Stats.Written.Total(),
+		w.Stats.Failed.Total(),
+		w.Stats.Written.Rate(time.Second),
+		w.Stats.Duration.Avg(),
+		w.Stats.Duration.Max(),
+	)
+}
+
+type InfluxDBWriterStats struct {
+	Flushed  *StatsCounter
+	Retried  *StatsCounter
+	Written  *StatsCounter
+	Failed   *StatsCounter
+	Duration *StatsTimer
+}
+
+func NewInfluxDBWriterStats() *InfluxDBWriterStats {
+	now := time.Now()
+	return &InfluxDBWriterStats{
+		Flushed:  NewStatsCounter(now),
+		Retried:  NewStatsCounter(now),
+		Written:  NewStatsCounter(now),
+		Failed:   NewStatsCounter(now),
+		Duration: NewStatsTimer(1000),
+	}
+}
+
+func (s *InfluxDBWriterStats) Reset() {}
@@ -0,0 +1,299 @@
+package metcap
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"regexp"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// InfluxDB v1 precisions, values of the precision query parameter
+var influxPrecisions = map[string]struct {
+	param string
+	unit  time.Duration
+}{
+	"ns": {"ns", time.Nanosecond},
+	"us": {"u", time.Microsecond},
+	"ms": {"ms", time.Millisecond},
+	"s":  {"s", time.Second},
+}
+
+// influxDropped matches count of rejected points in partial write error
+var influxDropped = regexp.MustCompile(`dropped=(\d+)`)
+
+// InfluxWriteError is returned by InfluxDBv1Writer.Write. Temporary errors
+// (network or server failures) may succeed when retried, the others mean
+// the data was rejected; in case of a partial write the accepted points
+// were stored and Dropped tells how many weren't.
+type InfluxWriteError struct {
+	status  int
+	msg     string
+	err     error
+	dropped int
+}
+
+func (e *InfluxWriteError) Error() string {
+	if e.err != nil {
+		return fmt.Sprintf("[influxdb] Error: %v", e.err)
+	}
+	return fmt.Sprintf("[influxdb] Error: %d %s: %s", e.status, http.StatusText(e.status), e.msg)
+}
+
+func (e *InfluxWriteError) Unwrap() error {
+	return e.err
+}
+
+// Temporary reports network failures, rate limiting and server errors
+func (e *InfluxWriteError) Temporary() bool {
+	return e.status == 0 || e.status == http.StatusTooManyRequests || e.status >= 500
+}
+
+// Partial reports the write was rejected only partially
+func (e *InfluxWriteError) Partial() bool {
+	return strings.HasPrefix(e.msg, "partial write")
+}
+
+// Dropped returns count of points that weren't written
+func (e *InfluxWriteError) Dropped() int {
+	return e.dropped
+}
+
+// InfluxDBv1Writer batches metrics to line protocol and writes them to
+// the InfluxDB v1 /write endpoint
+type InfluxDBv1Writer struct {
+	Config        *WriterConfig
+	ModuleWg      *sync.WaitGroup
+	Input         <-chan *Metric
+	Client        *http.Client
+	URL           string
+	Precision     time.Duration
+	BatchSize     int
+	FlushInterval time.Duration
+	MaxRetries    int
+	Logger        *Logger
+	ExitFlag      *Flag
+	Stats         *InfluxDBWriterStats
+	batch         []string
+}
+
+// NewInfluxDBv1Writer
+func NewInfluxDBv1Writer(c *WriterConfig, input <-chan *Metric, module_wg *sync.WaitGroup, logger *Logger, exitFlag *Flag) (*InfluxDBv1Writer, error) {
+	logger.Info("[influxdb] Initializing module")
+
+	if c.InfluxPrecision == "" {
+		c.InfluxPrecision = "ns"
+	}
+	precision, ok := influxPrecisions[c.InfluxPrecision]
+	if !ok {
+		return nil, fmt.Errorf("unknown influx_precision '%s'", c.InfluxPrecision)
+	}
+
+	if c.InfluxBatchSize == 0 {
+		c.InfluxBatchSize = 5000
+	}
+
+	if c.InfluxFlushInterval.Duration == 0 {
+		c.InfluxFlushInterval.Duration = 1 * time.Second
+	}
+
+	if c.InfluxMaxRetries == 0 {
+		c.InfluxMaxRetries = 5
+	}
+
+	query := url.Values{}
+	query.Set("db", c.InfluxDB)
+	query.Set("precision", precision.param)
+	if c.InfluxRP != "" {
+		query.Set("rp", c.InfluxRP)
+	}
+
+	return &InfluxDBv1Writer{
+		Config:        c,
+		ModuleWg:      module_wg,
+		Input:         input,
+		Client:        &http.Client{Timeout: time.Duration(c.Timeout) * time.Second},
+		URL:           strings.TrimRight(c.InfluxURL, "/") + "/write?" + query.Encode(),
+		Precision:     precision.unit,
+		BatchSize:     c.InfluxBatchSize,
+		FlushInterval: c.InfluxFlushInterval.Duration,
+		MaxRetries:    c.InfluxMaxRetries,
+		Logger:        logger,
+		ExitFlag:      exitFlag,
+		Stats:         NewInfluxDBWriterStats(),
+		batch:         make([]string, 0, c.InfluxBatchSize),
+	}, nil
+}
+
+func (w *InfluxDBv1Writer) Start() {
+	w.ModuleWg.Add(1)
+	defer w.ModuleWg.Done()
+	w.Logger.Info("[influxdb] Writing to %s (database: %s)", w.Config.InfluxURL, w.Config.InfluxDB)
+
+	ticker := time.NewTicker(w.FlushInterval)
+	defer ticker.Stop()
+
+	exitCheck := time.NewTicker(10 * time.Millisecond)
+	defer exitCheck.Stop()
+
+	for {
+		select {
+		case m := <-w.Input:
+			w.add(m)
+		case <-ticker.C:
+			w.flush()
+		case <-exitCheck.C:
+			if !w.ExitFlag.Get() {
+				continue
+			}
+			w.Logger.Info("[influxdb] Draining buffer...")
+			for empty := 0; empty < 10; {
+				select {
+				case m := <-w.Input:
+					w.add(m)
+					empty = 0
+				case <-time.After(100 * time.Millisecond):
+					empty++
+				}
+			}
+			w.flush()
+			w.Logger.Info("[influxdb] Stopped")
+			return
+		}
+	}
+}
+
+func (w *InfluxDBv1Writer) add(m *Metric) {
+	line := m.SerializeLineProtocolPrecision(w.Precision)
+	if line == "" {
+		pipelineStats.Dropped.Add("serialize", 1)
+		return
+	}
+	w.batch = append(w.batch, line)
+	if len(w.batch) >= w.BatchSize {
+		w.flush()
+	}
+}
+
+// Write sends the lines in one request, error is *InfluxWriteError
+func (w *InfluxDBv1Writer) Write(lines []string) error {
+	body := []byte(strings.Join(lines, "\n"))
+	if w.Config.InfluxWriteGzip {
+		compressed, err := Compress(CompressionGzip, body)
+		if err != nil {
+			return &InfluxWriteError{err: err}
+		}
+		body = compressed
+	}
+
+	req, err := http.NewRequest("POST", w.URL, bytes.NewReader(body))
+	if err != nil {
+		return &InfluxWriteError{err: err}
+	}
+	req.Header.Set("Content-Type", "text/plain; charset=utf-8")
+	if w.Config.InfluxWriteGzip {
+		req.Header.Set("Content-Encoding", "gzip")
+	}
+	if w.Config.InfluxUsername != "" {
+		req.SetBasicAuth(w.Config.InfluxUsername, w.Config.InfluxPassword)
+	}
+
+	res, err := w.Client.Do(req)
+	if err != nil {
+		return &InfluxWriteError{err: err}
+	}
+	defer res.Body.Close()
+	data, _ := ioutil.ReadAll(res.Body)
+	if res.StatusCode/100 == 2 {
+		return nil
+	}
+
+	e := &InfluxWriteError{status: res.StatusCode, msg: strings.TrimSpace(string(data)), dropped: len(lines)}
+	var payload struct {
+		Error string `json:"error"`
+	}
+	if json.Unmarshal(data, &payload) == nil && payload.Error != "" {
+		e.msg = payload.Error
+	}
+	if e.Partial() {
+		if match := influxDropped.FindStringSubmatch(e.msg); match != nil {
+			if n, err := strconv.Atoi(match[1]); err == nil && n <= len(lines) {
+				e.dropped = n
+			}
+		}
+	}
+	return e
+}
+
+// flush writes the batch, temporary failures are retried with exponential
+// backoff and jitter, rejected points are dropped
+func (w *InfluxDBv1Writer) flush() {
+	if len(w.batch) == 0 {
+		return
+	}
+	n := len(w.batch)
+	lines := w.batch
+	defer func() { w.batch = w.batch[:0] }()
+
+	retries := 0
+	var rejected *InfluxWriteError
+	retry := writerRetryPolicy(w.MaxRetries)
+	retry.OnRetry = func(attempt int, delay time.Duration, err error) {
+		w.Logger.Warn("[influxdb] Failed to write %d metrics, retrying in %v: %v", n, delay, err)
+		w.Stats.Retried.Increment(1)
+		retries++
+	}
+	err := retry.Do(context.Background(), func() error {
+		start := time.Now()
+		err := w.Write(lines)
+		w.Stats.Duration.Add(time.Since(start))
+		if err == nil {
+			pipelineStats.PublishDuration.Observe(time.Since(start))
+			return nil
+		}
+		if e := err.(*InfluxWriteError); !e.Temporary() {
+			rejected = e
+			return Permanent(err)
+		}
+		return err
+	})
+
+	switch {
+	case err == nil:
+		w.Stats.Flushed.Increment(1)
+		w.Stats.Written.Increment(n)
+	case rejected != nil:
+		if rejected.Partial() {
+			w.Logger.Error("[influxdb] %d of %d metrics rejected by server: %s", rejected.Dropped(), n, rejected.msg)
+			w.Stats.Flushed.Increment(1)
+			w.Stats.Written.Increment(n - rejected.Dropped())
+		} else {
+			w.Logger.Error("[influxdb] Dropping %d metrics rejected by server: %v", n, err)
+		}
+		w.Stats.Failed.Increment(rejected.Dropped())
+		pipelineStats.Dropped.Add("write_rejected", rejected.Dropped())
+	default:
+		w.Logger.Error("[influxdb] Failed to write %d metrics after %d retries: %v", n, retries, err)
+		w.Stats.Failed.Increment(n)
+		pipelineStats.Dropped.Add("write_failed", n)
+	}
+}
+
+func (w *InfluxDBv1Writer) LogReport() {
+	w.Logger.Info("[influxdb] flushes: %d/%d (total/retried), metrics: %d/%d/%.3f (written/failed/rate_per_sec), duration: %s/%s (avg/max)",
+		w.Stats.Flushed.Total(),
+		w.Stats.Retried.Total(),
+		w.Stats.Written.Total(),
+		w.Stats.Failed.Total(),
+		w.Stats.Written.Rate(time.Second),
+		w.Stats.Duration.Avg(),
+		w.Stats.Duration.Max(),
+	)
+}
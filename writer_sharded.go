@@ -0,0 +1,93 @@
+package metcap
+
+import (
+	"hash/fnv"
+	"sync"
+	"time"
+)
+
+// ShardedWriter splits metrics among InfluxShardCount InfluxDBv2Writers by
+// hash of the name and "host" tag, so that each series is always written
+// by the same writer and concurrent writes don't contend on it in InfluxDB
+type ShardedWriter struct {
+	ModuleWg *sync.WaitGroup
+	Input    <-chan *Metric
+	Shards   []*InfluxDBv2Writer
+	Logger   *Logger
+	ExitFlag *Flag
+	inputs   []chan *Metric
+}
+
+// NewShardedWriter
+func NewShardedWriter(c *WriterConfig, input <-chan *Metric, module_wg *sync.WaitGroup, logger *Logger, exitFlag *Flag) (*ShardedWriter, error) {
+	w := &ShardedWriter{
+		ModuleWg: module_wg,
+		Input:    input,
+		Logger:   logger,
+		ExitFlag: exitFlag,
+	}
+	size := c.InfluxBatchSize
+	if size == 0 {
+		size = 5000
+	}
+	for i := 0; i < c.InfluxShardCount; i++ {
+		shardInput := make(chan *Metric, size)
+		shard, err := NewInfluxDBv2Writer(c, shardInput, module_wg, logger.With("shard", i), exitFlag)
+		if err != nil {
+			return nil, err
+		}
+		w.inputs = append(w.inputs, shardInput)
+		w.Shards = append(w.Shards, shard)
+	}
+	return w, nil
+}
+
+// Shard returns index of the writer the metric belongs to
+func (w *ShardedWriter) Shard(m *Metric) int {
+	h := fnv.New32a()
+	h.Write([]byte(m.Name))
+	h.Write([]byte{0})
+	h.Write([]byte(m.Fields["host"]))
+	return int(h.Sum32() % uint32(len(w.Shards)))
+}
+
+func (w *ShardedWriter) Start() {
+	w.ModuleWg.Add(1)
+	defer w.ModuleWg.Done()
+	w.Logger.Info("[influxdb] Writing by %d shards", len(w.Shards))
+	for _, shard := range w.Shards {
+		go shard.Start()
+	}
+
+	exitCheck := time.NewTicker(10 * time.Millisecond)
+	defer exitCheck.Stop()
+
+	for {
+		select {
+		case m := <-w.Input:
+			w.inputs[w.Shard(m)] <- m
+		case <-exitCheck.C:
+			if !w.ExitFlag.Get() {
+				continue
+			}
+			// same as the shards, keep forwarding until the input stays
+			// empty for a while
+			for empty := 0; empty < 10; {
+				select {
+				case m := <-w.Input:
+					w.inputs[w.Shard(m)] <- m
+					empty = 0
+				case <-time.After(100 * time.Millisecond):
+					empty++
+				}
+			}
+			return
+		}
+	}
+}
+
+func (w *ShardedWriter) LogReport() {
+	for _, shard := range w.Shards {
+		shard.LogReport()
+	}
+}
@@ -0,0 +1,200 @@
+package metcap
+
+import (
+	"bytes"
+	"net"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// statsdReplacer strips separators of StatsD format from metric names
+var statsdReplacer = strings.NewReplacer(":", "_", "|", "_", "@", "_", "\n", "_")
+
+// StatsDWriter forwards metrics to StatsD over UDP, packing as many of
+// them into one datagram as fit into MaxUDPSize. Main value is named after
+// the metric, the other fields "<metric>.<field>"; fields ending with
+// "_count" or "_total" become counters, all the others gauges. Tags are
+// left out, plain StatsD has no notion of them.
+type StatsDWriter struct {
+	Config        *WriterConfig
+	ModuleWg      *sync.WaitGroup
+	Input         <-chan *Metric
+	Conn          net.Conn
+	MaxUDPSize    int
+	FlushInterval time.Duration
+	Logger        *Logger
+	ExitFlag      *Flag
+	Stats         *StatsDWriterStats
+	datagram      bytes.Buffer
+}
+
+// NewStatsDWriter
+func NewStatsDWriter(c *WriterConfig, input <-chan *Metric, module_wg *sync.WaitGroup, logger *Logger, exitFlag *Flag) (*StatsDWriter, error) {
+	logger.Info("[statsd] Initializing module")
+
+	if c.StatsDMaxUDPSize == 0 {
+		c.StatsDMaxUDPSize = 1432
+	}
+
+	if c.BulkWait.Duration == 0 {
+		c.BulkWait.Duration = 1 * time.Second
+	}
+
+	conn, err := net.Dial("udp", c.StatsDAddr)
+	if err != nil {
+		return nil, err
+	}
+
+	return &StatsDWriter{
+		Config:        c,
+		ModuleWg:      module_wg,
+		Input:         input,
+		Conn:          conn,
+		MaxUDPSize:    c.StatsDMaxUDPSize,
+		FlushInterval: c.BulkWait.Duration,
+		Logger:        logger,
+		ExitFlag:      exitFlag,
+		Stats:         NewStatsDWriterStats(),
+	}, nil
+}
+
+// statsdType returns StatsD metric type of the field
+func statsdType(field string) string {
+	if strings.HasSuffix(field, "_count") || strings.HasSuffix(field, "_total") {
+		return "c"
+	}
+	return "g"
+}
+
+// Lines formats the metric as StatsD lines, string and bool fields are
+// left out
+func (w *StatsDWriter) Lines(m *Metric) []string {
+	var lines []string
+	line := func(name string, field string, value float64) {
+		name = w.Config.StatsDPrefix + statsdReplacer.Replace(name) + w.Config.StatsDSuffix
+		typ := statsdType(field)
+		formatted := strconv.FormatFloat(value, 'f', -1, 64)
+		// signed gauge values are relative, negative one has to be set from zero
+		if typ == "g" && value < 0 {
+			lines = append(lines, name+":0|g")
+		}
+		lines = append(lines, name+":"+formatted+"|"+typ)
+	}
+
+	if m.Value != 0 || len(m.Values) == 0 {
+		line(m.Name, m.Name, m.Value)
+	}
+	fields := make([]string, 0, len(m.Values))
+	for k := range m.Values {
+		fields = append(fields, k)
+	}
+	sort.Strings(fields)
+	for _, k := range fields {
+		switch value := m.Values[k].(type) {
+		case float64:
+			line(m.Name+"."+k, k, value)
+		case int64:
+			line(m.Name+"."+k, k, float64(value))
+		}
+	}
+	return lines
+}
+
+func (w *StatsDWriter) Start() {
+	w.ModuleWg.Add(1)
+	defer w.ModuleWg.Done()
+	defer w.Conn.Close()
+	w.Logger.Info("[statsd] Sending metrics to %s", w.Config.StatsDAddr)
+
+	ticker := time.NewTicker(w.FlushInterval)
+	defer ticker.Stop()
+
+	exitCheck := time.NewTicker(10 * time.Millisecond)
+	defer exitCheck.Stop()
+
+	for {
+		select {
+		case m := <-w.Input:
+			w.add(m)
+		case <-ticker.C:
+			w.flush()
+		case <-exitCheck.C:
+			if !w.ExitFlag.Get() {
+				continue
+			}
+			w.Logger.Info("[statsd] Draining buffer...")
+			for empty := 0; empty < 10; {
+				select {
+				case m := <-w.Input:
+					w.add(m)
+					empty = 0
+				case <-time.After(100 * time.Millisecond):
+					empty++
+				}
+			}
+			w.flush()
+			w.Logger.Info("[statsd] Stopped")
+			return
+		}
+	}
+}
+
+func (w *StatsDWriter) add(m *Metric) {
+	for _, line := range w.Lines(m) {
+		if w.datagram.Len() > 0 && w.datagram.Len()+1+len(line) > w.MaxUDPSize {
+			w.flush()
+		}
+		if w.datagram.Len() > 0 {
+			w.datagram.WriteByte('\n')
+		}
+		w.datagram.WriteString(line)
+		w.Stats.Lines.Increment(1)
+	}
+	w.Stats.Metrics.Increment(1)
+}
+
+// flush sends the pending datagram
+func (w *StatsDWriter) flush() {
+	if w.datagram.Len() == 0 {
+		return
+	}
+	defer w.datagram.Reset()
+	if _, err := w.Conn.Write(w.datagram.Bytes()); err != nil {
+		w.Logger.Error("[statsd] Failed to send datagram: %v", err)
+		w.Stats.Failed.Increment(1)
+		return
+	}
+	w.Stats.Datagrams.Increment(1)
+}
+
+func (w *StatsDWriter) LogReport() {
+	w.Logger.Info("[statsd] datagrams: %d/%d (sent/failed), metrics: %d/%d/%.3f (metrics/lines/rate_per_sec)",
+		w.Stats.Datagrams.Total(),
+		w.Stats.Failed.Total(),
+		w.Stats.Metrics.Total(),
+		w.Stats.Lines.Total(),
+		w.Stats.Metrics.Rate(time.Second),
+	)
+}
+
+type StatsDWriterStats struct {
+	Datagrams *StatsCounter
+	Failed    *StatsCounter
+	Metrics   *StatsCounter
+	Lines     *StatsCounter
+}
+
+func NewStatsDWriterStats() *StatsDWriterStats {
+	now := time.Now()
+	return &StatsDWriterStats{
+		Datagrams: NewStatsCounter(now),
+		Failed:    NewStatsCounter(now),
+		Metrics:   NewStatsCounter(now),
+		Lines:     NewStatsCounter(now),
+	}
+}
+
+func (s *StatsDWriterStats) Reset() {}
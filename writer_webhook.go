@@ -0,0 +1,257 @@
+package metcap
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+)
+
+// WebhookMetric is the JSON form of a metric POSTed by WebhookWriter, each
+// request body is an array of them:
+//
+//	[{"name": "cpu", "timestamp": "2006-01-02T15:04:05.999999999Z",
+//	  "tags": {"host": "web1"}, "fields": {"value": 0.5, "idle": 97}}]
+//
+// Timestamp is RFC 3339 in UTC, fields hold "value" and all the other
+// fields of the metric. Fields may be added to the schema, existing ones
+// won't be changed or removed.
+type WebhookMetric struct {
+	Name      string                 `json:"name"`
+	Timestamp string                 `json:"timestamp"`
+	Tags      map[string]string      `json:"tags"`
+	Fields    map[string]interface{} `json:"fields"`
+}
+
+// NewWebhookMetric
+func NewWebhookMetric(m *Metric) WebhookMetric {
+	fields := make(map[string]interface{}, len(m.Values)+1)
+	for k, v := range m.Values {
+		fields[k] = v
+	}
+	if m.Value != 0 || len(m.Values) == 0 {
+		fields["value"] = m.Value
+	}
+	tags := m.Fields
+	if tags == nil {
+		tags = map[string]string{}
+	}
+	ts := m.Timestamp
+	if ts.IsZero() {
+		ts = time.Now()
+	}
+	return WebhookMetric{
+		Name:      m.Name,
+		Timestamp: ts.UTC().Format(time.RFC3339Nano),
+		Tags:      tags,
+		Fields:    fields,
+	}
+}
+
+// WebhookWriter POSTs batches of metrics as JSON arrays of WebhookMetric
+type WebhookWriter struct {
+	Config        *WriterConfig
+	ModuleWg      *sync.WaitGroup
+	Input         <-chan *Metric
+	Client        *http.Client
+	BatchSize     int
+	FlushInterval time.Duration
+	MaxRetries    int
+	Logger        *Logger
+	ExitFlag      *Flag
+	Stats         *WebhookWriterStats
+	batch         []WebhookMetric
+}
+
+// NewWebhookWriter
+func NewWebhookWriter(c *WriterConfig, input <-chan *Metric, module_wg *sync.WaitGroup, logger *Logger, exitFlag *Flag) (*WebhookWriter, error) {
+	logger.Info("[webhook] Initializing module")
+
+	if !strings.HasPrefix(c.WebhookURL, "http://") && !strings.HasPrefix(c.WebhookURL, "https://") {
+		return nil, fmt.Errorf("invalid webhook_url '%s'", c.WebhookURL)
+	}
+
+	if c.WebhookBatchSize == 0 {
+		c.WebhookBatchSize = 1000
+	}
+
+	if c.WebhookFlushInterval.Duration == 0 {
+		c.WebhookFlushInterval.Duration = 5 * time.Second
+	}
+
+	if c.WebhookTimeout.Duration == 0 {
+		c.WebhookTimeout.Duration = 10 * time.Second
+	}
+
+	if c.WebhookMaxRetries == 0 {
+		c.WebhookMaxRetries = 3
+	}
+
+	return &WebhookWriter{
+		Config:        c,
+		ModuleWg:      module_wg,
+		Input:         input,
+		Client:        &http.Client{Timeout: c.WebhookTimeout.Duration},
+		BatchSize:     c.WebhookBatchSize,
+		FlushInterval: c.WebhookFlushInterval.Duration,
+		MaxRetries:    c.WebhookMaxRetries,
+		Logger:        logger,
+		ExitFlag:      exitFlag,
+		Stats:         NewWebhookWriterStats(),
+		batch:         make([]WebhookMetric, 0, c.WebhookBatchSize),
+	}, nil
+}
+
+func (w *WebhookWriter) Start() {
+	w.ModuleWg.Add(1)
+	defer w.ModuleWg.Done()
+	w.Logger.Info("[webhook] Posting metrics to %s", w.Config.WebhookURL)
+
+	ticker := time.NewTicker(w.FlushInterval)
+	defer ticker.Stop()
+
+	exitCheck := time.NewTicker(10 * time.Millisecond)
+	defer exitCheck.Stop()
+
+	for {
+		select {
+		case m := <-w.Input:
+			w.add(m)
+		case <-ticker.C:
+			w.flush()
+		case <-exitCheck.C:
+			if !w.ExitFlag.Get() {
+				continue
+			}
+			w.Logger.Info("[webhook] Draining buffer...")
+			for empty := 0; empty < 10; {
+				select {
+				case m := <-w.Input:
+					w.add(m)
+					empty = 0
+				case <-time.After(100 * time.Millisecond):
+					empty++
+				}
+			}
+			w.flush()
+			w.Logger.Info("[webhook] Stopped")
+			return
+		}
+	}
+}
+
+func (w *WebhookWriter) add(m *Metric) {
+	w.batch = append(w.batch, NewWebhookMetric(m))
+	if len(w.batch) >= w.BatchSize {
+		w.flush()
+	}
+}
+
+// flush posts the batch, network failures, rate limiting and server errors
+// are retried with exponential backoff and jitter, other rejections drop
+// the batch
+func (w *WebhookWriter) flush() {
+	if len(w.batch) == 0 {
+		return
+	}
+	n := len(w.batch)
+	defer func() { w.batch = w.batch[:0] }()
+
+	body, err := json.Marshal(w.batch)
+	if err != nil {
+		w.Logger.Error("[webhook] Failed to serialize %d metrics: %v", n, err)
+		w.Stats.Failed.Increment(n)
+		pipelineStats.Dropped.Add("serialize", n)
+		return
+	}
+
+	retries, rejected := 0, false
+	retry := writerRetryPolicy(w.MaxRetries)
+	retry.OnRetry = func(attempt int, delay time.Duration, err error) {
+		w.Logger.Warn("[webhook] Failed to post %d metrics, retrying in %v: %v", n, delay, err)
+		w.Stats.Retried.Increment(1)
+		retries++
+	}
+	err = retry.Do(context.Background(), func() error {
+		status, err := w.post(body)
+		if err == nil {
+			return nil
+		}
+		if temporary := status == 0 || status == http.StatusTooManyRequests || status >= 500; !temporary {
+			rejected = true
+			return Permanent(err)
+		}
+		return err
+	})
+
+	switch {
+	case err == nil:
+		w.Stats.Flushed.Increment(1)
+		w.Stats.Posted.Increment(n)
+	case rejected:
+		w.Logger.Error("[webhook] Dropping %d metrics rejected by %s: %v", n, w.Config.WebhookURL, err)
+		w.Stats.Failed.Increment(n)
+		pipelineStats.Dropped.Add("write_rejected", n)
+	default:
+		w.Logger.Error("[webhook] Failed to post %d metrics after %d retries: %v", n, retries, err)
+		w.Stats.Failed.Increment(n)
+		pipelineStats.Dropped.Add("write_failed", n)
+	}
+}
+
+// post sends the body, status is 0 when no response was received
+func (w *WebhookWriter) post(body []byte) (int, error) {
+	req, err := http.NewRequest("POST", w.Config.WebhookURL, bytes.NewReader(body))
+	if err != nil {
+		return 0, err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	for k, v := range w.Config.WebhookHeaders {
+		req.Header.Set(k, v)
+	}
+
+	res, err := w.Client.Do(req)
+	if err != nil {
+		return 0, err
+	}
+	defer res.Body.Close()
+	data, _ := ioutil.ReadAll(res.Body)
+	if res.StatusCode/100 != 2 {
+		return res.StatusCode, fmt.Errorf("%s: %s", res.Status, strings.TrimSpace(string(data)))
+	}
+	return res.StatusCode, nil
+}
+
+func (w *WebhookWriter) LogReport() {
+	w.Logger.Info("[webhook] flushes: %d/%d (total/retried), metrics: %d/%d/%.3f (posted/failed/rate_per_sec)",
+		w.Stats.Flushed.Total(),
+		w.Stats.Retried.Total(),
+		w.Stats.Posted.Total(),
+		w.Stats.Failed.Total(),
+		w.Stats.Posted.Rate(time.Second),
+	)
+}
+
+type WebhookWriterStats struct {
+	Flushed *StatsCounter
+	Retried *StatsCounter
+	Posted  *StatsCounter
+	Failed  *StatsCounter
+}
+
+func NewWebhookWriterStats() *WebhookWriterStats {
+	now := time.Now()
+	return &WebhookWriterStats{
+		Flushed: NewStatsCounter(now),
+		Retried: NewStatsCounter(now),
+		Posted:  NewStatsCounter(now),
+		Failed:  NewStatsCounter(now),
+	}
+}
+
+func (s *WebhookWriterStats) Reset() {}